@@ -0,0 +1,454 @@
+// Command k8ts preserves the logs of deleted Kubernetes pods. It parses
+// the command line and runs the commands of packages monitor and deploy.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/akamensky/argparse"
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/internal/version"
+	"github.com/badeadan/k8ts/pkg/deploy"
+	"github.com/badeadan/k8ts/pkg/monitor"
+	"github.com/badeadan/k8ts/pkg/server"
+)
+
+type ParserAction func() error
+
+func parseArgs() int {
+	parser := argparse.NewParser("k8ts", "k8ts ... because some pods need to be remembered")
+	settings := settings.New()
+	configPath := parser.String("", "config",
+		&argparse.Options{Help: "Read options from this YAML file", Required: false})
+	logLevel := settings.Selector(&parser.Command, "", "log-level", logger.LevelNames,
+		&argparse.Options{Help: "Log messages of this level and above", Required: false, Default: "info"})
+	logFormat := settings.Selector(&parser.Command, "", "log-format", []string{"logfmt", "json"},
+		&argparse.Options{Help: "Log as key=value pairs or as JSON objects", Required: false, Default: "logfmt"})
+
+	deployCmd := parser.NewCommand("deploy", "Deploy k8ts on a remote host via SSH")
+	deployArgs := deploy.AttachArgs(settings, deployCmd)
+	deployStatusCmd := deployCmd.NewCommand("status", "Report the k8ts version, service state and monitor options of targets")
+	deployUpgradeCmd := deployCmd.NewCommand("upgrade", "Replace k8ts on targets, rolling back if the service doesn't stay up")
+	deployArgs.AttachUpgradeArgs(settings, deployUpgradeCmd)
+	attachK8sArgs := func(cmd *argparse.Command) *deploy.K8sArgs {
+		return &deploy.K8sArgs{
+			Image: settings.String(cmd, "", "image",
+				&argparse.Options{Help: "k8ts container image (see `make image`)", Required: false}),
+			Namespace: settings.String(cmd, "", "namespace",
+				&argparse.Options{Help: "Namespace of the DaemonSet", Required: false, Default: deploy.DefaultK8sNamespace}),
+		}
+	}
+	deployK8sCmd := deployCmd.NewCommand("k8s", "Generate or apply a DaemonSet running k8ts on every node of a cluster")
+	k8sArgs := attachK8sArgs(deployK8sCmd)
+	k8sArgs.Output = settings.String(deployK8sCmd, "o", "output",
+		&argparse.Options{Help: "Write the manifests to this file rather than to stdout", Required: false})
+	k8sArgs.Apply = settings.Flag(deployK8sCmd, "", "apply",
+		&argparse.Options{Help: "Apply the manifests with kubectl", Required: false})
+	k8sArgs.Kubeconfig = deployArgs.Kubeconfig
+	k8sArgs.Context = deployArgs.Context
+	deployRemoveCmd := deployCmd.NewCommand("remove", "Stop and remove k8ts from targets")
+	deployArgs.AttachRemoveArgs(settings, deployRemoveCmd)
+
+	serviceCmd := parser.NewCommand("service", "Control k8ts service running on this host")
+	serviceArgs := monitor.ServiceArgs{
+		Install: monitor.ServiceInstallArgs{
+			Command: serviceCmd.NewCommand("install", "Install service"),
+			Monitor: monitor.AttachArgs(settings, serviceCmd),
+		},
+		Uninstall: serviceCmd.NewCommand("uninstall", "Uninstall service"),
+		Status:    serviceCmd.NewCommand("status", "Print the state, uptime and last errors of the service, failing unless it is active"),
+		Restart:   serviceCmd.NewCommand("restart", "Restart service"),
+		Logs:      serviceCmd.NewCommand("logs", "Print the logs of the service"),
+	}
+	serviceArgs.UserLevel = settings.Flag(serviceCmd, "", "user",
+		&argparse.Options{Help: "Manage a service of the systemd manager of the user rather than of the system", Required: false})
+	serviceArgs.Install.UserLevel = serviceArgs.UserLevel
+	serviceInstallCmd := serviceArgs.Install.Command
+	serviceArgs.Install.RunAs = settings.String(serviceInstallCmd, "", "run-as",
+		&argparse.Options{Help: "Run the service as this user, created if needed, with only CAP_DAC_READ_SEARCH (and CAP_CHOWN with --tombstone-owner or --tombstone-group)", Required: false})
+	serviceArgs.Install.Description = settings.String(serviceInstallCmd, "", "description",
+		&argparse.Options{Help: "Description of the service", Required: false,
+			Default: "Preserve logs of Kubernetes pods and jobs"})
+	serviceArgs.Install.Requires = settings.String(serviceInstallCmd, "", "requires",
+		&argparse.Options{Help: "Units the systemd service requires, space separated (e.g. k3s.service, empty for none)", Required: false,
+			Default: monitor.DefaultServiceRequires})
+	serviceArgs.Install.After = settings.String(serviceInstallCmd, "", "after",
+		&argparse.Options{Help: "Units the systemd service starts after, space separated", Required: false})
+	serviceArgs.Install.Restart = settings.Selector(serviceInstallCmd, "", "restart",
+		[]string{"always", "on-failure", "on-abnormal", "on-watchdog", "no"},
+		&argparse.Options{Help: "When systemd restarts the service", Required: false, Default: "always"})
+	serviceArgs.Install.Environment = settings.Records(serviceInstallCmd, "", "environment",
+		&argparse.Options{Help: "Environment variable (KEY=value) of the systemd service (repeatable)", Required: false})
+	serviceArgs.Install.UnitTemplate = settings.String(serviceInstallCmd, "", "unit-template",
+		&argparse.Options{Help: "Go template file rendering the service definition instead of the built-in one", Required: false})
+	serviceArgs.Install.Harden = settings.Flag(serviceInstallCmd, "", "harden",
+		&argparse.Options{Help: "Sandbox the systemd service: read-only system but for the tombstone and spool directories, no new privileges", Required: false})
+	serviceArgs.Install.CPUQuota = settings.String(serviceInstallCmd, "", "cpu-quota",
+		&argparse.Options{Help: "CPU time the systemd service may use (e.g. 20%)", Required: false})
+	serviceArgs.Install.MemoryMax = settings.String(serviceInstallCmd, "", "memory-max",
+		&argparse.Options{Help: "Memory the systemd service may use (e.g. 256M)", Required: false})
+	serviceArgs.Install.IOWeight = settings.Int(serviceInstallCmd, "", "io-weight",
+		&argparse.Options{Help: "IO weight of the systemd service, 1 to 10000 (100 by default)", Required: false})
+	serviceArgs.Install.Nice = settings.Int(serviceInstallCmd, "", "nice",
+		&argparse.Options{Help: "Scheduling priority of the systemd service, -20 to 19", Required: false})
+	serviceArgs.Install.PruneOlderThan = settings.String(serviceInstallCmd, "", "prune-older-than",
+		&argparse.Options{Help: "Have a systemd timer prune tombstones older than this (e.g. 30d)", Required: false})
+	serviceArgs.Install.PruneMaxSize = settings.String(serviceInstallCmd, "", "prune-max-size",
+		&argparse.Options{Help: "Have a systemd timer prune the oldest tombstones beyond this size (e.g. 10G)", Required: false})
+	serviceArgs.Install.PruneSchedule = settings.String(serviceInstallCmd, "", "prune-schedule",
+		&argparse.Options{Help: "When the prune timer runs (systemd OnCalendar)", Required: false, Default: "daily"})
+	serviceArgs.LogLines = settings.Int(serviceArgs.Logs, "n", "lines",
+		&argparse.Options{Help: "Number of lines to print", Required: false, Default: 50})
+	serviceArgs.LogFollow = settings.Flag(serviceArgs.Logs, "f", "follow",
+		&argparse.Options{Help: "Keep printing new lines", Required: false})
+
+	monitorCmd := parser.NewCommand("monitor", "Monitor kubernetes pod logs")
+	monitorArgs := monitor.AttachArgs(settings, monitorCmd)
+	monitorContainer := settings.Flag(monitorCmd, "", "container",
+		&argparse.Options{Help: "Run as the main process of a container: log JSON to stdout, exit on SIGTERM and reap children", Required: false})
+
+	serverCmd := parser.NewCommand("server", "Collect tombstones streamed by k8ts agents")
+	serverArgs := server.Args{
+		Listen: settings.String(serverCmd, "l", "listen",
+			&argparse.Options{Help: "Address to listen on", Required: false, Default: ":7443"}),
+		DataDir: settings.String(serverCmd, "d", "data-dir",
+			&argparse.Options{Help: "Where to store received tombstones", Required: false, Default: "/var/lib/k8ts"}),
+		Cert: settings.String(serverCmd, "c", "cert",
+			&argparse.Options{Help: "Server TLS certificate", Required: true}),
+		Key: settings.String(serverCmd, "k", "key",
+			&argparse.Options{Help: "Server TLS private key", Required: true}),
+		ClientCA: settings.String(serverCmd, "a", "client-ca",
+			&argparse.Options{Help: "CA used to verify agent certificates", Required: true}),
+		Retention: settings.String(serverCmd, "r", "retention",
+			&argparse.Options{Help: "Delete tombstones older than this (e.g. 30d, 12h)", Required: false}),
+	}
+
+	listCmd := parser.NewCommand("list", "List preserved tombstones")
+	listArgs := monitor.ListArgs{
+		Filter: monitor.AttachFilterArgs(settings, listCmd),
+		Output: settings.Selector(listCmd, "o", "output", []string{"table", "json"},
+			&argparse.Options{Help: "Output format", Required: false, Default: "table"}),
+		Watched: settings.Flag(listCmd, "w", "watched",
+			&argparse.Options{Help: "List the logs the running monitor watches rather than tombstones", Required: false}),
+	}
+
+	grepCmd := parser.NewCommand("grep", "Search preserved logs")
+	grepArgs := monitor.GrepArgs{
+		Filter: monitor.AttachFilterArgs(settings, grepCmd),
+		Pattern: settings.Pattern(grepCmd, "e", "regexp",
+			&argparse.Options{Help: "Pattern to search for", Required: true}),
+		IgnoreCase: settings.Flag(grepCmd, "i", "ignore-case",
+			&argparse.Options{Help: "Ignore case distinctions", Required: false}),
+		Multiline: settings.Pattern(grepCmd, "", "multiline-start",
+			&argparse.Options{Help: "Match and print whole records, lines not matching this pattern continuing the one before them", Required: false}),
+	}
+
+	catCmd := parser.NewCommand("cat", "Print preserved logs")
+	catArgs := monitor.CatArgs{
+		Filter: monitor.AttachFilterArgs(settings, catCmd),
+		Files: settings.List(catCmd, "f", "file",
+			&argparse.Options{Help: "Tombstone to print (repeatable)", Required: false}),
+		Format: settings.Selector(catCmd, "F", "format", []string{"raw", "text", "json", "logfmt"},
+			&argparse.Options{Help: "Output format", Required: false, Default: "raw"}),
+		Prefix: settings.Selector(catCmd, "", "prefix", []string{monitor.PrefixNone, monitor.PrefixContainer, monitor.PrefixPod},
+			&argparse.Options{Help: "Prefix every line with the container (or pod/container) it comes from", Required: false,
+				Default: monitor.PrefixNone}),
+	}
+
+	tailCmd := parser.NewCommand("tail", "Follow logs of running pods")
+	tailArgs := monitor.TailArgs{
+		Pattern: settings.Pattern(tailCmd, "p", "pattern",
+			&argparse.Options{Help: "Follow logs whose file name matches this pattern", Required: true}),
+		Lines: settings.Int(tailCmd, "n", "lines",
+			&argparse.Options{Help: "Number of existing lines to print first", Required: false, Default: 10}),
+		Format: settings.Selector(tailCmd, "F", "format", []string{"raw", "text", "json", "logfmt"},
+			&argparse.Options{Help: "Output format", Required: false, Default: "text"}),
+		Prefix: settings.Selector(tailCmd, "", "prefix", []string{monitor.PrefixNone, monitor.PrefixContainer, monitor.PrefixPod},
+			&argparse.Options{Help: "Prefix every line with the container (or pod/container) it comes from", Required: false,
+				Default: monitor.PrefixPod}),
+	}
+
+	statsCmd := parser.NewCommand("stats", "Show tombstone and monitor statistics")
+	statsArgs := monitor.StatsArgs{
+		Filter: monitor.AttachFilterArgs(settings, statsCmd),
+		Output: settings.Selector(statsCmd, "o", "output", []string{"text", "json"},
+			&argparse.Options{Help: "Output format", Required: false, Default: "text"}),
+	}
+
+	exportCmd := parser.NewCommand("export", "Package tombstones into a support bundle")
+	exportArgs := monitor.ExportArgs{
+		Filter: monitor.AttachFilterArgs(settings, exportCmd),
+		Output: settings.String(exportCmd, "o", "output",
+			&argparse.Options{Help: "Bundle to create (.tar.gz)", Required: true}),
+	}
+
+	convertCmd := parser.NewCommand("convert", "Convert container logs to text")
+	convertArgs := monitor.ConvertArgs{
+		Files: settings.List(convertCmd, "f", "file",
+			&argparse.Options{Help: "Log to convert (repeatable). Default: stdin", Required: false}),
+		Output: settings.String(convertCmd, "o", "output-dir",
+			&argparse.Options{Help: "Write converted files here instead of stdout", Required: false}),
+		Format: settings.Selector(convertCmd, "F", "format", []string{"text", "json", "logfmt"},
+			&argparse.Options{Help: "Output format", Required: false, Default: "text"}),
+	}
+
+	verifyCmd := parser.NewCommand("verify", "Check the signatures of tombstones")
+	verifyArgs := monitor.VerifyArgs{
+		Filter: monitor.AttachFilterArgs(settings, verifyCmd),
+		PublicKey: settings.String(verifyCmd, "k", "public-key",
+			&argparse.Options{Help: "Ed25519 public key (PEM) of the signing key of the monitor", Required: true}),
+	}
+
+	importCmd := parser.NewCommand("import", "Import logs of deleted pods left in /var/log/pods")
+	importArgs := monitor.ImportArgs{
+		PodsDir: settings.String(importCmd, "", "pods-dir",
+			&argparse.Options{Help: "Kubelet pod logs directory", Required: false, Default: monitor.KubernetesPodLogsPath}),
+		Dir: settings.String(importCmd, "d", "dir",
+			&argparse.Options{Help: "Tombstone directory", Required: false, Default: monitor.TombstonePath}),
+		SkipConversion: settings.Flag(importCmd, "s", "skip-conversion",
+			&argparse.Options{Help: "Do not convert logs from JSON to text.", Required: false}),
+		DryRun: settings.Flag(importCmd, "", "dry-run",
+			&argparse.Options{Help: "Only show what would be imported", Required: false}),
+	}
+
+	manifestCmd := parser.NewCommand("manifest", "Write a Helm chart or kustomize base deploying k8ts as a DaemonSet")
+	manifestArgs := deploy.ManifestArgs{
+		Format: settings.Selector(manifestCmd, "f", "format", []string{"helm", "kustomize"},
+			&argparse.Options{Help: "Layout of the files written", Required: false, Default: "helm"}),
+		Output: settings.String(manifestCmd, "o", "output",
+			&argparse.Options{Help: "Directory to write the files to", Required: true}),
+		K8s:     attachK8sArgs(manifestCmd),
+		Monitor: monitor.AttachArgs(settings, manifestCmd),
+	}
+
+	pruneCmd := parser.NewCommand("prune", "Remove expired and old tombstones")
+	pruneArgs := monitor.PruneArgs{
+		Dir: settings.String(pruneCmd, "d", "dir",
+			&argparse.Options{Help: "Tombstone directory", Required: false, Default: monitor.TombstonePath}),
+		OlderThan: settings.String(pruneCmd, "", "older-than",
+			&argparse.Options{Help: "Remove tombstones preserved before this duration (e.g. 30d, 12h), besides expired ones", Required: false}),
+		MaxSize: settings.String(pruneCmd, "", "max-size",
+			&argparse.Options{Help: "Remove the oldest tombstones until the others fit in this size (e.g. 10G)", Required: false}),
+		DryRun: settings.Flag(pruneCmd, "", "dry-run",
+			&argparse.Options{Help: "Only show what would be removed", Required: false}),
+	}
+
+	snapshotCmd := parser.NewCommand("snapshot", "Preserve the current content of logs the running monitor watches")
+	snapshotArgs := monitor.SnapshotArgs{
+		Pattern: settings.Pattern(snapshotCmd, "p", "pattern",
+			&argparse.Options{Help: "Preserve logs whose file name matches this pattern", Required: true}),
+	}
+
+	ruleCmd := parser.NewCommand("rule", "List, add or remove the filter rules of the running monitor")
+	ruleArgs := monitor.AttachRuleArgs(settings, ruleCmd)
+
+	doctorCmd := parser.NewCommand("doctor", "Check whether this host is ready to run k8ts")
+
+	benchCmd := parser.NewCommand("bench", "Measure how fast the monitor preserves synthetic logs deleted together")
+	benchArgs := monitor.BenchArgs{
+		Dir: settings.String(benchCmd, "d", "dir",
+			&argparse.Options{Help: "Directory of the synthetic logs and their tombstones. Default: a temporary one", Required: false}),
+		Logs: settings.Int(benchCmd, "n", "logs",
+			&argparse.Options{Help: "Number of logs created then deleted together", Required: false, Default: 200}),
+		LogSize: settings.String(benchCmd, "", "log-size",
+			&argparse.Options{Help: "Size of every log (e.g. 1M)", Required: false, Default: "1M"}),
+		LineSize: settings.Int(benchCmd, "", "line-size",
+			&argparse.Options{Help: "Size of the messages of log lines", Required: false, Default: 200}),
+		Format: settings.Selector(benchCmd, "", "format", []string{"cri", "docker"},
+			&argparse.Options{Help: "Format of the logs, as written by containerd and CRI-O or by Docker", Required: false, Default: "cri"}),
+		Timeout: settings.Int(benchCmd, "", "timeout",
+			&argparse.Options{Help: "Give up waiting for the monitor after this many seconds", Required: false, Default: 300}),
+		Keep: settings.Flag(benchCmd, "", "keep",
+			&argparse.Options{Help: "Leave the directory, tombstones and audit log included, behind", Required: false}),
+		Output: settings.Selector(benchCmd, "o", "output", []string{"text", "json"},
+			&argparse.Options{Help: "Output format", Required: false, Default: "text"}),
+		Monitor: monitor.AttachArgs(settings, benchCmd),
+	}
+
+	versionCmd := parser.NewCommand("version", "Show version and build information")
+	versionArgs := VersionArgs{
+		output: settings.Selector(versionCmd, "o", "output", []string{"text", "json"},
+			&argparse.Options{Help: "Output format", Required: false, Default: "text"}),
+	}
+
+	// argparse insists on a command, so --version is handled up front.
+	if len(os.Args) == 2 && os.Args[1] == "--version" {
+		fmt.Println(version.Current())
+		return 0
+	}
+
+	err := parser.Parse(os.Args)
+	if err != nil {
+		fmt.Print(parser.Usage(err))
+		return 1
+	}
+	err = settings.Resolve(*configPath)
+	if err == nil {
+		err = settings.ValidatePatterns()
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	monitorArgs.ConfigPath = settings.ConfigPath
+	deployArgs.Monitor.ConfigPath = settings.ConfigPath
+	manifestArgs.Monitor.ConfigPath = settings.ConfigPath
+	serviceArgs.Install.Monitor.ConfigPath = settings.ConfigPath
+	logger.Configure(*logLevel, *logFormat)
+
+	var action ParserAction = func() error {
+		fmt.Println("No command selected.")
+		fmt.Println(parser.Usage(err))
+		return errors.New("no-command")
+	}
+	if deployCmd.Happened() {
+		action = func() error {
+			return deploy.All(deployArgs)
+		}
+		if deployStatusCmd.Happened() {
+			action = func() error {
+				return deploy.Status(deployArgs)
+			}
+		} else if deployUpgradeCmd.Happened() {
+			action = func() error {
+				return deploy.Upgrade(deployArgs)
+			}
+		} else if deployRemoveCmd.Happened() {
+			action = func() error {
+				return deploy.Remove(deployArgs)
+			}
+		} else if deployK8sCmd.Happened() {
+			action = func() error {
+				return deploy.K8s(k8sArgs, deployArgs.Monitor)
+			}
+		}
+	} else if serviceCmd.Happened() {
+		if serviceArgs.Install.Command.Happened() {
+			action = func() error {
+				return monitor.ServiceInstall(&serviceArgs.Install)
+			}
+		} else if serviceArgs.Uninstall.Happened() {
+			action = func() error {
+				return monitor.ServiceUninstall(&serviceArgs)
+			}
+		} else if serviceArgs.Status.Happened() {
+			action = func() error {
+				return monitor.ServiceStatus(&serviceArgs)
+			}
+		} else if serviceArgs.Restart.Happened() {
+			action = func() error {
+				return monitor.ServiceRestart(&serviceArgs)
+			}
+		} else if serviceArgs.Logs.Happened() {
+			action = func() error {
+				return monitor.ServiceLogs(&serviceArgs)
+			}
+		}
+	} else if monitorCmd.Happened() {
+		action = func() error {
+			m, err := monitor.New(monitorArgs)
+			if err != nil {
+				return err
+			}
+			if *monitorContainer {
+				monitor.EnterContainerMode(m)
+			}
+			return m.Run(context.Background())
+		}
+	} else if serverCmd.Happened() {
+		action = func() error {
+			return server.Run(&serverArgs)
+		}
+	} else if listCmd.Happened() {
+		action = func() error {
+			return monitor.List(&listArgs)
+		}
+	} else if grepCmd.Happened() {
+		action = func() error {
+			return monitor.Grep(&grepArgs)
+		}
+	} else if catCmd.Happened() {
+		action = func() error {
+			return monitor.Cat(&catArgs)
+		}
+	} else if tailCmd.Happened() {
+		action = func() error {
+			return monitor.Tail(&tailArgs)
+		}
+	} else if statsCmd.Happened() {
+		action = func() error {
+			return monitor.Stats(&statsArgs)
+		}
+	} else if exportCmd.Happened() {
+		action = func() error {
+			return monitor.Export(&exportArgs)
+		}
+	} else if convertCmd.Happened() {
+		action = func() error {
+			return monitor.RunConvert(&convertArgs)
+		}
+	} else if verifyCmd.Happened() {
+		action = func() error {
+			return monitor.Verify(&verifyArgs)
+		}
+	} else if importCmd.Happened() {
+		action = func() error {
+			return monitor.ImportLogs(&importArgs)
+		}
+	} else if manifestCmd.Happened() {
+		action = func() error {
+			return deploy.WriteManifest(&manifestArgs)
+		}
+	} else if pruneCmd.Happened() {
+		action = func() error {
+			return monitor.Prune(&pruneArgs)
+		}
+	} else if snapshotCmd.Happened() {
+		action = func() error {
+			return monitor.SnapshotLogs(&snapshotArgs)
+		}
+	} else if ruleCmd.Happened() {
+		action = func() error {
+			return monitor.Rule(ruleArgs)
+		}
+	} else if doctorCmd.Happened() {
+		action = monitor.RunDoctor
+	} else if benchCmd.Happened() {
+		action = func() error {
+			return monitor.Bench(&benchArgs)
+		}
+	} else if versionCmd.Happened() {
+		action = func() error {
+			return printVersion(&versionArgs)
+		}
+	}
+	err = action()
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+	return 0
+}
+
+func main() {
+	os.Exit(parseArgs())
+}
+
+type VersionArgs struct {
+	output *string
+}
+
+func printVersion(args *VersionArgs) error {
+	info := version.Current()
+	if *args.output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(info)
+	}
+	fmt.Println(info)
+	return nil
+}
@@ -1,9 +1,15 @@
 module github.com/badeadan/k8ts
 
-go 1.12
+go 1.24.0
 
 require (
 	github.com/akamensky/argparse v0.0.0-20190309155458-28b0496b54cb
 	github.com/alessio/shellescape v0.0.0-20190409004728-b115ca0f9053
-	github.com/appleboy/easyssh-proxy v1.2.0
+	github.com/kevinburke/ssh_config v0.0.0-20190725054713-01f96b0aa0cd
+	github.com/klauspost/compress v1.11.13
+	go.starlark.net v0.0.0-20260210143700-b62fd896b91b
+	golang.org/x/crypto v0.48.0
+	golang.org/x/sys v0.41.0
+	golang.org/x/term v0.40.0
+	gopkg.in/yaml.v2 v2.4.0
 )
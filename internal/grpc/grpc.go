@@ -0,0 +1,250 @@
+// Package grpc encodes by hand the few gRPC calls k8ts makes, to container
+// runtimes and between agents and the collector: messages are
+// length-prefixed protobuf over HTTP/2, their fields being known, as the
+// kube-api source does with the API server rather than depending on client
+// libraries.
+package grpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	// MaxMessage bounds the messages read, the default of gRPC.
+	MaxMessage  = 16 << 20
+	ContentType = "application/grpc"
+)
+
+// The status codes of gRPC used.
+const (
+	OK                = 0
+	InvalidArgument   = 3
+	PermissionDenied  = 7
+	ResourceExhausted = 8
+	Aborted           = 10
+	// Unimplemented is the status of methods the server doesn't have,
+	// e.g. GetContainerEvents before containerd 1.7.
+	Unimplemented = 12
+	Internal      = 13
+)
+
+// Error is the status a call failed with.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("gRPC status %d: %s", e.Code, e.Message)
+}
+
+// IsUnimplemented tells whether err is the status of a method the server
+// doesn't have.
+func IsUnimplemented(err error) bool {
+	var status *Error
+	return errors.As(err, &status) && status.Code == Unimplemented
+}
+
+// Client calls the methods of the service at Base, e.g.
+// http://localhost/runtime.v1.RuntimeService/, through HTTP.
+type Client struct {
+	Base string
+	HTTP *http.Client
+}
+
+// Call makes a unary call of method and returns the response.
+func (c *Client) Call(ctx context.Context, method string, request []byte) ([]byte, error) {
+	var response []byte
+	err := c.Stream(ctx, method, bytes.NewReader(Frame(request)), func(message []byte) {
+		response = message
+	})
+	return response, err
+}
+
+// Stream makes a call of method with the messages framed in request and
+// hands every message of the response to handle until the server ends it.
+func (c *Client) Stream(ctx context.Context, method string, request io.Reader, handle func([]byte)) error {
+	httpRequest, err := http.NewRequest("POST", c.Base+method, request)
+	if err != nil {
+		return err
+	}
+	httpRequest = httpRequest.WithContext(ctx)
+	httpRequest.Header.Set("Content-Type", ContentType)
+	httpRequest.Header.Set("TE", "trailers")
+	response, err := c.HTTP.Do(httpRequest)
+	if err != nil {
+		return fmt.Errorf("%s: %v", method, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", method, response.Status)
+	}
+	reader := bufio.NewReader(response.Body)
+	for {
+		message, err := Read(reader, MaxMessage)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", method, err)
+		}
+		handle(message)
+	}
+	// The status is in the trailers, or in the headers of responses
+	// without messages.
+	status, message := response.Trailer.Get("Grpc-Status"), response.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = response.Header.Get("Grpc-Status"), response.Header.Get("Grpc-Message")
+	}
+	if status != "" && status != "0" {
+		code, _ := strconv.Atoi(status)
+		if unescaped, err := url.PathUnescape(message); err == nil {
+			message = unescaped
+		}
+		return fmt.Errorf("%s: %w", method, &Error{Code: code, Message: message})
+	}
+	return nil
+}
+
+// Frame prefixes message with its length, uncompressed.
+func Frame(message []byte) []byte {
+	frame := make([]byte, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(message)))
+	copy(frame[5:], message)
+	return frame
+}
+
+// Read reads the next message framed by Frame, or io.EOF once
+// there are no more. Messages larger than limit are refused before
+// anything is allocated for them.
+func Read(reader *bufio.Reader, limit int) ([]byte, error) {
+	prefix := make([]byte, 5)
+	_, err := io.ReadFull(reader, prefix)
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if prefix[0] != 0 {
+		return nil, &Error{Code: Unimplemented, Message: "compressed messages are not supported"}
+	}
+	if uint64(size) > uint64(limit) {
+		return nil, &Error{Code: ResourceExhausted,
+			Message: fmt.Sprintf("message of %d bytes, larger than %d", size, limit)}
+	}
+	message := make([]byte, size)
+	_, err = io.ReadFull(reader, message)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return message, err
+}
+
+// Reply answers a call served by k8ts with message, unless nil, and
+// the status of err.
+func Reply(w http.ResponseWriter, message []byte, err error) {
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	if message != nil && err == nil {
+		_, _ = w.Write(Frame(message))
+	}
+	code, text := OK, ""
+	if err != nil {
+		code, text = Internal, err.Error()
+		var status *Error
+		if errors.As(err, &status) {
+			code, text = status.Code, status.Message
+		}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", url.PathEscape(text))
+}
+
+// ProtoFields calls handle with the number of every field of the protobuf
+// message, along with its value for varints and its bytes for
+// length-delimited fields.
+func ProtoFields(message []byte, handle func(number int, value uint64, data []byte) error) error {
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return errors.New("invalid protobuf message")
+		}
+		message = message[n:]
+		var value uint64
+		var data []byte
+		switch key & 7 {
+		case 0:
+			value, n = binary.Uvarint(message)
+			if n <= 0 {
+				return errors.New("invalid protobuf varint")
+			}
+			message = message[n:]
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(message) < size {
+				return errors.New("truncated protobuf message")
+			}
+			message = message[size:]
+		case 2:
+			size, n := binary.Uvarint(message)
+			if n <= 0 || uint64(len(message)-n) < size {
+				return errors.New("truncated protobuf message")
+			}
+			data = message[n : n+int(size)]
+			message = message[n+int(size):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		err := handle(int(key>>3), value, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ProtoMapEntry adds the entry of a map<string, string> to entries.
+func ProtoMapEntry(data []byte, entries map[string]string) error {
+	var key, value string
+	err := ProtoFields(data, func(number int, _ uint64, data []byte) error {
+		switch number {
+		case 1:
+			key = string(data)
+		case 2:
+			value = string(data)
+		}
+		return nil
+	})
+	entries[key] = value
+	return err
+}
+
+// ProtoString encodes the string field number.
+func ProtoString(number int, value string) []byte {
+	return ProtoBytes(number, []byte(value))
+}
+
+// ProtoBytes encodes the bytes field number.
+func ProtoBytes(number int, value []byte) []byte {
+	field := binary.AppendUvarint(nil, uint64(number)<<3|2)
+	field = binary.AppendUvarint(field, uint64(len(value)))
+	return append(field, value...)
+}
+
+// ProtoVarint encodes the integer or boolean field number.
+func ProtoVarint(number int, value uint64) []byte {
+	field := binary.AppendUvarint(nil, uint64(number)<<3)
+	return binary.AppendUvarint(field, value)
+}
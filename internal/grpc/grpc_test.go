@@ -0,0 +1,119 @@
+package grpc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestGRPCFrameRoundTrip(t *testing.T) {
+	messages := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte("x"), 70000)}
+	var stream bytes.Buffer
+	for _, message := range messages {
+		stream.Write(Frame(message))
+	}
+	reader := bufio.NewReader(&stream)
+	for i, want := range messages {
+		got, err := Read(reader, MaxMessage)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("message %d is %d bytes (%v), want %d", i+1, len(got), err, len(want))
+		}
+	}
+	if _, err := Read(reader, MaxMessage); err != io.EOF {
+		t.Errorf("end of the stream gives %v, want EOF", err)
+	}
+}
+
+func TestGRPCReadErrors(t *testing.T) {
+	for _, c := range []struct {
+		name  string
+		frame []byte
+		limit int
+		err   error
+		code  int
+	}{
+		{"truncated prefix", []byte{0, 0, 0}, 10, io.ErrUnexpectedEOF, 0},
+		{"truncated message", []byte{0, 0, 0, 0, 4, 'a', 'b'}, 10, io.ErrUnexpectedEOF, 0},
+		{"no message", []byte{0, 0, 0, 0, 4}, 10, io.ErrUnexpectedEOF, 0},
+		{"compressed", []byte{1, 0, 0, 0, 1, 'a'}, 10, nil, Unimplemented},
+		{"over the limit", Frame([]byte("eleven byte")), 10, nil, ResourceExhausted},
+		{"largest prefix", []byte{0, 0xff, 0xff, 0xff, 0xff}, MaxMessage, nil, ResourceExhausted},
+	} {
+		_, err := Read(bufio.NewReader(bytes.NewReader(c.frame)), c.limit)
+		var status *Error
+		switch {
+		case c.err != nil && err != c.err:
+			t.Errorf("%s: %v, want %v", c.name, err, c.err)
+		case c.err == nil && (!errors.As(err, &status) || status.Code != c.code):
+			t.Errorf("%s: %v, want status %d", c.name, err, c.code)
+		}
+	}
+	if _, err := Read(bufio.NewReader(bytes.NewReader(Frame([]byte("ten bytes!")))), 10); err != nil {
+		t.Errorf("message at the limit: %v", err)
+	}
+}
+
+func TestProtoFields(t *testing.T) {
+	var message []byte
+	message = append(message, ProtoString(1, "name")...)
+	message = append(message, ProtoVarint(2, 300)...)
+	// A fixed64 and a fixed32 field, skipped.
+	message = append(message, 3<<3|1, 1, 2, 3, 4, 5, 6, 7, 8)
+	message = append(message, 4<<3|5, 1, 2, 3, 4)
+	message = append(message, ProtoBytes(5, []byte{0, 1})...)
+	message = append(message, ProtoVarint(6, 0)...)
+
+	type field struct {
+		number int
+		value  uint64
+		data   string
+	}
+	var got []field
+	err := ProtoFields(message, func(number int, value uint64, data []byte) error {
+		got = append(got, field{number, value, string(data)})
+		return nil
+	})
+	want := []field{{1, 0, "name"}, {2, 300, ""}, {3, 0, ""}, {4, 0, ""}, {5, 0, "\x00\x01"}, {6, 0, ""}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("fields %+v (%v), want %+v", got, err, want)
+	}
+
+	for name, message := range map[string][]byte{
+		"truncated key":     {0x80},
+		"truncated varint":  {1 << 3, 0x80},
+		"truncated fixed64": {1<<3 | 1, 1, 2, 3},
+		"truncated fixed32": {1<<3 | 5, 1, 2},
+		"truncated bytes":   {1<<3 | 2, 5, 'a'},
+		"huge length":       {1<<3 | 2, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01},
+		"group":             {1<<3 | 3},
+	} {
+		if err := ProtoFields(message, func(int, uint64, []byte) error { return nil }); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+
+	stop := errors.New("stop")
+	if err := ProtoFields(message, func(int, uint64, []byte) error { return stop }); err != stop {
+		t.Errorf("error of the handler is %v", err)
+	}
+}
+
+func TestProtoMapEntry(t *testing.T) {
+	entries := map[string]string{}
+	for _, entry := range [][]byte{
+		append(ProtoString(1, "app"), ProtoString(2, "web")...),
+		append(ProtoString(2, "api"), ProtoString(1, "tier")...),
+		ProtoString(1, "empty"),
+	} {
+		if err := ProtoMapEntry(entry, entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{"app": "web", "tier": "api", "empty": ""}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("entries %v, want %v", entries, want)
+	}
+}
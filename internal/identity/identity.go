@@ -0,0 +1,33 @@
+// Package identity names the node and cluster k8ts runs in, which
+// tombstones, uploads, metrics and alerts are stamped with.
+package identity
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// cluster holds --cluster-name, stamped along with the node name so that
+// the tombstones of many clusters can be told apart once gathered.
+var cluster atomic.Value
+
+// SetCluster sets the name of the cluster, from --cluster-name.
+func SetCluster(name string) {
+	cluster.Store(name)
+}
+
+// Cluster returns the name of the cluster, empty unless set.
+func Cluster() string {
+	name, _ := cluster.Load().(string)
+	return name
+}
+
+// Node is the name of the node k8ts runs on, given to the DaemonSet as
+// NODE_NAME, or else the hostname.
+func Node() string {
+	if node := os.Getenv("NODE_NAME"); node != "" {
+		return node
+	}
+	node, _ := os.Hostname()
+	return node
+}
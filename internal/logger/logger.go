@@ -0,0 +1,144 @@
+// Package logger writes the messages of k8ts, leveled and with key/value
+// context, to stderr unless told otherwise.
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// LevelNames are the levels of messages, from the most verbose.
+var LevelNames = []string{"debug", "info", "warn", "error"}
+
+// structuredLogger writes leveled messages with key/value context either
+// in logfmt (time=... level=info msg="..." key=value) or as JSON objects.
+type structuredLogger struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	level  logLevel
+	asJSON bool
+}
+
+var logger = &structuredLogger{out: os.Stderr, level: levelInfo}
+
+// Configure sets the level of the messages logged, one of LevelNames, and
+// their format, logfmt or json.
+func Configure(level string, format string) {
+	for i, name := range LevelNames {
+		if name == level {
+			logger.level = logLevel(i)
+		}
+	}
+	logger.asJSON = format == "json"
+}
+
+// SetOutput writes the messages to out as JSON objects, e.g. to stdout for
+// the container runtime to collect.
+func SetOutput(out io.Writer) {
+	logger.out = out
+	logger.asJSON = true
+}
+
+func Debug(msg string, keyvals ...interface{}) {
+	logger.log(levelDebug, msg, keyvals)
+}
+
+func Info(msg string, keyvals ...interface{}) {
+	logger.log(levelInfo, msg, keyvals)
+}
+
+func Warn(msg string, keyvals ...interface{}) {
+	logger.log(levelWarn, msg, keyvals)
+}
+
+func Error(msg string, keyvals ...interface{}) {
+	logger.log(levelError, msg, keyvals)
+}
+
+// Fatal logs an error and exits.
+func Fatal(msg string, keyvals ...interface{}) {
+	logger.log(levelError, msg, keyvals)
+	os.Exit(1)
+}
+
+func (l *structuredLogger) log(level logLevel, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+	var line string
+	if l.asJSON {
+		line = l.formatJSON(level, msg, keyvals)
+	} else {
+		line = l.formatLogfmt(level, msg, keyvals)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, _ = io.WriteString(l.out, line)
+}
+
+func (l *structuredLogger) formatLogfmt(level logLevel, msg string, keyvals []interface{}) string {
+	var out strings.Builder
+	out.WriteString("time=" + time.Now().Format(time.RFC3339Nano))
+	out.WriteString(" level=" + LevelNames[level])
+	out.WriteString(" msg=" + LogfmtValue(msg))
+	for i := 0; i < len(keyvals); i += 2 {
+		key, value := keyValue(keyvals, i)
+		out.WriteString(" " + key + "=" + LogfmtValue(fmt.Sprint(value)))
+	}
+	out.WriteString("\n")
+	return out.String()
+}
+
+// LogfmtValue quotes value when needed to be a logfmt value.
+func LogfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\t\\") || !strconv.CanBackquote(value) {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func (l *structuredLogger) formatJSON(level logLevel, msg string, keyvals []interface{}) string {
+	entry := make(map[string]interface{}, 3+len(keyvals)/2)
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = LevelNames[level]
+	entry["msg"] = msg
+	for i := 0; i < len(keyvals); i += 2 {
+		key, value := keyValue(keyvals, i)
+		switch v := value.(type) {
+		case error:
+			entry[key] = v.Error()
+		case fmt.Stringer:
+			entry[key] = v.String()
+		default:
+			entry[key] = v
+		}
+	}
+	content, err := json.Marshal(entry)
+	if err != nil {
+		return `{"level":"error","msg":` + strconv.Quote(err.Error()) + "}\n"
+	}
+	return string(content) + "\n"
+}
+
+func keyValue(keyvals []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(keyvals[i])
+	if i+1 >= len(keyvals) {
+		return key, ""
+	}
+	return key, keyvals[i+1]
+}
@@ -0,0 +1,623 @@
+// Package settings registers the options of the commands of k8ts so that
+// they can also be set in the configuration file or the environment, and
+// be rendered back as arguments or a configuration file.
+package settings
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/alessio/shellescape"
+	"gopkg.in/yaml.v2"
+)
+
+// Every command line option can also be set in the configuration file
+// (same name as the long option, e.g. `include-log: ^nginx`) or through a
+// K8TS_* environment variable (K8TS_INCLUDE_LOG). Flags take precedence
+// over the configuration file which takes precedence over the environment.
+const EnvPrefix = "K8TS_"
+const configEnv = EnvPrefix + "CONFIG"
+
+// Setting is an option registered through settings so its value can be
+// resolved from the configuration file and environment after parsing.
+type Setting struct {
+	Command  *argparse.Command
+	Name     string
+	Value    interface{}
+	Choices  []string
+	Required bool
+	Provided bool
+	Pattern  bool
+	Glob     bool
+	Records  bool
+	Fallback interface{}
+}
+
+// Settings are the options registered on the commands of a parser.
+type Settings struct {
+	Options    []*Setting
+	shorts     map[*argparse.Command]map[string]bool
+	ConfigPath string
+}
+
+// New returns settings without options yet.
+func New() *Settings {
+	return &Settings{
+		Options: make([]*Setting, 0),
+		shorts:  make(map[*argparse.Command]map[string]bool),
+	}
+}
+
+// track wraps the options of an argument so settings learns whether it
+// was given on the command line. It also drops short names already taken
+// on the same command, which argparse would otherwise silently resolve by
+// dropping the whole argument.
+func (s *Settings) track(cmd *argparse.Command, short string, name string, opts *argparse.Options) (*Setting, string, *argparse.Options) {
+	option := &Setting{Command: cmd, Name: name}
+	s.Options = append(s.Options, option)
+	if s.shorts[cmd] == nil {
+		s.shorts[cmd] = make(map[string]bool)
+	}
+	if s.shorts[cmd][short] {
+		short = ""
+	} else if short != "" {
+		s.shorts[cmd][short] = true
+	}
+	wrapped := argparse.Options{}
+	if opts != nil {
+		wrapped = *opts
+	}
+	// Required options may come from the file or the environment, so
+	// they are only checked once everything is resolved.
+	option.Required = wrapped.Required
+	option.Fallback = wrapped.Default
+	wrapped.Required = false
+	validate := wrapped.Validate
+	wrapped.Validate = func(args []string) error {
+		option.Provided = true
+		if validate != nil {
+			return validate(args)
+		}
+		return nil
+	}
+	return option, short, &wrapped
+}
+
+func (s *Settings) String(cmd *argparse.Command, short string, long string, opts *argparse.Options) *string {
+	option, short, opts := s.track(cmd, short, long, opts)
+	value := cmd.String(short, long, opts)
+	option.Value = value
+	return value
+}
+
+func (s *Settings) Flag(cmd *argparse.Command, short string, long string, opts *argparse.Options) *bool {
+	option, short, opts := s.track(cmd, short, long, opts)
+	value := cmd.Flag(short, long, opts)
+	option.Value = value
+	return value
+}
+
+func (s *Settings) Int(cmd *argparse.Command, short string, long string, opts *argparse.Options) *int {
+	option, short, opts := s.track(cmd, short, long, opts)
+	value := cmd.Int(short, long, opts)
+	option.Value = value
+	return value
+}
+
+func (s *Settings) List(cmd *argparse.Command, short string, long string, opts *argparse.Options) *[]string {
+	option, short, opts := s.track(cmd, short, long, opts)
+	value := cmd.List(short, long, opts)
+	option.Value = value
+	return value
+}
+
+func (s *Settings) Selector(cmd *argparse.Command, short string, long string, choices []string, opts *argparse.Options) *string {
+	option, short, opts := s.track(cmd, short, long, opts)
+	value := cmd.Selector(short, long, choices, opts)
+	option.Value = value
+	option.Choices = choices
+	return value
+}
+
+// Records registers a list option whose values hold commas of their own,
+// e.g. sinks given as KIND:KEY=VALUE,KEY=VALUE. A value of the
+// configuration file or the environment is taken whole rather than split
+// on commas: several are given as a YAML list, or one per line in the
+// environment.
+func (s *Settings) Records(cmd *argparse.Command, short string, long string, opts *argparse.Options) *[]string {
+	value := s.List(cmd, short, long, opts)
+	s.Options[len(s.Options)-1].Records = true
+	return value
+}
+
+// Pattern registers a string option holding a regular expression. It is
+// validated by ValidatePatterns once all sources are resolved.
+func (s *Settings) Pattern(cmd *argparse.Command, short string, long string, opts *argparse.Options) *string {
+	value := s.String(cmd, short, long, opts)
+	s.Options[len(s.Options)-1].Pattern = true
+	return value
+}
+
+// Glob registers a string option holding a shell-style glob, validated
+// along with the regular expressions.
+func (s *Settings) Glob(cmd *argparse.Command, short string, long string, opts *argparse.Options) *string {
+	value := s.String(cmd, short, long, opts)
+	s.Options[len(s.Options)-1].Glob = true
+	return value
+}
+
+// ValidatePatterns checks the regular expressions of the commands that
+// ran so a typo is reported before anything starts (or gets deployed).
+func (s *Settings) ValidatePatterns() error {
+	for _, option := range s.Options {
+		if !option.Command.Happened() {
+			continue
+		}
+		if err := option.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate compiles the value of an option holding a regular expression
+// or a glob.
+func (o *Setting) validate() error {
+	if !(o.Pattern || o.Glob) {
+		return nil
+	}
+	value := *o.Value.(*string)
+	if value == "" {
+		return nil
+	}
+	compile := CompilePattern
+	if o.Glob {
+		compile = CompileGlob
+	}
+	_, err := compile(o.Name, value)
+	return err
+}
+
+// CompilePattern compiles the regular expression given for an option and
+// explains what is wrong with it, pointing at the offending position.
+func CompilePattern(name string, pattern string) (*regexp.Regexp, error) {
+	compiled, err := regexp.Compile(pattern)
+	if err == nil {
+		return compiled, nil
+	}
+	syntaxErr, ok := err.(*syntax.Error)
+	if !ok {
+		return nil, fmt.Errorf("invalid --%s pattern: %v", name, err)
+	}
+	position := strings.Index(pattern, syntaxErr.Expr)
+	if position < 0 {
+		position = 0
+	}
+	return nil, fmt.Errorf("invalid --%s pattern at position %d: %s\n    %s\n    %s^",
+		name, position+1, syntaxErr.Code, pattern, strings.Repeat(" ", position))
+}
+
+// CompileGlob turns a shell-style glob (`*`, `?`, `[a-z]`, `[!a-z]`) into
+// a regular expression matching whole names, so globs and patterns can be
+// used interchangeably.
+func CompileGlob(name string, glob string) (*regexp.Regexp, error) {
+	expr, err := globToPattern(glob)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --%s glob: %v", name, err)
+	}
+	compiled, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --%s glob: %v", name, err)
+	}
+	return compiled, nil
+}
+
+func globToPattern(glob string) (string, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated '[' at position %d", i+1)
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return expr.String(), nil
+}
+
+// Since returns the options registered after the given number of options
+// was reached, i.e. the options added by a group of attach calls.
+func (s *Settings) Since(mark int) []*Setting {
+	return s.Options[mark:]
+}
+
+// MarshalArgs renders options back into command line arguments which
+// parse to the same values. Options left to their default are omitted.
+func MarshalArgs(options []*Setting) string {
+	args := ArgList(options)
+	for i, arg := range args {
+		args[i] = shellescape.Quote(arg)
+	}
+	return strings.Join(args, " ")
+}
+
+// ArgList returns the command line arguments giving the current values
+// of options, unquoted.
+func ArgList(options []*Setting) []string {
+	args := make([]string, 0, len(options))
+	for _, option := range options {
+		if !option.changed() {
+			continue
+		}
+		flag := "--" + option.Name
+		switch value := option.Value.(type) {
+		case *string:
+			args = append(args, flag, *value)
+		case *bool:
+			if *value {
+				args = append(args, flag)
+			}
+		case *int:
+			args = append(args, flag, strconv.Itoa(*value))
+		case *[]string:
+			for _, item := range *value {
+				args = append(args, flag, item)
+			}
+		}
+	}
+	return args
+}
+
+// envName returns the environment variable for an option name.
+func envName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+func LoadConfigFile(path string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	if path == "" {
+		return values, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfigFile(path, content)
+}
+
+func ParseConfigFile(path string, content []byte) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	err := yaml.Unmarshal(content, &values)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file '%s': %v", path, err)
+	}
+	return values, nil
+}
+
+// MarshalConfig renders a configuration file setting the current values of
+// options, on top of the content of the file at base if any. Options left
+// to their default are omitted.
+func MarshalConfig(options []*Setting, base string) ([]byte, error) {
+	file, err := LoadConfigFile(base)
+	if err != nil {
+		return nil, err
+	}
+	for _, option := range options {
+		var value interface{}
+		if option.changed() {
+			switch v := option.Value.(type) {
+			case *string:
+				value = *v
+			case *bool:
+				value = *v
+			case *int:
+				value = *v
+			case *[]string:
+				value = *v
+			}
+		}
+		if value != nil {
+			file[option.Name] = value
+		} else if option.Provided {
+			delete(file, option.Name)
+		}
+	}
+	return yaml.Marshal(file)
+}
+
+// ConfigArgs renders the options a configuration file sets as the command
+// line arguments MarshalArgs would give for them.
+func ConfigArgs(options []*Setting, file map[string]interface{}) (string, error) {
+	saved := Snapshot(options)
+	defer Restore(options, saved)
+	for _, option := range options {
+		option.Reset()
+		if value, ok := file[option.Name]; ok {
+			err := option.Set(value)
+			if err != nil {
+				return "", fmt.Errorf("invalid '%s': %v", option.Name, err)
+			}
+		}
+	}
+	return MarshalArgs(options), nil
+}
+
+// Resolve fills the options of the commands that ran and were not given
+// on the command line from the configuration file or the environment.
+func (s *Settings) Resolve(configPath string) error {
+	if configPath == "" {
+		configPath = os.Getenv(configEnv)
+	}
+	s.ConfigPath = configPath
+	file, err := LoadConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	for _, option := range s.Options {
+		if option.Provided || !option.Command.Happened() {
+			continue
+		}
+		if value, ok := file[option.Name]; ok {
+			err = option.Set(value)
+			if err != nil {
+				return fmt.Errorf("invalid '%s' in %s: %v", option.Name, configPath, err)
+			}
+		} else if value, ok := os.LookupEnv(envName(option.Name)); ok {
+			err = option.Set(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s: %v", envName(option.Name), err)
+			}
+		} else if option.Required {
+			return fmt.Errorf("[--%s] is required (or set it with %s)",
+				option.Name, envName(option.Name))
+		}
+	}
+	return nil
+}
+
+// Apply sets options from values named as in the configuration file, and
+// the others to their default, for programs which don't parse a command
+// line.
+func Apply(options []*Setting, values map[string]interface{}) error {
+	named := make(map[string]*Setting, len(options))
+	for _, option := range options {
+		option.Reset()
+		named[option.Name] = option
+	}
+	for name, value := range values {
+		option, ok := named[name]
+		if !ok {
+			return fmt.Errorf("unknown option '%s'", name)
+		}
+		if err := option.Set(value); err != nil {
+			return fmt.Errorf("invalid '%s': %v", name, err)
+		}
+		if err := option.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reload reads the configuration file again and updates the
+// options not given on the command line. Options removed from the file fall
+// back to the environment, then to their default. On error the options are
+// left untouched.
+func Reload(options []*Setting, configPath string) error {
+	file, err := LoadConfigFile(configPath)
+	if err != nil {
+		return err
+	}
+	saved := Snapshot(options)
+	for _, option := range options {
+		if option.Provided {
+			continue
+		}
+		if value, ok := file[option.Name]; ok {
+			err = option.Set(value)
+			if err != nil {
+				err = fmt.Errorf("invalid '%s' in %s: %v", option.Name, configPath, err)
+			}
+		} else if value, ok := os.LookupEnv(envName(option.Name)); ok {
+			err = option.Set(value)
+			if err != nil {
+				err = fmt.Errorf("invalid %s: %v", envName(option.Name), err)
+			}
+		} else {
+			option.Reset()
+		}
+		if err != nil {
+			Restore(options, saved)
+			return err
+		}
+	}
+	return nil
+}
+
+// changed tells whether an option differs from its default value, e.g.
+// an option whose default was cleared.
+func (o *Setting) changed() bool {
+	switch value := o.Value.(type) {
+	case *string:
+		fallback, _ := o.Fallback.(string)
+		return *value != fallback
+	case *bool:
+		fallback, _ := o.Fallback.(bool)
+		return *value != fallback
+	case *int:
+		fallback, _ := o.Fallback.(int)
+		return *value != fallback
+	case *[]string:
+		return len(*value) > 0
+	}
+	return false
+}
+
+// Reset puts an option back to its default value.
+func (o *Setting) Reset() {
+	switch target := o.Value.(type) {
+	case *string:
+		*target, _ = o.Fallback.(string)
+	case *bool:
+		*target, _ = o.Fallback.(bool)
+	case *int:
+		*target, _ = o.Fallback.(int)
+	case *[]string:
+		*target, _ = o.Fallback.([]string)
+	}
+}
+
+// Snapshot copies the current values of options, see Restore and
+// Changed.
+func Snapshot(options []*Setting) []interface{} {
+	values := make([]interface{}, len(options))
+	for i, option := range options {
+		switch value := option.Value.(type) {
+		case *string:
+			values[i] = *value
+		case *bool:
+			values[i] = *value
+		case *int:
+			values[i] = *value
+		case *[]string:
+			values[i] = append([]string(nil), *value...)
+		}
+	}
+	return values
+}
+
+func Restore(options []*Setting, values []interface{}) {
+	for i, option := range options {
+		switch value := option.Value.(type) {
+		case *string:
+			*value = values[i].(string)
+		case *bool:
+			*value = values[i].(bool)
+		case *int:
+			*value = values[i].(int)
+		case *[]string:
+			*value = values[i].([]string)
+		}
+	}
+}
+
+// Changed returns the names of the options whose value differs
+// from the snapshot, along with the old and new values.
+func Changed(options []*Setting, before []interface{}) [][3]string {
+	after := Snapshot(options)
+	changes := make([][3]string, 0)
+	for i, option := range options {
+		old, current := fmt.Sprint(before[i]), fmt.Sprint(after[i])
+		if old != current {
+			changes = append(changes, [3]string{option.Name, old, current})
+		}
+	}
+	return changes
+}
+
+// Set assigns a value coming from YAML or from the environment.
+func (o *Setting) Set(value interface{}) error {
+	switch target := o.Value.(type) {
+	case *string:
+		text := fmt.Sprint(value)
+		if o.Choices != nil && !Contains(o.Choices, text) {
+			return fmt.Errorf("must be one of %s", strings.Join(o.Choices, ", "))
+		}
+		*target = text
+	case *bool:
+		switch v := value.(type) {
+		case bool:
+			*target = v
+		default:
+			parsed, err := strconv.ParseBool(fmt.Sprint(v))
+			if err != nil {
+				return err
+			}
+			*target = parsed
+		}
+	case *int:
+		parsed, err := strconv.Atoi(fmt.Sprint(value))
+		if err != nil {
+			return err
+		}
+		*target = parsed
+	case *[]string:
+		switch v := value.(type) {
+		case []string:
+			*target = append([]string(nil), v...)
+		case []interface{}:
+			list := make([]string, 0, len(v))
+			for _, item := range v {
+				list = append(list, fmt.Sprint(item))
+			}
+			*target = list
+		default:
+			if o.Records {
+				*target = splitLines(fmt.Sprint(v))
+			} else {
+				*target = strings.Split(fmt.Sprint(v), ",")
+			}
+		}
+	}
+	return nil
+}
+
+// splitLines returns the lines of value which aren't blank.
+func splitLines(value string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func Contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseDuration extends time.ParseDuration with a "d" (days) unit since
+// retention periods are usually expressed in days.
+func ParseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,52 @@
+package settings
+
+import "testing"
+
+func TestCompileGlob(t *testing.T) {
+	for _, c := range []struct {
+		glob    string
+		matches []string
+		misses  []string
+	}{
+		{"web-*", []string{"web-", "web-1_shop_app"}, []string{"api-web-1", "web"}},
+		{"api-?", []string{"api-1"}, []string{"api-12", "api-"}},
+		{"node-[0-9]", []string{"node-7"}, []string{"node-a", "node-10"}},
+		{"[!a-z]*", []string{"0-system", "-"}, []string{"kube-system", ""}},
+		{"a.b+c", []string{"a.b+c"}, []string{"axb+c", "a.bbc"}},
+		{`lit\*`, []string{"lit*"}, []string{"literal"}},
+		{`path[\]`, []string{`path\`}, []string{"path"}},
+		{"", []string{""}, []string{"x"}},
+	} {
+		pattern, err := CompileGlob("pods", c.glob)
+		if err != nil {
+			t.Errorf("%q: %v", c.glob, err)
+			continue
+		}
+		for _, name := range c.matches {
+			if !pattern.MatchString(name) {
+				t.Errorf("%q doesn't match %q", c.glob, name)
+			}
+		}
+		for _, name := range c.misses {
+			if pattern.MatchString(name) {
+				t.Errorf("%q matches %q", c.glob, name)
+			}
+		}
+	}
+	for _, glob := range []string{"node-[0-9", "node-[z-a]"} {
+		if _, err := CompileGlob("pods", glob); err == nil {
+			t.Errorf("%q compiles", glob)
+		}
+	}
+}
+
+func TestCompilePattern(t *testing.T) {
+	if _, err := CompilePattern("keep-if", "^panic"); err != nil {
+		t.Error(err)
+	}
+	_, err := CompilePattern("keep-if", "error [a-")
+	want := "invalid --keep-if pattern at position 7: missing closing ]\n    error [a-\n          ^"
+	if err == nil || err.Error() != want {
+		t.Errorf("error is %v, want %s", err, want)
+	}
+}
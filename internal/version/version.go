@@ -0,0 +1,42 @@
+// Package version tells which build of k8ts is running.
+package version
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Set at build time through -ldflags "-X
+// github.com/badeadan/k8ts/internal/version.Version=..." (see Makefile).
+var (
+	Version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// Info describes the build of k8ts.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+}
+
+// Current describes the running build.
+func Current() Info {
+	return Info{
+		Version:   Version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+// String renders the build information on a single line, the same format
+// printed on a remote host by `k8ts --version`.
+func (b Info) String() string {
+	return fmt.Sprintf("k8ts %s (commit %s, built %s, %s, %s)",
+		b.Version, b.Commit, b.BuildDate, b.GoVersion, b.Platform)
+}
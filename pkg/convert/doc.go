@@ -0,0 +1,30 @@
+// Package convert reads the logs container runtimes write under
+// /var/log/containers, Docker JSON or CRI lines, and converts them, e.g. to
+// plain text.
+//
+// Lines are read with a LineReader, parsed into Entry values with
+// ParseRecord, cleaned up with a Rewrite and put back together with an
+// Assembler when the runtime split them or they continue a multiline
+// record:
+//
+//	assembler := convert.Assembler{}
+//	scanner := convert.NewLineReader(source)
+//	defer scanner.Release()
+//	for scanner.Scan() {
+//		entry, err := convert.ParseRecord(scanner.Bytes())
+//		if err != nil {
+//			continue
+//		}
+//		if entry, complete := assembler.Add(entry); complete {
+//			fmt.Println(entry.Time, entry.Stream, entry.Log)
+//		}
+//	}
+//	for _, entry := range assembler.Flush() {
+//		fmt.Println(entry.Time, entry.Stream, entry.Log)
+//	}
+//
+// Secrets are replaced in complete messages with Rewrite.Redact, using the
+// Redaction presets or patterns of one's own.
+//
+// ConvertLog does just that, rendering the lines in a format of its own.
+package convert
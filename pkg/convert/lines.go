@@ -0,0 +1,125 @@
+package convert
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+)
+
+// DefaultBufferSize is the size of the buffers logs are read and written
+// through, unless BufferSize is changed.
+const DefaultBufferSize = 64 * 1024
+
+// DefaultMaxRetainedLine is the longest line a LineReader keeps the buffer
+// of for the next ones, so that a single huge line doesn't hold on to
+// megabytes for the rest of a log.
+const DefaultMaxRetainedLine = 1024 * 1024
+
+// The buffer sizes in use, which may be lowered under tight memory limits
+// before any log is read.
+var (
+	BufferSize      = DefaultBufferSize
+	MaxRetainedLine = DefaultMaxRetainedLine
+)
+
+// The buffers of the conversion are shared, as many logs may be converted
+// at once when a node is drained.
+var (
+	readerPool = sync.Pool{New: func() interface{} { return bufio.NewReaderSize(nil, BufferSize) }}
+	writerPool = sync.Pool{New: func() interface{} { return bufio.NewWriterSize(nil, BufferSize) }}
+)
+
+// NewPooledWriter buffers writes to destination, to be flushed then given
+// back with ReleaseWriter.
+func NewPooledWriter(destination io.Writer) *bufio.Writer {
+	writer := writerPool.Get().(*bufio.Writer)
+	writer.Reset(destination)
+	return writer
+}
+
+// ReleaseWriter gives writer back to the pool, discarding what wasn't
+// flushed.
+func ReleaseWriter(writer *bufio.Writer) {
+	writer.Reset(nil)
+	writerPool.Put(writer)
+}
+
+// LineReader reads a log line by line like bufio.Scanner, but whatever
+// the length of the lines: the scanner gives up past 64KB, and pods do
+// log huge JSON documents or stack dumps on a single line.
+type LineReader struct {
+	reader *bufio.Reader
+	line   []byte
+	long   []byte
+	err    error
+}
+
+func NewLineReader(source io.Reader) *LineReader {
+	reader := readerPool.Get().(*bufio.Reader)
+	reader.Reset(source)
+	return &LineReader{reader: reader}
+}
+
+// Release gives the buffer of r back to the pool once done reading. Those
+// which aren't released are left to the garbage collector.
+func (r *LineReader) Release() {
+	if r.reader == nil {
+		return
+	}
+	r.reader.Reset(nil)
+	readerPool.Put(r.reader)
+	r.reader, r.line, r.long = nil, nil, nil
+	if r.err == nil {
+		r.err = io.EOF
+	}
+}
+
+// Scan reads the next line, false once there are none left or reading
+// failed.
+func (r *LineReader) Scan() bool {
+	if r.err != nil {
+		return false
+	}
+	if cap(r.long) > MaxRetainedLine {
+		r.long = nil
+	}
+	r.long = r.long[:0]
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			r.long = append(r.long, chunk...)
+			continue
+		}
+		r.line = chunk
+		if len(r.long) > 0 {
+			r.long = append(r.long, chunk...)
+			r.line = r.long
+		}
+		if err != nil {
+			r.err = err
+			if len(r.line) == 0 {
+				return false
+			}
+		}
+		r.line = bytes.TrimSuffix(bytes.TrimSuffix(r.line, []byte{'\n'}), []byte{'\r'})
+		return true
+	}
+}
+
+// Bytes returns the current line, without its line ending, until the
+// next call to Scan.
+func (r *LineReader) Bytes() []byte {
+	return r.line
+}
+
+func (r *LineReader) Text() string {
+	return string(r.line)
+}
+
+func (r *LineReader) Err() error {
+	if r.err == io.EOF {
+		return nil
+	}
+	return r.err
+}
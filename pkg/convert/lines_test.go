@@ -0,0 +1,105 @@
+package convert
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func readLines(t *testing.T, source io.Reader) []string {
+	t.Helper()
+	reader := NewLineReader(source)
+	defer reader.Release()
+	var lines []string
+	for reader.Scan() {
+		lines = append(lines, reader.Text())
+	}
+	if err := reader.Err(); err != nil {
+		t.Fatalf("reading lines: %v", err)
+	}
+	return lines
+}
+
+func assertLines(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d is %.40q (%d bytes), want %.40q (%d bytes)", i+1, got[i], len(got[i]), want[i], len(want[i]))
+		}
+	}
+}
+
+func TestLineReaderLongLines(t *testing.T) {
+	long := strings.Repeat("a", 3*BufferSize+17)
+	huge := strings.Repeat("b", MaxRetainedLine+BufferSize)
+	content := "short\n" + long + "\n" + huge + "\nafter\n" + long + "\n"
+	assertLines(t, readLines(t, strings.NewReader(content)), "short", long, huge, "after", long)
+}
+
+func TestLineReaderReleasesHugeLines(t *testing.T) {
+	huge := strings.Repeat("x", MaxRetainedLine+1)
+	reader := NewLineReader(strings.NewReader(huge + "\nnext\n"))
+	defer reader.Release()
+	if !reader.Scan() || len(reader.Bytes()) != len(huge) {
+		t.Fatalf("huge line not read: %v", reader.Err())
+	}
+	if !reader.Scan() || reader.Text() != "next" {
+		t.Fatalf("line after the huge one not read: %v", reader.Err())
+	}
+	if cap(reader.long) > MaxRetainedLine {
+		t.Errorf("buffer of %d bytes kept after a huge line", cap(reader.long))
+	}
+}
+
+func TestLineReaderFinalLineWithoutNewline(t *testing.T) {
+	assertLines(t, readLines(t, strings.NewReader("first\nlast")), "first", "last")
+	long := strings.Repeat("c", 2*BufferSize)
+	assertLines(t, readLines(t, strings.NewReader("first\n"+long)), "first", long)
+	assertLines(t, readLines(t, strings.NewReader("first\n")), "first")
+	assertLines(t, readLines(t, strings.NewReader("")))
+}
+
+func TestLineReaderCRLF(t *testing.T) {
+	content := "windows\r\n\r\nmixed\nbare\rcarriage return\r\nlast\r"
+	want := []string{"windows", "", "mixed", "bare\rcarriage return", "last"}
+	assertLines(t, readLines(t, strings.NewReader(content)), want...)
+	// Line endings split across reads.
+	assertLines(t, readLines(t, iotest.OneByteReader(strings.NewReader(content))), want...)
+	long := strings.Repeat("d", BufferSize-1)
+	assertLines(t, readLines(t, strings.NewReader(long+"\r\n"+long+"\r\n")), long, long)
+}
+
+func TestLineReaderError(t *testing.T) {
+	failure := errors.New("read failed")
+	source := io.MultiReader(strings.NewReader("complete\npartial"), iotest.ErrReader(failure))
+	reader := NewLineReader(source)
+	defer reader.Release()
+	var lines []string
+	for reader.Scan() {
+		lines = append(lines, reader.Text())
+	}
+	assertLines(t, lines, "complete", "partial")
+	if reader.Err() != failure {
+		t.Errorf("error is %v, want %v", reader.Err(), failure)
+	}
+	if reader.Scan() {
+		t.Error("Scan went on after an error")
+	}
+}
+
+func TestLineReaderBytesUntilNextScan(t *testing.T) {
+	reader := NewLineReader(bytes.NewReader([]byte("one\ntwo\n")))
+	defer reader.Release()
+	reader.Scan()
+	first := append([]byte(nil), reader.Bytes()...)
+	reader.Scan()
+	if string(first) != "one" || reader.Text() != "two" {
+		t.Errorf("read %q then %q", first, reader.Text())
+	}
+}
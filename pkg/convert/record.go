@@ -0,0 +1,329 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+)
+
+// Entry is a line of a container log.
+type Entry struct {
+	Log    string
+	Stream string
+	Time   string
+	// Partial is set on the fragments of a line split by the runtime but
+	// the last one.
+	Partial bool `json:"-"`
+}
+
+// ParseRecord parses a line in one of the log formats:
+//
+//	docker:  {"log":"message\n","stream":"stdout","time":"2019-04-10T08:00:00.0Z"}
+//	cri:     2019-04-10T08:00:00.0Z stdout F message
+//	text:    2019-04-10T08:00:00.0Z stdout message   (written by k8ts)
+//	ndjson:  {"ts":"2019-04-10T08:00:00.0Z","stream":"stdout","msg":"message",...}
+//
+// Runtimes split long lines: CRI fragments are tagged P but the last one,
+// Docker ones lack the trailing newline. They are marked Partial, for an
+// Assembler to put them back together.
+func ParseRecord(line []byte) (Entry, error) {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) > 0 && line[0] == '{' {
+		record := struct {
+			Entry
+			TS  string `json:"ts"`
+			Msg string `json:"msg"`
+		}{}
+		err := json.Unmarshal(line, &record)
+		entry := record.Entry
+		if entry.Time == "" && entry.Log == "" {
+			entry.Time, entry.Log = record.TS, record.Msg
+		} else if entry.Log != "" && !strings.HasSuffix(entry.Log, "\n") {
+			entry.Partial = true
+		}
+		entry.Log = strings.TrimSuffix(entry.Log, "\n")
+		return entry, err
+	}
+	fields := strings.SplitN(string(line), " ", 4)
+	if len(fields) < 2 || (fields[1] != "stdout" && fields[1] != "stderr") {
+		return Entry{}, errors.New("unrecognized log line")
+	}
+	entry := Entry{Time: fields[0], Stream: fields[1]}
+	switch {
+	case len(fields) == 4 && (fields[2] == "F" || fields[2] == "P"):
+		entry.Log = fields[3]
+		entry.Partial = fields[2] == "P"
+	case len(fields) == 4:
+		entry.Log = fields[2] + " " + fields[3]
+	case len(fields) == 3 && (fields[2] == "F" || fields[2] == "P"):
+		entry.Partial = fields[2] == "P"
+	case len(fields) == 3:
+		entry.Log = fields[2]
+	}
+	return entry, nil
+}
+
+// RenderRecord writes entry as a single line in the given format:
+// json, text or logfmt.
+func RenderRecord(destination io.Writer, format string, entry Entry) error {
+	var line []byte
+	switch format {
+	case "json":
+		encoded, err := json.Marshal(struct {
+			Log    string `json:"log"`
+			Stream string `json:"stream"`
+			Time   string `json:"time"`
+		}{entry.Log + "\n", entry.Stream, entry.Time})
+		if err != nil {
+			return err
+		}
+		line = append(encoded, '\n')
+	case "logfmt":
+		line = []byte("time=" + logger.LogfmtValue(entry.Time) +
+			" stream=" + logger.LogfmtValue(entry.Stream) +
+			" msg=" + logger.LogfmtValue(entry.Log) + "\n")
+	default:
+		line = []byte(entry.Time + " " + entry.Stream + " " + entry.Log + "\n")
+	}
+	_, err := destination.Write(line)
+	return err
+}
+
+// ansiEscape matches the escape sequences of terminals: colors and cursor
+// moves (CSI), window titles and hyperlinks (OSC) and the shorter ones,
+// e.g. charset switches.
+var ansiEscape = regexp.MustCompile(`\x1b(?:\[[0-?]*[ -/]*[@-~]|\][^\x07\x1b]*(?:\x07|\x1b\\)|[ -/]*[0-~])`)
+
+// StripEscapes removes the escape sequences of colored output from a log
+// message.
+func StripEscapes(message string) string {
+	if strings.IndexByte(message, 0x1b) < 0 {
+		return message
+	}
+	return ansiEscape.ReplaceAllString(message, "")
+}
+
+// TimeOriginal keeps timestamps as the runtime wrote them. The other
+// formats of a Rewrite are RFC 3339 with a fixed precision, which
+// ParseRecord still reads.
+const TimeOriginal = "original"
+
+var timeLayouts = map[string]string{
+	"rfc3339":        time.RFC3339,
+	"rfc3339-millis": "2006-01-02T15:04:05.000Z07:00",
+	"rfc3339-micros": "2006-01-02T15:04:05.000000Z07:00",
+	"rfc3339-nano":   "2006-01-02T15:04:05.000000000Z07:00",
+}
+
+// Rewrite is how the lines of a log are cleaned up when converted. The
+// zero Rewrite leaves them alone.
+type Rewrite struct {
+	stripANSI  bool
+	timeLayout string
+	// timeZone is the one timestamps are converted to, the one they were
+	// written in when nil.
+	timeZone *time.Location
+	// redactions are applied to whole messages, once their lines are put
+	// back together, by Redact.
+	redactions []Redaction
+}
+
+// NewRewrite returns a Rewrite removing the escape sequences of messages
+// with stripANSI and converting timestamps to timeFormat, TimeOriginal or
+// rfc3339 with a precision (rfc3339-millis, -micros or -nano), in the time
+// zone named timeZone, and redacting messages with redactions.
+func NewRewrite(stripANSI bool, timeFormat string, timeZone string, redactions []Redaction) (Rewrite, error) {
+	r := Rewrite{stripANSI: stripANSI, redactions: redactions}
+	if timeFormat != "" && timeFormat != TimeOriginal {
+		layout, ok := timeLayouts[timeFormat]
+		if !ok {
+			return r, fmt.Errorf("invalid time-format '%s', expected %s, rfc3339, rfc3339-millis, rfc3339-micros or rfc3339-nano",
+				timeFormat, TimeOriginal)
+		}
+		r.timeLayout = layout
+	}
+	if timeZone != "" {
+		location, err := time.LoadLocation(timeZone)
+		if err != nil {
+			return r, fmt.Errorf("invalid time-zone '%s': %v", timeZone, err)
+		}
+		r.timeZone = location
+	}
+	return r, nil
+}
+
+// Apply rewrites entry. Timestamps which aren't RFC 3339 are left alone.
+func (r Rewrite) Apply(entry *Entry) {
+	if r.stripANSI {
+		entry.Log = StripEscapes(entry.Log)
+	}
+	if r.timeLayout == "" && r.timeZone == nil {
+		return
+	}
+	stamp, err := time.Parse(time.RFC3339Nano, entry.Time)
+	if err != nil {
+		return
+	}
+	if r.timeZone != nil {
+		stamp = stamp.In(r.timeZone)
+	}
+	layout := r.timeLayout
+	if layout == "" {
+		layout = time.RFC3339Nano
+	}
+	entry.Time = stamp.Format(layout)
+}
+
+// Redact returns message with the secrets of the redactions of r replaced.
+// Messages are redacted once complete, as a secret may span the fragments
+// of a split line or the lines of a multiline record.
+func (r Rewrite) Redact(message string) string {
+	for _, redaction := range r.redactions {
+		message = redaction.Apply(message)
+	}
+	return message
+}
+
+// MaxAssembledLine bounds a line put back together from fragments, in case
+// the final one never comes.
+const MaxAssembledLine = 16 * 1024 * 1024
+
+// Assembler joins the fragments of split lines, per stream as those of
+// stdout and stderr may interleave. A line takes the time of its first
+// fragment.
+//
+// With a Start pattern, it also joins the lines of multiline records such
+// as stack traces: a line not matching it continues the record before it.
+type Assembler struct {
+	Start   *regexp.Regexp
+	pending map[string]*assembly
+	records map[string]*assembly
+}
+
+// assembly is a line or a record being put together. Its message is only
+// copied to a builder once something is added to it, and built once
+// complete, as copying it at every fragment would be quadratic.
+type assembly struct {
+	entry Entry
+	more  *strings.Builder
+}
+
+func (a *assembly) add(separator string, message string) {
+	if a.more == nil {
+		a.more = &strings.Builder{}
+		a.more.WriteString(a.entry.Log)
+	}
+	a.more.WriteString(separator)
+	a.more.WriteString(message)
+}
+
+func (a *assembly) size() int {
+	if a.more == nil {
+		return len(a.entry.Log)
+	}
+	return a.more.Len()
+}
+
+func (a *assembly) complete() Entry {
+	if a.more != nil {
+		a.entry.Log = a.more.String()
+	}
+	a.entry.Partial = false
+	return a.entry
+}
+
+// Add returns the complete line once the last fragment of entry is given,
+// or the previous record once entry starts a new one.
+func (a *Assembler) Add(entry Entry) (Entry, bool) {
+	if a.pending == nil {
+		a.pending = make(map[string]*assembly)
+	}
+	line, ok := a.pending[entry.Stream]
+	if ok {
+		line.add("", entry.Log)
+	} else {
+		line = &assembly{entry: entry}
+	}
+	if entry.Partial && line.size() < MaxAssembledLine {
+		a.pending[entry.Stream] = line
+		return Entry{}, false
+	}
+	delete(a.pending, entry.Stream)
+	return a.join(line.complete())
+}
+
+func (a *Assembler) join(entry Entry) (Entry, bool) {
+	if a.Start == nil {
+		return entry, true
+	}
+	if a.records == nil {
+		a.records = make(map[string]*assembly)
+	}
+	record, ok := a.records[entry.Stream]
+	if ok && !a.Start.MatchString(entry.Log) && record.size() < MaxAssembledLine {
+		record.add("\n", entry.Log)
+		return Entry{}, false
+	}
+	a.records[entry.Stream] = &assembly{entry: entry}
+	if !ok {
+		return Entry{}, false
+	}
+	return record.complete(), true
+}
+
+// Flush returns the lines whose last fragment never came and the last
+// records, at the end of a log.
+func (a *Assembler) Flush() []Entry {
+	entries := make([]Entry, 0, len(a.pending)+len(a.records))
+	for _, line := range a.pending {
+		if record, complete := a.join(line.complete()); complete {
+			entries = append(entries, record)
+		}
+	}
+	for _, record := range a.records {
+		entries = append(entries, record.complete())
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time < entries[j].Time
+	})
+	a.pending, a.records = nil, nil
+	return entries
+}
+
+// ConvertLog renders every line of source in the given format, as
+// RenderRecord does. It stops at the first line that can't be parsed.
+func ConvertLog(destination io.Writer, source io.Reader, format string) error {
+	assembler := Assembler{}
+	scanner := NewLineReader(source)
+	defer scanner.Release()
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		entry, err := ParseRecord(line)
+		if err != nil {
+			return fmt.Errorf("failed to unpack log entry %q: %v", line, err)
+		}
+		entry, complete := assembler.Add(entry)
+		if !complete {
+			continue
+		}
+		err = RenderRecord(destination, format, entry)
+		if err != nil {
+			return err
+		}
+	}
+	for _, entry := range assembler.Flush() {
+		err := RenderRecord(destination, format, entry)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
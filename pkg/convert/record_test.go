@@ -0,0 +1,146 @@
+package convert
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// assemble parses the lines of a log and returns the entries put back
+// together by an Assembler with start, flushed at the end.
+func assemble(t *testing.T, start string, lines ...string) []Entry {
+	t.Helper()
+	assembler := Assembler{}
+	if start != "" {
+		assembler.Start = regexp.MustCompile(start)
+	}
+	var entries []Entry
+	for _, line := range lines {
+		entry, err := ParseRecord([]byte(line))
+		if err != nil {
+			t.Fatalf("parsing %q: %v", line, err)
+		}
+		if entry, complete := assembler.Add(entry); complete {
+			entries = append(entries, entry)
+		}
+	}
+	return append(entries, assembler.Flush()...)
+}
+
+func assertEntries(t *testing.T, got []Entry, want ...Entry) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d entries, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d is %+v, want %+v", i+1, got[i], want[i])
+		}
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want Entry
+	}{
+		// docker
+		{`{"log":"message\n","stream":"stdout","time":"2019-04-10T08:00:00.0Z"}`,
+			Entry{Time: "2019-04-10T08:00:00.0Z", Stream: "stdout", Log: "message"}},
+		{`{"log":"split","stream":"stderr","time":"2019-04-10T08:00:00.0Z"}`,
+			Entry{Time: "2019-04-10T08:00:00.0Z", Stream: "stderr", Log: "split", Partial: true}},
+		{`{"log":"\n","stream":"stdout","time":"2019-04-10T08:00:00.0Z"}` + "\r\n",
+			Entry{Time: "2019-04-10T08:00:00.0Z", Stream: "stdout"}},
+		// cri
+		{"2019-04-10T08:00:00.0Z stdout F message with spaces",
+			Entry{Time: "2019-04-10T08:00:00.0Z", Stream: "stdout", Log: "message with spaces"}},
+		{"2019-04-10T08:00:00.0Z stderr P first half",
+			Entry{Time: "2019-04-10T08:00:00.0Z", Stream: "stderr", Log: "first half", Partial: true}},
+		{"2019-04-10T08:00:00.0Z stdout F ", Entry{Time: "2019-04-10T08:00:00.0Z", Stream: "stdout"}},
+		{"2019-04-10T08:00:00.0Z stdout F", Entry{Time: "2019-04-10T08:00:00.0Z", Stream: "stdout"}},
+		// text, as written by k8ts
+		{"2019-04-10T08:00:00.0Z stdout message with spaces",
+			Entry{Time: "2019-04-10T08:00:00.0Z", Stream: "stdout", Log: "message with spaces"}},
+		{"2019-04-10T08:00:00.0Z stderr message", Entry{Time: "2019-04-10T08:00:00.0Z", Stream: "stderr", Log: "message"}},
+		{"2019-04-10T08:00:00.0Z stdout Final words",
+			Entry{Time: "2019-04-10T08:00:00.0Z", Stream: "stdout", Log: "Final words"}},
+		// ndjson
+		{`{"ts":"2019-04-10T08:00:00.0Z","stream":"stdout","msg":"message","pod":"web","unparsed":false}`,
+			Entry{Time: "2019-04-10T08:00:00.0Z", Stream: "stdout", Log: "message"}},
+	} {
+		got, err := ParseRecord([]byte(c.line))
+		if err != nil || got != c.want {
+			t.Errorf("%q parses as %+v (%v), want %+v", c.line, got, err, c.want)
+		}
+	}
+	for _, line := range []string{
+		"",
+		"plain text",
+		"2019-04-10T08:00:00.0Z stdin F message",
+		`{"log": unterminated`,
+	} {
+		if entry, err := ParseRecord([]byte(line)); err == nil {
+			t.Errorf("%q parses as %+v", line, entry)
+		}
+	}
+}
+
+func TestAssemblerCRIFragments(t *testing.T) {
+	entries := assemble(t, "",
+		"2024-05-01T10:00:00.1Z stdout P first ",
+		"2024-05-01T10:00:00.2Z stderr F error",
+		"2024-05-01T10:00:00.3Z stdout P half, ",
+		"2024-05-01T10:00:00.4Z stdout F end",
+		"2024-05-01T10:00:00.5Z stdout F whole",
+		// An empty final fragment ends the line.
+		"2024-05-01T10:00:00.6Z stdout P trailing",
+		"2024-05-01T10:00:00.7Z stdout F")
+	assertEntries(t, entries,
+		Entry{Time: "2024-05-01T10:00:00.2Z", Stream: "stderr", Log: "error"},
+		Entry{Time: "2024-05-01T10:00:00.1Z", Stream: "stdout", Log: "first half, end"},
+		Entry{Time: "2024-05-01T10:00:00.5Z", Stream: "stdout", Log: "whole"},
+		Entry{Time: "2024-05-01T10:00:00.6Z", Stream: "stdout", Log: "trailing"})
+}
+
+func TestAssemblerDockerFragments(t *testing.T) {
+	entries := assemble(t, "",
+		`{"log":"split ","stream":"stdout","time":"2024-05-01T10:00:00.1Z"}`,
+		`{"log":"line\n","stream":"stdout","time":"2024-05-01T10:00:00.2Z"}`,
+		// Never completed, flushed at the end.
+		`{"log":"cut","stream":"stderr","time":"2024-05-01T10:00:00.3Z"}`)
+	assertEntries(t, entries,
+		Entry{Time: "2024-05-01T10:00:00.1Z", Stream: "stdout", Log: "split line"},
+		Entry{Time: "2024-05-01T10:00:00.3Z", Stream: "stderr", Log: "cut"})
+}
+
+func TestAssemblerLimit(t *testing.T) {
+	fragment := strings.Repeat("x", 1<<20)
+	count := MaxAssembledLine/len(fragment) + 2
+	lines := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		lines = append(lines, "2024-05-01T10:00:00Z stdout P "+fragment)
+	}
+	entries := assemble(t, "", lines...)
+	// The line is cut once it reaches the limit, the rest starting the
+	// next one.
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if len(entries[0].Log) != MaxAssembledLine || len(entries[1].Log) != 2*len(fragment) {
+		t.Errorf("lines of %d and %d bytes", len(entries[0].Log), len(entries[1].Log))
+	}
+}
+
+func TestAssemblerMultiline(t *testing.T) {
+	entries := assemble(t, `^\d{4}-`,
+		"2024-05-01T10:00:00.1Z stderr F 2024-05-01 panic: boom",
+		"2024-05-01T10:00:00.2Z stderr F goroutine 1 [running]:",
+		"2024-05-01T10:00:00.3Z stderr P main.main(",
+		"2024-05-01T10:00:00.4Z stderr F )",
+		"2024-05-01T10:00:00.5Z stdout F 2024-05-01 served",
+		"2024-05-01T10:00:00.6Z stderr F 2024-05-01 next")
+	assertEntries(t, entries,
+		Entry{Time: "2024-05-01T10:00:00.1Z", Stream: "stderr", Log: "2024-05-01 panic: boom\ngoroutine 1 [running]:\nmain.main()"},
+		Entry{Time: "2024-05-01T10:00:00.5Z", Stream: "stdout", Log: "2024-05-01 served"},
+		Entry{Time: "2024-05-01T10:00:00.6Z", Stream: "stderr", Log: "2024-05-01 next"})
+}
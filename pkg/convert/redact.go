@@ -0,0 +1,144 @@
+package convert
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Redaction replaces the matches of a pattern in log messages, e.g. the
+// tokens an application logs by mistake, before they reach tombstones.
+type Redaction struct {
+	Name    string
+	Pattern *regexp.Regexp
+	// Replacement is expanded as by regexp.Expand: $1 or ${name} stand for
+	// the groups of the match.
+	Replacement string
+	// valid tells the matches which really are secrets from those which
+	// only look alike, e.g. numbers failing the checksum of card numbers.
+	// The Replacement of such redactions is taken literally.
+	valid func(match string) bool
+}
+
+// NewRedaction compiles a redaction named name, replacing the matches of
+// pattern with the template replacement, [REDACTED:name] when empty.
+func NewRedaction(name string, pattern string, replacement string) (Redaction, error) {
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return Redaction{}, fmt.Errorf("invalid pattern of redaction '%s': %v", name, err)
+	}
+	if replacement == "" {
+		replacement = redacted(name)
+	}
+	return Redaction{Name: name, Pattern: compiled, Replacement: replacement}, nil
+}
+
+func redacted(name string) string {
+	return "[REDACTED:" + name + "]"
+}
+
+// Apply returns message with the matches of r replaced.
+func (r Redaction) Apply(message string) string {
+	if r.valid == nil {
+		return r.Pattern.ReplaceAllString(message, r.Replacement)
+	}
+	return r.Pattern.ReplaceAllStringFunc(message, func(match string) string {
+		if !r.valid(match) {
+			return match
+		}
+		return r.Replacement
+	})
+}
+
+// redactionPresets are the secrets commonly found in logs, by the name
+// they are asked for with.
+var redactionPresets = map[string][]Redaction{
+	// JSON Web Tokens, whose header and payload are base64 encoded JSON
+	// objects, hence start with eyJ. The signature is empty when unsigned.
+	"jwt": {{
+		Pattern: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+	}},
+	// AWS access key ids, by their prefix, and secret access keys, which
+	// look like any base64 so only next to their name.
+	"aws": {{
+		Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA|ABIA|ACCA|AGPA|AIDA|AIPA|ANPA|ANVA|AROA|APKA)[A-Z0-9]{16}\b`),
+	}, {
+		Pattern:     regexp.MustCompile(`(?i)(aws_?secret_?(?:access_?)?key["']?\s*[:=]\s*["']?)[A-Za-z0-9/+=]{40}\b`),
+		Replacement: "${1}" + redacted("aws"),
+	}},
+	// Google API keys, OAuth access tokens and the key ids of service
+	// account keys, whose private_key the private-key preset covers.
+	"gcp": {{
+		Pattern: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}`),
+	}, {
+		Pattern: regexp.MustCompile(`\bya29\.[0-9A-Za-z_-]+`),
+	}, {
+		Pattern:     regexp.MustCompile(`("private_key_id"\s*:\s*")[0-9a-f]{40}`),
+		Replacement: "${1}" + redacted("gcp"),
+	}},
+	// PEM and PGP private key blocks, to the end of the message when it
+	// doesn't have the end of the block: the lines of a key logged as
+	// several lines only make a message with --multiline-start.
+	"private-key": {{
+		Pattern: regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY(?: BLOCK)?-----(?s:.*?)(?:-----END [A-Z0-9 ]*PRIVATE KEY(?: BLOCK)?-----|$)`),
+	}},
+	// Payment card numbers of the major networks, 13 to 19 digits possibly
+	// grouped by spaces or dashes, passing the Luhn check.
+	"credit-card": {{
+		Pattern: regexp.MustCompile(`\b[2-6](?:[ -]?[0-9]){12,18}\b`),
+		valid:   luhnValid,
+	}},
+}
+
+func init() {
+	for name, redactions := range redactionPresets {
+		for i := range redactions {
+			redactions[i].Name = name
+			if redactions[i].Replacement == "" {
+				redactions[i].Replacement = redacted(name)
+			}
+		}
+	}
+}
+
+// RedactionPresets returns the names of the built-in redactions.
+func RedactionPresets() []string {
+	names := make([]string, 0, len(redactionPresets))
+	for name := range redactionPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RedactionPreset returns the redactions of the preset named name.
+func RedactionPreset(name string) ([]Redaction, error) {
+	redactions, ok := redactionPresets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown redaction preset '%s', expected %s", name,
+			strings.Join(RedactionPresets(), ", "))
+	}
+	return redactions, nil
+}
+
+// luhnValid tells whether the digits of number pass the Luhn check.
+func luhnValid(number string) bool {
+	sum, digits := 0, 0
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		digit := int(c - '0')
+		if digits%2 == 1 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		digits++
+	}
+	return digits >= 13 && sum%10 == 0
+}
@@ -0,0 +1,248 @@
+package deploy
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/alessio/shellescape"
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/internal/version"
+	"github.com/badeadan/k8ts/pkg/monitor"
+)
+
+const defaultReleaseURL = "https://github.com/badeadan/k8ts/releases/download/{version}/k8ts-{os}-{arch}"
+
+// Every release publishes the checksums of its binaries, as sha256sum
+// prints them, along with their base64 encoded Ed25519 signature (see
+// `make release`), next to the binaries.
+const (
+	releaseSums      = "SHA256SUMS"
+	releaseSignature = "SHA256SUMS.sig"
+	// maxReleaseSums bounds the checksums and signature downloaded.
+	maxReleaseSums = 64 << 10
+)
+
+// unameArchitectures maps `uname -m` to Go architecture names.
+var unameArchitectures = map[string]string{
+	"x86_64":  "amd64",
+	"amd64":   "amd64",
+	"aarch64": "arm64",
+	"arm64":   "arm64",
+	"armv7l":  "arm",
+	"armv6l":  "arm",
+	"i386":    "386",
+	"i686":    "386",
+}
+
+// parsePlatform turns the output of `uname -sm` into a GOOS/GOARCH pair.
+func parsePlatform(uname string) (string, error) {
+	fields := strings.Fields(uname)
+	if len(fields) != 2 {
+		return "", fmt.Errorf("unexpected uname output '%s'", strings.TrimSpace(uname))
+	}
+	arch, ok := unameArchitectures[fields[1]]
+	if !ok {
+		return "", fmt.Errorf("unsupported architecture '%s'", fields[1])
+	}
+	return strings.ToLower(fields[0]) + "/" + arch, nil
+}
+
+// binaryStore finds a k8ts binary for a target platform: the running one
+// if it matches, else k8ts-<os>-<arch> from --binaries (see `make
+// release`), else the release asset downloaded once per platform and
+// checked against the checksums of the release, signed by releaseKey.
+type binaryStore struct {
+	dir        string
+	releaseURL string
+	releaseKey string
+	mutex      sync.Mutex
+	downloads  map[string]string
+}
+
+func newBinaryStore(dir string, releaseURL string, releaseKey string) *binaryStore {
+	return &binaryStore{dir: dir, releaseURL: releaseURL, releaseKey: releaseKey,
+		downloads: make(map[string]string)}
+}
+
+func (b *binaryStore) path(platform string) (string, error) {
+	if platform == runtime.GOOS+"/"+runtime.GOARCH {
+		return os.Executable()
+	}
+	name := "k8ts-" + strings.Replace(platform, "/", "-", 1)
+	if b.dir != "" {
+		path := filepath.Join(b.dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if path, ok := b.downloads[platform]; ok {
+		return path, nil
+	}
+	path, err := b.download(platform, name)
+	if err != nil {
+		return "", fmt.Errorf("no k8ts binary for %s (build one with `make release` and use --binaries): %v",
+			platform, err)
+	}
+	b.downloads[platform] = path
+	return path, nil
+}
+
+func (b *binaryStore) download(platform string, name string) (string, error) {
+	if b.releaseURL == "" {
+		return "", fmt.Errorf("downloads are disabled")
+	}
+	parts := strings.SplitN(platform, "/", 2)
+	url := strings.NewReplacer("{version}", version.Version, "{os}", parts[0], "{arch}", parts[1]).
+		Replace(b.releaseURL)
+	sums, err := b.releaseSums(url)
+	if err != nil {
+		return "", err
+	}
+	asset := path.Base(url)
+	want, ok := sums[asset]
+	if !ok {
+		return "", fmt.Errorf("%s has no checksum in the %s of the release", asset, releaseSums)
+	}
+	logger.Info("Downloading k8ts", "platform", platform, "url", url)
+	response, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s replied %s", url, response.Status)
+	}
+	dir, err := ioutil.TempDir("", "k8ts-binaries")
+	if err != nil {
+		return "", err
+	}
+	binary := filepath.Join(dir, name)
+	file, err := os.OpenFile(binary, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), response.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && hex.EncodeToString(hash.Sum(nil)) != want {
+		err = fmt.Errorf("checksum mismatch on %s, expected %s, got %s", url, want, hex.EncodeToString(hash.Sum(nil)))
+	}
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return "", err
+	}
+	logger.Debug("Download verified", "url", url, "sha256", want)
+	return binary, nil
+}
+
+// releaseSums returns the checksums of the release of the binary at url by
+// asset name, once their signature is verified with --release-key.
+func (b *binaryStore) releaseSums(url string) (map[string]string, error) {
+	base := url[:strings.LastIndex(url, "/")+1]
+	content, err := fetchReleaseFile(base + releaseSums)
+	if err != nil {
+		return nil, err
+	}
+	if b.releaseKey == "" {
+		logger.Warn("No --release-key, the checksums of the release are not authenticated", "url", base+releaseSums)
+	} else {
+		key, err := monitor.LoadVerifyKey(b.releaseKey)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := fetchReleaseFile(base + releaseSignature)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+		if err != nil || !ed25519.Verify(key, content, signature) {
+			return nil, fmt.Errorf("invalid signature of %s, expected one by key %s", base+releaseSums, monitor.KeyID(key))
+		}
+	}
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(string(content)))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			sums[strings.TrimPrefix(fields[1], "*")] = strings.ToLower(fields[0])
+		}
+	}
+	return sums, nil
+}
+
+// fetchReleaseFile downloads a small file of a release.
+func fetchReleaseFile(url string) ([]byte, error) {
+	response, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s replied %s", url, response.Status)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(response.Body, maxReleaseSums+1))
+	if err == nil && len(content) > maxReleaseSums {
+		err = fmt.Errorf("%s is larger than %d bytes", url, maxReleaseSums)
+	}
+	return content, err
+}
+
+// checksum returns the hex encoded SHA-256 of a file, as sha256sum prints it.
+func checksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = file.Close() }()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifyUpload compares the checksum of the uploaded binary with the local
+// one so that a truncated or corrupted transfer is never installed.
+func verifyUpload(target *sshClient, localPath string, remotePath string) error {
+	want, err := checksum(localPath)
+	if err != nil {
+		return err
+	}
+	output, err := target.run("sha256sum " + shellescape.Quote(remotePath))
+	if err != nil {
+		return fmt.Errorf("failed to verify '%s': %v", remotePath, err)
+	}
+	fields := strings.Fields(output)
+	if len(fields) == 0 || fields[0] != want {
+		return fmt.Errorf("checksum mismatch on '%s' after upload, expected %s, got '%s'",
+			remotePath, want, strings.TrimSpace(output))
+	}
+	logger.Debug("Upload verified", "path", remotePath, "sha256", want)
+	return nil
+}
+
+// cleanup removes the downloaded binaries.
+func (b *binaryStore) cleanup() {
+	for _, path := range b.downloads {
+		_ = os.RemoveAll(filepath.Dir(path))
+	}
+}
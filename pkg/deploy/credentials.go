@@ -0,0 +1,74 @@
+package deploy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/badeadan/k8ts/internal/settings"
+	"golang.org/x/term"
+)
+
+// credentials are secrets given once for every host of a deploy, so they
+// never have to appear in target URLs, shell history or process lists.
+type credentials struct {
+	password       string
+	becomePassword string
+	keyPassphrase  string
+}
+
+// keyPassphraseEnv holds the passphrase of encrypted SSH keys when neither
+// --ask-key-pass nor --key-passphrase-file is given, for unattended deploys.
+const keyPassphraseEnv = settings.EnvPrefix + "KEY_PASSPHRASE"
+
+func readCredentials(args *Args) (*credentials, error) {
+	c := &credentials{}
+	var err error
+	c.password, err = readSecret(*args.AskPass, *args.PasswordFile, "SSH password: ")
+	if err != nil {
+		return nil, err
+	}
+	c.becomePassword, err = readSecret(*args.AskBecomePass, *args.BecomePasswordFile, "sudo password: ")
+	if err != nil {
+		return nil, err
+	}
+	c.keyPassphrase, err = readSecret(*args.AskKeyPass, *args.KeyPassphraseFile, "SSH key passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if c.keyPassphrase == "" {
+		c.keyPassphrase = os.Getenv(keyPassphraseEnv)
+	}
+	return c, nil
+}
+
+// readSecret prompts for a secret on the terminal or reads it from the
+// first line of a file.
+func readSecret(ask bool, path string, prompt string) (string, error) {
+	if path != "" {
+		content, err := ioutil.ReadFile(expandHome(path))
+		if err != nil {
+			return "", err
+		}
+		return strings.SplitN(string(content), "\n", 2)[0], nil
+	}
+	if !ask {
+		return "", nil
+	}
+	return promptSecret(prompt)
+}
+
+func promptSecret(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("unable to prompt for a password without a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
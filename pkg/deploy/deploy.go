@@ -0,0 +1,496 @@
+package deploy
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/alessio/shellescape"
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/pkg/monitor"
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultDeployParallelism = 10
+
+// deployTargets returns the hosts given with repeated and/or comma
+// separated --target options, without duplicates.
+func deployTargets(values []string) []string {
+	targets := make([]string, 0, len(values))
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, target := range strings.Split(value, ",") {
+			target = strings.TrimSpace(target)
+			if target == "" || seen[target] {
+				continue
+			}
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// remotePaths are the directories of a target where k8ts is uploaded,
+// then installed.
+type remotePaths struct {
+	installDir string
+	uploadDir  string
+}
+
+func (p remotePaths) binary() string {
+	return path.Join(p.installDir, monitor.BinaryName)
+}
+
+func (p remotePaths) upload() string {
+	return path.Join(p.uploadDir, monitor.BinaryName)
+}
+
+// validate rejects relative directories and those which would need
+// quoting in the commands run on targets.
+func (p remotePaths) validate() error {
+	for _, dir := range []string{p.installDir, p.uploadDir} {
+		if !path.IsAbs(dir) || shellescape.Quote(dir) != dir {
+			return fmt.Errorf("invalid remote directory '%s', expected a plain absolute path", dir)
+		}
+	}
+	return nil
+}
+
+// sshTimeouts bound the connection to a target and the upload of k8ts.
+type sshTimeouts struct {
+	connect time.Duration
+	upload  time.Duration
+}
+
+// deployJob is a host to deploy to along with its own settings.
+type deployJob struct {
+	target      string
+	host        *SshHost
+	proxies     []*SshHost
+	paths       remotePaths
+	timeouts    sshTimeouts
+	monitorArgs string
+	// monitorConfig holds the monitor options installed on the host.
+	monitorConfig []byte
+	err           error
+}
+
+// deployJobs lists the hosts from the command line then the inventory.
+// Jobs with an invalid configuration are kept so they show up in the
+// summary.
+func deployJobs(args *Args) ([]*deployJob, error) {
+	jobs := make([]*deployJob, 0)
+	targets := make([]inventoryHost, 0)
+	for _, target := range deployTargets(*args.Target) {
+		targets = append(targets, inventoryHost{Host: target})
+	}
+	if *args.Inventory != "" {
+		inv, err := loadInventory(*args.Inventory)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, inv.Hosts...)
+	}
+	if *args.AllNodes {
+		nodes, err := clusterNodes(args)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, nodes...)
+	}
+	config, err := loadSSHConfig(*args.SSHConfig)
+	if err != nil {
+		return nil, err
+	}
+	paths := remotePaths{installDir: *args.InstallPath, uploadDir: *args.UploadPath}
+	if err := paths.validate(); err != nil {
+		return nil, err
+	}
+	timeouts := sshTimeouts{
+		connect: time.Duration(*args.SSHTimeout) * time.Second,
+		upload:  time.Duration(*args.UploadTimeout) * time.Second,
+	}
+	for i := range targets {
+		target := &targets[i]
+		job := &deployJob{target: target.Host, paths: paths, timeouts: timeouts}
+		job.host, job.proxies, job.err = target.sshHosts(args, config)
+		if job.err == nil {
+			job.monitorArgs, job.err = target.monitorArgs(args.Monitor)
+		}
+		if job.err == nil {
+			job.monitorConfig, job.err = target.monitorConfig(args.Monitor)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// All deploys k8ts to every target, running at most --parallel
+// deployments at once, then prints how it went on each host.
+func All(args *Args) error {
+	binaries := newBinaryStore(*args.Binaries, *args.ReleaseURL, *args.ReleaseKey)
+	defer binaries.cleanup()
+	smokeTimeout := time.Duration(*args.SmokeTimeout) * time.Second
+	jobs, err := forEachTarget(args, "Deploying", func(job *deployJob, target *sshClient) error {
+		err := deploy(target, job.paths, job.monitorConfig, binaries)
+		if err != nil || smokeTimeout <= 0 {
+			return err
+		}
+		return smokeTest(target, job.paths, smokeTimeout)
+	})
+	if err != nil {
+		return err
+	}
+	return summarizeDeploy(jobs, "deploy")
+}
+
+// forEachTarget connects to every target of the command line and the
+// inventory, at most --parallel at once, and runs action on each of them.
+// Failures are recorded in the jobs returned.
+func forEachTarget(args *Args, verb string, action func(*deployJob, *sshClient) error) ([]*deployJob, error) {
+	jobs, err := deployJobs(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("no target given, use --target, --inventory or --all-nodes")
+	}
+	parallel := *args.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	hostKeys, err := hostKeyCallback(*args.KnownHosts, *args.InsecureHostKey)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := readCredentials(args)
+	if err != nil {
+		return nil, err
+	}
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for _, job := range jobs {
+		if job.err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(job *deployJob) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			job.run(hostKeys, secrets, verb, action)
+		}(job)
+	}
+	wg.Wait()
+	return jobs, nil
+}
+
+func (job *deployJob) run(hostKeys ssh.HostKeyCallback, secrets *credentials, verb string, action func(*deployJob, *sshClient) error) {
+	logger.Info(verb, "host", job.target)
+	for _, host := range append([]*SshHost{job.host}, job.proxies...) {
+		if host.password == "" {
+			host.password = secrets.password
+		}
+		if host.keyPassphrase == "" {
+			host.keyPassphrase = secrets.keyPassphrase
+		}
+	}
+	var target *sshClient
+	target, job.err = dialSSH(job.host, job.proxies, hostKeys, job.timeouts.connect)
+	if job.err == nil {
+		target.becomePassword = secrets.becomePassword
+		target.uploadTimeout = job.timeouts.upload
+		job.err = action(job, target)
+		target.Close()
+	}
+	if job.err != nil {
+		logger.Error("Failed on target", "host", job.target, "error", job.err)
+	}
+}
+
+func summarizeDeploy(jobs []*deployJob, task string) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tRESULT")
+	failed := 0
+	for _, job := range jobs {
+		if job.err != nil {
+			failed++
+			fmt.Fprintf(w, "%s\tFAILED: %v\n", job.target, job.err)
+		} else {
+			fmt.Fprintf(w, "%s\tOK\n", job.target)
+		}
+	}
+	_ = w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%s failed on %d of %d targets", task, failed, len(jobs))
+	}
+	return nil
+}
+
+const defaultRemoteInstallPath string = "/usr/bin"
+const defaultRemoteUploadPath string = "/tmp"
+const uploadAttempts = 3
+const uploadBackoff = 5 * time.Second
+
+// deploy installs k8ts on target and its service with the monitor options
+// of monitorConfig, uploaded as a configuration file rather than given on
+// the command line, where auth.log and ps would show the secrets they may
+// hold.
+func deploy(target *sshClient, paths remotePaths, monitorConfig []byte, binaries *binaryStore) error {
+	uploadPath, err := uploadBinary(target, paths, binaries)
+	if err != nil {
+		return err
+	}
+	installPath := paths.binary()
+	_, err = target.sudo("mv " + uploadPath + " " + installPath)
+	if err != nil {
+		return fmt.Errorf("failed to install '%s': %v", installPath, err)
+	}
+	output, err := target.run("mktemp")
+	if err != nil {
+		return fmt.Errorf("failed to create the monitor configuration: %v", err)
+	}
+	configPath := shellescape.Quote(strings.TrimSpace(output))
+	defer func() { _, _ = target.run("rm -f " + configPath) }()
+	err = target.uploadContent(monitorConfig, strings.TrimSpace(output), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to upload the monitor configuration: %v", err)
+	}
+	err = uninstallService(target, installPath)
+	if err != nil {
+		return err
+	}
+	output, err = target.sudo(installPath + " service install --config " + configPath)
+	if err != nil {
+		return fmt.Errorf("failed to install the service: %v", withOutput(err, output))
+	}
+	logger.Info("Deploy successful", "host", target.name)
+	return nil
+}
+
+// uninstallService removes the service of the k8ts at installPath, if
+// installed.
+func uninstallService(target *sshClient, installPath string) error {
+	output, err := target.sudo(installPath + " service uninstall")
+	if err != nil && !strings.Contains(err.Error(), monitor.ServiceNotInstalled) {
+		return fmt.Errorf("failed to uninstall the service: %v", withOutput(err, output))
+	}
+	return nil
+}
+
+// uploadBinary copies the k8ts binary matching the target platform to the
+// upload directory and returns its path there.
+func uploadBinary(target *sshClient, paths remotePaths, binaries *binaryStore) (string, error) {
+	uname, err := target.run("uname -sm")
+	if err != nil {
+		return "", fmt.Errorf("failed to detect the target platform: %v", err)
+	}
+	platform, err := parsePlatform(uname)
+	if err != nil {
+		return "", err
+	}
+	binaryPath, err := binaries.path(platform)
+	if err != nil {
+		return "", err
+	}
+	uploadPath := paths.upload()
+	backoff := uploadBackoff
+	for attempt := 1; ; attempt++ {
+		_, _ = target.run("rm -f " + uploadPath)
+		err = target.upload(binaryPath, uploadPath, 0755)
+		if err != nil {
+			err = fmt.Errorf("upload to '%s' failed: %v", uploadPath, err)
+		} else {
+			err = verifyUpload(target, binaryPath, uploadPath)
+		}
+		if err == nil {
+			return uploadPath, nil
+		}
+		_, _ = target.run("rm -f " + uploadPath)
+		if attempt == uploadAttempts {
+			return "", err
+		}
+		logger.Warn("Upload failed, retrying", "host", target.name, "attempt", attempt, "delay", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Args are the options of deploy and its commands, registered on a command
+// with AttachArgs or set with NewArgs.
+type Args struct {
+	Target             *[]string
+	TargetKey          *string
+	Proxy              *[]string
+	ProxyKey           *[]string
+	Parallel           *int
+	Inventory          *string
+	Binaries           *string
+	ReleaseURL         *string
+	ReleaseKey         *string
+	KnownHosts         *[]string
+	InsecureHostKey    *bool
+	SSHConfig          *string
+	AskPass            *bool
+	PasswordFile       *string
+	AskBecomePass      *bool
+	BecomePasswordFile *string
+	AskKeyPass         *bool
+	KeyPassphraseFile  *string
+	VerifyTime         *int
+	Purge              *bool
+	ArchiveDir         *string
+	InstallPath        *string
+	UploadPath         *string
+	SSHTimeout         *int
+	UploadTimeout      *int
+	SmokeTimeout       *int
+	AllNodes           *bool
+	NodeSelector       *string
+	NodeAddress        *string
+	Kubeconfig         *string
+	Context            *string
+	Monitor            *monitor.Args
+}
+
+type SshHost struct {
+	user          string
+	password      string
+	host          string
+	port          string
+	keyPath       string
+	keyPassphrase string
+}
+
+func NewSshHost(host string, keyPath string) (*SshHost, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	// The port is optional, see sshConfigFile.apply.
+	host, port := u.Hostname(), u.Port()
+	password, ok := u.User.Password()
+	if !ok {
+		password = ""
+	}
+	return &SshHost{
+		user:     u.User.Username(),
+		password: password,
+		host:     host,
+		port:     port,
+		keyPath:  keyPath,
+	}, nil
+}
+
+// AttachArgs registers the options of deploy and its commands on cmd,
+// the monitor options of the targets included.
+func AttachArgs(settings *settings.Settings, cmd *argparse.Command) *Args {
+	return &Args{
+		Target: settings.List(cmd, "t", "target",
+			&argparse.Options{Help: "Where to deploy k8ts (repeat it or separate hosts with commas)", Required: false}),
+		TargetKey: settings.String(cmd, "k", "target-key",
+			&argparse.Options{Help: "SSH key to use when connecting to taget", Required: false}),
+		Proxy: settings.List(cmd, "p", "proxy",
+			&argparse.Options{Help: "Next hop (proxy) used to reach target host, repeat it to go through several jump hosts in order", Required: false}),
+		ProxyKey: settings.List(cmd, "q", "proxy-key",
+			&argparse.Options{Help: "SSH key to use when connecting to proxy, once per proxy or once for all", Required: false}),
+		Parallel: settings.Int(cmd, "", "parallel",
+			&argparse.Options{Help: "Number of targets deployed to at once", Required: false,
+				Default: defaultDeployParallelism}),
+		Inventory: settings.String(cmd, "", "inventory",
+			&argparse.Options{Help: "YAML (or .ini) file listing the hosts to deploy to", Required: false}),
+		Binaries: settings.String(cmd, "", "binaries",
+			&argparse.Options{Help: "Directory holding k8ts-<os>-<arch> binaries for other platforms", Required: false}),
+		ReleaseURL: settings.String(cmd, "", "release-url",
+			&argparse.Options{Help: "Where to download binaries missing from --binaries (empty to disable)", Required: false,
+				Default: defaultReleaseURL}),
+		ReleaseKey: settings.String(cmd, "", "release-key",
+			&argparse.Options{Help: "Ed25519 public key (PEM) the checksums of downloaded releases must be signed with", Required: false}),
+		KnownHosts: settings.List(cmd, "", "known-hosts",
+			&argparse.Options{Help: "known_hosts file(s) used to verify host keys", Required: false,
+				Default: []string{defaultKnownHosts}}),
+		InsecureHostKey: settings.Flag(cmd, "", "insecure-ignore-host-key",
+			&argparse.Options{Help: "Do not verify host keys (labs only)", Required: false}),
+		SSHConfig: settings.String(cmd, "", "ssh-config",
+			&argparse.Options{Help: "OpenSSH client configuration used to resolve host aliases", Required: false,
+				Default: defaultSSHConfig}),
+		AskPass: settings.Flag(cmd, "", "ask-pass",
+			&argparse.Options{Help: "Prompt for the SSH password of hosts without key", Required: false}),
+		PasswordFile: settings.String(cmd, "", "password-file",
+			&argparse.Options{Help: "Read the SSH password from this file", Required: false}),
+		AskBecomePass: settings.Flag(cmd, "", "ask-become-pass",
+			&argparse.Options{Help: "Prompt for the sudo password used on targets", Required: false}),
+		BecomePasswordFile: settings.String(cmd, "", "become-password-file",
+			&argparse.Options{Help: "Read the sudo password from this file", Required: false}),
+		AskKeyPass: settings.Flag(cmd, "", "ask-key-pass",
+			&argparse.Options{Help: "Prompt for the passphrase of encrypted SSH keys", Required: false}),
+		KeyPassphraseFile: settings.String(cmd, "", "key-passphrase-file",
+			&argparse.Options{Help: "Read the passphrase of encrypted SSH keys from this file", Required: false}),
+		InstallPath: settings.String(cmd, "", "remote-install-path",
+			&argparse.Options{Help: "Directory of targets where k8ts is installed", Required: false,
+				Default: defaultRemoteInstallPath}),
+		UploadPath: settings.String(cmd, "", "remote-upload-path",
+			&argparse.Options{Help: "Directory of targets where k8ts is uploaded before being installed", Required: false,
+				Default: defaultRemoteUploadPath}),
+		SSHTimeout: settings.Int(cmd, "", "ssh-timeout",
+			&argparse.Options{Help: "Seconds to wait for SSH connections to targets and proxies", Required: false,
+				Default: defaultSSHTimeout}),
+		UploadTimeout: settings.Int(cmd, "", "upload-timeout",
+			&argparse.Options{Help: "Seconds an upload of k8ts may take, 0 for no limit", Required: false,
+				Default: defaultUploadTimeout}),
+		SmokeTimeout: settings.Int(cmd, "", "smoke-timeout",
+			&argparse.Options{Help: "Seconds to wait for k8ts to run on targets after a deploy, 0 to skip the check", Required: false,
+				Default: defaultSmokeTimeout}),
+		AllNodes: settings.Flag(cmd, "", "all-nodes",
+			&argparse.Options{Help: "Deploy to the nodes of the cluster, listed with kubectl", Required: false}),
+		NodeSelector: settings.String(cmd, "", "node-selector",
+			&argparse.Options{Help: "Label selector of the nodes deployed to with --all-nodes (e.g. 'pool=ingress')", Required: false}),
+		NodeAddress: settings.Selector(cmd, "", "node-address", nodeAddressTypes,
+			&argparse.Options{Help: "Node address to connect to", Required: false, Default: "InternalIP"}),
+		Kubeconfig: settings.String(cmd, "", "kubeconfig",
+			&argparse.Options{Help: "kubeconfig used by kubectl", Required: false}),
+		Context: settings.String(cmd, "", "context",
+			&argparse.Options{Help: "kubeconfig context used by kubectl", Required: false}),
+		Monitor: monitor.AttachArgs(settings, cmd),
+	}
+}
+
+// AttachUpgradeArgs registers the options of `deploy upgrade` on cmd.
+func (args *Args) AttachUpgradeArgs(settings *settings.Settings, cmd *argparse.Command) {
+	args.VerifyTime = settings.Int(cmd, "", "verify-time",
+		&argparse.Options{Help: "Seconds the service must stay up after an upgrade", Required: false,
+			Default: defaultUpgradeVerifyTime})
+}
+
+// AttachRemoveArgs registers the options of `deploy remove` on cmd.
+func (args *Args) AttachRemoveArgs(settings *settings.Settings, cmd *argparse.Command) {
+	args.Purge = settings.Flag(cmd, "", "purge",
+		&argparse.Options{Help: "Also remove the tombstones and pending collector uploads", Required: false})
+	args.ArchiveDir = settings.String(cmd, "", "archive",
+		&argparse.Options{Help: "Save the tombstones of every target in this local directory first", Required: false})
+}
+
+// NewArgs returns the options of deploy for programs deploying k8ts
+// without its command line, named as in the configuration file, e.g.
+// "target": []string{"node-1", "node-2"}. The monitor options of the
+// targets go along with them. The options left out keep their default.
+func NewArgs(values map[string]interface{}) (*Args, error) {
+	parser := argparse.NewParser("k8ts", "")
+	options := settings.New()
+	args := AttachArgs(options, &parser.Command)
+	args.AttachUpgradeArgs(options, &parser.Command)
+	args.AttachRemoveArgs(options, &parser.Command)
+	err := settings.Apply(options.Options, values)
+	if err != nil {
+		return nil, err
+	}
+	return args, nil
+}
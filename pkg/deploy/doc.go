@@ -0,0 +1,18 @@
+// Package deploy installs k8ts on the nodes of a cluster, over SSH as the
+// service running `k8ts monitor` or as a DaemonSet: it is `k8ts deploy`
+// and `k8ts manifest`.
+//
+// An operator deploys with the options of the command line, named as in
+// the configuration file, the monitor options of the targets included:
+//
+//	args, err := deploy.NewArgs(map[string]interface{}{
+//		"target":       []string{"root@node-1", "root@node-2"},
+//		"include-glob": "payments-*",
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	return deploy.All(args)
+//
+// Status, Upgrade and Remove take the same options.
+package deploy
@@ -0,0 +1,366 @@
+package deploy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/pkg/monitor"
+	"gopkg.in/yaml.v2"
+)
+
+// inventoryHost describes how to reach a host and how to configure the
+// monitor installed on it. Empty settings are taken from the host group,
+// then from the inventory defaults, then from the command line.
+type inventoryHost struct {
+	Host          string     `yaml:"host"`
+	Group         string     `yaml:"group"`
+	User          string     `yaml:"user"`
+	Password      string     `yaml:"password"`
+	Key           string     `yaml:"key"`
+	KeyPassphrase string     `yaml:"key-passphrase"`
+	Proxy         stringList `yaml:"proxy"`
+	ProxyKey      stringList `yaml:"proxy-key"`
+	// Monitor holds options as in the configuration file of the monitor,
+	// lists being YAML sequences.
+	Monitor map[string]interface{} `yaml:"monitor"`
+}
+
+// inventory lists the hosts to deploy to, e.g.
+//
+//	defaults:
+//	  user: root
+//	  key: ~/.ssh/nodes
+//	  key-passphrase: ${sops:secrets.enc.yaml#ssh.passphrase}
+//	groups:
+//	  ingress:
+//	    monitor:
+//	      include-glob: "ingress-*"
+//	hosts:
+//	  - host: node-1:22
+//	    group: ingress
+//	    monitor:
+//	      keep-if: panic
+//	      sink:
+//	        - directory
+//	        - directory:path=/mnt/archive
+//	        - collector:url=https://collector:7443,ca=/etc/k8ts/ca.pem
+type inventory struct {
+	Defaults inventoryHost            `yaml:"defaults"`
+	Groups   map[string]inventoryHost `yaml:"groups"`
+	Hosts    []inventoryHost          `yaml:"hosts"`
+}
+
+func loadInventory(path string) (*inventory, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	inv := &inventory{}
+	if strings.EqualFold(filepath.Ext(path), ".ini") {
+		err = parseInventoryINI(inv, string(content))
+	} else {
+		err = yaml.UnmarshalStrict(content, inv)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid inventory '%s': %v", path, err)
+	}
+	secrets := newSecretResolver(filepath.Dir(path))
+	for i := range inv.Hosts {
+		host := &inv.Hosts[i]
+		if host.Host == "" {
+			return nil, fmt.Errorf("invalid inventory '%s': host #%d has no address", path, i+1)
+		}
+		if host.Group != "" {
+			group, ok := inv.Groups[host.Group]
+			if !ok {
+				return nil, fmt.Errorf("invalid inventory '%s': unknown group '%s' for %s", path, host.Group, host.Host)
+			}
+			host.inherit(&group)
+		}
+		host.inherit(&inv.Defaults)
+		err = host.resolveSecrets(secrets)
+		if err != nil {
+			return nil, fmt.Errorf("invalid inventory '%s': %s: %v", path, host.Host, err)
+		}
+	}
+	return inv, nil
+}
+
+// parseInventoryINI reads the INI flavour of the inventory: a [defaults]
+// section of key=value lines, a [group:<name>] section of the same for
+// every host group and a [hosts] section with one host per line followed
+// by its settings, monitor options being prefixed with "monitor.":
+//
+//	[group:ingress]
+//	monitor.include-glob=ingress-*
+//
+//	[hosts]
+//	node-1:22 group=ingress user=admin monitor.keep-if=panic
+func parseInventoryINI(inv *inventory, content string) error {
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, ";") {
+			continue
+		}
+		if strings.HasPrefix(text, "[") && strings.HasSuffix(text, "]") {
+			section = strings.TrimSpace(text[1 : len(text)-1])
+			continue
+		}
+		var err error
+		switch {
+		case section == "defaults":
+			err = inv.Defaults.setINI(text)
+		case strings.HasPrefix(section, "group:"):
+			name := strings.TrimSpace(strings.TrimPrefix(section, "group:"))
+			if inv.Groups == nil {
+				inv.Groups = make(map[string]inventoryHost)
+			}
+			group := inv.Groups[name]
+			err = group.setINI(text)
+			inv.Groups[name] = group
+		case section == "hosts":
+			fields := strings.Fields(text)
+			host := inventoryHost{Host: fields[0]}
+			for _, field := range fields[1:] {
+				if err = host.setINI(field); err != nil {
+					break
+				}
+			}
+			inv.Hosts = append(inv.Hosts, host)
+		default:
+			err = fmt.Errorf("outside of [defaults], [group:<name>] or [hosts]")
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (h *inventoryHost) setINI(setting string) error {
+	parts := strings.SplitN(setting, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected key=value, got '%s'", setting)
+	}
+	key, value := strings.TrimSpace(parts[0]), strings.Trim(strings.TrimSpace(parts[1]), `"`)
+	switch {
+	case key == "group":
+		h.Group = value
+	case key == "user":
+		h.User = value
+	case key == "password":
+		h.Password = value
+	case key == "key":
+		h.Key = value
+	case key == "key-passphrase":
+		h.KeyPassphrase = value
+	case key == "proxy":
+		h.Proxy = splitList(value)
+	case key == "proxy-key":
+		h.ProxyKey = splitList(value)
+	case strings.HasPrefix(key, "monitor."):
+		if h.Monitor == nil {
+			h.Monitor = make(map[string]interface{})
+		}
+		h.Monitor[strings.TrimPrefix(key, "monitor.")] = value
+	default:
+		return fmt.Errorf("unknown setting '%s'", key)
+	}
+	return nil
+}
+
+func (h *inventoryHost) inherit(defaults *inventoryHost) {
+	inheritString := func(value *string, fallback string) {
+		if *value == "" {
+			*value = fallback
+		}
+	}
+	inheritString(&h.User, defaults.User)
+	inheritString(&h.Password, defaults.Password)
+	inheritString(&h.Key, defaults.Key)
+	inheritString(&h.KeyPassphrase, defaults.KeyPassphrase)
+	if len(h.Proxy) == 0 {
+		h.Proxy = defaults.Proxy
+	}
+	if len(h.ProxyKey) == 0 {
+		h.ProxyKey = defaults.ProxyKey
+	}
+	monitor := make(map[string]interface{})
+	for name, value := range defaults.Monitor {
+		monitor[name] = value
+	}
+	for name, value := range h.Monitor {
+		monitor[name] = value
+	}
+	h.Monitor = monitor
+}
+
+// sshHosts returns the address of the host and of its proxies, falling
+// back to the command line keys and proxies, then to the SSH configuration.
+func (h *inventoryHost) sshHosts(args *Args, config *sshConfigFile) (*SshHost, []*SshHost, error) {
+	key := expandHome(h.Key)
+	if key == "" {
+		key = *args.TargetKey
+	}
+	host, err := NewSshHost("ssh://"+h.Host, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid SSH target: %v", err)
+	}
+	if h.User != "" {
+		host.user = h.User
+	}
+	if h.Password != "" {
+		host.password = h.Password
+	}
+	host.keyPassphrase = h.KeyPassphrase
+	jumps, err := config.apply(host)
+	if err != nil {
+		return nil, nil, err
+	}
+	addresses, keys := []string(h.Proxy), []string(h.ProxyKey)
+	if len(addresses) == 0 {
+		addresses = *args.Proxy
+	}
+	if len(addresses) == 0 {
+		addresses = jumps
+	}
+	if len(keys) == 0 {
+		keys = *args.ProxyKey
+	}
+	if len(keys) > 1 && len(keys) != len(addresses) {
+		return nil, nil, fmt.Errorf("%d proxy keys given for %d proxies", len(keys), len(addresses))
+	}
+	proxies := make([]*SshHost, 0, len(addresses))
+	for i, address := range addresses {
+		proxyKey := ""
+		if len(keys) == 1 {
+			proxyKey = keys[0]
+		} else if len(keys) > 1 {
+			proxyKey = keys[i]
+		}
+		proxy, err := NewSshHost("ssh://"+address, expandHome(proxyKey))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid SSH proxy '%s': %v", address, err)
+		}
+		proxy.keyPassphrase = h.KeyPassphrase
+		_, err = config.apply(proxy)
+		if err != nil {
+			return nil, nil, err
+		}
+		proxies = append(proxies, proxy)
+	}
+	return host, proxies, nil
+}
+
+// monitorArgs renders the monitor options of the command line with the
+// host specific ones applied on top.
+func (h *inventoryHost) monitorArgs(args *monitor.Args) (string, error) {
+	var rendered string
+	err := h.withMonitorOptions(args, func() error {
+		rendered = args.String()
+		return nil
+	})
+	return rendered, err
+}
+
+// monitorConfig renders the same options as monitorArgs as a configuration
+// file, which keeps the secrets they may hold off command lines.
+func (h *inventoryHost) monitorConfig(args *monitor.Args) ([]byte, error) {
+	var content []byte
+	err := h.withMonitorOptions(args, func() error {
+		var err error
+		content, err = settings.MarshalConfig(args.Options, "")
+		return err
+	})
+	return content, err
+}
+
+// withMonitorOptions calls render with the host specific monitor options
+// applied on top of those of the command line, restored afterwards.
+func (h *inventoryHost) withMonitorOptions(args *monitor.Args, render func() error) error {
+	saved := settings.Snapshot(args.Options)
+	defer settings.Restore(args.Options, saved)
+	names := make([]string, 0, len(h.Monitor))
+	for name := range h.Monitor {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		option := findSetting(args.Options, name)
+		if option == nil {
+			return fmt.Errorf("unknown monitor option '%s'", name)
+		}
+		err := option.Set(h.Monitor[name])
+		if err != nil {
+			return fmt.Errorf("invalid monitor option '%s': %v", name, err)
+		}
+		if option.Pattern || option.Glob {
+			value := *option.Value.(*string)
+			if option.Pattern && value != "" {
+				_, err = settings.CompilePattern(name, value)
+			} else if option.Glob && value != "" {
+				_, err = settings.CompileGlob(name, value)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return render()
+}
+
+// stringList is a list given either as a YAML sequence or as a comma
+// separated string.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*l = list
+		return nil
+	}
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	*l = splitList(value)
+	return nil
+}
+
+func splitList(value string) []string {
+	list := make([]string, 0)
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func findSetting(options []*settings.Setting, name string) *settings.Setting {
+	for _, option := range options {
+		if option.Name == name {
+			return option
+		}
+	}
+	return nil
+}
+
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
@@ -0,0 +1,395 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/pkg/monitor"
+	"github.com/badeadan/k8ts/pkg/sink/collector"
+)
+
+const DefaultK8sNamespace = "kube-system"
+
+// Where the DaemonSet mounts the ConfigMap holding --config and the Secret
+// holding the collector certificates.
+const k8sConfigDir = "/etc/k8ts/config"
+const k8sTLSDir = "/etc/k8ts/tls"
+
+type K8sArgs struct {
+	Image      *string
+	Namespace  *string
+	Output     *string
+	Apply      *bool
+	Kubeconfig *string
+	Context    *string
+}
+
+// k8sManifest is what the DaemonSet template renders.
+type k8sManifest struct {
+	Namespace string
+	Image     string
+	Args      []string
+	Config    string
+	TLS       map[string][]byte
+	Paths     map[string]string
+	// HealthPort is the port of --http-listen, probed by the kubelet.
+	HealthPort string
+	// RBAC grants the service account of the DaemonSet the access to the
+	// API server --kube-api in-cluster needs.
+	RBAC bool
+	// CRD defines the K8tsPolicy resources read with --cluster-policies.
+	CRD bool
+}
+
+// k8sRBACRules are what the monitor reads from the API server.
+const k8sRBACRules = `  - apiGroups: [""]
+    resources: ["pods"]
+    verbs: ["get", "list", "watch"]
+  - apiGroups: [""]
+    resources: ["events"]
+    verbs: ["list"]
+  - apiGroups: ["apps"]
+    resources: ["replicasets"]
+    verbs: ["get"]
+  - apiGroups: ["batch"]
+    resources: ["jobs"]
+    verbs: ["get"]
+  - apiGroups: ["k8ts.io"]
+    resources: ["k8tspolicies"]
+    verbs: ["get", "list", "watch"]`
+
+const k8sManifestTemplate = `
+{{- define "configmap"}}
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: k8ts
+  namespace: {{quote .Namespace}}
+  labels:
+    app.kubernetes.io/name: k8ts
+data:
+  config.yaml: {{quote .Config}}
+{{- end}}
+{{- define "secret"}}
+apiVersion: v1
+kind: Secret
+metadata:
+  name: k8ts-collector
+  namespace: {{quote .Namespace}}
+  labels:
+    app.kubernetes.io/name: k8ts
+type: Opaque
+data:
+{{- range $name, $content := .TLS}}
+  {{$name}}: {{base64 $content | quote}}
+{{- end}}
+{{- end}}
+{{- define "crd"}}
+` + monitor.PolicyCRD + `
+{{- end}}
+{{- define "rbac"}}
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: k8ts
+  namespace: {{quote .Namespace}}
+  labels:
+    app.kubernetes.io/name: k8ts
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: k8ts
+  labels:
+    app.kubernetes.io/name: k8ts
+rules:
+` + k8sRBACRules + `
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: k8ts
+  labels:
+    app.kubernetes.io/name: k8ts
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: k8ts
+subjects:
+  - kind: ServiceAccount
+    name: k8ts
+    namespace: {{quote .Namespace}}
+{{- end}}
+{{- define "daemonset"}}
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: k8ts
+  namespace: {{quote .Namespace}}
+  labels:
+    app.kubernetes.io/name: k8ts
+spec:
+  selector:
+    matchLabels:
+      app.kubernetes.io/name: k8ts
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/name: k8ts
+    spec:
+{{- if .RBAC}}
+      serviceAccountName: k8ts
+{{- end}}
+      tolerations:
+        - operator: Exists
+      containers:
+        - name: k8ts
+          image: {{quote .Image}}
+          args:
+{{- range .Args}}
+            - {{quote .}}
+{{- end}}
+            - "--spool-dir"
+            - {{quote .Paths.spool}}
+{{- if .Config}}
+            - "--config"
+            - {{quote .Paths.configFile}}
+{{- end}}
+          env:
+            - name: NODE_NAME
+              valueFrom:
+                fieldRef:
+                  fieldPath: spec.nodeName
+          securityContext:
+            runAsUser: 0
+{{- if .HealthPort}}
+          livenessProbe:
+            httpGet:
+              path: /healthz
+              port: {{.HealthPort}}
+          readinessProbe:
+            httpGet:
+              path: /readyz
+              port: {{.HealthPort}}
+{{- end}}
+          volumeMounts:
+            - name: logs
+              mountPath: /var/log
+            - name: docker-containers
+              mountPath: /var/lib/docker/containers
+              readOnly: true
+            - name: spool
+              mountPath: {{quote .Paths.spool}}
+            - name: state
+              mountPath: {{quote .Paths.state}}
+{{- if .Config}}
+            - name: config
+              mountPath: {{quote .Paths.config}}
+              readOnly: true
+{{- end}}
+{{- if .TLS}}
+            - name: tls
+              mountPath: {{quote .Paths.tls}}
+              readOnly: true
+{{- end}}
+      volumes:
+        - name: logs
+          hostPath:
+            path: /var/log
+        - name: docker-containers
+          hostPath:
+            path: /var/lib/docker/containers
+        - name: spool
+          hostPath:
+            path: {{quote .Paths.spool}}
+            type: DirectoryOrCreate
+        - name: state
+          hostPath:
+            path: {{quote .Paths.state}}
+            type: DirectoryOrCreate
+{{- if .Config}}
+        - name: config
+          configMap:
+            name: k8ts
+{{- end}}
+{{- if .TLS}}
+        - name: tls
+          secret:
+            secretName: k8ts-collector
+{{- end}}
+{{- end}}
+`
+
+var k8sTemplates = template.Must(template.New("k8s").Funcs(template.FuncMap{
+	"quote":  yamlQuote,
+	"base64": base64.StdEncoding.EncodeToString,
+}).Parse(k8sManifestTemplate))
+
+// yamlQuote renders a string as a double quoted YAML scalar, JSON strings
+// being valid ones.
+func yamlQuote(value string) (string, error) {
+	quoted, err := json.Marshal(value)
+	return string(quoted), err
+}
+
+// render renders the named templates as a multi-document YAML stream.
+func (m *k8sManifest) render(names ...string) (string, error) {
+	documents := make([]string, 0, len(names))
+	for _, name := range names {
+		var out bytes.Buffer
+		err := k8sTemplates.ExecuteTemplate(&out, name, m)
+		if err != nil {
+			return "", err
+		}
+		documents = append(documents, strings.TrimLeft(out.String(), "\n"))
+	}
+	return strings.Join(documents, "\n---\n") + "\n", nil
+}
+
+// resources are the templates making up the manifest.
+func (m *k8sManifest) resources() []string {
+	names := make([]string, 0, 5)
+	if m.CRD {
+		names = append(names, "crd")
+	}
+	if m.RBAC {
+		names = append(names, "rbac")
+	}
+	if m.Config != "" {
+		names = append(names, "configmap")
+	}
+	if len(m.TLS) > 0 {
+		names = append(names, "secret")
+	}
+	return append(names, "daemonset")
+}
+
+// newK8sManifest describes the DaemonSet running `k8ts monitor` with the
+// monitor options on every node, along with the ConfigMap holding the
+// --config file and the Secret holding the collector certificates.
+func newK8sManifest(args *K8sArgs, monitorArgs *monitor.Args) (*k8sManifest, error) {
+	if *args.Image == "" {
+		return nil, fmt.Errorf("no k8ts image given, use --image (see `make image`)")
+	}
+	manifest := &k8sManifest{
+		Namespace: *args.Namespace,
+		Image:     *args.Image,
+		TLS:       make(map[string][]byte),
+		Paths: map[string]string{
+			"spool":      *monitorArgs.SpoolDir,
+			"state":      filepath.Dir(monitor.StatePath),
+			"config":     k8sConfigDir,
+			"configFile": path.Join(k8sConfigDir, "config.yaml"),
+			"tls":        k8sTLSDir,
+		},
+	}
+	if manifest.Paths["spool"] == "" {
+		manifest.Paths["spool"] = collector.DefaultSpoolPath
+	}
+	if *monitorArgs.HTTPListen != "" {
+		_, port, err := net.SplitHostPort(*monitorArgs.HTTPListen)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --http-listen: %v", err)
+		}
+		manifest.HealthPort = port
+	}
+	manifest.RBAC = *monitorArgs.KubeAPI == monitor.KubeInCluster
+	manifest.CRD = *monitorArgs.ClusterPolicies
+	// The certificates are read from the Secret on nodes.
+	saved := settings.Snapshot(monitorArgs.Options)
+	defer settings.Restore(monitorArgs.Options, saved)
+	moved := make(map[*string]bool)
+	for _, file := range []*string{monitorArgs.CollectorCert, monitorArgs.CollectorKey, monitorArgs.CollectorCA} {
+		if *file == "" {
+			continue
+		}
+		content, err := ioutil.ReadFile(*file)
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(*file)
+		if _, ok := manifest.TLS[name]; ok {
+			return nil, fmt.Errorf("collector certificates must have different file names, '%s' is used twice", name)
+		}
+		manifest.TLS[name] = content
+		*file = path.Join(k8sTLSDir, name)
+		moved[file] = true
+	}
+	// Options of the --config file are left to it, so that editing the
+	// ConfigMap reconfigures the monitors.
+	options := monitorArgs.Options
+	if monitorArgs.ConfigPath != "" {
+		content, err := ioutil.ReadFile(monitorArgs.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		file, err := settings.LoadConfigFile(monitorArgs.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Config = string(content)
+		options = make([]*settings.Setting, 0, len(monitorArgs.Options))
+		for _, option := range monitorArgs.Options {
+			value, _ := option.Value.(*string)
+			if _, inFile := file[option.Name]; !inFile || option.Provided || moved[value] {
+				options = append(options, option)
+			}
+		}
+	}
+	// The template gives the spool directory along with its mount.
+	*monitorArgs.SpoolDir = ""
+	manifest.Args = append([]string{"monitor", "--container"}, settings.ArgList(options)...)
+	return manifest, nil
+}
+
+// kubectl prepares a kubectl command for the kubeconfig and context given,
+// if any.
+func kubectl(kubeconfig string, context string, args ...string) *exec.Cmd {
+	if kubeconfig != "" {
+		args = append(args, "--kubeconfig", kubeconfig)
+	}
+	if context != "" {
+		args = append(args, "--context", context)
+	}
+	return exec.Command("kubectl", args...)
+}
+
+// K8s writes the manifests of `k8ts deploy k8s` or applies them with
+// kubectl, for clusters whose nodes can't be reached with SSH.
+func K8s(args *K8sArgs, monitorArgs *monitor.Args) error {
+	manifest, err := newK8sManifest(args, monitorArgs)
+	if err != nil {
+		return err
+	}
+	manifests, err := manifest.render(manifest.resources()...)
+	if err != nil {
+		return err
+	}
+	if !*args.Apply {
+		if *args.Output == "" || *args.Output == "-" {
+			_, err = fmt.Print(manifests)
+			return err
+		}
+		return ioutil.WriteFile(*args.Output, []byte(manifests), 0644)
+	}
+	cmd := kubectl(*args.Kubeconfig, *args.Context, "apply", "-f", "-")
+	cmd.Stdin = bytes.NewBufferString(manifests)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("kubectl apply failed: %v", err)
+	}
+	return nil
+}
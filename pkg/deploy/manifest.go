@@ -0,0 +1,350 @@
+package deploy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/badeadan/k8ts/internal/version"
+	"github.com/badeadan/k8ts/pkg/monitor"
+	"gopkg.in/yaml.v2"
+)
+
+type ManifestArgs struct {
+	Format  *string
+	Output  *string
+	K8s     *K8sArgs
+	Monitor *monitor.Args
+}
+
+// helmValues are the values.yaml of the chart, defaulting to the options
+// `k8ts manifest` was given.
+type helmValues struct {
+	Image        string            `yaml:"image"`
+	Args         []string          `yaml:"args"`
+	SpoolDir     string            `yaml:"spoolDir"`
+	Config       string            `yaml:"config"`
+	CollectorTLS map[string]string `yaml:"collectorTLS"`
+	Tolerations  []interface{}     `yaml:"tolerations"`
+	NodeSelector map[string]string `yaml:"nodeSelector"`
+	Resources    map[string]string `yaml:"resources"`
+	HealthPort   string            `yaml:"healthPort"`
+	RBAC         bool              `yaml:"rbac"`
+}
+
+const helmChart = `apiVersion: v2
+name: k8ts
+description: Preserve logs of Kubernetes pods and jobs
+type: application
+version: 0.1.0
+appVersion: %q
+`
+
+const helmConfigMap = `{{- if .Values.config }}
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Release.Name }}
+  namespace: {{ .Release.Namespace }}
+  labels:
+    app.kubernetes.io/name: k8ts
+    app.kubernetes.io/instance: {{ .Release.Name }}
+data:
+  config.yaml: {{ .Values.config | quote }}
+{{- end }}
+`
+
+const helmSecret = `{{- if .Values.collectorTLS }}
+apiVersion: v1
+kind: Secret
+metadata:
+  name: {{ .Release.Name }}-collector
+  namespace: {{ .Release.Namespace }}
+  labels:
+    app.kubernetes.io/name: k8ts
+    app.kubernetes.io/instance: {{ .Release.Name }}
+type: Opaque
+data:
+  {{- range $name, $content := .Values.collectorTLS }}
+  {{ $name }}: {{ $content | b64enc | quote }}
+  {{- end }}
+{{- end }}
+`
+
+const helmRBAC = `{{- if .Values.rbac }}
+apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{ .Release.Name }}
+  namespace: {{ .Release.Namespace }}
+  labels:
+    app.kubernetes.io/name: k8ts
+    app.kubernetes.io/instance: {{ .Release.Name }}
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: {{ .Release.Name }}
+  labels:
+    app.kubernetes.io/name: k8ts
+    app.kubernetes.io/instance: {{ .Release.Name }}
+rules:
+` + k8sRBACRules + `
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRoleBinding
+metadata:
+  name: {{ .Release.Name }}
+  labels:
+    app.kubernetes.io/name: k8ts
+    app.kubernetes.io/instance: {{ .Release.Name }}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: ClusterRole
+  name: {{ .Release.Name }}
+subjects:
+  - kind: ServiceAccount
+    name: {{ .Release.Name }}
+    namespace: {{ .Release.Namespace }}
+{{- end }}
+`
+
+const helmDaemonSet = `apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: {{ .Release.Name }}
+  namespace: {{ .Release.Namespace }}
+  labels:
+    app.kubernetes.io/name: k8ts
+    app.kubernetes.io/instance: {{ .Release.Name }}
+spec:
+  selector:
+    matchLabels:
+      app.kubernetes.io/name: k8ts
+      app.kubernetes.io/instance: {{ .Release.Name }}
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/name: k8ts
+        app.kubernetes.io/instance: {{ .Release.Name }}
+    spec:
+      {{- if .Values.rbac }}
+      serviceAccountName: {{ .Release.Name }}
+      {{- end }}
+      {{- with .Values.tolerations }}
+      tolerations:
+        {{- toYaml . | nindent 8 }}
+      {{- end }}
+      {{- with .Values.nodeSelector }}
+      nodeSelector:
+        {{- toYaml . | nindent 8 }}
+      {{- end }}
+      containers:
+        - name: k8ts
+          image: {{ .Values.image | quote }}
+          args:
+            {{- toYaml .Values.args | nindent 12 }}
+            - --spool-dir
+            - {{ .Values.spoolDir | quote }}
+            {{- if .Values.config }}
+            - --config
+            - ` + k8sConfigDir + `/config.yaml
+            {{- end }}
+          env:
+            - name: NODE_NAME
+              valueFrom:
+                fieldRef:
+                  fieldPath: spec.nodeName
+          securityContext:
+            runAsUser: 0
+          {{- with .Values.healthPort }}
+          livenessProbe:
+            httpGet:
+              path: /healthz
+              port: {{ . }}
+          readinessProbe:
+            httpGet:
+              path: /readyz
+              port: {{ . }}
+          {{- end }}
+          {{- with .Values.resources }}
+          resources:
+            {{- toYaml . | nindent 12 }}
+          {{- end }}
+          volumeMounts:
+            - name: logs
+              mountPath: /var/log
+            - name: docker-containers
+              mountPath: /var/lib/docker/containers
+              readOnly: true
+            - name: spool
+              mountPath: {{ .Values.spoolDir | quote }}
+            - name: state
+              mountPath: /run/k8ts
+            {{- if .Values.config }}
+            - name: config
+              mountPath: ` + k8sConfigDir + `
+              readOnly: true
+            {{- end }}
+            {{- if .Values.collectorTLS }}
+            - name: tls
+              mountPath: ` + k8sTLSDir + `
+              readOnly: true
+            {{- end }}
+      volumes:
+        - name: logs
+          hostPath:
+            path: /var/log
+        - name: docker-containers
+          hostPath:
+            path: /var/lib/docker/containers
+        - name: spool
+          hostPath:
+            path: {{ .Values.spoolDir | quote }}
+            type: DirectoryOrCreate
+        - name: state
+          hostPath:
+            path: /run/k8ts
+            type: DirectoryOrCreate
+        {{- if .Values.config }}
+        - name: config
+          configMap:
+            name: {{ .Release.Name }}
+        {{- end }}
+        {{- if .Values.collectorTLS }}
+        - name: tls
+          secret:
+            secretName: {{ .Release.Name }}-collector
+        {{- end }}
+`
+
+// writeFiles writes files, named relatively to dir.
+func writeFiles(dir string, files map[string]string) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(path, []byte(files[name]), 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Println(path)
+	}
+	return nil
+}
+
+// helmFiles lays out a chart whose values default to the manifest.
+func helmFiles(manifest *k8sManifest) (map[string]string, error) {
+	values := helmValues{
+		Image:        manifest.Image,
+		Args:         manifest.Args,
+		SpoolDir:     manifest.Paths["spool"],
+		Config:       manifest.Config,
+		CollectorTLS: make(map[string]string),
+		Tolerations:  []interface{}{map[string]string{"operator": "Exists"}},
+		NodeSelector: map[string]string{},
+		Resources:    map[string]string{},
+		HealthPort:   manifest.HealthPort,
+		RBAC:         manifest.RBAC,
+	}
+	for name, content := range manifest.TLS {
+		values.CollectorTLS[name] = string(content)
+	}
+	content, err := yaml.Marshal(&values)
+	if err != nil {
+		return nil, err
+	}
+	// Helm installs the CRDs of crds/ before the templates.
+	return map[string]string{
+		"Chart.yaml":               fmt.Sprintf(helmChart, version.Version),
+		"crds/k8tspolicy.yaml":     monitor.PolicyCRD + "\n",
+		"values.yaml":              string(content),
+		"templates/configmap.yaml": helmConfigMap,
+		"templates/secret.yaml":    helmSecret,
+		"templates/rbac.yaml":      helmRBAC,
+		"templates/daemonset.yaml": helmDaemonSet,
+	}, nil
+}
+
+// kustomizeFiles lays out a kustomize base generating the ConfigMap and
+// the Secret from the files they hold.
+func kustomizeFiles(manifest *k8sManifest) (map[string]string, error) {
+	daemonSet, err := manifest.render("daemonset")
+	if err != nil {
+		return nil, err
+	}
+	resources := []string{"daemonset.yaml"}
+	files := map[string]string{"daemonset.yaml": daemonSet}
+	if manifest.CRD {
+		files["crd.yaml"] = monitor.PolicyCRD + "\n"
+		resources = append(resources, "crd.yaml")
+	}
+	if manifest.RBAC {
+		rbac, err := manifest.render("rbac")
+		if err != nil {
+			return nil, err
+		}
+		files["rbac.yaml"] = rbac
+		resources = append(resources, "rbac.yaml")
+	}
+	kustomization := yaml.MapSlice{
+		{Key: "apiVersion", Value: "kustomize.config.k8s.io/v1beta1"},
+		{Key: "kind", Value: "Kustomization"},
+		{Key: "namespace", Value: manifest.Namespace},
+		{Key: "resources", Value: resources},
+	}
+	if manifest.Config != "" {
+		files["config.yaml"] = manifest.Config
+		kustomization = append(kustomization, yaml.MapItem{Key: "configMapGenerator", Value: []yaml.MapSlice{{
+			{Key: "name", Value: "k8ts"},
+			{Key: "files", Value: []string{"config.yaml"}},
+		}}})
+	}
+	if len(manifest.TLS) > 0 {
+		tls := make([]string, 0, len(manifest.TLS))
+		for name, content := range manifest.TLS {
+			files["tls/"+name] = string(content)
+			tls = append(tls, "tls/"+name)
+		}
+		sort.Strings(tls)
+		kustomization = append(kustomization, yaml.MapItem{Key: "secretGenerator", Value: []yaml.MapSlice{{
+			{Key: "name", Value: "k8ts-collector"},
+			{Key: "files", Value: tls},
+		}}})
+	}
+	content, err := yaml.Marshal(kustomization)
+	if err != nil {
+		return nil, err
+	}
+	files["kustomization.yaml"] = string(content)
+	return files, nil
+}
+
+// WriteManifest writes a Helm chart or a kustomize base deploying k8ts as
+// a DaemonSet with the monitor options given, for GitOps repositories.
+func WriteManifest(args *ManifestArgs) error {
+	manifest, err := newK8sManifest(args.K8s, args.Monitor)
+	if err != nil {
+		return err
+	}
+	var files map[string]string
+	switch *args.Format {
+	case "helm":
+		files, err = helmFiles(manifest)
+	case "kustomize":
+		files, err = kustomizeFiles(manifest)
+	}
+	if err != nil {
+		return err
+	}
+	return writeFiles(*args.Output, files)
+}
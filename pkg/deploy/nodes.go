@@ -0,0 +1,73 @@
+package deploy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/badeadan/k8ts/internal/logger"
+)
+
+// nodeAddressTypes are the types of node addresses reported by Kubernetes.
+var nodeAddressTypes = []string{"InternalIP", "ExternalIP", "Hostname", "InternalDNS", "ExternalDNS"}
+
+// nodeList is the part of `kubectl get nodes -o json` deploy needs.
+type nodeList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Status struct {
+			Addresses []struct {
+				Type    string `json:"type"`
+				Address string `json:"address"`
+			} `json:"addresses"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// clusterNodes lists the nodes matching --node-selector as hosts to deploy
+// to, reached at their --node-address.
+func clusterNodes(args *Args) ([]inventoryHost, error) {
+	command := []string{"get", "nodes", "-o", "json"}
+	if *args.NodeSelector != "" {
+		command = append(command, "-l", *args.NodeSelector)
+	}
+	cmd := kubectl(*args.Kubeconfig, *args.Context, command...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list nodes: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	nodes := nodeList{}
+	err = json.Unmarshal(stdout.Bytes(), &nodes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list nodes: %v", err)
+	}
+	hosts := make([]inventoryHost, 0, len(nodes.Items))
+	for _, node := range nodes.Items {
+		address := ""
+		for _, candidate := range node.Status.Addresses {
+			if candidate.Type == *args.NodeAddress {
+				address = candidate.Address
+				break
+			}
+		}
+		if address == "" {
+			logger.Warn("Node has no such address, skipping it", "node", node.Metadata.Name, "type", *args.NodeAddress)
+			continue
+		}
+		if strings.Contains(address, ":") {
+			address = "[" + address + "]"
+		}
+		logger.Debug("Found node", "node", node.Metadata.Name, "address", address)
+		hosts = append(hosts, inventoryHost{Host: address})
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no node found with a %s address", *args.NodeAddress)
+	}
+	return hosts, nil
+}
@@ -0,0 +1,92 @@
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/alessio/shellescape"
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/monitor"
+	"github.com/badeadan/k8ts/pkg/sink/collector"
+)
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// remove reverses deploy: the service, the binaries and the monitor state
+// go away, the tombstones and pending uploads only if purge is set. They
+// are first saved to archiveDir, if given.
+func remove(target *sshClient, paths remotePaths, name string, purge bool, archiveDir string) error {
+	installPath := paths.binary()
+	if _, err := target.run("test -e " + installPath); err == nil {
+		err = uninstallService(target, installPath)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := target.sudo("rm -f " + installPath + " " + installPath + ".old")
+	if err != nil {
+		return fmt.Errorf("failed to remove '%s': %v", installPath, err)
+	}
+	_, err = target.sudo("rm -rf " + filepath.Dir(monitor.StatePath))
+	if err != nil {
+		return err
+	}
+	if archiveDir != "" {
+		err = archiveTombstones(target, name, archiveDir)
+		if err != nil {
+			return err
+		}
+	}
+	if !purge {
+		return nil
+	}
+	_, err = target.sudo("rm -rf " + monitor.TombstonePath + " " + filepath.Dir(collector.DefaultSpoolPath))
+	if err != nil {
+		return fmt.Errorf("failed to remove tombstones: %v", err)
+	}
+	return nil
+}
+
+// archiveTombstones saves the tombstone directory of the target to
+// archiveDir as <target>-tombstones-<time>.tar.gz.
+func archiveTombstones(target *sshClient, name string, archiveDir string) error {
+	if _, err := target.run("test -d " + monitor.TombstonePath); err != nil {
+		logger.Info("No tombstones to archive", "host", name)
+		return nil
+	}
+	err := os.MkdirAll(archiveDir, 0755)
+	if err != nil {
+		return err
+	}
+	archivePath := filepath.Join(archiveDir, fmt.Sprintf("%s-tombstones-%s.tar.gz",
+		unsafeFileChars.ReplaceAllString(name, "_"), time.Now().Format("20060102-150405")))
+	file, err := os.Create(archivePath)
+	if err != nil {
+		return err
+	}
+	err = target.sudoTo("tar czf - -C "+shellescape.Quote(filepath.Dir(monitor.TombstonePath))+" "+
+		shellescape.Quote(filepath.Base(monitor.TombstonePath)), file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(archivePath)
+		return fmt.Errorf("failed to archive tombstones: %v", err)
+	}
+	logger.Info("Tombstones archived", "host", name, "path", archivePath)
+	return nil
+}
+
+// Remove removes k8ts from every target.
+func Remove(args *Args) error {
+	jobs, err := forEachTarget(args, "Removing", func(job *deployJob, target *sshClient) error {
+		return remove(target, job.paths, job.target, *args.Purge, *args.ArchiveDir)
+	})
+	if err != nil {
+		return err
+	}
+	return summarizeDeploy(jobs, "remove")
+}
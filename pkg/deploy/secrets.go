@@ -0,0 +1,229 @@
+package deploy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// secretReference matches the references to secrets kept out of the
+// inventory, so that it can be committed: ${vault:<path>#<field>} reads
+// the field of a HashiCorp Vault secret and ${sops:<file>#<key>} the key
+// of a SOPS encrypted file, nested keys being separated by dots.
+var secretReference = regexp.MustCompile(`\$\{(vault|sops):([^#}]+)#([^}]+)\}`)
+
+const vaultTimeout = 10 * time.Second
+
+// secretResolver expands the secret references of inventory settings.
+// Every Vault secret and SOPS file is read once however many hosts refer
+// to it.
+type secretResolver struct {
+	// dir is where the SOPS files given with a relative path are, that of
+	// the inventory.
+	dir     string
+	secrets map[string]map[string]interface{}
+	vault   *http.Client
+}
+
+func newSecretResolver(dir string) *secretResolver {
+	return &secretResolver{dir: dir, secrets: make(map[string]map[string]interface{})}
+}
+
+// expand returns value with the secrets it refers to in place of their
+// references.
+func (r *secretResolver) expand(value string) (string, error) {
+	var err error
+	expanded := secretReference.ReplaceAllStringFunc(value, func(reference string) string {
+		if err != nil {
+			return reference
+		}
+		parts := secretReference.FindStringSubmatch(reference)
+		var secret string
+		secret, err = r.lookup(parts[1], parts[2], parts[3])
+		if err != nil {
+			err = fmt.Errorf("%s: %v", reference, err)
+		}
+		return secret
+	})
+	return expanded, err
+}
+
+func (r *secretResolver) lookup(kind string, path string, key string) (string, error) {
+	if kind == "sops" {
+		path = expandHome(path)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(r.dir, path)
+		}
+	}
+	id := kind + ":" + path
+	data, ok := r.secrets[id]
+	if !ok {
+		var err error
+		if kind == "vault" {
+			data, err = r.readVault(path)
+		} else {
+			data, err = readSOPS(path)
+		}
+		if err != nil {
+			return "", err
+		}
+		r.secrets[id] = data
+	}
+	var value interface{} = data
+	for _, name := range strings.Split(key, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("no key '%s'", key)
+		}
+		value, ok = object[name]
+		if !ok {
+			return "", fmt.Errorf("no key '%s'", key)
+		}
+	}
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case map[string]interface{}, []interface{}, nil:
+		return "", fmt.Errorf("key '%s' isn't a string", key)
+	default:
+		return fmt.Sprint(value), nil
+	}
+}
+
+// readVault reads the secret at path from the Vault server of the
+// VAULT_ADDR environment variable with the token of VAULT_TOKEN, else of
+// ~/.vault-token (written by `vault login`), as the vault command does.
+// VAULT_NAMESPACE and VAULT_CACERT are honoured too.
+func (r *secretResolver) readVault(path string) (map[string]interface{}, error) {
+	address := os.Getenv("VAULT_ADDR")
+	if address == "" {
+		return nil, fmt.Errorf("VAULT_ADDR isn't set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		content, err := ioutil.ReadFile(expandHome("~/.vault-token"))
+		if err != nil {
+			return nil, fmt.Errorf("no Vault token, set VAULT_TOKEN or run vault login")
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if r.vault == nil {
+		tlsConfig := &tls.Config{}
+		if ca := os.Getenv("VAULT_CACERT"); ca != "" {
+			caData, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return nil, err
+			}
+			rootCAs := x509.NewCertPool()
+			if !rootCAs.AppendCertsFromPEM(caData) {
+				return nil, fmt.Errorf("no certificates found in '%s'", ca)
+			}
+			tlsConfig.RootCAs = rootCAs
+		}
+		r.vault = &http.Client{Timeout: vaultTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+	request, err := http.NewRequest("GET", strings.TrimSuffix(address, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		request.Header.Set("X-Vault-Namespace", namespace)
+	}
+	response, err := r.vault.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Vault replied %s", response.Status)
+	}
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err = json.Unmarshal(body, &secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Vault response: %v", err)
+	}
+	// The version 2 of the KV engine nests the secret along with its
+	// metadata.
+	if data, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, ok := secret.Data["metadata"]; ok {
+			return data, nil
+		}
+	}
+	return secret.Data, nil
+}
+
+// readSOPS decrypts the file at path with the sops command, which finds
+// the keys (age, PGP, cloud KMS) the file was encrypted for.
+func readSOPS(path string) (map[string]interface{}, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("sops", "--decrypt", "--output-type", "json", path)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s with sops: %v %s", path, err, strings.TrimSpace(stderr.String()))
+	}
+	var data map[string]interface{}
+	err = json.Unmarshal(stdout.Bytes(), &data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid content of %s: %v", path, err)
+	}
+	return data, nil
+}
+
+// resolveSecrets expands the secret references of the password, key
+// passphrase and monitor options of h, e.g. the credentials of a sink.
+func (h *inventoryHost) resolveSecrets(r *secretResolver) error {
+	var err error
+	h.Password, err = r.expand(h.Password)
+	if err != nil {
+		return fmt.Errorf("password: %v", err)
+	}
+	h.KeyPassphrase, err = r.expand(h.KeyPassphrase)
+	if err != nil {
+		return fmt.Errorf("key-passphrase: %v", err)
+	}
+	for name, value := range h.Monitor {
+		h.Monitor[name], err = r.expandValue(value)
+		if err != nil {
+			return fmt.Errorf("monitor option '%s': %v", name, err)
+		}
+	}
+	return nil
+}
+
+// expandValue expands the secret references of a monitor option, or of
+// every item of a list option.
+func (r *secretResolver) expandValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return r.expand(v)
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			expanded, err := r.expandValue(item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = expanded
+		}
+		return items, nil
+	}
+	return value, nil
+}
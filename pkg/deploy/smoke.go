@@ -0,0 +1,56 @@
+package deploy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/monitor"
+)
+
+const defaultSmokeTimeout = 30
+const smokeInterval = 2 * time.Second
+
+// smokeChecks returns what's wrong with k8ts on the target, if anything:
+// the service must be active, the monitor must have published its state
+// and created the tombstone directory.
+func smokeChecks(target *sshClient, paths remotePaths, system *monitor.InitSystem) []string {
+	failures := make([]string, 0)
+	if state, _ := serviceHealth(target, system); state != "active" {
+		failures = append(failures, fmt.Sprintf("service is %s", state))
+	}
+	output, err := target.run(paths.binary() + " stats -o json")
+	result := monitor.StoreStats{}
+	if err != nil {
+		failures = append(failures, fmt.Sprintf("k8ts stats failed: %v", err))
+	} else if json.Unmarshal([]byte(output), &result) != nil || result.Monitor == nil {
+		failures = append(failures, "monitor not running")
+	}
+	if _, err := target.run("test -d " + monitor.TombstonePath); err != nil {
+		failures = append(failures, "no tombstone directory")
+	}
+	return failures
+}
+
+// smokeTest waits up to timeout for k8ts to be up and running on the
+// target after a deploy.
+func smokeTest(target *sshClient, paths remotePaths, timeout time.Duration) error {
+	system, err := monitor.DetectInitSystem(target.run)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		failures := smokeChecks(target, paths, system)
+		if len(failures) == 0 {
+			logger.Info("Smoke test passed", "host", target.name)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("smoke test failed after %v: %s", timeout, strings.Join(failures, ", "))
+		}
+		time.Sleep(smokeInterval)
+	}
+}
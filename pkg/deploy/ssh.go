@@ -0,0 +1,383 @@
+package deploy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/alessio/shellescape"
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/monitor"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const defaultSSHTimeout = 60
+const defaultUploadTimeout = 600
+const uploadProgressInterval = 10 * time.Second
+const defaultKnownHosts = "~/.ssh/known_hosts"
+
+// sshClient runs commands and uploads files on a host, possibly reached
+// through proxies (jump hosts).
+type sshClient struct {
+	name           string
+	client         *ssh.Client
+	hops           []*ssh.Client
+	becomePassword string
+	uploadTimeout  time.Duration
+}
+
+// hostKeyCallback verifies host keys against known_hosts files so deploy
+// never runs sudo on an impostor.
+func hostKeyCallback(files []string, insecure bool) (ssh.HostKeyCallback, error) {
+	if insecure {
+		logger.Warn("Host keys are not verified")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, expandHome(file))
+	}
+	verify, err := knownhosts.New(paths...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load known hosts: %v (use --known-hosts or --insecure-ignore-host-key)", err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := verify(hostname, remote, key)
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok {
+			return err
+		}
+		fingerprint := ssh.FingerprintSHA256(key)
+		if len(keyErr.Want) == 0 {
+			return fmt.Errorf("unknown host key for %s (%s %s), check it and add it to %s",
+				hostname, key.Type(), fingerprint, strings.Join(files, ", "))
+		}
+		known := make([]string, 0, len(keyErr.Want))
+		for _, want := range keyErr.Want {
+			known = append(known, fmt.Sprintf("%s %s (%s:%d)", want.Key.Type(),
+				ssh.FingerprintSHA256(want.Key), want.Filename, want.Line))
+		}
+		return fmt.Errorf("HOST KEY MISMATCH for %s: got %s %s, expected %s",
+			hostname, key.Type(), fingerprint, strings.Join(known, ", "))
+	}, nil
+}
+
+func sshConfig(host *SshHost, hostKeys ssh.HostKeyCallback, timeout time.Duration) (*ssh.ClientConfig, error) {
+	auths := make([]ssh.AuthMethod, 0)
+	if host.password != "" {
+		password := host.password
+		auths = append(auths, ssh.Password(password),
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range questions {
+					answers[i] = password
+				}
+				return answers, nil
+			}))
+	}
+	if host.keyPath != "" {
+		signer, err := loadKey(host.keyPath, host.keyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		auths = append(auths, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			conn, err := net.Dial("unix", socket)
+			if err != nil {
+				return nil, err
+			}
+			defer func() { _ = conn.Close() }()
+			return agent.NewClient(conn).Signers()
+		}))
+	}
+	return &ssh.ClientConfig{
+		User:            host.user,
+		Auth:            auths,
+		HostKeyCallback: hostKeys,
+		Timeout:         timeout,
+	}, nil
+}
+
+// loadKey reads a private key, decrypting it with passphrase if needed.
+func loadKey(keyPath string, passphrase string) (ssh.Signer, error) {
+	content, err := ioutil.ReadFile(expandHome(keyPath))
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(content)
+	if err == nil {
+		return signer, nil
+	}
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return nil, fmt.Errorf("invalid SSH key '%s': %v", keyPath, err)
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("SSH key '%s' is encrypted, give its passphrase with --ask-key-pass, "+
+			"--key-passphrase-file or %s", keyPath, keyPassphraseEnv)
+	}
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(content, []byte(passphrase))
+	if errors.Is(err, x509.IncorrectPasswordError) {
+		return nil, fmt.Errorf("wrong passphrase for SSH key '%s'", keyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH key '%s': %v", keyPath, err)
+	}
+	return signer, nil
+}
+
+// dialSSH connects to target, going through the proxies (jump hosts) in
+// order, each hop being reached from the previous one. timeout applies to
+// the connection and handshake with every hop.
+func dialSSH(target *SshHost, proxies []*SshHost, hostKeys ssh.HostKeyCallback, timeout time.Duration) (*sshClient, error) {
+	c := &sshClient{name: net.JoinHostPort(target.host, target.port)}
+	hops := append(append([]*SshHost{}, proxies...), target)
+	for _, hop := range hops {
+		config, err := sshConfig(hop, hostKeys, timeout)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		address := net.JoinHostPort(hop.host, hop.port)
+		var conn net.Conn
+		if c.client == nil {
+			conn, err = net.DialTimeout("tcp", address, timeout)
+		} else {
+			conn, err = c.client.Dial("tcp", address)
+		}
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("%s: %v", address, err)
+		}
+		// Forwarded connections don't support deadlines, this only
+		// bounds the handshake with the first hop.
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+		sshConn, channels, requests, err := ssh.NewClientConn(conn, address, config)
+		_ = conn.SetDeadline(time.Time{})
+		if err != nil {
+			_ = conn.Close()
+			c.Close()
+			return nil, fmt.Errorf("%s: %v", address, err)
+		}
+		if c.client != nil {
+			c.hops = append(c.hops, c.client)
+		}
+		c.client = ssh.NewClient(sshConn, channels, requests)
+	}
+	return c, nil
+}
+
+// Close disconnects from the target and every hop.
+func (c *sshClient) Close() {
+	if c.client != nil {
+		_ = c.client.Close()
+	}
+	for i := len(c.hops) - 1; i >= 0; i-- {
+		_ = c.hops[i].Close()
+	}
+}
+
+// run executes a command and returns its output. The error output is
+// part of the error returned if the command fails.
+func (c *sshClient) run(command string) (string, error) {
+	return c.runWithInput(command, "")
+}
+
+// sudo runs a command as root, giving sudo the become password if any.
+func (c *sshClient) sudo(command string) (string, error) {
+	var stdout bytes.Buffer
+	err := c.sudoTo(command, &stdout)
+	return stdout.String(), err
+}
+
+// sudoTo runs a command as root, writing its output to w.
+func (c *sshClient) sudoTo(command string, w io.Writer) error {
+	if c.becomePassword == "" {
+		return c.stream("sudo "+command, "", w)
+	}
+	return c.stream("sudo -S -p '' "+command, c.becomePassword+"\n", w)
+}
+
+func (c *sshClient) runWithInput(command string, input string) (string, error) {
+	var stdout bytes.Buffer
+	err := c.stream(command, input, &stdout)
+	return stdout.String(), err
+}
+
+// stream runs a command, feeding it input and writing its output to w.
+func (c *sshClient) stream(command string, input string, w io.Writer) error {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = session.Close() }()
+	session.Stdin = strings.NewReader(input)
+	var stderr bytes.Buffer
+	session.Stdout = w
+	session.Stderr = &stderr
+	err = session.Run(command)
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return fmt.Errorf("%v: %s", err, message)
+		}
+		return err
+	}
+	return nil
+}
+
+// withOutput adds the output of a failed remote command to its error.
+func withOutput(err error, output string) error {
+	if output = strings.TrimSpace(output); output != "" {
+		return fmt.Errorf("%v: %s", err, output)
+	}
+	return err
+}
+
+// upload copies a local file to the remote host using the scp protocol,
+// logging its progress and giving up after the upload timeout, if any.
+func (c *sshClient) upload(localPath string, remotePath string, mode os.FileMode) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return c.uploadFrom(file, stat.Size(), remotePath, mode)
+}
+
+// uploadContent writes content to a file of the remote host as upload
+// does, e.g. settings which mustn't show up on a command line.
+func (c *sshClient) uploadContent(content []byte, remotePath string, mode os.FileMode) error {
+	return c.uploadFrom(bytes.NewReader(content), int64(len(content)), remotePath, mode)
+}
+
+func (c *sshClient) uploadFrom(source io.Reader, size int64, remotePath string, mode os.FileMode) error {
+	session, err := c.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = session.Close() }()
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	err = session.Start("scp -qt " + shellescape.Quote(path.Dir(remotePath)))
+	if err != nil {
+		return err
+	}
+	content := &progressReader{reader: source}
+	done := make(chan struct{})
+	defer close(done)
+	var timedOut int32
+	go func() {
+		var expired <-chan time.Time
+		if c.uploadTimeout > 0 {
+			timer := time.NewTimer(c.uploadTimeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		ticker := time.NewTicker(uploadProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				logger.Info("Uploading", "host", c.name, "sent", monitor.FormatSize(content.sent()),
+					"size", monitor.FormatSize(size))
+			case <-expired:
+				atomic.StoreInt32(&timedOut, 1)
+				_ = session.Close()
+				return
+			}
+		}
+	}()
+	acks := bufio.NewReader(stdout)
+	err = scpSend(stdin, acks, content, size, path.Base(remotePath), mode)
+	_ = stdin.Close()
+	if waitErr := session.Wait(); err == nil && waitErr != nil {
+		err = fmt.Errorf("%v: %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil && atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("timed out after %v with %s of %s sent (see --upload-timeout)",
+			c.uploadTimeout, monitor.FormatSize(content.sent()), monitor.FormatSize(size))
+	}
+	return err
+}
+
+// progressReader counts the bytes read, for progress reports.
+type progressReader struct {
+	count  int64 // first for 64-bit alignment of atomic operations
+	reader io.Reader
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(&r.count, int64(n))
+	return n, err
+}
+
+func (r *progressReader) sent() int64 {
+	return atomic.LoadInt64(&r.count)
+}
+
+func scpSend(stdin io.Writer, acks *bufio.Reader, content io.Reader, size int64, name string, mode os.FileMode) error {
+	err := scpAck(acks)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stdin, "C%04o %d %s\n", mode.Perm(), size, name)
+	if err != nil {
+		return err
+	}
+	err = scpAck(acks)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(stdin, content)
+	if err != nil {
+		return err
+	}
+	_, err = stdin.Write([]byte{0})
+	if err != nil {
+		return err
+	}
+	return scpAck(acks)
+}
+
+// scpAck reads the status byte scp sends after each step, followed by a
+// message on warnings and errors.
+func scpAck(acks *bufio.Reader) error {
+	status, err := acks.ReadByte()
+	if err != nil {
+		return err
+	}
+	if status == 0 {
+		return nil
+	}
+	message, _ := acks.ReadString('\n')
+	return fmt.Errorf("scp: %s", strings.TrimSpace(message))
+}
@@ -0,0 +1,98 @@
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+const defaultSSHConfig = "~/.ssh/config"
+const defaultSSHPort = "22"
+
+// sshConfigFile resolves host aliases the way `ssh` does, so that
+// `k8ts deploy -t prod-node-7` reaches the same host as `ssh prod-node-7`.
+type sshConfigFile struct {
+	path   string
+	config *ssh_config.Config
+}
+
+// loadSSHConfig reads an OpenSSH client configuration. A missing file is
+// the same as an empty one.
+func loadSSHConfig(path string) (*sshConfigFile, error) {
+	file := &sshConfigFile{path: path}
+	if path == "" {
+		return file, nil
+	}
+	content, err := os.Open(expandHome(path))
+	if os.IsNotExist(err) {
+		return file, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = content.Close() }()
+	file.config, err = ssh_config.Decode(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SSH configuration '%s': %v", path, err)
+	}
+	return file, nil
+}
+
+func (f *sshConfigFile) get(alias string, key string) (value string, err error) {
+	if f.config == nil {
+		return "", nil
+	}
+	// ssh_config panics on the Match directives it doesn't support.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: %v", f.path, r)
+		}
+	}()
+	return f.config.Get(alias, key)
+}
+
+// apply completes host with the HostName, Port, User and IdentityFile of
+// its alias, settings given explicitly taking precedence, and returns the
+// ProxyJump hosts.
+func (f *sshConfigFile) apply(host *SshHost) ([]string, error) {
+	alias := host.host
+	settings := make(map[string]string)
+	for _, key := range []string{"HostName", "Port", "User", "IdentityFile", "ProxyJump"} {
+		value, err := f.get(alias, key)
+		if err != nil {
+			return nil, err
+		}
+		settings[key] = value
+	}
+	if name := settings["HostName"]; name != "" {
+		host.host = strings.Replace(name, "%h", alias, -1)
+	}
+	if host.port == "" {
+		host.port = settings["Port"]
+	}
+	if host.port == "" {
+		host.port = defaultSSHPort
+	}
+	if host.user == "" {
+		host.user = settings["User"]
+	}
+	if host.user == "" {
+		if current, err := user.Current(); err == nil {
+			host.user = current.Username
+		}
+	}
+	if identity := expandHome(settings["IdentityFile"]); host.keyPath == "" && identity != "" {
+		// Like ssh, ignore identity files which don't exist.
+		if _, err := os.Stat(identity); err == nil {
+			host.keyPath = identity
+		}
+	}
+	jump := settings["ProxyJump"]
+	if jump == "" || strings.EqualFold(jump, "none") {
+		return nil, nil
+	}
+	return splitList(jump), nil
+}
@@ -0,0 +1,116 @@
+package deploy
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/alessio/shellescape"
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/pkg/monitor"
+)
+
+// hostStatus is what `k8ts deploy status` finds on a target.
+type hostStatus struct {
+	version     string
+	service     string
+	monitorArgs string
+	installed   bool
+}
+
+var optionsMutex sync.Mutex
+
+// remoteStatus reads the version of the installed binary, the state of
+// the service and the monitor options of its definition or configuration
+// file, rendered as command line arguments of options.
+func remoteStatus(target *sshClient, paths remotePaths, options []*settings.Setting) (*hostStatus, error) {
+	status := &hostStatus{version: "unknown", service: "unknown"}
+	installPath := paths.binary()
+	// Binaries older than --version fail here but still run.
+	if output, err := target.run(installPath + " --version"); err == nil {
+		if fields := strings.Fields(output); len(fields) > 1 {
+			status.version = fields[1]
+		}
+	}
+	system, err := monitor.DetectInitSystem(target.run)
+	if err != nil {
+		return nil, err
+	}
+	if state, _ := system.State(target.run); state != "" {
+		status.service = state
+	}
+	definition, err := target.run("cat " + system.Path)
+	if err != nil {
+		if _, statErr := target.run("test -e " + installPath); statErr != nil {
+			status.version = "not installed"
+		}
+		return status, nil
+	}
+	status.installed = true
+	status.monitorArgs = system.MonitorArgs(definition)
+	if status.monitorArgs == "--config "+shellescape.Quote(monitor.ServiceConfigPath) {
+		// Only root can read it, as it may hold secrets.
+		content, err := target.sudo("cat " + monitor.ServiceConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		file, err := settings.ParseConfigFile(monitor.ServiceConfigPath, []byte(content))
+		if err != nil {
+			return nil, err
+		}
+		// ConfigArgs borrows the options shared by every target.
+		optionsMutex.Lock()
+		status.monitorArgs, err = settings.ConfigArgs(options, file)
+		optionsMutex.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", monitor.ServiceConfigPath, err)
+		}
+	}
+	return status, nil
+}
+
+// Status reports the state of k8ts on every target, flagging those
+// whose monitor options differ from the ones deploy would install.
+func Status(args *Args) error {
+	var mutex sync.Mutex
+	statuses := make(map[*deployJob]*hostStatus)
+	jobs, err := forEachTarget(args, "Checking", func(job *deployJob, target *sshClient) error {
+		status, err := remoteStatus(target, job.paths, args.Monitor.Options)
+		if err != nil {
+			return err
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		statuses[job] = status
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tVERSION\tSERVICE\tDRIFT\tMONITOR OPTIONS")
+	failed := 0
+	for _, job := range jobs {
+		status := statuses[job]
+		if job.err != nil {
+			failed++
+			fmt.Fprintf(w, "%s\tFAILED: %v\n", job.target, job.err)
+			continue
+		}
+		drift := "-"
+		if status.installed {
+			drift = "no"
+			if status.monitorArgs != strings.TrimSpace(job.monitorArgs) {
+				drift = "yes"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", job.target, status.version, status.service, drift, status.monitorArgs)
+	}
+	_ = w.Flush()
+	if failed > 0 {
+		return fmt.Errorf("status unavailable on %d of %d targets", failed, len(jobs))
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package deploy
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/monitor"
+)
+
+const defaultUpgradeVerifyTime = 30
+
+// serviceHealth returns the state of the service and how many times the
+// init system restarted it (empty when it doesn't count restarts).
+func serviceHealth(target *sshClient, system *monitor.InitSystem) (string, string) {
+	return system.State(target.run)
+}
+
+// upgrade replaces the installed binary, keeping the previous one as
+// k8ts.old, restarts the service and puts the previous binary back if the
+// service doesn't stay up for verifyTime.
+func upgrade(target *sshClient, paths remotePaths, binaries *binaryStore, verifyTime time.Duration) error {
+	installPath := paths.binary()
+	oldPath := installPath + ".old"
+	if _, err := target.run("test -e " + installPath); err != nil {
+		return fmt.Errorf("k8ts is not installed, deploy it first")
+	}
+	system, err := monitor.DetectInitSystem(target.run)
+	if err != nil {
+		return err
+	}
+	uploadPath, err := uploadBinary(target, paths, binaries)
+	if err != nil {
+		return err
+	}
+	_, err = target.sudo("cp -p " + installPath + " " + oldPath)
+	if err != nil {
+		_, _ = target.run("rm -f " + uploadPath)
+		return fmt.Errorf("failed to keep the previous binary as '%s': %v", oldPath, err)
+	}
+	_, err = target.sudo("mv " + uploadPath + " " + installPath)
+	if err != nil {
+		return fmt.Errorf("failed to install '%s': %v", installPath, err)
+	}
+	_, err = target.sudo(system.Restart)
+	if err == nil {
+		_, restarts := serviceHealth(target, system)
+		logger.Info("Upgraded. Verifying the service stays up", "seconds", int(verifyTime.Seconds()))
+		time.Sleep(verifyTime)
+		state, after := serviceHealth(target, system)
+		if state == "active" && after == restarts {
+			return nil
+		}
+		err = fmt.Errorf("service is %s after %v (restarts: %s -> %s)", state, verifyTime, restarts, after)
+	}
+	logger.Warn("Upgrade failed, rolling back", "error", err)
+	_, rollbackErr := target.sudo("mv " + oldPath + " " + installPath)
+	if rollbackErr == nil {
+		_, rollbackErr = target.sudo(system.Restart)
+	}
+	if rollbackErr != nil {
+		return fmt.Errorf("upgrade failed (%v) and so did the rollback: %v", err, rollbackErr)
+	}
+	return fmt.Errorf("upgrade failed, rolled back to the previous version: %v", err)
+}
+
+// Upgrade upgrades k8ts on every target, keeping their monitor
+// options.
+func Upgrade(args *Args) error {
+	binaries := newBinaryStore(*args.Binaries, *args.ReleaseURL, *args.ReleaseKey)
+	defer binaries.cleanup()
+	verifyTime := time.Duration(*args.VerifyTime) * time.Second
+	jobs, err := forEachTarget(args, "Upgrading", func(job *deployJob, target *sshClient) error {
+		return upgrade(target, job.paths, binaries, verifyTime)
+	})
+	if err != nil {
+		return err
+	}
+	return summarizeDeploy(jobs, "upgrade")
+}
@@ -0,0 +1,498 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// adminSocketPath is where a running monitor serves its admin API, to root
+// only, for the commands of the node such as `k8ts snapshot` and `k8ts
+// stats`, which asks it rather than reading the state published to
+// StatePath.
+var adminSocketPath = "/run/k8ts/admin.sock"
+
+// adminCallTimeout is how long a request waits for the event loop, which
+// may be waiting to watch again after a failure.
+const adminCallTimeout = 10 * time.Second
+
+// snapshotsDirName is the directory of the tombstone store holding the
+// snapshots of live logs, one directory per snapshot time.
+const snapshotsDirName = "snapshots"
+
+// adminFilters are the filter options which can be changed through the
+// admin API, until the configuration is reloaded.
+var adminFilters = []string{"include-log", "exclude-log", "include-glob", "exclude-glob", "keep-if"}
+
+// watchedFile is a log watched by the monitor, as listed by the admin API.
+type watchedFile struct {
+	File      string `json:"file"`
+	Path      string `json:"path"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	Container string `json:"container"`
+	Policy    string `json:"policy"`
+	Size      int64  `json:"size"`
+}
+
+// adminServer serves the admin API of the monitor on a Unix socket. The
+// requests are handled by the event loop, which owns the state of the
+// monitor and is woken up through a pipe.
+type adminServer struct {
+	path    string
+	mutex   sync.Mutex
+	pending []*adminCall
+	wake    *os.File
+	signal  *os.File
+	server  *http.Server
+}
+
+// adminCall is a request waiting for the event loop.
+type adminCall struct {
+	run  func(m *Monitor)
+	done chan struct{}
+}
+
+// newAdminServer listens on the socket at path, replacing the one left
+// over by a previous monitor.
+func newAdminServer(path string) (*adminServer, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on admin socket %s: %v", path, err)
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	wake, signal, err := os.Pipe()
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	a := &adminServer{path: path, wake: wake, signal: signal}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", a.handleStatus)
+	mux.HandleFunc("/v1/files", a.handleFiles)
+	mux.HandleFunc("/v1/filters", a.handleFilters)
+	mux.HandleFunc("/v1/rules", a.handleRules)
+	mux.HandleFunc("/v1/snapshot", a.handleSnapshot)
+	mux.HandleFunc("/v1/prune", a.handlePrune)
+	a.server = &http.Server{Handler: mux}
+	go func() {
+		err := a.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("Admin API unavailable", "path", path, "error", err)
+		}
+	}()
+	logger.Info("Serving the admin API", "path", path)
+	return a, nil
+}
+
+func (a *adminServer) close() {
+	_ = a.server.Close()
+	_ = os.Remove(a.path)
+}
+
+// call runs fn from the event loop and waits for it, false when the event
+// loop didn't get to it in time, in which case fn is never run.
+func (a *adminServer) call(fn func(m *Monitor)) bool {
+	call := &adminCall{run: fn, done: make(chan struct{})}
+	a.mutex.Lock()
+	a.pending = append(a.pending, call)
+	a.mutex.Unlock()
+	_, _ = a.signal.Write([]byte{0})
+	select {
+	case <-call.done:
+		return true
+	case <-time.After(adminCallTimeout):
+	}
+	a.mutex.Lock()
+	for i, pending := range a.pending {
+		if pending == call {
+			a.pending = append(a.pending[:i], a.pending[i+1:]...)
+			a.mutex.Unlock()
+			return false
+		}
+	}
+	a.mutex.Unlock()
+	// The event loop is running it already.
+	<-call.done
+	return true
+}
+
+// serve runs the pending calls, from the event loop once woken up. Calls
+// are taken one at a time, so that those timing out meanwhile are still
+// pending and can be withdrawn.
+func (a *adminServer) serve(m *Monitor) {
+	drain := make([]byte, 512)
+	_, _ = a.wake.Read(drain)
+	for {
+		a.mutex.Lock()
+		if len(a.pending) == 0 {
+			a.mutex.Unlock()
+			return
+		}
+		call := a.pending[0]
+		a.pending = a.pending[1:]
+		a.mutex.Unlock()
+		call.run(m)
+		close(call.done)
+	}
+}
+
+// reply runs fn from the event loop and writes what it returns as JSON,
+// or the error it fails with.
+func (a *adminServer) reply(w http.ResponseWriter, fn func(m *Monitor) (interface{}, int, error)) {
+	var result interface{}
+	var status int
+	var err error
+	if !a.call(func(m *Monitor) { result, status, err = fn(m) }) {
+		http.Error(w, "the monitor is busy", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// handleStatus returns the state of the monitor, as published to
+// StatePath.
+func (a *adminServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	a.reply(w, func(m *Monitor) (interface{}, int, error) {
+		m.full.current(&m.state)
+		m.state.WatchedFiles = len(m.monitoredFiles)
+		content, err := m.state.encode()
+		return json.RawMessage(content), http.StatusInternalServerError, err
+	})
+}
+
+// handleFiles lists the logs watched, sorted by name.
+func (a *adminServer) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	a.reply(w, func(m *Monitor) (interface{}, int, error) {
+		return m.watchedFiles(), 0, nil
+	})
+}
+
+func (m *Monitor) watchedFiles() []watchedFile {
+	files := make([]watchedFile, 0, len(m.monitoredFiles))
+	for fileName, file := range m.monitoredFiles {
+		name := store.ParseLogName(fileName)
+		watched := watchedFile{File: fileName, Path: file.Name(), Namespace: name.Namespace, Pod: name.Pod,
+			Container: name.Container, Policy: m.policyFor(fileName).name}
+		if stat, err := file.Stat(); err == nil {
+			watched.Size = stat.Size()
+		}
+		files = append(files, watched)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].File < files[j].File
+	})
+	return files
+}
+
+// handleFilters returns the filter options, or changes those given as a
+// JSON object by a PUT, e.g. {"keep-if": "panic"}, until the configuration
+// is reloaded. Include and exclude filters apply to the logs created from
+// then on.
+func (a *adminServer) handleFilters(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+	changes := make(map[string]string)
+	if r.Method == http.MethodPut {
+		err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&changes)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid filters: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	a.reply(w, func(m *Monitor) (interface{}, int, error) {
+		err := m.setFilters(changes)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return m.filters(), 0, nil
+	})
+}
+
+// filters returns the current values of the filter options.
+func (m *Monitor) filters() map[string]string {
+	filters := make(map[string]string, len(adminFilters))
+	for _, option := range m.args.Options {
+		if value, ok := option.Value.(*string); ok && settings.Contains(adminFilters, option.Name) {
+			filters[option.Name] = *value
+		}
+	}
+	return filters
+}
+
+// setFilters changes filter options and applies them, leaving them as they
+// were if they are invalid.
+func (m *Monitor) setFilters(changes map[string]string) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	before := settings.Snapshot(m.args.Options)
+	for name := range changes {
+		if !settings.Contains(adminFilters, name) {
+			return fmt.Errorf("unknown filter '%s', expected one of %s", name, strings.Join(adminFilters, ", "))
+		}
+	}
+	for _, option := range m.args.Options {
+		if value, ok := changes[option.Name]; ok {
+			_ = option.Set(value)
+		}
+	}
+	err := m.configure()
+	if err != nil {
+		settings.Restore(m.args.Options, before)
+		_ = m.configure()
+		return err
+	}
+	for _, change := range settings.Changed(m.args.Options, before) {
+		logger.Info("Filter changed through the admin API", "option", change[0], "old", change[1], "new", change[2])
+	}
+	return nil
+}
+
+// handleSnapshot preserves the current content of the watched log given
+// as file, or of those whose name matches pattern, without waiting for
+// them to be deleted.
+func (a *adminServer) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	fileName := query.Get("file")
+	var pattern *regexp.Regexp
+	if query.Get("pattern") != "" {
+		var err error
+		pattern, err = settings.CompilePattern("pattern", query.Get("pattern"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if fileName == "" {
+		http.Error(w, "no file or pattern given", http.StatusBadRequest)
+		return
+	}
+	var done <-chan snapshotResult
+	count := 0
+	if !a.call(func(m *Monitor) { done, count = m.snapshot(fileName, pattern) }) {
+		http.Error(w, "the monitor is busy", http.StatusServiceUnavailable)
+		return
+	}
+	if count == 0 {
+		http.Error(w, "no watched log matches", http.StatusNotFound)
+		return
+	}
+	// The copies may take a while, they go on if the client gives up.
+	results := make([]snapshotResult, 0, count)
+	for len(results) < count {
+		select {
+		case result := <-done:
+			results = append(results, result)
+		case <-r.Context().Done():
+			return
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].File < results[j].File
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(results)
+}
+
+// snapshotResult is how the snapshot of a log went.
+type snapshotResult struct {
+	File     string `json:"file"`
+	Decision string `json:"decision"`
+	Path     string `json:"path,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// snapshot queues the copies of the current content of the watched log
+// fileName, or of those whose name matches pattern, to the same snapshot
+// directory. It returns the channel telling how every copy went, and how
+// many there are.
+func (m *Monitor) snapshot(fileName string, pattern *regexp.Regexp) (<-chan snapshotResult, int) {
+	selected := make([]string, 0)
+	for name := range m.monitoredFiles {
+		if name == fileName || (pattern != nil && pattern.MatchString(name)) {
+			selected = append(selected, name)
+		}
+	}
+	sort.Strings(selected)
+	// Results are buffered so that copies never wait for a client which
+	// gave up.
+	done := make(chan snapshotResult, len(selected))
+	dir := snapshotDir(TombstonePath, time.Now())
+	count := 0
+	for _, name := range selected {
+		logger.Info("Snapshot requested", "file", name)
+		fileName := name
+		queued := m.snapshotFile(fileName, dir, 0, func(decision *auditRecord, kept *store.Tombstone, end int64) {
+			result := snapshotResult{File: fileName, Decision: decision.Decision, Error: decision.Error}
+			if kept != nil {
+				result.Path, result.Size = kept.Path, kept.Size
+			} else if result.Error == "" {
+				result.Error = fmt.Sprintf("not preserved: %s (%s)", decision.Decision, decision.Rule)
+			}
+			done <- result
+		})
+		if queued {
+			count++
+		}
+	}
+	return done, count
+}
+
+// snapshotFile queues the copy of the watched log fileName from offset from
+// on to dir, through a descriptor of its own so that the offset of the one
+// watched isn't moved. done is told how it went and where the copy ended.
+func (m *Monitor) snapshotFile(fileName string, dir string, from int64,
+	done func(decision *auditRecord, kept *store.Tombstone, end int64)) bool {
+	file := m.monitoredFiles[fileName]
+	fd, err := syscall.Open(fmt.Sprintf("/proc/self/fd/%d", file.Fd()), syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		logger.Error("Failed to open log again for its snapshot", "file", fileName, "error", err)
+		return false
+	}
+	job := &preservation{
+		fileName:     fileName,
+		source:       os.NewFile(uintptr(fd), file.Name()),
+		policy:       m.policyFor(fileName),
+		kube:         m.kube,
+		describePods: *m.args.DescribePods,
+		snapshotDir:  dir,
+		snapshotFrom: from,
+	}
+	job.done = func(decision *auditRecord, kept *store.Tombstone) {
+		done(decision, kept, job.snapshotEnd)
+	}
+	m.copies.run(func() { m.preserve(job) })
+	return true
+}
+
+// snapshotDir is where the snapshots taken at started go.
+func snapshotDir(root string, started time.Time) string {
+	return filepath.Join(root, snapshotsDirName, started.UTC().Format("20060102T150405Z"))
+}
+
+// handlePrune deletes the expired tombstones then those older than
+// older-than and the oldest ones past max-size, if given, as `k8ts prune`
+// does.
+func (a *adminServer) handlePrune(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	query := r.URL.Query()
+	deadline, maxSize, err := pruneLimits(query.Get("older-than"), query.Get("max-size"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Pruning leaves the state of the monitor alone, it needn't wait for
+	// the event loop.
+	pruned, err := pruneTombstones(TombstonePath, deadline, maxSize, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"pruned": pruned})
+}
+
+// adminClient talks to the admin API of the monitor running on this node,
+// which bounds how long requests wait.
+var adminClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", adminSocketPath)
+		},
+	},
+}
+
+// errNoMonitor is returned by adminRequest when no monitor serves the
+// admin API.
+var errNoMonitor = errors.New("no monitor is running")
+
+// adminRequest sends a request to the admin API and decodes its JSON
+// response into result.
+func adminRequest(method string, path string, body interface{}, result interface{}) error {
+	if _, err := os.Stat(adminSocketPath); err != nil {
+		return errNoMonitor
+	}
+	var content io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		content = bytes.NewReader(encoded)
+	}
+	request, err := http.NewRequest(method, "http://k8ts"+path, content)
+	if err != nil {
+		return err
+	}
+	response, err := adminClient.Do(request)
+	if err != nil {
+		// The socket of a monitor which was killed is left behind.
+		if strings.Contains(err.Error(), "connection refused") {
+			return errNoMonitor
+		}
+		return err
+	}
+	defer func() { _ = response.Body.Close() }()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 4096))
+		return fmt.Errorf("monitor: %s", strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
@@ -0,0 +1,135 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/sink"
+)
+
+const defaultAuditLogMaxSize = "10M"
+
+// auditLogBackups is how many rotated audit logs (<path>.1 being the most
+// recent) are kept.
+const auditLogBackups = 5
+
+// The deliveries of the sinks are audited and observed like the decisions
+// of the monitor.
+func init() {
+	sink.SetReporter(func(d sink.Delivery) {
+		result := &auditRecord{File: filepath.Base(d.Path), Decision: "uploaded", Sink: d.Sink, Bytes: d.Bytes}
+		if d.Err != nil {
+			result.Decision, result.Error = "upload failed", d.Err.Error()
+		}
+		audit.record(result, d.Started)
+		telemetry.observe(result, d.Started)
+	})
+}
+
+// auditRecord is a preservation decision, or the result of handing a
+// tombstone to a sink, as written to the audit log.
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	File     string    `json:"file"`
+	Policy   string    `json:"policy,omitempty"`
+	Decision string    `json:"decision"`
+	Rule     string    `json:"rule,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Unparsed int       `json:"unparsedLines,omitempty"`
+	Dropped  int64     `json:"droppedBytes,omitempty"`
+	Duration float64   `json:"durationMs,omitempty"`
+	Sink     string    `json:"sink,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// auditLog appends audit records to a JSON lines file, rotated once it
+// grows past maxSize. Records are dropped while no path is configured.
+type auditLog struct {
+	mutex   sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+var audit = &auditLog{}
+
+// configure switches the audit log to path, disabling it if empty.
+func (a *auditLog) configure(path string, maxSize string) error {
+	size, err := parseSize(maxSize)
+	if err != nil {
+		return fmt.Errorf("invalid --audit-log-max-size: %v", err)
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.maxSize = size
+	if path == a.path {
+		return nil
+	}
+	a.close()
+	a.path = path
+	return nil
+}
+
+func (a *auditLog) close() {
+	if a.file != nil {
+		_ = a.file.Close()
+		a.file = nil
+	}
+}
+
+// record writes r, stamped now. Durations are measured from started,
+// unless it is zero.
+func (a *auditLog) record(r *auditRecord, started time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.path == "" {
+		return
+	}
+	r.Time = time.Now()
+	if !started.IsZero() {
+		r.Duration = float64(r.Time.Sub(started).Nanoseconds()) / 1e6
+	}
+	content, err := json.Marshal(r)
+	if err != nil {
+		logger.Error("Failed to encode audit record", "file", r.File, "error", err)
+		return
+	}
+	content = append(content, '\n')
+	if a.file != nil && a.maxSize > 0 && a.size+int64(len(content)) > a.maxSize {
+		a.rotate()
+	}
+	if a.file == nil {
+		a.file, err = os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+		if err != nil {
+			logger.Error("Failed to open audit log", "path", a.path, "error", err)
+			return
+		}
+		if stat, err := a.file.Stat(); err == nil {
+			a.size = stat.Size()
+		}
+	}
+	n, err := a.file.Write(content)
+	a.size += int64(n)
+	if err != nil {
+		logger.Error("Failed to write audit log", "path", a.path, "error", err)
+	}
+}
+
+// rotate shifts <path>.N to <path>.N+1, dropping the oldest one, and
+// moves the current log to <path>.1.
+func (a *auditLog) rotate() {
+	a.close()
+	for i := auditLogBackups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	err := os.Rename(a.path, a.path+".1")
+	if err != nil {
+		logger.Warn("Failed to rotate audit log", "path", a.path, "error", err)
+	}
+}
@@ -0,0 +1,274 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/badeadan/k8ts/pkg/convert"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+type BenchArgs struct {
+	Dir      *string
+	Logs     *int
+	LogSize  *string
+	LineSize *int
+	Format   *string
+	Timeout  *int
+	Keep     *bool
+	Output   *string
+	Monitor  *Args
+}
+
+// benchResult is what `k8ts bench` measured.
+type benchResult struct {
+	Logs           int            `json:"logs"`
+	LogBytes       int64          `json:"logBytes"`
+	CreateSeconds  float64        `json:"createSeconds"`
+	DeleteSeconds  float64        `json:"deleteSeconds"`
+	EventRate      float64        `json:"eventsPerSecond"`
+	LogRate        float64        `json:"logsPerSecond"`
+	ByteRate       float64        `json:"bytesPerSecond"`
+	TombstoneBytes int64          `json:"tombstoneBytes"`
+	Decisions      map[string]int `json:"decisions"`
+	LostEvents     int            `json:"lostEvents"`
+	Dropped        int            `json:"dropped"`
+	TimedOut       bool           `json:"timedOut,omitempty"`
+	PeakHeap       uint64         `json:"peakHeapBytes"`
+	MaxRSS         int64          `json:"maxRssBytes"`
+}
+
+// Bench runs a monitor, with the monitor options given, against synthetic
+// container logs in a directory of its own: all the logs are created at
+// once then deleted at once, as on a node being drained, and it reports
+// how fast the logs were watched and preserved, how much memory it took and
+// how many events were lost and logs dropped on the way.
+func Bench(args *BenchArgs) error {
+	size, err := parseSize(*args.LogSize)
+	if err != nil || size <= 0 {
+		return fmt.Errorf("invalid --log-size '%s'", *args.LogSize)
+	}
+	if *args.Logs < 1 || *args.LineSize < 1 {
+		return fmt.Errorf("--logs and --line-size must be positive")
+	}
+	dir := *args.Dir
+	if dir == "" {
+		dir, err = ioutil.TempDir("", "k8ts-bench")
+	} else {
+		err = os.MkdirAll(dir, 0755)
+	}
+	if err != nil {
+		return err
+	}
+	if !*args.Keep {
+		defer func() { _ = os.RemoveAll(dir) }()
+	}
+	podsPath := filepath.Join(dir, "pods")
+	KubernetesLogsPath = filepath.Join(dir, "containers")
+	TombstonePath = filepath.Join(dir, "tombstone")
+	StatePath = filepath.Join(dir, "monitor.json")
+	adminSocketPath = filepath.Join(dir, "admin.sock")
+	*args.Monitor.AdminSocket = adminSocketPath
+	auditPath := filepath.Join(dir, "audit.jsonl")
+	*args.Monitor.AuditLog, *args.Monitor.AuditLogMaxSize = auditPath, "0"
+	for _, path := range []string{podsPath, KubernetesLogsPath} {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Generating %d logs of %s in %s\n", *args.Logs, FormatSize(size), dir)
+	content := benchLog(size, *args.LineSize, *args.Format)
+	names := make([]string, *args.Logs)
+	for i := range names {
+		names[i] = fmt.Sprintf("bench-%d_bench_app-%064x.log", i, i)
+		err = ioutil.WriteFile(filepath.Join(podsPath, names[i]), content, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	m, err := New(args.Monitor)
+	if err != nil {
+		return err
+	}
+	// The bench leaves the init system alone.
+	m.container = true
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- m.Run(ctx) }()
+	peakHeap := make(chan uint64)
+	go samplePeakHeap(ctx, peakHeap)
+	deadline := time.Now().Add(time.Duration(*args.Timeout) * time.Second)
+	if !benchWait(deadline, func() bool { return m.health.ready() == nil }) {
+		cancel()
+		return fmt.Errorf("monitor not ready: %v", m.health.ready())
+	}
+
+	result := benchResult{Logs: *args.Logs, LogBytes: int64(len(content)) * int64(*args.Logs)}
+	fmt.Fprintln(os.Stderr, "Creating the logs")
+	started := time.Now()
+	for _, name := range names {
+		err = os.Symlink(filepath.Join(podsPath, name), filepath.Join(KubernetesLogsPath, name))
+		if err != nil {
+			cancel()
+			return err
+		}
+	}
+	// Logs whose event was lost to an overflow of the inotify queue are
+	// watched all the same once the monitor has reconciled.
+	var state *monitorState
+	result.TimedOut = !benchWait(deadline, func() bool {
+		state = loadMonitorState()
+		return state != nil && state.WatchedFiles >= len(names)
+	})
+	result.CreateSeconds = time.Since(started).Seconds()
+	if state != nil && state.EventsProcessed < uint64(len(names)) {
+		result.LostEvents = len(names) - int(state.EventsProcessed)
+	}
+
+	fmt.Fprintln(os.Stderr, "Deleting the logs")
+	started = time.Now()
+	for _, name := range names {
+		_ = os.Remove(filepath.Join(KubernetesLogsPath, name))
+		_ = os.Remove(filepath.Join(podsPath, name))
+	}
+	decided := benchWait(deadline, func() bool { return len(readAuditRecords(auditPath)) >= len(names) })
+	result.TimedOut = result.TimedOut || !decided
+	result.DeleteSeconds = time.Since(started).Seconds()
+	cancel()
+	err = <-stopped
+	if err != nil {
+		return err
+	}
+	result.PeakHeap = <-peakHeap
+
+	records := readAuditRecords(auditPath)
+	result.Decisions = map[string]int{}
+	for _, record := range records {
+		result.Decisions[record.Decision]++
+	}
+	result.Dropped = len(names) - len(records)
+	if result.CreateSeconds > 0 {
+		result.EventRate = float64(len(names)) / result.CreateSeconds
+	}
+	if result.DeleteSeconds > 0 {
+		result.LogRate = float64(len(records)) / result.DeleteSeconds
+		result.ByteRate = float64(result.LogBytes) / result.DeleteSeconds
+	}
+	tombstones, _ := store.FindTombstones(TombstonePath, nil)
+	for _, t := range tombstones {
+		result.TombstoneBytes += t.Size
+	}
+	var usage syscall.Rusage
+	if syscall.Getrusage(syscall.RUSAGE_SELF, &usage) == nil {
+		// Linux counts in kilobytes.
+		result.MaxRSS = int64(usage.Maxrss) * 1024
+	}
+
+	if *args.Output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+	printBench(&result)
+	return nil
+}
+
+// benchLog returns size bytes of log lines of lineSize bytes, in the format
+// of the container runtime: cri or docker.
+func benchLog(size int64, lineSize int, format string) []byte {
+	var content bytes.Buffer
+	base := time.Now().UTC()
+	for i := 0; int64(content.Len()) < size; i++ {
+		timestamp := base.Add(time.Duration(i) * time.Millisecond).Format(time.RFC3339Nano)
+		message := fmt.Sprintf("bench line %d ", i)
+		if len(message) < lineSize {
+			message += strings.Repeat("x", lineSize-len(message))
+		}
+		if format == "docker" {
+			line, _ := json.Marshal(convert.Entry{Log: message + "\n", Stream: "stdout", Time: timestamp})
+			content.Write(line)
+			content.WriteByte('\n')
+		} else {
+			fmt.Fprintf(&content, "%s stdout F %s\n", timestamp, message)
+		}
+	}
+	return content.Bytes()
+}
+
+// benchWait polls done until it returns true, telling whether it did
+// before deadline.
+func benchWait(deadline time.Time, done func() bool) bool {
+	for !done() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// samplePeakHeap sends the peak of the heap in use until ctx is cancelled.
+func samplePeakHeap(ctx context.Context, peak chan<- uint64) {
+	var stats runtime.MemStats
+	highest := uint64(0)
+	for {
+		runtime.ReadMemStats(&stats)
+		if stats.HeapInuse > highest {
+			highest = stats.HeapInuse
+		}
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			peak <- highest
+			return
+		}
+	}
+}
+
+// readAuditRecords returns the complete records of the decisions in the
+// audit log at path, leaving out those of uploads to sinks.
+func readAuditRecords(path string) []auditRecord {
+	content, _ := ioutil.ReadFile(path)
+	var records []auditRecord
+	for _, line := range bytes.SplitAfter(content, []byte("\n")) {
+		var record auditRecord
+		if bytes.HasSuffix(line, []byte("\n")) && json.Unmarshal(line, &record) == nil && record.Sink == "" {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func printBench(result *benchResult) {
+	fmt.Printf("Logs:        %d x %s (%s)\n", result.Logs, FormatSize(result.LogBytes/int64(result.Logs)),
+		FormatSize(result.LogBytes))
+	fmt.Printf("Created:     %d logs watched in %.2fs (%.0f events/s, %d lost)\n", result.Logs,
+		result.CreateSeconds, result.EventRate, result.LostEvents)
+	fmt.Printf("Deleted:     %d logs preserved in %.2fs (%.1f logs/s, %s/s)\n", result.Logs-result.Dropped,
+		result.DeleteSeconds, result.LogRate, FormatSize(int64(result.ByteRate)))
+	fmt.Printf("Tombstones:  %s\n", FormatSize(result.TombstoneBytes))
+	decisions := make([]string, 0, len(result.Decisions))
+	for _, decision := range []string{"kept", "skipped", "dropped", "metadata-only", "failed"} {
+		if count := result.Decisions[decision]; count > 0 {
+			decisions = append(decisions, fmt.Sprintf("%s %d", decision, count))
+		}
+	}
+	fmt.Printf("Decisions:   %s\n", strings.Join(decisions, ", "))
+	fmt.Printf("Dropped:     %d logs without decision\n", result.Dropped)
+	fmt.Printf("Memory:      peak heap %s, max RSS %s\n", FormatSize(int64(result.PeakHeap)),
+		FormatSize(result.MaxRSS))
+	if result.TimedOut {
+		fmt.Println("Timed out before the monitor caught up, raise --timeout")
+	}
+}
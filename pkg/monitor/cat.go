@@ -0,0 +1,118 @@
+package monitor
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/convert"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+type CatArgs struct {
+	Filter *FilterArgs
+	Files  *[]string
+	Format *string
+	Prefix *string
+}
+
+// Cat prints tombstones selected either explicitly or through filters.
+// Tombstones of the same container (rotations, restarts) are printed
+// together, oldest first, their lines prefixed with the container they
+// come from with --prefix.
+func Cat(args *CatArgs) error {
+	var tombstones []store.Tombstone
+	if len(*args.Files) > 0 {
+		for _, path := range *args.Files {
+			stat, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			tombstones = append(tombstones, store.DescribeTombstone(path, stat))
+		}
+	} else {
+		if *args.Filter.pod == "" && *args.Filter.namespace == "" {
+			return errors.New("select tombstones with --file, --pod or --namespace")
+		}
+		filter, err := newTombstoneFilter(args.Filter)
+		if err != nil {
+			return err
+		}
+		tombstones, err = store.FindTombstones(*args.Filter.dir, filter)
+		if err != nil {
+			return err
+		}
+	}
+	output := bufio.NewWriter(os.Stdout)
+	defer func() { _ = output.Flush() }()
+	for _, group := range groupByContainer(tombstones) {
+		for _, t := range group {
+			destination := io.Writer(output)
+			if prefix := linePrefix(*args.Prefix, t.Pod, t.Container); prefix != "" {
+				destination = &prefixWriter{writer: output, prefix: []byte(prefix)}
+			}
+			err := catTombstone(destination, t.Path, *args.Format)
+			if err != nil {
+				return fmt.Errorf("failed to print '%s': %v", t.Path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// groupByContainer keeps the order of tombstones but moves all tombstones
+// of a container next to its first one.
+func groupByContainer(tombstones []store.Tombstone) [][]store.Tombstone {
+	groups := make([][]store.Tombstone, 0)
+	index := make(map[string]int)
+	for _, t := range tombstones {
+		key := t.Namespace + "/" + t.Pod + "/" + t.Container
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], t)
+	}
+	return groups
+}
+
+func catTombstone(destination io.Writer, path string, format string) error {
+	source, err := store.OpenTombstone(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = source.Close() }()
+	if format == "raw" {
+		_, err = io.Copy(destination, source)
+		return err
+	}
+	unrecognized := 0
+	assembler := convert.Assembler{}
+	scanner := convert.NewLineReader(source)
+	for scanner.Scan() {
+		entry, err := convert.ParseRecord(scanner.Bytes())
+		if err != nil {
+			unrecognized++
+			_, err = fmt.Fprintf(destination, "%s\n", scanner.Bytes())
+		} else if entry, complete := assembler.Add(entry); complete {
+			err = convert.RenderRecord(destination, format, entry)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, entry := range assembler.Flush() {
+		if err := convert.RenderRecord(destination, format, entry); err != nil {
+			return err
+		}
+	}
+	if unrecognized > 0 {
+		logger.Warn("Unrecognized lines printed as is", "path", path, "lines", unrecognized)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,212 @@
+package monitor
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/convert"
+)
+
+// cgroupRoot is where the cgroup hierarchies are mounted, the v1
+// controllers in directories of their own.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupLimits are the memory and CPU limits of the cgroup of the
+// monitor, e.g. the resources of the k8ts container of the DaemonSet. Zero
+// when unlimited.
+type cgroupLimits struct {
+	memory int64
+	cpus   float64
+}
+
+// Past this, a v1 memory limit is the default one: unlimited.
+const unlimitedMemory = 1 << 62
+
+// readCgroupLimits finds the cgroup of the monitor in /proc/self/cgroup and
+// reads its limits, from cgroup v1 controllers or from cgroup v2.
+func readCgroupLimits() cgroupLimits {
+	var limits cgroupLimits
+	content, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return limits
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			switch controller {
+			case "memory":
+				if memory, ok := readCgroupValue("memory", fields[2], "memory.limit_in_bytes"); ok {
+					limits.memory = memory
+				}
+			case "cpu":
+				quota, ok := readCgroupValue("cpu", fields[2], "cpu.cfs_quota_us")
+				period, _ := readCgroupValue("cpu", fields[2], "cpu.cfs_period_us")
+				if ok && quota > 0 && period > 0 {
+					limits.cpus = float64(quota) / float64(period)
+				}
+			case "":
+				// cgroup v2, whose files only exist when the
+				// controllers are enabled.
+				if memory, ok := readCgroupValue("", fields[2], "memory.max"); ok && limits.memory == 0 {
+					limits.memory = memory
+				}
+				if cpus := readCPUMax(fields[2]); cpus > 0 && limits.cpus == 0 {
+					limits.cpus = cpus
+				}
+			}
+		}
+	}
+	if limits.memory >= unlimitedMemory {
+		limits.memory = 0
+	}
+	return limits
+}
+
+// cgroupFile returns the path of a file of the cgroup at path in the
+// hierarchy of controller. Within a container, the hierarchy may be
+// mounted from the cgroup of the container rather than from its root.
+func cgroupFile(controller string, path string, name string) string {
+	file := filepath.Join(cgroupRoot, controller, path, name)
+	if _, err := os.Stat(file); err != nil {
+		return filepath.Join(cgroupRoot, controller, name)
+	}
+	return file
+}
+
+// readCgroupValue reads a number from a file of a cgroup, false when
+// missing or "max".
+func readCgroupValue(controller string, path string, name string) (int64, bool) {
+	content, err := ioutil.ReadFile(cgroupFile(controller, path, name))
+	if err != nil {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	return value, err == nil
+}
+
+// readCPUMax reads the CPUs of the cgroup v2 at path from the quota and
+// period of its cpu.max, 0 when unlimited.
+func readCPUMax(path string) float64 {
+	content, err := ioutil.ReadFile(cgroupFile("", path, "cpu.max"))
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) != 2 {
+		return 0
+	}
+	quota, err := strconv.ParseInt(fields[0], 10, 64)
+	period, periodErr := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || periodErr != nil || quota <= 0 || period <= 0 {
+		return 0
+	}
+	return float64(quota) / float64(period)
+}
+
+// copyMemory is about what a copy holds on to while converting a log: its
+// read and write buffers and the longest line it keeps.
+func copyMemory() int64 {
+	return int64(2*convert.BufferSize + convert.MaxRetainedLine)
+}
+
+// fitCopies returns how many tombstones may be written at once within the
+// limits: a copy per CPU, and copies taking a quarter of the memory at
+// most, the rest being left to the monitor, its caches and the spikes of
+// huge lines.
+func (l cgroupLimits) fitCopies(copies int) int {
+	if l.cpus > 0 {
+		if cpus := int(math.Ceil(l.cpus)); cpus < copies {
+			copies = cpus
+		}
+	}
+	if l.memory > 0 {
+		if fit := int(l.memory / 4 / copyMemory()); fit < copies {
+			copies = fit
+		}
+	}
+	if copies < 1 {
+		copies = 1
+	}
+	return copies
+}
+
+// sizeBuffers shrinks the buffers logs are read and written through to the
+// memory limit, before any is allocated.
+func (l cgroupLimits) sizeBuffers() {
+	if l.memory == 0 {
+		return
+	}
+	convert.BufferSize = int(clamp(l.memory/4096, 4*1024, convert.DefaultBufferSize))
+	convert.MaxRetainedLine = int(clamp(l.memory/256, 64*1024, convert.DefaultMaxRetainedLine))
+}
+
+func clamp(value int64, min int64, max int64) int64 {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
+
+// memoryPressureRatio is the share of the memory limit past which copies
+// are written one at a time until the memory of the monitor goes down.
+const memoryPressureRatio = 0.75
+
+// memoryPressureInterval is how long the memory of the monitor is measured
+// for, reading it stopping the world for a moment.
+const memoryPressureInterval = 100 * time.Millisecond
+
+// memoryPressure tells when the monitor gets close to its memory limit.
+type memoryPressure struct {
+	mutex     sync.Mutex
+	limit     int64
+	used      int64
+	measured  time.Time
+	pressured bool
+}
+
+func (p *memoryPressure) configure(limit int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.limit = limit
+}
+
+// high tells whether the memory the monitor got from the system, and
+// hasn't given back, is past memoryPressureRatio of its limit.
+func (p *memoryPressure) high() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.limit == 0 {
+		return false
+	}
+	if time.Since(p.measured) < memoryPressureInterval {
+		return p.pressured
+	}
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	p.used, p.measured = int64(stats.Sys-stats.HeapReleased), time.Now()
+	pressured := float64(p.used) > float64(p.limit)*memoryPressureRatio
+	if pressured != p.pressured {
+		if pressured {
+			logger.Warn("Close to the memory limit, writing tombstones one at a time", "used", FormatSize(p.used),
+				"limit", FormatSize(p.limit))
+		} else {
+			logger.Info("Memory back under the limit", "used", FormatSize(p.used), "limit", FormatSize(p.limit))
+		}
+		p.pressured = pressured
+	}
+	return p.pressured
+}
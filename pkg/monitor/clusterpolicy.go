@@ -0,0 +1,308 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"gopkg.in/yaml.v2"
+)
+
+// K8tsPolicy resources hold policies for every node of a cluster, with the
+// settings of the `policies` of the configuration file as spec.
+const k8tsPoliciesPath = "/apis/k8ts.io/v1alpha1/k8tspolicies"
+
+const PolicyCRD = `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: k8tspolicies.k8ts.io
+  labels:
+    app.kubernetes.io/name: k8ts
+spec:
+  group: k8ts.io
+  scope: Cluster
+  names:
+    kind: K8tsPolicy
+    listKind: K8tsPolicyList
+    plural: k8tspolicies
+    singular: k8tspolicy
+  versions:
+    - name: v1alpha1
+      served: true
+      storage: true
+      schema:
+        openAPIV3Schema:
+          type: object
+          properties:
+            spec:
+              type: object
+              properties:
+                namespaces:
+                  type: array
+                  items:
+                    type: string
+                pods:
+                  type: array
+                  items:
+                    type: string
+                labels:
+                  type: string
+                include-log:
+                  type: string
+                exclude-log:
+                  type: string
+                include-glob:
+                  type: string
+                exclude-glob:
+                  type: string
+                keep-if:
+                  type: string
+                skip-conversion:
+                  type: boolean
+                output-format:
+                  type: string
+                  enum: ["text", "ndjson", "csv", "tsv"]
+                output-template:
+                  type: string
+                collector:
+                  type: string
+                sinks:
+                  type: array
+                  items:
+                    type: object
+                    required: ["kind"]
+                    additionalProperties:
+                      type: string
+                retention:
+                  type: string
+                multiline-start:
+                  type: string
+                strip-ansi:
+                  type: boolean
+                time-format:
+                  type: string
+                  enum: ["original", "rfc3339", "rfc3339-millis", "rfc3339-micros", "rfc3339-nano"]
+                time-zone:
+                  type: string
+                extract:
+                  type: string
+      additionalPrinterColumns:
+        - name: Namespaces
+          type: string
+          jsonPath: .spec.namespaces
+        - name: Keep-If
+          type: string
+          jsonPath: .spec.keep-if
+        - name: Retention
+          type: string
+          jsonPath: .spec.retention`
+
+// clusterPolicy is a K8tsPolicy resource, named after the policy.
+type clusterPolicy struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Spec json.RawMessage `json:"spec"`
+}
+
+// config reads the spec, JSON being YAML.
+func (c *clusterPolicy) config() (policyConfig, error) {
+	config := policyConfig{}
+	if len(c.Spec) > 0 {
+		err := yaml.Unmarshal(c.Spec, &config)
+		if err != nil {
+			return config, fmt.Errorf("invalid K8tsPolicy '%s': %v", c.Metadata.Name, err)
+		}
+	}
+	config.Name = c.Metadata.Name
+	return config, nil
+}
+
+// policyWatch keeps the K8tsPolicy resources of the cluster, waking the
+// event loop up through a pipe when they change.
+type policyWatch struct {
+	kube     *kubeClient
+	mutex    sync.Mutex
+	policies map[string]policyConfig
+	wake     *os.File
+	signal   *os.File
+}
+
+func newPolicyWatch(kube *kubeClient) (*policyWatch, error) {
+	if kube == nil {
+		return nil, fmt.Errorf("--cluster-policies needs --kube-api")
+	}
+	wake, signal, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	w := &policyWatch{kube: kube, wake: wake, signal: signal}
+	go w.run()
+	return w, nil
+}
+
+// run lists the policies then watches them, listing them again whenever
+// the watch breaks.
+func (w *policyWatch) run() {
+	backoff := time.Second
+	for {
+		list := struct {
+			Metadata struct {
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"metadata"`
+			Items []clusterPolicy `json:"items"`
+		}{}
+		err := w.kube.get(k8tsPoliciesPath, &list)
+		if err != nil {
+			logger.Warn("Failed to list K8tsPolicy resources", "retry", backoff, "error", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+		policies := make(map[string]policyConfig)
+		for _, item := range list.Items {
+			w.add(policies, &item)
+		}
+		w.update(policies)
+		version := list.Metadata.ResourceVersion
+		for version != "" {
+			version, err = w.watch(version)
+			if err != nil {
+				logger.Warn("K8tsPolicy watch interrupted", "error", err)
+			}
+		}
+	}
+}
+
+// watch streams the changes since version, returning the last version
+// seen or "" when the policies must be listed again.
+func (w *policyWatch) watch(version string) (string, error) {
+	stream, err := w.kube.stream(fmt.Sprintf("%s?watch=true&resourceVersion=%s&timeoutSeconds=%d",
+		k8tsPoliciesPath, url.QueryEscape(version), int(podWatchTimeout.Seconds())))
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = stream.Close() }()
+	decoder := json.NewDecoder(stream)
+	for {
+		event := struct {
+			Type   string        `json:"type"`
+			Object clusterPolicy `json:"object"`
+		}{}
+		err = decoder.Decode(&event)
+		if err != nil {
+			if err == io.EOF {
+				return version, nil
+			}
+			return "", err
+		}
+		w.mutex.Lock()
+		policies := make(map[string]policyConfig, len(w.policies))
+		for name, config := range w.policies {
+			policies[name] = config
+		}
+		w.mutex.Unlock()
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			w.add(policies, &event.Object)
+		case "DELETED":
+			delete(policies, event.Object.Metadata.Name)
+		case "ERROR":
+			return "", nil
+		default:
+			continue
+		}
+		version = event.Object.Metadata.ResourceVersion
+		w.update(policies)
+	}
+}
+
+// add records a policy, a broken one being left out.
+func (w *policyWatch) add(policies map[string]policyConfig, item *clusterPolicy) {
+	config, err := item.config()
+	if err != nil {
+		logger.Error("K8tsPolicy ignored", "policy", item.Metadata.Name, "error", err)
+		delete(policies, item.Metadata.Name)
+		return
+	}
+	policies[item.Metadata.Name] = config
+}
+
+func (w *policyWatch) update(policies map[string]policyConfig) {
+	w.mutex.Lock()
+	w.policies = policies
+	w.mutex.Unlock()
+	_, _ = w.signal.Write([]byte{0})
+}
+
+// take returns the policies, sorted by name, once the event loop was
+// woken up.
+func (w *policyWatch) take() []policyConfig {
+	drain := make([]byte, 512)
+	_, _ = w.wake.Read(drain)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	configs := make([]policyConfig, 0, len(w.policies))
+	for _, config := range w.policies {
+		configs = append(configs, config)
+	}
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].Name < configs[j].Name
+	})
+	return configs
+}
+
+// withClusterPolicies puts the K8tsPolicy resources ahead of the policies
+// of the configuration file, which they replace when they have the same
+// name. Policies which can't be compiled are left out rather than holding
+// the others back.
+func withClusterPolicies(cluster []policyConfig, configs []policyConfig, args *Args) []policyConfig {
+	merged := make([]policyConfig, 0, len(cluster)+len(configs))
+	names := make(map[string]bool)
+	for _, config := range cluster {
+		if config.Name == defaultPolicyName {
+			logger.Error("K8tsPolicy ignored", "policy", config.Name, "error", "reserved name")
+			continue
+		}
+		if _, err := compilePolicy(config, args); err != nil {
+			logger.Error("K8tsPolicy ignored", "policy", config.Name, "error", err)
+			continue
+		}
+		merged = append(merged, config)
+		names[config.Name] = true
+	}
+	for _, config := range configs {
+		if names[config.Name] {
+			logger.Warn("Policy of the configuration file replaced by a K8tsPolicy", "policy", config.Name)
+			continue
+		}
+		merged = append(merged, config)
+	}
+	return merged
+}
+
+// applyClusterPolicies reconfigures the monitor with new K8tsPolicy
+// resources.
+func (m *Monitor) applyClusterPolicies(cluster []policyConfig) {
+	previous, policyConfig := m.clusterPolicies, m.policyConfig
+	m.clusterPolicies = cluster
+	err := m.configure()
+	if err != nil {
+		m.clusterPolicies = previous
+		logger.Error("K8tsPolicy resources not applied", "error", err)
+		return
+	}
+	if policyConfig != m.policyConfig {
+		logger.Info("Policies changed", "policies", describePolicies(m.policies))
+	}
+}
@@ -0,0 +1,166 @@
+package monitor
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/akamensky/argparse"
+	"github.com/badeadan/k8ts/internal/settings"
+)
+
+func newMonitorParser() (*argparse.Parser, *Args) {
+	parser := argparse.NewParser("k8ts", "")
+	args := AttachArgs(settings.New(), parser.NewCommand("monitor", ""))
+	return parser, args
+}
+
+// assertRoundTrip checks that the arguments and the configuration file
+// rendered for the options of args give them the same values.
+func assertRoundTrip(t *testing.T, args *Args) {
+	t.Helper()
+	want := settings.Snapshot(args.Options)
+
+	parser, parsed := newMonitorParser()
+	err := parser.Parse(append([]string{"k8ts", "monitor"}, settings.ArgList(args.Options)...))
+	if err != nil {
+		t.Fatalf("parsing %q: %v", settings.ArgList(args.Options), err)
+	}
+	assertValues(t, "arguments", parsed, want)
+
+	content, err := settings.MarshalConfig(args.Options, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := settings.ParseConfigFile("config.yaml", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, loaded := newMonitorParser()
+	err = settings.Apply(loaded.Options, file)
+	if err != nil {
+		t.Fatalf("applying %s: %v", content, err)
+	}
+	assertValues(t, "configuration file", loaded, want)
+}
+
+func assertValues(t *testing.T, source string, args *Args, want []interface{}) {
+	t.Helper()
+	for i, got := range settings.Snapshot(args.Options) {
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("%s: --%s is %#v, want %#v", source, args.Options[i].Name, got, want[i])
+		}
+	}
+}
+
+func TestMonitorArgsRoundTrip(t *testing.T) {
+	_, args := newMonitorParser()
+	for i, option := range args.Options {
+		option.Reset()
+		switch value := option.Value.(type) {
+		case *string:
+			*value = fmt.Sprintf("value '%d' with spaces", i)
+			for _, choice := range option.Choices {
+				if choice != *value && choice != option.Fallback {
+					*value = choice
+					break
+				}
+			}
+		case *bool:
+			*value = true
+		case *int:
+			*value, _ = option.Fallback.(int)
+			*value += i + 1
+		case *[]string:
+			*value = []string{fmt.Sprintf("item %d", i), "-"}
+		}
+	}
+	assertRoundTrip(t, args)
+}
+
+func TestMonitorArgsClearedDefaults(t *testing.T) {
+	_, args := newMonitorParser()
+	cleared := 0
+	for _, option := range args.Options {
+		option.Reset()
+		switch value := option.Value.(type) {
+		case *string:
+			if *value != "" && option.Choices == nil {
+				*value = ""
+				cleared++
+			}
+		case *int:
+			if *value != 0 {
+				*value = 0
+				cleared++
+			}
+		}
+	}
+	if cleared == 0 {
+		t.Fatal("no option with a default to clear")
+	}
+	assertRoundTrip(t, args)
+}
+
+func TestMonitorArgsDefaults(t *testing.T) {
+	_, args := newMonitorParser()
+	for _, option := range args.Options {
+		option.Reset()
+	}
+	if rendered := settings.ArgList(args.Options); len(rendered) != 0 {
+		t.Errorf("options left to their default give %q", rendered)
+	}
+	assertRoundTrip(t, args)
+}
+
+func TestSinksRoundTrip(t *testing.T) {
+	archive := "directory:path=/mnt/archive,mode=0600"
+	collector := "collector:url=https://collector.example.com:7443,ca=/etc/k8ts/ca.pem"
+	want := []string{archive, collector}
+
+	// Flags, and the arguments and configuration file rendered for them.
+	parser, args := newMonitorParser()
+	err := parser.Parse([]string{"k8ts", "monitor", "--sink", archive, "--sink", collector})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*args.Sinks, want) {
+		t.Fatalf("flags give sinks %q", *args.Sinks)
+	}
+	assertRoundTrip(t, args)
+
+	// A single sink is a string of the configuration file.
+	file, err := settings.ParseConfigFile("config.yaml", []byte("sink: "+collector+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, args = newMonitorParser()
+	err = settings.Apply(args.Options, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*args.Sinks, []string{collector}) {
+		t.Errorf("configuration file gives sinks %q", *args.Sinks)
+	}
+
+	// Several sinks are given one per line in the environment.
+	for value, want := range map[string][]string{
+		collector:                         {collector},
+		archive + "\n" + collector + "\n": want,
+	} {
+		t.Setenv(settings.EnvPrefix+"SINK", value)
+		options := settings.New()
+		parser := argparse.NewParser("k8ts", "")
+		args := AttachArgs(options, parser.NewCommand("monitor", ""))
+		err = parser.Parse([]string{"k8ts", "monitor"})
+		if err == nil {
+			err = options.Resolve("")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*args.Sinks, want) {
+			t.Errorf("environment %q gives sinks %q", value, *args.Sinks)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package monitor
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/badeadan/k8ts/internal/logger"
+)
+
+// EnterContainerMode prepares the monitor to be the main process of a
+// container, as in the DaemonSet generated by `k8ts deploy k8s`: logs go
+// to stdout as JSON for the container runtime to collect, SIGTERM stops it
+// once queued copies are done and, when it runs as PID 1, orphaned
+// children are reaped.
+func EnterContainerMode(m *Monitor) {
+	m.container = true
+	logger.SetOutput(os.Stdout)
+	stop := make(chan os.Signal, 1)
+	// PID 1 gets no default handler, without this SIGTERM is ignored and
+	// the kubelet waits for the grace period before killing the pod.
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-stop
+		// Pending collector uploads are spooled and resumed on restart,
+		// queued copies are finished as their logs are gone from the node.
+		logger.Info("Stopping", "signal", sig)
+		m.copies.wait()
+		os.Exit(0)
+	}()
+	if os.Getpid() == 1 {
+		go reapChildren()
+	}
+}
+
+// reapChildren waits for every process reparented to k8ts so that they
+// don't linger as zombies. The monitor runs no commands of its own, so
+// there is no exec.Cmd whose exit status this could steal.
+func reapChildren() {
+	children := make(chan os.Signal, 1)
+	signal.Notify(children, syscall.SIGCHLD)
+	for range children {
+		for {
+			var status syscall.WaitStatus
+			pid, err := syscall.Wait4(-1, &status, syscall.WNOHANG, nil)
+			if pid <= 0 || err != nil {
+				break
+			}
+			logger.Debug("Reaped child", "pid", pid, "status", status.ExitStatus())
+		}
+	}
+}
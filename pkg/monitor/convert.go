@@ -0,0 +1,220 @@
+package monitor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/badeadan/k8ts/internal/identity"
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/convert"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// Formats of the tombstones written by the monitor, unless conversion is
+// skipped.
+const (
+	outputText   = "text"
+	outputNDJSON = "ndjson"
+)
+
+// defaultOutputFormat renders text tombstones the way `k8ts cat` and
+// `k8ts grep` parse them back.
+const defaultOutputFormat = "{{.Time}} {{.Stream}} {{.Log}}"
+
+var defaultOutputTemplate = template.Must(compileOutputTemplate(defaultOutputFormat))
+
+// templateEntry is what --output-template renders: a log line and the
+// container it comes from.
+type templateEntry struct {
+	Time      string
+	Stream    string
+	Log       string
+	Pod       string
+	Namespace string
+	Container string
+	Node      string
+}
+
+// compileOutputTemplate parses an --output-template and tries it out, as
+// unknown fields only show up when it is executed.
+func compileOutputTemplate(text string) (*template.Template, error) {
+	format, err := template.New("output").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output template: %v", err)
+	}
+	err = format.Execute(ioutil.Discard, templateEntry{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid output template: %v", err)
+	}
+	return format, nil
+}
+
+// renderTemplate writes entry, from the container of context, as a line of
+// text. The default template is written without going through
+// text/template, which takes most of the conversion time otherwise.
+func renderTemplate(destination *bufio.Writer, format *template.Template, entry convert.Entry, context *templateEntry) error {
+	if format == defaultOutputTemplate {
+		_, _ = destination.WriteString(entry.Time)
+		_ = destination.WriteByte(' ')
+		_, _ = destination.WriteString(entry.Stream)
+		_ = destination.WriteByte(' ')
+		_, _ = destination.WriteString(entry.Log)
+		return destination.WriteByte('\n')
+	}
+	context.Time, context.Stream, context.Log = entry.Time, entry.Stream, entry.Log
+	err := format.Execute(destination, context)
+	if err != nil {
+		return err
+	}
+	return destination.WriteByte('\n')
+}
+
+// ndjsonRecord is a log line in the normalized schema of --output-format
+// ndjson, whatever the format of the container runtime, for analytics
+// tools to ingest tombstones as they are.
+type ndjsonRecord struct {
+	TS        string `json:"ts"`
+	Stream    string `json:"stream"`
+	Msg       string `json:"msg"`
+	Pod       string `json:"pod"`
+	Namespace string `json:"namespace"`
+	Container string `json:"container"`
+	Node      string `json:"node"`
+	Unparsed  bool   `json:"unparsed,omitempty"`
+}
+
+// convertToNDJSON renders every line of source as an ndjsonRecord of the
+// container of name. Lines which can't be parsed are kept as the message
+// of a record marked unparsed, and counted. Lines are rewritten then
+// joined into records starting with multiline when given, which are
+// redacted.
+func convertToNDJSON(destination io.Writer, source io.Reader, multiline *regexp.Regexp, rewrite convert.Rewrite, name store.LogName) (int, error) {
+	node := identity.Node()
+	output := convert.NewPooledWriter(destination)
+	defer convert.ReleaseWriter(output)
+	encoder := json.NewEncoder(output)
+	encoder.SetEscapeHTML(false)
+	unparsed := 0
+	assembler := convert.Assembler{Start: multiline}
+	write := func(entry convert.Entry) error {
+		return encoder.Encode(&ndjsonRecord{TS: entry.Time, Stream: entry.Stream, Msg: rewrite.Redact(entry.Log),
+			Pod: name.Pod, Namespace: name.Namespace, Container: name.Container, Node: node})
+	}
+	scanner := convert.NewLineReader(source)
+	defer scanner.Release()
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		entry, err := convert.ParseRecord(line)
+		if err != nil {
+			unparsed++
+			err = encoder.Encode(&ndjsonRecord{Msg: rewrite.Redact(string(line)), Unparsed: true,
+				Pod: name.Pod, Namespace: name.Namespace, Container: name.Container, Node: node})
+		} else {
+			rewrite.Apply(&entry)
+			if entry, complete := assembler.Add(entry); complete {
+				err = write(entry)
+			}
+		}
+		if err != nil {
+			logger.Error("Write failed", "error", err)
+			return unparsed, err
+		}
+	}
+	for _, entry := range assembler.Flush() {
+		if err := write(entry); err != nil {
+			return unparsed, err
+		}
+	}
+	reportUnparsed(name, unparsed)
+	if err := scanner.Err(); err != nil {
+		return unparsed, err
+	}
+	return unparsed, output.Flush()
+}
+
+// unparsedPrefix marks the lines of text tombstones which were copied as
+// they are, not being in a log format k8ts knows.
+const unparsedPrefix = "[unparsed] "
+
+func reportUnparsed(name store.LogName, unparsed int) {
+	if unparsed > 0 {
+		logger.Warn("Log lines kept as they are, their format is unknown", "namespace", name.Namespace,
+			"pod", name.Pod, "container", name.Container, "lines", unparsed)
+	}
+}
+
+type ConvertArgs struct {
+	Files  *[]string
+	Output *string
+	Format *string
+}
+
+// convert runs the conversion used for tombstones on arbitrary files (or
+// stdin) so logs copied off a node can be read the same way.
+func RunConvert(args *ConvertArgs) error {
+	if len(*args.Files) == 0 {
+		source, err := store.Decompress(os.Stdin)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = source.Close() }()
+		output := bufio.NewWriter(os.Stdout)
+		defer func() { _ = output.Flush() }()
+		return convert.ConvertLog(output, source, *args.Format)
+	}
+	if *args.Output != "" {
+		err := os.MkdirAll(*args.Output, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	for _, path := range *args.Files {
+		err := convertFile(path, *args.Output, *args.Format)
+		if err != nil {
+			return fmt.Errorf("failed to convert '%s': %v", path, err)
+		}
+	}
+	return nil
+}
+
+func convertFile(path string, outputDir string, format string) error {
+	source, err := store.OpenTombstone(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = source.Close() }()
+	if outputDir == "" {
+		output := bufio.NewWriter(os.Stdout)
+		err = convert.ConvertLog(output, source, format)
+		if flushErr := output.Flush(); err == nil {
+			err = flushErr
+		}
+		return err
+	}
+	name := filepath.Base(path)
+	for _, suffix := range []string{".gz", ".zst"} {
+		name = strings.TrimSuffix(name, suffix)
+	}
+	destination, err := os.OpenFile(filepath.Join(outputDir, name),
+		os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	output := bufio.NewWriter(destination)
+	err = convert.ConvertLog(output, source, format)
+	if flushErr := output.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/badeadan/k8ts/pkg/convert"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// convertedLog mixes the formats a tombstone may hold with lines in none.
+var convertedLog = strings.Join([]string{
+	`{"log":"GET /a 200 12ms\n","stream":"stdout","time":"2024-05-01T10:00:00.1Z"}`,
+	"garbage token=secret",
+	"2024-05-01T10:00:00.2Z stdout P GET /b ",
+	"2024-05-01T10:00:00.3Z stdout F 500 80ms",
+	"",
+	"2024-05-01T10:00:00.4Z stderr F token=secret",
+}, "\n") + "\n"
+
+var convertedName = store.LogName{Pod: "web", Namespace: "shop", Container: "app"}
+
+func newTestRewrite(t *testing.T) convert.Rewrite {
+	t.Helper()
+	redaction, err := convert.NewRedaction("token", `token=\S+`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrite, err := convert.NewRewrite(false, "", "", []convert.Redaction{redaction})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rewrite
+}
+
+func TestConvertToNDJSON(t *testing.T) {
+	t.Setenv("NODE_NAME", "node-a")
+	var output bytes.Buffer
+	unparsed, err := convertToNDJSON(&output, strings.NewReader(convertedLog), nil, newTestRewrite(t), convertedName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unparsed != 2 {
+		t.Errorf("%d lines unparsed, want 2", unparsed)
+	}
+	var got []ndjsonRecord
+	decoder := json.NewDecoder(&output)
+	for decoder.More() {
+		var record ndjsonRecord
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, record)
+	}
+	record := func(ts, stream, msg string, unparsed bool) ndjsonRecord {
+		return ndjsonRecord{TS: ts, Stream: stream, Msg: msg, Pod: "web", Namespace: "shop",
+			Container: "app", Node: "node-a", Unparsed: unparsed}
+	}
+	want := []ndjsonRecord{
+		record("2024-05-01T10:00:00.1Z", "stdout", "GET /a 200 12ms", false),
+		record("", "", "garbage [REDACTED:token]", true),
+		record("2024-05-01T10:00:00.2Z", "stdout", "GET /b 500 80ms", false),
+		record("", "", "", true),
+		record("2024-05-01T10:00:00.4Z", "stderr", "[REDACTED:token]", false),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d records, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("record %d is %+v, want %+v", i+1, got[i], want[i])
+		}
+	}
+}
+
+func TestConvertToColumns(t *testing.T) {
+	pattern := regexp.MustCompile(`^GET (?P<path>\S+) (\d+)`)
+	for _, c := range []struct {
+		comma rune
+		want  string
+	}{
+		{',', "time,stream,path,group2\n" +
+			"2024-05-01T10:00:00.1Z,stdout,/a,200\n" +
+			"2024-05-01T10:00:00.2Z,stdout,/b,500\n"},
+		{'\t', "time\tstream\tpath\tgroup2\n" +
+			"2024-05-01T10:00:00.1Z\tstdout\t/a\t200\n" +
+			"2024-05-01T10:00:00.2Z\tstdout\t/b\t500\n"},
+	} {
+		var output bytes.Buffer
+		unparsed, err := convertToColumns(&output, strings.NewReader(convertedLog), pattern, c.comma, nil,
+			newTestRewrite(t), convertedName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The unmatched stderr line is left out without being unparsed.
+		if unparsed != 2 {
+			t.Errorf("%d lines unparsed, want 2", unparsed)
+		}
+		if output.String() != c.want {
+			t.Errorf("columns separated by %q are\n%s\nwant\n%s", c.comma, output.String(), c.want)
+		}
+	}
+}
+
+func TestConvertToColumnsMultiline(t *testing.T) {
+	log := "2024-05-01T10:00:00.1Z stderr F panic: boom\n" +
+		"2024-05-01T10:00:00.2Z stderr F main.go:12\n" +
+		"2024-05-01T10:00:00.3Z stderr F panic: again\n"
+	var output bytes.Buffer
+	_, err := convertToColumns(&output, strings.NewReader(log), regexp.MustCompile(`(?s)panic: (\w+)\n(.*)`), ',',
+		regexp.MustCompile(`^panic`), convert.Rewrite{}, convertedName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "time,stream,group1,group2\n" +
+		"2024-05-01T10:00:00.1Z,stderr,boom,main.go:12\n"
+	if output.String() != want {
+		t.Errorf("columns are\n%s\nwant\n%s", output.String(), want)
+	}
+}
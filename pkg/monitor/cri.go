@@ -0,0 +1,177 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/badeadan/k8ts/internal/grpc"
+	"github.com/badeadan/k8ts/internal/logger"
+)
+
+const criService = "/runtime.v1.RuntimeService/"
+
+// The state of containers not yet started and the event types of the CRI
+// used.
+const (
+	criContainerCreated = 0
+	criContainerStarted = 1
+	criContainerDeleted = 3
+)
+
+// criClient makes the gRPC calls of the Container Runtime Interface to
+// the runtime.
+type criClient struct {
+	grpc.Client
+	socket string
+}
+
+// newCRIClient talks to the runtime listening on socket, or else on the
+// first socket of runtimeSockets found but Docker's, which doesn't serve
+// the CRI.
+func newCRIClient(socket string) (*criClient, error) {
+	if socket == "" {
+		paths := make([]string, 0, len(runtimeSockets))
+		for _, candidate := range runtimeSockets {
+			if candidate.runtime == "docker" {
+				continue
+			}
+			paths = append(paths, candidate.socket)
+			if info, err := os.Stat(candidate.socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+				socket = candidate.socket
+				break
+			}
+		}
+		if socket == "" {
+			return nil, fmt.Errorf("no container runtime socket in %s, give it with --cri-socket",
+				strings.Join(paths, ", "))
+		}
+	}
+	// gRPC is HTTP/2 without TLS on the socket.
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+	transport := &http.Transport{
+		Protocols: protocols,
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &criClient{
+		Client: grpc.Client{Base: "http://localhost" + criService, HTTP: &http.Client{Transport: transport}},
+		socket: socket,
+	}, nil
+}
+
+// call makes a unary call of method and returns the response.
+func (c *criClient) call(method string, request []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), runtimeCallTimeout)
+	defer cancel()
+	return c.Client.Call(ctx, method, request)
+}
+
+func (c *criClient) address() string {
+	return c.socket
+}
+
+// list returns the containers of the runtime, by ListContainers.
+func (c *criClient) list() (map[string]bool, error) {
+	response, err := c.call("ListContainers", nil)
+	if err != nil {
+		return nil, err
+	}
+	containers := make(map[string]bool)
+	err = grpc.ProtoFields(response, func(number int, _ uint64, data []byte) error {
+		if number != 1 {
+			return nil
+		}
+		var id string
+		var state uint64
+		err := grpc.ProtoFields(data, func(number int, value uint64, data []byte) error {
+			switch number {
+			case 1:
+				id = string(data)
+			case 6:
+				state = value
+			}
+			return nil
+		})
+		containers[id] = state != criContainerCreated
+		return err
+	})
+	return containers, err
+}
+
+// describe returns the container id, by ContainerStatus.
+func (c *criClient) describe(id string) (*runtimeContainer, error) {
+	response, err := c.call("ContainerStatus", grpc.ProtoString(1, id))
+	if err != nil {
+		return nil, err
+	}
+	container := &runtimeContainer{id: id}
+	var labels map[string]string
+	err = grpc.ProtoFields(response, func(number int, _ uint64, data []byte) error {
+		if number != 1 {
+			return nil
+		}
+		return grpc.ProtoFields(data, func(number int, _ uint64, data []byte) error {
+			switch number {
+			case 2:
+				return grpc.ProtoFields(data, func(number int, _ uint64, data []byte) error {
+					if number == 1 {
+						container.name = string(data)
+					}
+					return nil
+				})
+			case 12:
+				if labels == nil {
+					labels = make(map[string]string)
+				}
+				return grpc.ProtoMapEntry(data, labels)
+			case 15:
+				container.logPath = string(data)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	container.setPod(labels)
+	return container, nil
+}
+
+// follow streams the events of GetContainerEvents.
+func (c *criClient) follow(handle func(id string, started bool)) error {
+	err := c.Stream(context.Background(), "GetContainerEvents", bytes.NewReader(grpc.Frame(nil)), func(message []byte) {
+		var id string
+		var kind uint64
+		err := grpc.ProtoFields(message, func(number int, value uint64, data []byte) error {
+			switch number {
+			case 1:
+				id = string(data)
+			case 2:
+				kind = value
+			}
+			return nil
+		})
+		if err != nil {
+			logger.Warn("Invalid container event", "error", err)
+			return
+		}
+		switch kind {
+		case criContainerStarted:
+			handle(id, true)
+		case criContainerDeleted:
+			handle(id, false)
+		}
+	})
+	if grpc.IsUnimplemented(err) {
+		return errNoEvents
+	}
+	return err
+}
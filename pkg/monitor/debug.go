@@ -0,0 +1,25 @@
+package monitor
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/badeadan/k8ts/internal/logger"
+)
+
+// serveDebug serves the Go runtime profiles on address, under
+// /debug/pprof/ as `go tool pprof` expects. They expose the internals of
+// the monitor and are meant to be bound to localhost.
+func serveDebug(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	logger.Info("Serving debug profiles", "address", address)
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		logger.Error("Debug profiles unavailable", "address", address, "error", err)
+	}
+}
@@ -0,0 +1,197 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// podDescription is the part of a pod `kubectl describe` shows.
+type podDescription struct {
+	Metadata struct {
+		Name              string            `json:"name"`
+		Namespace         string            `json:"namespace"`
+		CreationTimestamp time.Time         `json:"creationTimestamp"`
+		Labels            map[string]string `json:"labels"`
+		Annotations       map[string]string `json:"annotations"`
+		OwnerReferences   []store.PodOwner  `json:"ownerReferences"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName   string `json:"nodeName"`
+		Containers []struct {
+			Name      string `json:"name"`
+			Image     string `json:"image"`
+			Resources struct {
+				Limits   map[string]string `json:"limits"`
+				Requests map[string]string `json:"requests"`
+			} `json:"resources"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase      string `json:"phase"`
+		Reason     string `json:"reason"`
+		Message    string `json:"message"`
+		PodIP      string `json:"podIP"`
+		Conditions []struct {
+			Type    string `json:"type"`
+			Status  string `json:"status"`
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"conditions"`
+		ContainerStatuses []containerStatus `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+type podEvents struct {
+	Items []struct {
+		Type          string     `json:"type"`
+		Reason        string     `json:"reason"`
+		Message       string     `json:"message"`
+		Count         int        `json:"count"`
+		LastTimestamp *time.Time `json:"lastTimestamp"`
+		EventTime     *time.Time `json:"eventTime"`
+		Source        struct {
+			Component string `json:"component"`
+		} `json:"source"`
+	} `json:"items"`
+}
+
+// describePod writes what `kubectl describe pod` would show, events
+// included, next to a tombstone. Scheduling and probe failures often
+// explain what the logs show.
+func describePod(k *kubeClient, tombstonePath string, namespace string, name string) {
+	var out bytes.Buffer
+	pod := podDescription{}
+	err := k.get(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", namespace, name), &pod)
+	if err == nil {
+		writePodDescription(&out, &pod)
+	} else {
+		logger.Debug("Failed to describe pod", "namespace", namespace, "pod", name, "error", err)
+		fmt.Fprintf(&out, "Name:       %s\nNamespace:  %s\n", name, namespace)
+		fmt.Fprintf(&out, "Pod gone from the API server before it could be described (%v)\n", err)
+	}
+	events := podEvents{}
+	selector := url.QueryEscape("involvedObject.kind=Pod,involvedObject.name=" + name)
+	err = k.get(fmt.Sprintf("/api/v1/namespaces/%s/events?fieldSelector=%s", namespace, selector), &events)
+	if err != nil {
+		logger.Debug("Failed to list pod events", "namespace", namespace, "pod", name, "error", err)
+	}
+	writePodEvents(&out, &events)
+	err = ioutil.WriteFile(tombstonePath+store.DescribeSuffix, out.Bytes(), 0644)
+	if err != nil {
+		logger.Error("Failed to write pod description", "path", tombstonePath+store.DescribeSuffix, "error", err)
+	}
+}
+
+func writePodDescription(out io.Writer, pod *podDescription) {
+	table := tabwriter.NewWriter(out, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(table, "Name:\t%s\n", pod.Metadata.Name)
+	fmt.Fprintf(table, "Namespace:\t%s\n", pod.Metadata.Namespace)
+	fmt.Fprintf(table, "Node:\t%s\n", pod.Spec.NodeName)
+	fmt.Fprintf(table, "Created:\t%s\n", pod.Metadata.CreationTimestamp.Format(time.RFC3339))
+	fmt.Fprintf(table, "Labels:\t%s\n", formatMap(pod.Metadata.Labels))
+	fmt.Fprintf(table, "Annotations:\t%s\n", formatMap(pod.Metadata.Annotations))
+	fmt.Fprintf(table, "Status:\t%s\n", pod.Status.Phase)
+	if pod.Status.Reason != "" {
+		fmt.Fprintf(table, "Reason:\t%s\n", pod.Status.Reason)
+	}
+	if pod.Status.Message != "" {
+		fmt.Fprintf(table, "Message:\t%s\n", pod.Status.Message)
+	}
+	fmt.Fprintf(table, "IP:\t%s\n", pod.Status.PodIP)
+	for _, owner := range pod.Metadata.OwnerReferences {
+		fmt.Fprintf(table, "Controlled By:\t%s/%s\n", owner.Kind, owner.Name)
+	}
+	_ = table.Flush()
+	fmt.Fprintln(out, "Containers:")
+	for _, container := range pod.Spec.Containers {
+		fmt.Fprintf(out, "  %s:\n", container.Name)
+		table = tabwriter.NewWriter(out, 0, 8, 1, ' ', 0)
+		fmt.Fprintf(table, "    Image:\t%s\n", container.Image)
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.Name != container.Name {
+				continue
+			}
+			fmt.Fprintf(table, "    Container ID:\t%s\n", status.ContainerID)
+			writeContainerState(table, "State", status.State)
+			if status.LastState.Waiting != nil || status.LastState.Terminated != nil {
+				writeContainerState(table, "Last State", status.LastState)
+			}
+			fmt.Fprintf(table, "    Restart Count:\t%d\n", status.RestartCount)
+		}
+		if len(container.Resources.Limits) > 0 {
+			fmt.Fprintf(table, "    Limits:\t%s\n", formatMap(container.Resources.Limits))
+		}
+		if len(container.Resources.Requests) > 0 {
+			fmt.Fprintf(table, "    Requests:\t%s\n", formatMap(container.Resources.Requests))
+		}
+		_ = table.Flush()
+	}
+	if len(pod.Status.Conditions) > 0 {
+		fmt.Fprintln(out, "Conditions:")
+		table = tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(table, "  TYPE\tSTATUS\tREASON\tMESSAGE")
+		for _, condition := range pod.Status.Conditions {
+			fmt.Fprintf(table, "  %s\t%s\t%s\t%s\n", condition.Type, condition.Status, condition.Reason, condition.Message)
+		}
+		_ = table.Flush()
+	}
+}
+
+func writeContainerState(out io.Writer, label string, state containerState) {
+	switch {
+	case state.Terminated != nil:
+		fmt.Fprintf(out, "    %s:\tTerminated\n", label)
+		fmt.Fprintf(out, "      Reason:\t%s\n", state.Terminated.Reason)
+		fmt.Fprintf(out, "      Exit Code:\t%d\n", state.Terminated.ExitCode)
+	case state.Waiting != nil:
+		fmt.Fprintf(out, "    %s:\tWaiting\n", label)
+		fmt.Fprintf(out, "      Reason:\t%s\n", state.Waiting.Reason)
+	default:
+		fmt.Fprintf(out, "    %s:\tRunning\n", label)
+	}
+}
+
+func writePodEvents(out io.Writer, events *podEvents) {
+	if len(events.Items) == 0 {
+		fmt.Fprintln(out, "Events:  <none>")
+		return
+	}
+	fmt.Fprintln(out, "Events:")
+	table := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "  LAST SEEN\tTYPE\tREASON\tFROM\tCOUNT\tMESSAGE")
+	for _, event := range events.Items {
+		seen := ""
+		if event.LastTimestamp != nil {
+			seen = event.LastTimestamp.Format(time.RFC3339)
+		} else if event.EventTime != nil {
+			seen = event.EventTime.Format(time.RFC3339)
+		}
+		fmt.Fprintf(table, "  %s\t%s\t%s\t%s\t%d\t%s\n", seen, event.Type, event.Reason,
+			event.Source.Component, event.Count, strings.TrimSpace(event.Message))
+	}
+	_ = table.Flush()
+}
+
+// formatMap renders labels, annotations or resources as key=value pairs,
+// sorted by key.
+func formatMap(values map[string]string) string {
+	if len(values) == 0 {
+		return "<none>"
+	}
+	pairs := make([]string, 0, len(values))
+	for key, value := range values {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
@@ -0,0 +1,134 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/identity"
+	"github.com/badeadan/k8ts/internal/logger"
+)
+
+// diskPressure watches the free space of the tombstone volume. Below
+// --min-free, the monitor only keeps the logs matching keep-if instead of
+// filling the volume up.
+type diskPressure struct {
+	minFree int64
+	percent float64
+	webhook string
+	active  bool
+	// mutex is held while checking, from the event loop and the copy
+	// queue.
+	mutex sync.Mutex
+}
+
+// configure sets the threshold, either a size (e.g. 500M) or a percentage
+// of the volume (e.g. 5%), disabling the checks if empty.
+func (d *diskPressure) configure(minFree string, webhook string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.minFree, d.percent, d.webhook = 0, 0, webhook
+	if minFree == "" {
+		return nil
+	}
+	if strings.HasSuffix(minFree, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(minFree, "%"), 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return fmt.Errorf("invalid --min-free '%s'", minFree)
+		}
+		d.percent = percent
+		return nil
+	}
+	size, err := parseSize(minFree)
+	if err != nil {
+		return fmt.Errorf("invalid --min-free: %v", err)
+	}
+	d.minFree = size
+	return nil
+}
+
+// check measures the free space of the tombstone volume, publishes it in
+// state and tells whether the volume is under pressure.
+func (d *diskPressure) check(state *monitorState) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if d.minFree == 0 && d.percent == 0 {
+		d.active, state.DiskPressure = false, false
+		return false
+	}
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(TombstonePath, &stat)
+	if err != nil {
+		logger.Warn("Failed to measure free space", "path", TombstonePath, "error", err)
+		return d.active
+	}
+	free := int64(stat.Bavail) * int64(stat.Bsize)
+	threshold := d.minFree
+	if d.percent > 0 {
+		threshold = int64(float64(stat.Blocks) * float64(stat.Bsize) * d.percent / 100)
+	}
+	state.TombstoneFree = free
+	telemetry.gauge("k8ts.tombstone.free.bytes", free)
+	active := free < threshold
+	if active == d.active {
+		return active
+	}
+	d.active = active
+	state.DiskPressure = active
+	if active {
+		logger.Warn("Low free space, only keeping logs matching keep-if", "path", TombstonePath,
+			"free", FormatSize(free), "threshold", FormatSize(threshold))
+	} else {
+		logger.Info("Free space recovered, keeping logs again", "path", TombstonePath,
+			"free", FormatSize(free), "threshold", FormatSize(threshold))
+	}
+	if d.webhook != "" {
+		go alertDiskPressure(d.webhook, active, free, threshold)
+	}
+	return active
+}
+
+type diskAlert struct {
+	Time      time.Time `json:"time"`
+	Cluster   string    `json:"cluster,omitempty"`
+	Node      string    `json:"node"`
+	Path      string    `json:"path"`
+	Pressure  bool      `json:"pressure"`
+	Free      int64     `json:"freeBytes"`
+	Threshold int64     `json:"thresholdBytes"`
+}
+
+// alertDiskPressure posts a diskAlert to webhook when the tombstone volume
+// enters or leaves pressure.
+func alertDiskPressure(webhook string, active bool, free int64, threshold int64) {
+	content, err := json.Marshal(diskAlert{
+		Time:      time.Now(),
+		Cluster:   identity.Cluster(),
+		Node:      identity.Node(),
+		Path:      TombstonePath,
+		Pressure:  active,
+		Free:      free,
+		Threshold: threshold,
+	})
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	response, err := client.Post(webhook, "application/json", bytes.NewReader(content))
+	if err != nil {
+		logger.Warn("Disk pressure alert failed", "webhook", webhook, "error", err)
+		return
+	}
+	_ = response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		logger.Warn("Disk pressure alert rejected", "webhook", webhook, "status", response.Status)
+	}
+}
@@ -0,0 +1,158 @@
+package monitor
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// Degraded modes of the monitor when the tombstone volume is full, entered
+// one after the other as writes keep failing.
+const (
+	degradedNone = iota
+	degradedPrune
+	degradedKeepOnly
+	degradedMetadataOnly
+)
+
+var degradedModes = []string{"", "prune", "keep-only", "metadata-only"}
+
+// diskFullHeadroom is the free space, on top of the size of the log which
+// didn't fit, made by an emergency prune and needed to leave degraded
+// mode.
+const diskFullHeadroom = 16 << 20
+
+// diskFull degrades the preservation of logs when tombstones fail to be
+// written because their volume is full, rather than failing every one of
+// them: the oldest tombstones are pruned to make room, then only the logs
+// matching keep-if or kept for their pod are preserved, then only their
+// metadata is recorded. The monitor recovers once the volume has room
+// again for the last log which didn't fit.
+type diskFull struct {
+	mutex        sync.Mutex
+	level        int
+	needed       int64
+	dropped      int
+	droppedBytes int64
+}
+
+// isDiskFull tells whether err is a write failing for lack of space.
+func isDiskFull(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == syscall.ENOSPC || err == syscall.EDQUOT
+}
+
+// freeSpace returns the space left to unprivileged users on the volume of
+// path.
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// current returns the degraded mode of the monitor, leaving it first if
+// the volume has room again.
+func (f *diskFull) current(state *monitorState) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.level == degradedNone {
+		return f.level
+	}
+	free, err := freeSpace(TombstonePath)
+	if err != nil || free < f.needed {
+		return f.level
+	}
+	logger.Info("Free space recovered, leaving degraded mode", "path", TombstonePath, "free", FormatSize(free),
+		"mode", degradedModes[f.level], "dropped", f.dropped, "droppedBytes", f.droppedBytes)
+	f.level, f.needed, f.dropped, f.droppedBytes = degradedNone, 0, 0, 0
+	f.publish(state)
+	return f.level
+}
+
+// escalate enters the next degraded mode after a log of size bytes didn't
+// fit on the volume while the monitor was in mode from, pruning the
+// tombstones preserved before started when entering the prune mode. Copies
+// failing together only escalate once.
+func (f *diskFull) escalate(from int, size int64, started time.Time, merging *sync.Mutex, state *monitorState) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.needed = size + diskFullHeadroom
+	if f.level != from || f.level == degradedMetadataOnly {
+		return f.level
+	}
+	f.level++
+	logger.Warn("Tombstone volume full, degrading", "path", TombstonePath, "mode", degradedModes[f.level])
+	f.publish(state)
+	if f.level == degradedPrune {
+		merging.Lock()
+		emergencyPrune(TombstonePath, f.needed, started)
+		merging.Unlock()
+	}
+	return f.level
+}
+
+// drop records a log left out, or whose content was, in degraded mode.
+func (f *diskFull) drop(size int64, state *monitorState) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.dropped++
+	f.droppedBytes += size
+	state.mutex.Lock()
+	state.DroppedLogs++
+	state.mutex.Unlock()
+}
+
+// publish shows the degraded mode in state and telemetry. Called with the
+// mutex held.
+func (f *diskFull) publish(state *monitorState) {
+	state.mutex.Lock()
+	state.Degraded = degradedModes[f.level]
+	state.mutex.Unlock()
+	telemetry.gauge("k8ts.degraded", int64(f.level))
+}
+
+// emergencyPrune deletes the expired tombstones of root, then the oldest
+// ones, until the volume has needed bytes free. Only tombstones preserved
+// before started are pruned, not those being written.
+func emergencyPrune(root string, needed int64, started time.Time) {
+	tombstones, err := store.FindTombstones(root, nil)
+	if err != nil {
+		logger.Warn("Failed to look for tombstones to prune", "path", root, "error", err)
+	}
+	now := time.Now()
+	pruned, freed := 0, int64(0)
+	left := make([]store.Tombstone, 0, len(tombstones))
+	for _, t := range tombstones {
+		if t.ExpiresAt != nil && t.ExpiresAt.Before(now) {
+			if removeTombstone(t, false) {
+				pruned++
+				freed += t.Size
+			}
+			continue
+		}
+		left = append(left, t)
+	}
+	for _, t := range left {
+		free, err := freeSpace(root)
+		if err != nil || free >= needed || !t.PreservedAt.Before(started) {
+			break
+		}
+		if removeTombstone(t, false) {
+			pruned++
+			freed += t.Size
+		}
+	}
+	logger.Warn("Pruned tombstones to make room", "path", root, "pruned", pruned, "freed", FormatSize(freed))
+}
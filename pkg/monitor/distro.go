@@ -0,0 +1,77 @@
+package monitor
+
+import (
+	"fmt"
+	"os"
+)
+
+const distributionAuto = "auto"
+
+// distribution is where a Kubernetes distribution puts the socket of its
+// container runtime and the kubeconfig of its kubelet, which differ from
+// the kubeadm layout. The kubelet writes container logs to
+// /var/log/containers and /var/log/pods on all of them.
+type distribution struct {
+	name string
+	// markers are paths only found on the nodes of the distribution.
+	markers []string
+	// criSocket is empty when the runtime may be any of runtimeSockets.
+	criSocket     string
+	kubeletConfig string
+}
+
+// distributions are looked for in order, the last one being the default.
+var distributions = []*distribution{{
+	name:          "k3s",
+	markers:       []string{"/var/lib/rancher/k3s"},
+	criSocket:     "/run/k3s/containerd/containerd.sock",
+	kubeletConfig: "/var/lib/rancher/k3s/agent/kubelet.kubeconfig",
+}, {
+	name:          "rke2",
+	markers:       []string{"/var/lib/rancher/rke2"},
+	criSocket:     "/run/k3s/containerd/containerd.sock",
+	kubeletConfig: "/var/lib/rancher/rke2/agent/kubelet.kubeconfig",
+}, {
+	name:          "microk8s",
+	markers:       []string{"/var/snap/microk8s"},
+	criSocket:     "/var/snap/microk8s/common/run/containerd.sock",
+	kubeletConfig: "/var/snap/microk8s/current/credentials/kubelet.config",
+}, {
+	name:          "openshift",
+	markers:       []string{"/etc/machine-config-daemon"},
+	criSocket:     "/var/run/crio/crio.sock",
+	kubeletConfig: "/var/lib/kubelet/kubeconfig",
+}, {
+	name:          "kubeadm",
+	kubeletConfig: "/etc/kubernetes/kubelet.conf",
+}}
+
+// distributionNames are the choices of --distribution.
+func distributionNames() []string {
+	names := []string{distributionAuto}
+	for _, d := range distributions {
+		names = append(names, d.name)
+	}
+	return names
+}
+
+// findDistribution returns the distribution named name, or else the one
+// whose markers are found on this host.
+func findDistribution(name string) (*distribution, error) {
+	for _, d := range distributions {
+		if d.name == name {
+			return d, nil
+		}
+	}
+	if name != distributionAuto {
+		return nil, fmt.Errorf("unknown distribution '%s'", name)
+	}
+	for _, d := range distributions {
+		for _, marker := range d.markers {
+			if _, err := os.Stat(marker); err == nil {
+				return d, nil
+			}
+		}
+	}
+	return distributions[len(distributions)-1], nil
+}
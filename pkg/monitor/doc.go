@@ -0,0 +1,28 @@
+// Package monitor preserves the logs of the containers of a Kubernetes
+// node as tombstones, under TombstonePath, when they are deleted: it is
+// `k8ts monitor`, along with the commands of the node which read
+// tombstones or talk to the running monitor.
+//
+// A node agent runs a monitor of its own with the options of the command
+// line, named as in the configuration file:
+//
+//	args, err := monitor.NewArgs(map[string]interface{}{
+//		"include-glob": "payments-*",
+//		"kube-api":     "in-cluster",
+//		"retention":    "30d",
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	m, err := monitor.New(args)
+//	if err != nil {
+//		return err
+//	}
+//	return m.Run(ctx)
+//
+// Run returns once ctx is cancelled and the copies in progress are done.
+// The audit log, telemetry and logger of the monitor are those of the
+// process, which runs one monitor at a time. The directory and collector
+// sinks, packages of their own under pkg/sink, are imported and so
+// registered along with this package.
+package monitor
@@ -0,0 +1,162 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// dockerEvents are the container events the Docker source follows: a
+// container which died has written its whole log, which is preserved
+// then, in case it is destroyed before its next event is read.
+var dockerEvents = map[string]bool{"start": true, "die": false, "destroy": false}
+
+// dockerClient asks the Docker Engine API about the containers of nodes
+// still running pods with Docker (dockershim or cri-dockerd).
+type dockerClient struct {
+	socket string
+	client *http.Client
+}
+
+// newDockerClient talks to the Docker daemon listening on socket, or else
+// on its usual socket.
+func newDockerClient(socket string) *dockerClient {
+	if socket == "" {
+		for _, candidate := range runtimeSockets {
+			if candidate.runtime == "docker" {
+				socket = candidate.socket
+			}
+		}
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &dockerClient{socket: socket, client: &http.Client{Transport: transport}}
+}
+
+func (c *dockerClient) address() string {
+	return c.socket
+}
+
+// open makes the request of path, with a timeout unless following events.
+func (c *dockerClient) open(ctx context.Context, path string) (*http.Response, error) {
+	request, err := http.NewRequest("GET", "http://docker"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := c.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		var failure struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &failure) == nil && failure.Message != "" {
+			return nil, fmt.Errorf("%s: %s", path, failure.Message)
+		}
+		return nil, fmt.Errorf("%s: %s", path, response.Status)
+	}
+	return response, nil
+}
+
+func (c *dockerClient) get(path string, value interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), runtimeCallTimeout)
+	defer cancel()
+	response, err := c.open(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(value)
+}
+
+// list returns the containers of the daemon. Only the logs of running
+// containers are watched, the others died already.
+func (c *dockerClient) list() (map[string]bool, error) {
+	var list []struct {
+		ID    string `json:"Id"`
+		State string `json:"State"`
+	}
+	err := c.get("/containers/json?all=1", &list)
+	if err != nil {
+		return nil, err
+	}
+	containers := make(map[string]bool, len(list))
+	for _, container := range list {
+		containers[container.ID] = container.State == "running"
+	}
+	return containers, nil
+}
+
+// describe inspects the container id. Its log is the LogPath Docker gives,
+// /var/lib/docker/containers/<id>/<id>-json.log unless its data-root was
+// moved, or none with log drivers other than json-file.
+func (c *dockerClient) describe(id string) (*runtimeContainer, error) {
+	var inspect struct {
+		Name    string `json:"Name"`
+		LogPath string `json:"LogPath"`
+		Config  struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"Config"`
+	}
+	err := c.get("/containers/"+url.PathEscape(id)+"/json", &inspect)
+	if err != nil {
+		return nil, err
+	}
+	container := &runtimeContainer{id: id, name: strings.TrimPrefix(inspect.Name, "/")}
+	// The sandbox of every pod is a container too, without a log of its
+	// own in /var/log/containers.
+	if inspect.Config.Labels["io.kubernetes.docker.type"] == "podsandbox" {
+		return container, nil
+	}
+	container.setPod(inspect.Config.Labels)
+	container.logPath = inspect.LogPath
+	return container, nil
+}
+
+// follow streams the events of the containers started, dead and
+// destroyed.
+func (c *dockerClient) follow(handle func(id string, started bool)) error {
+	names := make([]string, 0, len(dockerEvents))
+	for name := range dockerEvents {
+		names = append(names, name)
+	}
+	filters, err := json.Marshal(map[string][]string{"type": {"container"}, "event": names})
+	if err != nil {
+		return err
+	}
+	response, err := c.open(context.Background(), "/events?filters="+url.QueryEscape(string(filters)))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var event struct {
+			Type   string `json:"Type"`
+			Action string `json:"Action"`
+			Actor  struct {
+				ID string `json:"ID"`
+			} `json:"Actor"`
+		}
+		err = decoder.Decode(&event)
+		if err != nil {
+			return err
+		}
+		started, ok := dockerEvents[event.Action]
+		if event.Type == "container" && ok {
+			handle(event.Actor.ID, started)
+		}
+	}
+}
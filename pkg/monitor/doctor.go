@@ -0,0 +1,213 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/badeadan/k8ts/pkg/convert"
+)
+
+const (
+	minInotifyWatches   = 8192
+	minInotifyInstances = 128
+	minFreeSpace        = 1 << 30
+)
+
+var runtimeSockets = []struct {
+	runtime string
+	socket  string
+}{
+	{"containerd", "/run/containerd/containerd.sock"},
+	{"containerd (k3s)", "/run/k3s/containerd/containerd.sock"},
+	{"containerd (microk8s)", "/var/snap/microk8s/common/run/containerd.sock"},
+	{"CRI-O", "/var/run/crio/crio.sock"},
+	{"docker", "/var/run/docker.sock"},
+}
+
+type finding struct {
+	severity string
+	message  string
+	hint     string
+}
+
+type doctor struct {
+	findings []finding
+}
+
+func (d *doctor) ok(format string, a ...interface{}) {
+	d.findings = append(d.findings, finding{"OK", fmt.Sprintf(format, a...), ""})
+}
+
+func (d *doctor) warn(hint string, format string, a ...interface{}) {
+	d.findings = append(d.findings, finding{"WARN", fmt.Sprintf(format, a...), hint})
+}
+
+func (d *doctor) fail(hint string, format string, a ...interface{}) {
+	d.findings = append(d.findings, finding{"FAIL", fmt.Sprintf(format, a...), hint})
+}
+
+// RunDoctor checks whether this host is fit to run the monitor and prints
+// what to fix if it isn't.
+func RunDoctor() error {
+	d := &doctor{}
+	d.checkInotify()
+	d.checkLogsPath()
+	d.checkTombstonePath()
+	d.checkRuntime()
+	d.checkInitSystem()
+	failed := false
+	for _, f := range d.findings {
+		fmt.Printf("[%-4s] %s\n", f.severity, f.message)
+		if f.hint != "" {
+			fmt.Printf("       %s\n", f.hint)
+		}
+		failed = failed || f.severity == "FAIL"
+	}
+	if failed {
+		return errors.New("environment is not ready for k8ts")
+	}
+	return nil
+}
+
+func readProcInt(path string) (int, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(content)))
+}
+
+func (d *doctor) checkInotify() {
+	limits := []struct {
+		name    string
+		minimum int
+	}{
+		{"max_user_watches", minInotifyWatches},
+		{"max_user_instances", minInotifyInstances},
+	}
+	for _, limit := range limits {
+		path := "/proc/sys/fs/inotify/" + limit.name
+		value, err := readProcInt(path)
+		if err != nil {
+			d.fail("Is this a Linux host with inotify support?",
+				"Unable to read %s: %v", path, err)
+			continue
+		}
+		if value < limit.minimum {
+			d.warn(fmt.Sprintf("Raise it with: sysctl -w fs.inotify.%s=%d", limit.name, limit.minimum),
+				"fs.inotify.%s is %d", limit.name, value)
+		} else {
+			d.ok("fs.inotify.%s is %d", limit.name, value)
+		}
+	}
+}
+
+func (d *doctor) checkLogsPath() {
+	stat, err := os.Stat(KubernetesLogsPath)
+	if err != nil {
+		d.fail("Is kubelet running on this host?", "%s: %v", KubernetesLogsPath, err)
+		return
+	}
+	if !stat.IsDir() {
+		d.fail("", "%s is not a directory", KubernetesLogsPath)
+		return
+	}
+	if syscall.Access(KubernetesLogsPath, 4 /* R_OK */) != nil {
+		d.fail("Run k8ts as root", "%s is not readable", KubernetesLogsPath)
+		return
+	}
+	d.ok("%s is readable", KubernetesLogsPath)
+}
+
+func (d *doctor) checkTombstonePath() {
+	path := TombstonePath
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		// The monitor creates it; check the closest existing parent.
+		for os.IsNotExist(err) && path != "/" {
+			path = filepath.Dir(path)
+			_, err = os.Stat(path)
+		}
+	}
+	if syscall.Access(path, 2 /* W_OK */) != nil {
+		d.fail("Run k8ts as root", "%s is not writable", path)
+	} else {
+		d.ok("%s is writable", path)
+	}
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(path, &fs)
+	if err != nil {
+		d.warn("", "Unable to check free space on %s: %v", path, err)
+		return
+	}
+	free := int64(fs.Bavail) * int64(fs.Bsize)
+	if free < minFreeSpace {
+		d.warn("Tombstones are never deleted automatically, free some space",
+			"Only %s free on %s", FormatSize(free), path)
+	} else {
+		d.ok("%s free on %s", FormatSize(free), path)
+	}
+}
+
+func (d *doctor) checkRuntime() {
+	distribution, err := findDistribution(distributionAuto)
+	if err == nil {
+		d.ok("Detected the %s layout", distribution.name)
+	}
+	found := false
+	for _, candidate := range runtimeSockets {
+		if _, err := os.Stat(candidate.socket); err == nil {
+			d.ok("Found %s runtime socket %s", candidate.runtime, candidate.socket)
+			found = true
+		}
+	}
+	if !found {
+		d.warn("", "No known container runtime socket found")
+	}
+	entries, err := ioutil.ReadDir(KubernetesLogsPath)
+	if err != nil || len(entries) == 0 {
+		d.warn("", "No container log available to detect the log format")
+		return
+	}
+	file, err := openFile(entries[0].Name())
+	if err != nil {
+		d.warn("", "Unable to open %s to detect the log format", entries[0].Name())
+		return
+	}
+	defer func() { _ = file.Close() }()
+	scanner := convert.NewLineReader(file)
+	if !scanner.Scan() {
+		d.warn("", "%s is empty, unable to detect the log format", entries[0].Name())
+		return
+	}
+	line := scanner.Bytes()
+	if _, err := convert.ParseRecord(line); err != nil {
+		d.warn("Use --skip-conversion to preserve logs as they are",
+			"Unknown log format in %s", entries[0].Name())
+	} else if len(line) > 0 && line[0] == '{' {
+		d.ok("Container logs use the Docker JSON format")
+	} else {
+		d.ok("Container logs use the CRI format")
+	}
+}
+
+func (d *doctor) checkInitSystem() {
+	system, err := DetectInitSystem(runLocal)
+	if err != nil {
+		d.warn("Use `k8ts monitor` directly or through your init system",
+			"%v, `k8ts service install` won't work", err)
+		return
+	}
+	tool := strings.Fields(system.Restart)[0]
+	if _, err := exec.LookPath(tool); err != nil && !strings.HasPrefix(tool, "/") {
+		d.warn("", "%s not found in PATH", tool)
+		return
+	}
+	d.ok("%s is available", system.Name)
+}
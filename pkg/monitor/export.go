@@ -0,0 +1,142 @@
+package monitor
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/identity"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// bundleManifest describes the tombstones of a bundle, at its root.
+const bundleManifest = "manifest.json"
+
+type ExportArgs struct {
+	Filter *FilterArgs
+	Output *string
+}
+
+// Export packages matching tombstones, their metadata sidecars and a
+// manifest describing them into a gzip compressed tarball.
+func Export(args *ExportArgs) error {
+	filter, err := newTombstoneFilter(args.Filter)
+	if err != nil {
+		return err
+	}
+	tombstones, err := store.FindTombstones(*args.Filter.dir, filter)
+	if err != nil {
+		return err
+	}
+	if len(tombstones) == 0 {
+		return errors.New("no tombstone matches the filters")
+	}
+	bundle, err := os.OpenFile(*args.Output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeBundle(bundle, *args.Filter.dir, tombstones)
+	closeErr := bundle.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(*args.Output)
+		return err
+	}
+	fmt.Printf("Exported %d tombstones to %s\n", len(tombstones), *args.Output)
+	return nil
+}
+
+func writeBundle(destination io.Writer, root string, tombstones []store.Tombstone) error {
+	compressor := gzip.NewWriter(destination)
+	archive := tar.NewWriter(compressor)
+	// Bundles of many nodes can be unpacked side by side.
+	prefix := "k8ts-" + store.SafePathElement(identity.Node()) + "-" + time.Now().UTC().Format("20060102T150405Z")
+	manifest := make([]store.Tombstone, 0, len(tombstones))
+	exported := make(map[string]bool)
+	for _, t := range tombstones {
+		relative, err := filepath.Rel(root, t.Path)
+		if err != nil || strings.HasPrefix(relative, "..") {
+			relative = filepath.Base(t.Path)
+		}
+		name := filepath.ToSlash(filepath.Join(prefix, relative))
+		err = addFileToArchive(archive, t.Path, name)
+		if err != nil {
+			return err
+		}
+		for _, suffix := range store.CompanionSuffixes {
+			if _, err := os.Stat(t.Path + suffix); err == nil {
+				err = addFileToArchive(archive, t.Path+suffix, name+suffix)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		merged := filepath.Join(filepath.Dir(t.Path), store.MergedLogName)
+		if !exported[merged] {
+			exported[merged] = true
+			if _, err := os.Stat(merged); err == nil {
+				err = addFileToArchive(archive, merged, path.Join(path.Dir(name), store.MergedLogName))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		t.Path = name
+		manifest = append(manifest, t)
+	}
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = archive.WriteHeader(&tar.Header{
+		Name:    prefix + "/" + bundleManifest,
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = archive.Write(content)
+	if err != nil {
+		return err
+	}
+	err = archive.Close()
+	if err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+func addFileToArchive(archive *tar.Writer, path string, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(stat, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	err = archive.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(archive, file, stat.Size())
+	return err
+}
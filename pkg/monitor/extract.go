@@ -0,0 +1,105 @@
+package monitor
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/pkg/convert"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// Columnar formats of tombstones, one row per line matching --extract.
+const (
+	outputCSV = "csv"
+	outputTSV = "tsv"
+)
+
+// compileExtract compiles the pattern whose capture groups become the
+// columns of csv and tsv tombstones.
+func compileExtract(expression string) (*regexp.Regexp, error) {
+	pattern, err := settings.CompilePattern("extract", expression)
+	if err != nil {
+		return nil, err
+	}
+	if pattern.NumSubexp() == 0 {
+		return nil, fmt.Errorf("extract pattern '%s' has no capture group", expression)
+	}
+	return pattern, nil
+}
+
+// extractColumns names the columns of the rows: time and stream, then the
+// capture groups of pattern by name, or by number when they have none.
+func extractColumns(pattern *regexp.Regexp) []string {
+	columns := []string{"time", "stream"}
+	for i, name := range pattern.SubexpNames()[1:] {
+		if name == "" {
+			name = "group" + strconv.Itoa(i+1)
+		}
+		columns = append(columns, name)
+	}
+	return columns
+}
+
+// convertToColumns writes a row of the capture groups of pattern for every
+// line of source matching it, after a header, e.g. to load the request ids
+// and latencies of a log into a spreadsheet. Other lines, unparsed ones
+// included, are left out and counted. Lines are rewritten then joined into
+// records starting with multiline when given, which are redacted before
+// the columns are extracted.
+func convertToColumns(destination io.Writer, source io.Reader, pattern *regexp.Regexp, comma rune,
+	multiline *regexp.Regexp, rewrite convert.Rewrite, name store.LogName) (int, error) {
+	output := csv.NewWriter(destination)
+	output.Comma = comma
+	err := output.Write(extractColumns(pattern))
+	if err != nil {
+		return 0, err
+	}
+	unparsed, unmatched := 0, 0
+	row := make([]string, 0, 2+pattern.NumSubexp())
+	write := func(entry convert.Entry) error {
+		groups := pattern.FindStringSubmatch(rewrite.Redact(entry.Log))
+		if groups == nil {
+			unmatched++
+			return nil
+		}
+		row = append(append(row[:0], entry.Time, entry.Stream), groups[1:]...)
+		return output.Write(row)
+	}
+	assembler := convert.Assembler{Start: multiline}
+	scanner := convert.NewLineReader(source)
+	defer scanner.Release()
+	for scanner.Scan() {
+		entry, err := convert.ParseRecord(scanner.Bytes())
+		if err != nil {
+			unparsed++
+			continue
+		}
+		rewrite.Apply(&entry)
+		if entry, complete := assembler.Add(entry); complete {
+			err = write(entry)
+		}
+		if err != nil {
+			logger.Error("Write failed", "error", err)
+			return unparsed, err
+		}
+	}
+	for _, entry := range assembler.Flush() {
+		if err := write(entry); err != nil {
+			return unparsed, err
+		}
+	}
+	if unparsed > 0 || unmatched > 0 {
+		logger.Info("Log lines left out of the extraction", "namespace", name.Namespace,
+			"pod", name.Pod, "container", name.Container, "unparsed", unparsed, "unmatched", unmatched)
+	}
+	output.Flush()
+	if err := output.Error(); err != nil {
+		return unparsed, err
+	}
+	return unparsed, scanner.Err()
+}
@@ -0,0 +1,99 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/pkg/convert"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+type GrepArgs struct {
+	Filter     *FilterArgs
+	Pattern    *string
+	IgnoreCase *bool
+	Multiline  *string
+}
+
+// Grep prints the lines of matching tombstones that match the pattern,
+// prefixed with the pod they came from. With --multiline-start, whole
+// records are matched and printed instead. It fails only when nothing
+// matched, like grep(1).
+func Grep(args *GrepArgs) error {
+	expression := *args.Pattern
+	if *args.IgnoreCase {
+		expression = "(?i)" + expression
+	}
+	pattern, err := regexp.Compile(expression)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+	var start *regexp.Regexp
+	if *args.Multiline != "" {
+		start, err = settings.CompilePattern("multiline-start", *args.Multiline)
+		if err != nil {
+			return err
+		}
+	}
+	filter, err := newTombstoneFilter(args.Filter)
+	if err != nil {
+		return err
+	}
+	tombstones, err := store.FindTombstones(*args.Filter.dir, filter)
+	if err != nil {
+		return err
+	}
+	matches := 0
+	output := bufio.NewWriter(os.Stdout)
+	defer func() { _ = output.Flush() }()
+	for _, t := range tombstones {
+		source, err := store.OpenTombstone(t.Path)
+		if err != nil {
+			logger.Warn("Failed to open tombstone", "path", t.Path, "error", err)
+			continue
+		}
+		scanner := convert.NewLineReader(source)
+		prefix := t.Namespace + "/" + t.Pod + "/" + t.Container
+		var record []string
+		flush := func() {
+			if len(record) > 0 && pattern.MatchString(strings.Join(record, "\n")) {
+				matches++
+				for _, line := range record {
+					fmt.Fprintf(output, "%s: %s\n", prefix, line)
+				}
+			}
+			record = record[:0]
+		}
+		for scanner.Scan() {
+			if start == nil {
+				record = append(record, scanner.Text())
+				flush()
+				continue
+			}
+			// The lines which follow the first one of a record in text
+			// tombstones have no timestamp, they are matched as they are.
+			message := scanner.Text()
+			if entry, err := convert.ParseRecord(scanner.Bytes()); err == nil {
+				message = entry.Log
+			}
+			if start.MatchString(message) {
+				flush()
+			}
+			record = append(record, scanner.Text())
+		}
+		flush()
+		if err := scanner.Err(); err != nil {
+			logger.Warn("Failed to read tombstone", "path", t.Path, "error", err)
+		}
+		_ = source.Close()
+	}
+	if matches == 0 {
+		return fmt.Errorf("no match for '%s'", *args.Pattern)
+	}
+	return nil
+}
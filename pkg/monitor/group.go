@@ -0,0 +1,140 @@
+package monitor
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/badeadan/k8ts/pkg/convert"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// podTombstoneDir is where the tombstones of the pod of fileName go with
+// --group-pods.
+func podTombstoneDir(root string, fileName string) string {
+	name := store.ParseLogName(fileName)
+	return filepath.Join(root, store.SafePathElement(name.Namespace+"_"+name.Pod))
+}
+
+// mergeSource is a tombstone being merged, positioned on its next line.
+type mergeSource struct {
+	container string
+	scanner   *convert.LineReader
+	closer    io.Closer
+	line      string
+	time      time.Time
+	done      bool
+}
+
+// next reads the following line. Lines without a timestamp, e.g. the
+// continuation of a stack trace, keep the one of the line before them.
+func (s *mergeSource) next() {
+	if !s.scanner.Scan() {
+		s.done = true
+		return
+	}
+	entry, err := convert.ParseRecord(s.scanner.Bytes())
+	if err != nil {
+		s.line = s.scanner.Text()
+		return
+	}
+	if parsed, err := time.Parse(time.RFC3339Nano, entry.Time); err == nil {
+		s.time = parsed
+	}
+	s.line = entry.Time + " " + s.container + " " + entry.Stream + " " + entry.Log
+}
+
+// mergePodLogs writes the merged.log of a pod directory from the
+// tombstones it holds, removing the directory once they are all gone. The
+// merged.log replaced keeps its mode and ownership.
+func mergePodLogs(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	sources := make([]*mergeSource, 0, len(entries))
+	defer func() {
+		for _, source := range sources {
+			_ = source.closer.Close()
+		}
+	}()
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || name == store.MergedLogName || strings.HasPrefix(name, ".") || store.IsCompanion(name) {
+			continue
+		}
+		reader, err := store.OpenTombstone(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		scanner := convert.NewLineReader(reader)
+		source := &mergeSource{container: store.ParseLogName(name).Container, scanner: scanner, closer: reader}
+		sources = append(sources, source)
+		source.next()
+	}
+	if len(sources) == 0 {
+		_ = os.Remove(filepath.Join(dir, store.MergedLogName))
+		_ = os.Remove(dir)
+		return nil
+	}
+	// Written aside then renamed, as prune may merge the same pod at the
+	// same time as the monitor.
+	merged, err := ioutil.TempFile(dir, "."+store.MergedLogName)
+	if err != nil {
+		return err
+	}
+	output := bufio.NewWriter(merged)
+	for {
+		var first *mergeSource
+		for _, source := range sources {
+			if !source.done && (first == nil || source.time.Before(first.time)) {
+				first = source
+			}
+		}
+		if first == nil {
+			break
+		}
+		_, err = output.WriteString(first.line + "\n")
+		if err != nil {
+			break
+		}
+		first.next()
+	}
+	for _, source := range sources {
+		if scanErr := source.scanner.Err(); err == nil {
+			err = scanErr
+		}
+	}
+	if flushErr := output.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := merged.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		keepPermissions(merged.Name(), filepath.Join(dir, store.MergedLogName))
+		err = os.Rename(merged.Name(), filepath.Join(dir, store.MergedLogName))
+	}
+	if err != nil {
+		_ = os.Remove(merged.Name())
+	}
+	return err
+}
+
+// keepPermissions gives the file at path the mode and ownership of the one
+// at previous, if it exists.
+func keepPermissions(path string, previous string) {
+	info, err := os.Stat(previous)
+	if err != nil {
+		return
+	}
+	_ = os.Chmod(path, info.Mode().Perm())
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		_ = os.Chown(path, int(stat.Uid), int(stat.Gid))
+	}
+}
@@ -0,0 +1,100 @@
+package monitor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+)
+
+// healthTick is how often the event loop reports it is alive when serving
+// /healthz, which fails once it missed healthMissedTicks of them.
+const healthTick = 10 * time.Second
+const healthMissedTicks = 3
+
+// healthState is what the event loop tells /healthz and /readyz.
+type healthState struct {
+	mutex     sync.Mutex
+	watching  bool
+	heartbeat time.Time
+}
+
+// beat records that the event loop is turning.
+func (h *healthState) beat() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.heartbeat = time.Now()
+}
+
+// watch records that the log directory is watched.
+func (h *healthState) watch() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.watching = true
+	h.heartbeat = time.Now()
+}
+
+// lost records that the log directory is no longer watched, until it is
+// again.
+func (h *healthState) lost() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.watching = false
+	h.heartbeat = time.Now()
+}
+
+func (h *healthState) alive() (bool, time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return time.Since(h.heartbeat) < healthTick*healthMissedTicks, h.heartbeat
+}
+
+// ready tells why the monitor isn't ready to preserve logs, if it isn't:
+// the log directory must be watched and the tombstone one writable.
+func (h *healthState) ready() error {
+	h.mutex.Lock()
+	watching := h.watching
+	h.mutex.Unlock()
+	if !watching {
+		return fmt.Errorf("not watching %s yet", KubernetesLogsPath)
+	}
+	// Hidden files are skipped by the commands reading tombstones.
+	probe, err := ioutil.TempFile(TombstonePath, ".readyz")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", TombstonePath, err)
+	}
+	_ = probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// serveHealth serves /healthz, failing when the event loop is stuck, and
+// /readyz on address.
+func serveHealth(address string, health *healthState) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		alive, heartbeat := health.alive()
+		if !alive {
+			http.Error(w, fmt.Sprintf("event loop stuck since %s", heartbeat.Format(time.RFC3339)),
+				http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		err := health.ready()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = fmt.Fprintln(w, "ok")
+	})
+	logger.Info("Serving health checks", "address", address)
+	err := http.ListenAndServe(address, mux)
+	if err != nil {
+		logger.Error("Health checks unavailable", "address", address, "error", err)
+	}
+}
@@ -0,0 +1,166 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+const (
+	defaultHookTimeout     = 30
+	defaultHookConcurrency = 4
+)
+
+// maxPendingHooks bounds the hooks waiting for one of the others to end,
+// past which they are skipped, so that a node drain with a slow script
+// doesn't pile up goroutines.
+const maxPendingHooks = 1000
+
+// maxHookOutput is how much of the output of a failed hook is logged.
+const maxHookOutput = 4096
+
+// hookRunner runs the scripts of --on-keep and --on-skip once the
+// decision on a deleted log is made, at most concurrency of them at once
+// and each for timeout at most.
+type hookRunner struct {
+	mutex   sync.Mutex
+	onKeep  string
+	onSkip  string
+	timeout time.Duration
+	slots   chan struct{}
+	pending int
+	done    sync.WaitGroup
+}
+
+var hooks = &hookRunner{}
+
+func (h *hookRunner) configure(onKeep string, onSkip string, timeout int, concurrency int) error {
+	if timeout <= 0 {
+		return fmt.Errorf("invalid --hook-timeout %d", timeout)
+	}
+	if concurrency < 1 {
+		return fmt.Errorf("invalid --hook-concurrency %d", concurrency)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.onKeep, h.onSkip = onKeep, onSkip
+	h.timeout = time.Duration(timeout) * time.Second
+	// Hooks already running keep the slots they got.
+	if h.slots == nil || cap(h.slots) != concurrency {
+		h.slots = make(chan struct{}, concurrency)
+	}
+	return nil
+}
+
+// run starts the hook of decision, if any: --on-keep with the tombstone t
+// once a log was kept, --on-skip with the path of the log once it was
+// skipped or dropped.
+func (h *hookRunner) run(decision *auditRecord, logPath string, t *store.Tombstone) {
+	h.mutex.Lock()
+	var script, path string
+	switch decision.Decision {
+	case "kept", "metadata-only":
+		if t != nil {
+			script, path = h.onKeep, t.Path
+		}
+	case "skipped", "dropped":
+		script, path = h.onSkip, logPath
+	}
+	if script == "" {
+		h.mutex.Unlock()
+		return
+	}
+	if h.pending >= maxPendingHooks {
+		h.mutex.Unlock()
+		logger.Warn("Too many hooks pending, not running it", "hook", script, "file", decision.File)
+		return
+	}
+	h.pending++
+	h.done.Add(1)
+	slots, timeout := h.slots, h.timeout
+	h.mutex.Unlock()
+
+	env := append(os.Environ(), hookEnv(decision, t)...)
+	go func() {
+		defer h.done.Done()
+		slots <- struct{}{}
+		defer func() { <-slots }()
+		h.mutex.Lock()
+		h.pending--
+		h.mutex.Unlock()
+		runHook(script, path, env, timeout, decision.File)
+	}()
+}
+
+// hookEnv describes the decision to the hook, along with the coordinates
+// of the pod and, once kept, the metadata sidecar of the tombstone.
+func hookEnv(decision *auditRecord, t *store.Tombstone) []string {
+	name := store.ParseLogName(decision.File)
+	env := []string{
+		"K8TS_DECISION=" + decision.Decision,
+		"K8TS_RULE=" + decision.Rule,
+		"K8TS_POLICY=" + decision.Policy,
+		"K8TS_FILE=" + decision.File,
+		"K8TS_POD=" + name.Pod,
+		"K8TS_NAMESPACE=" + name.Namespace,
+		"K8TS_CONTAINER=" + name.Container,
+		"K8TS_CONTAINER_ID=" + name.ContainerID,
+	}
+	if t != nil {
+		env = append(env,
+			"K8TS_TOMBSTONE="+t.Path,
+			"K8TS_METADATA="+store.MetadataPath(t.Path),
+			"K8TS_SIZE="+strconv.FormatInt(t.Size, 10),
+			"K8TS_KEEP_REASON="+t.KeepReason)
+	}
+	return env
+}
+
+// runHook runs script with path as argument, killing it past timeout
+// along with the processes it started, which would otherwise keep its
+// output open.
+func runHook(script string, path string, env []string, timeout time.Duration, fileName string) {
+	started := time.Now()
+	cmd := exec.Command(script, path)
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	var output bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &output, &output
+	err := cmd.Start()
+	if err == nil {
+		var timedOut int32
+		timer := time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		})
+		err = cmd.Wait()
+		timer.Stop()
+		if atomic.LoadInt32(&timedOut) == 1 {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+	}
+	if err != nil {
+		text := strings.TrimSpace(output.String())
+		if len(text) > maxHookOutput {
+			text = text[len(text)-maxHookOutput:]
+		}
+		logger.Warn("Hook failed", "hook", script, "file", fileName, "error", err, "output", text)
+		return
+	}
+	logger.Debug("Hook done", "hook", script, "file", fileName, "duration", time.Since(started))
+}
+
+// wait returns once the hooks started are done, when the monitor stops.
+func (h *hookRunner) wait() {
+	h.done.Wait()
+}
@@ -0,0 +1,148 @@
+package monitor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/convert"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+const KubernetesPodLogsPath = "/var/log/pods"
+
+type ImportArgs struct {
+	PodsDir        *string
+	Dir            *string
+	SkipConversion *bool
+	DryRun         *bool
+}
+
+// ImportLogs backfills the tombstone store with the logs left in
+// /var/log/pods by pods that no longer exist. Kubelet lays them out as
+//
+//	<namespace>_<pod>_<uid>/<container>/<restart>.log[.<date>][.gz]
+//
+// rotated logs being decompressed as they are imported, and a pod is considered gone once no file in /var/log/containers
+// points into its directory.
+func ImportLogs(args *ImportArgs) error {
+	live, err := livePodDirs(*args.PodsDir)
+	if err != nil {
+		return err
+	}
+	pods, err := ioutil.ReadDir(*args.PodsDir)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(*args.Dir, 0755)
+	if err != nil {
+		return err
+	}
+	node, _ := os.Hostname()
+	imported := 0
+	for _, pod := range pods {
+		if !pod.IsDir() || live[pod.Name()] {
+			continue
+		}
+		parts := strings.SplitN(pod.Name(), "_", 3)
+		if len(parts) != 3 {
+			logger.Warn("Skipping unexpected directory", "name", pod.Name())
+			continue
+		}
+		logs, _ := filepath.Glob(filepath.Join(*args.PodsDir, pod.Name(), "*", "*.log*"))
+		for _, source := range logs {
+			// Kubelet compresses rotated logs to .gz.tmp files, renamed
+			// once complete.
+			if strings.HasSuffix(source, ".tmp") {
+				continue
+			}
+			rotation := strings.TrimSuffix(filepath.Base(source), ".gz")
+			rotation = strings.Replace(strings.Replace(rotation, ".log", "", 1), "-", "", -1)
+			t := store.Tombstone{
+				Namespace:   parts[0],
+				Pod:         parts[1],
+				Container:   filepath.Base(filepath.Dir(source)),
+				ContainerID: "imported." + rotation,
+				Node:        node,
+				Source:      source,
+				PreservedAt: time.Now(),
+				Imported:    true,
+			}
+			t.Path = filepath.Join(*args.Dir,
+				fmt.Sprintf("%s_%s_%s-%s.log", t.Pod, t.Namespace, t.Container, t.ContainerID))
+			if _, err := os.Stat(t.Path); err == nil {
+				continue
+			}
+			if *args.DryRun {
+				fmt.Printf("Would import %s as %s\n", source, t.Path)
+				continue
+			}
+			err = importLog(&t, *args.SkipConversion)
+			if err != nil {
+				logger.Error("Failed to import log", "source", source, "error", err)
+				continue
+			}
+			fmt.Printf("Imported %s as %s\n", source, t.Path)
+			imported++
+		}
+	}
+	fmt.Printf("Imported %d logs\n", imported)
+	return nil
+}
+
+// livePodDirs returns the pod log directories that still have a container
+// log linked from /var/log/containers.
+func livePodDirs(podsDir string) (map[string]bool, error) {
+	live := make(map[string]bool)
+	entries, err := ioutil.ReadDir(KubernetesLogsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return live, nil
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join(KubernetesLogsPath, entry.Name()))
+		if err != nil {
+			continue
+		}
+		relative, err := filepath.Rel(podsDir, target)
+		if err != nil || strings.HasPrefix(relative, "..") {
+			continue
+		}
+		live[strings.SplitN(relative, string(filepath.Separator), 2)[0]] = true
+	}
+	return live, nil
+}
+
+func importLog(t *store.Tombstone, skipConversion bool) error {
+	source, err := store.OpenTombstone(t.Source)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = source.Close() }()
+	destination, err := os.OpenFile(t.Path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if skipConversion {
+		err = passThrough(destination, source)
+	} else {
+		_, err = jsonToText(destination, source, nil, nil, convert.Rewrite{}, store.ParseLogName(t.Path))
+	}
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(t.Path)
+		return err
+	}
+	if stat, err := os.Stat(t.Path); err == nil {
+		t.Size = stat.Size()
+	}
+	return store.WriteMetadata(t)
+}
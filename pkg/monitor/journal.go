@@ -0,0 +1,255 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/identity"
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// journalDirName is the directory of the tombstone store holding an entry
+// for every tombstone being written, so that the copies interrupted by a
+// crash or a reboot are found on the next start.
+const journalDirName = ".journal"
+
+// journalInterval is how often the progress of a copy is journaled.
+const journalInterval = 5 * time.Second
+
+func journalDir() string {
+	return filepath.Join(TombstonePath, journalDirName)
+}
+
+// journalEntry describes a copy in progress: the log copied, identified by
+// its device and inode as its path may be reused, and how far it went.
+type journalEntry struct {
+	File      string    `json:"file"`
+	Tombstone string    `json:"tombstone"`
+	Source    string    `json:"source"`
+	Device    uint64    `json:"device"`
+	Inode     uint64    `json:"inode"`
+	Size      int64     `json:"size"`
+	Written   int64     `json:"written"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// copyJournal keeps the entry of a copy up to date until it ends.
+type copyJournal struct {
+	entry       journalEntry
+	path        string
+	destination *os.File
+	done        chan struct{}
+	tracking    sync.WaitGroup
+}
+
+// fileIdentity returns the device and inode of a file.
+func fileIdentity(info os.FileInfo) (uint64, uint64) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev), uint64(stat.Ino)
+	}
+	return 0, 0
+}
+
+// openedPath returns the path of an open file, where the symlinks of
+// /var/log/containers lead, even once the file is deleted.
+func openedPath(file *os.File) string {
+	path, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", file.Fd()))
+	if err != nil {
+		return file.Name()
+	}
+	return strings.TrimSuffix(path, " (deleted)")
+}
+
+// beginCopy journals the copy of the log fileName from source to the
+// tombstone destination, until end is called. Copies are not journaled
+// when the entry can't be written.
+func beginCopy(fileName string, source *os.File, destination *os.File) *copyJournal {
+	info, err := source.Stat()
+	if err != nil {
+		logger.Warn("Failed to journal copy", "file", fileName, "error", err)
+		return nil
+	}
+	device, inode := fileIdentity(info)
+	j := &copyJournal{
+		entry: journalEntry{
+			File:      fileName,
+			Tombstone: destination.Name(),
+			Source:    openedPath(source),
+			Device:    device,
+			Inode:     inode,
+			Size:      info.Size(),
+			StartedAt: time.Now(),
+		},
+		path:        filepath.Join(journalDir(), fileName+".json"),
+		destination: destination,
+		done:        make(chan struct{}),
+	}
+	err = os.MkdirAll(journalDir(), 0755)
+	if err == nil {
+		err = j.save()
+	}
+	if err != nil {
+		logger.Warn("Failed to journal copy", "file", fileName, "error", err)
+		return nil
+	}
+	j.tracking.Add(1)
+	go j.track()
+	return j
+}
+
+// save replaces the entry, synced to disk to outlive a reboot.
+func (j *copyJournal) save() error {
+	content, err := json.Marshal(&j.entry)
+	if err != nil {
+		return err
+	}
+	temporary := j.path + ".tmp"
+	file, err := os.OpenFile(temporary, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(content)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(temporary)
+		return err
+	}
+	return os.Rename(temporary, j.path)
+}
+
+// track journals the bytes written to the tombstone every
+// journalInterval.
+func (j *copyJournal) track() {
+	defer j.tracking.Done()
+	ticker := time.NewTicker(journalInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-j.done:
+			return
+		}
+		info, err := j.destination.Stat()
+		if err != nil {
+			continue
+		}
+		j.entry.Written = info.Size()
+		if err := j.save(); err != nil {
+			logger.Debug("Failed to journal copy progress", "file", j.entry.File, "error", err)
+		}
+	}
+}
+
+// end removes the entry once the copy is over, whether it succeeded or not.
+func (j *copyJournal) end() {
+	if j == nil {
+		return
+	}
+	close(j.done)
+	j.tracking.Wait()
+	_ = os.Remove(j.path)
+}
+
+// resumeCopies deals with the copies left in the journal by a previous
+// run: they are done again if their log is still around, otherwise their
+// tombstone is marked incomplete in its metadata sidecar rather than
+// passing for the whole log.
+func (m *Monitor) resumeCopies() {
+	entries, err := ioutil.ReadDir(journalDir())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("Failed to read copy journal", "path", journalDir(), "error", err)
+		}
+		return
+	}
+	for _, info := range entries {
+		path := filepath.Join(journalDir(), info.Name())
+		if filepath.Ext(path) != ".json" {
+			_ = os.Remove(path)
+			continue
+		}
+		content, err := ioutil.ReadFile(path)
+		var entry journalEntry
+		if err == nil {
+			err = json.Unmarshal(content, &entry)
+		}
+		if err != nil || entry.File == "" {
+			logger.Warn("Dropping unreadable copy journal entry", "path", path, "error", err)
+			_ = os.Remove(path)
+			continue
+		}
+		m.resumeCopy(&entry)
+		_ = os.Remove(path)
+	}
+}
+
+func (m *Monitor) resumeCopy(entry *journalEntry) {
+	tombstoneInfo, err := os.Stat(entry.Tombstone)
+	if err != nil {
+		logger.Info("Interrupted copy left no tombstone", "file", entry.File, "tombstone", entry.Tombstone)
+		return
+	}
+	source, err := os.Open(entry.Source)
+	if err == nil {
+		device, inode := uint64(0), uint64(0)
+		if info, err := source.Stat(); err == nil {
+			device, inode = fileIdentity(info)
+		}
+		if device == entry.Device && inode == entry.Inode {
+			logger.Warn("Copying again log whose copy was interrupted", "file", entry.File,
+				"tombstone", entry.Tombstone, "written", FormatSize(tombstoneInfo.Size()),
+				"size", FormatSize(entry.Size))
+			_ = os.Remove(entry.Tombstone)
+			job := &preservation{
+				fileName:     entry.File,
+				source:       source,
+				policy:       m.policyFor(entry.File),
+				kube:         m.kube,
+				rules:        m.rules,
+				groupPods:    *m.args.GroupPods,
+				describePods: *m.args.DescribePods,
+			}
+			m.copies.run(func() { m.preserve(job) })
+			return
+		}
+		_ = source.Close()
+	}
+	logger.Warn("Tombstone incomplete, its copy was interrupted and its log is gone", "file", entry.File,
+		"tombstone", entry.Tombstone, "written", FormatSize(tombstoneInfo.Size()), "size", FormatSize(entry.Size))
+	name := store.ParseLogName(entry.File)
+	t := store.Tombstone{
+		Path:        entry.Tombstone,
+		Pod:         name.Pod,
+		Namespace:   name.Namespace,
+		Container:   name.Container,
+		ContainerID: name.ContainerID,
+		Source:      entry.Source,
+		Size:        tombstoneInfo.Size(),
+		PreservedAt: entry.StartedAt,
+		Cluster:     identity.Cluster(),
+		Node:        identity.Node(),
+		Incomplete:  true,
+	}
+	err = store.WriteMetadata(&t)
+	if err != nil {
+		logger.Error("Failed to write metadata", "file", entry.File, "error", err)
+	}
+	signer.sign(entry.Tombstone)
+	m.policyFor(entry.File).permissions.applyTombstone(entry.Tombstone)
+	decision := &auditRecord{File: entry.File, Decision: "incomplete", Bytes: t.Size}
+	audit.record(decision, time.Time{})
+	telemetry.observe(decision, time.Time{})
+}
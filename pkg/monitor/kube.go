@@ -0,0 +1,569 @@
+package monitor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/store"
+	"gopkg.in/yaml.v2"
+)
+
+// KubeInCluster selects the service account of the pod k8ts runs in as
+// --kube-api, instead of a kubeconfig.
+const KubeInCluster = "in-cluster"
+
+// kubeKubelet selects the kubeconfig of the kubelet of the node, wherever
+// the distribution keeps it.
+const kubeKubelet = "kubelet"
+
+const kubeServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeTimeout bounds every request to the API server, which must not hold
+// tombstones back for long.
+const kubeTimeout = 5 * time.Second
+
+var errKubeNotFound = errors.New("not found")
+
+// kubeClient makes the few read-only requests of the monitor to the
+// Kubernetes API server, without pulling a client library in.
+type kubeClient struct {
+	server    string
+	token     string
+	tokenFile string
+	client    *http.Client
+}
+
+// kubeconfig is the part of a kubeconfig file the monitor needs.
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// newKubeClient connects to the API server of source, a kubeconfig file
+// or KubeInCluster.
+func newKubeClient(source string) (*kubeClient, error) {
+	if source == KubeInCluster {
+		return inClusterClient()
+	}
+	content, err := ioutil.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+	config := kubeconfig{}
+	err = yaml.Unmarshal(content, &config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kubeconfig '%s': %v", source, err)
+	}
+	clusterName, userName := "", ""
+	for _, context := range config.Contexts {
+		if context.Name == config.CurrentContext || config.CurrentContext == "" {
+			clusterName, userName = context.Context.Cluster, context.Context.User
+			break
+		}
+	}
+	// Paths in a kubeconfig are relative to it.
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(filepath.Dir(source), path)
+	}
+	k := &kubeClient{}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	for _, cluster := range config.Clusters {
+		if cluster.Name != clusterName {
+			continue
+		}
+		k.server = strings.TrimSuffix(cluster.Cluster.Server, "/")
+		tlsConfig.InsecureSkipVerify = cluster.Cluster.InsecureSkipTLSVerify
+		ca, err := inlineOrFile(cluster.Cluster.CertificateAuthorityData, resolve(cluster.Cluster.CertificateAuthority))
+		if err != nil {
+			return nil, err
+		}
+		if ca != nil {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("no certificates found in the certificate authority of '%s'", source)
+			}
+		}
+	}
+	if k.server == "" {
+		return nil, fmt.Errorf("no cluster found for the current context of '%s'", source)
+	}
+	for _, user := range config.Users {
+		if user.Name != userName {
+			continue
+		}
+		k.token, k.tokenFile = user.User.Token, resolve(user.User.TokenFile)
+		cert, err := inlineOrFile(user.User.ClientCertificateData, resolve(user.User.ClientCertificate))
+		if err != nil {
+			return nil, err
+		}
+		key, err := inlineOrFile(user.User.ClientKeyData, resolve(user.User.ClientKey))
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil {
+			certificate, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load the client certificate of '%s': %v", source, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{certificate}
+		}
+	}
+	k.client = &http.Client{Timeout: kubeTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	return k, nil
+}
+
+// inClusterClient uses the service account mounted in every pod.
+func inClusterClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod, give a kubeconfig to --kube-api")
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(kubeServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in the service account CA")
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: rootCAs}
+	return &kubeClient{
+		server: "https://" + net.JoinHostPort(host, port),
+		// The token is rotated, it is read again for every request.
+		tokenFile: filepath.Join(kubeServiceAccountDir, "token"),
+		client:    &http.Client{Timeout: kubeTimeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+	}, nil
+}
+
+// inlineOrFile returns the base64 data of a kubeconfig entry or the
+// content of the file it points to, or nil if it has neither.
+func inlineOrFile(data string, path string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if path != "" {
+		return ioutil.ReadFile(path)
+	}
+	return nil, nil
+}
+
+// get decodes the object at path of the API server into result.
+func (k *kubeClient) get(path string, result interface{}) error {
+	response, err := k.open(k.client, path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = response.Body.Close() }()
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// stream opens a watch at path, which lasts longer than kubeTimeout.
+func (k *kubeClient) stream(path string) (io.ReadCloser, error) {
+	response, err := k.open(&http.Client{Transport: k.client.Transport}, path)
+	if err != nil {
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (k *kubeClient) open(client *http.Client, path string) (*http.Response, error) {
+	request, err := http.NewRequest(http.MethodGet, k.server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	token := k.token
+	if k.tokenFile != "" {
+		content, err := ioutil.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	request.Header.Set("Accept", "application/json")
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		_ = response.Body.Close()
+		if response.StatusCode == http.StatusNotFound {
+			return nil, errKubeNotFound
+		}
+		return nil, fmt.Errorf("%s: %s", path, response.Status)
+	}
+	return response, nil
+}
+
+// kubeObject is the part of pods and their owners the monitor reads.
+type kubeObject struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		UID             string            `json:"uid"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Labels          map[string]string `json:"labels"`
+		Annotations     map[string]string `json:"annotations"`
+		OwnerReferences []struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"ownerReferences"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		Phase             string            `json:"phase"`
+		Reason            string            `json:"reason"`
+		Message           string            `json:"message"`
+		ContainerStatuses []containerStatus `json:"containerStatuses"`
+	} `json:"status"`
+}
+
+type containerStatus struct {
+	Name         string         `json:"name"`
+	ContainerID  string         `json:"containerID"`
+	RestartCount int            `json:"restartCount"`
+	State        containerState `json:"state"`
+	LastState    containerState `json:"lastState"`
+}
+
+type containerState struct {
+	Waiting *struct {
+		Reason string `json:"reason"`
+	} `json:"waiting"`
+	Terminated *struct {
+		ContainerID string `json:"containerID"`
+		Reason      string `json:"reason"`
+		ExitCode    int    `json:"exitCode"`
+	} `json:"terminated"`
+}
+
+// trimContainerID drops the runtime prefix (e.g. containerd://) of the
+// container IDs of the API, leaving the one in log names.
+func trimContainerID(containerID string) string {
+	if separator := strings.Index(containerID, "://"); separator >= 0 {
+		return containerID[separator+3:]
+	}
+	return containerID
+}
+
+// retentionAnnotation overrides the retention of the tombstones of a pod,
+// e.g. "72h" or "30d".
+const retentionAnnotation = "k8ts.io/retention"
+
+// Annotations too large to be worth keeping with every tombstone.
+var skippedAnnotations = []string{"kubectl.kubernetes.io/last-applied-configuration"}
+
+// metadata returns what a pod object tells about itself, without looking
+// its owners up.
+func (pod *kubeObject) metadata() *store.PodMetadata {
+	result := &store.PodMetadata{
+		Labels:      pod.Metadata.Labels,
+		Annotations: pod.Metadata.Annotations,
+		Node:        pod.Spec.NodeName,
+		Phase:       pod.Status.Phase,
+		Reason:      pod.Status.Reason,
+		Message:     pod.Status.Message,
+	}
+	for _, annotation := range skippedAnnotations {
+		delete(result.Annotations, annotation)
+	}
+	for _, owner := range pod.Metadata.OwnerReferences {
+		result.Owners = append(result.Owners, store.PodOwner{Kind: owner.Kind, Name: owner.Name})
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		c := store.PodContainer{
+			Name:        status.Name,
+			ContainerID: trimContainerID(status.ContainerID),
+			Restarts:    status.RestartCount,
+		}
+		if waiting := status.State.Waiting; waiting != nil {
+			c.Reason = waiting.Reason
+			c.CrashLooped = waiting.Reason == "CrashLoopBackOff"
+		}
+		if terminated := status.State.Terminated; terminated != nil {
+			c.Reason, c.ExitCode = terminated.Reason, terminated.ExitCode
+		}
+		if terminated := status.LastState.Terminated; terminated != nil {
+			c.LastID = trimContainerID(terminated.ContainerID)
+			c.LastReason, c.LastExitCode = terminated.Reason, terminated.ExitCode
+		}
+		result.Containers = append(result.Containers, c)
+	}
+	return result
+}
+
+// pod looks up a pod and its owners, following ReplicaSets up to their
+// Deployment.
+func (k *kubeClient) pod(namespace string, name string) (*store.PodMetadata, error) {
+	pod := kubeObject{}
+	err := k.get(fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", namespace, name), &pod)
+	if err != nil {
+		return nil, err
+	}
+	result := pod.metadata()
+	for _, owner := range pod.Metadata.OwnerReferences {
+		if owner.Kind != "ReplicaSet" {
+			continue
+		}
+		replicaSet := kubeObject{}
+		err = k.get(fmt.Sprintf("/apis/apps/v1/namespaces/%s/replicasets/%s", namespace, owner.Name), &replicaSet)
+		if err != nil {
+			logger.Debug("Failed to look up ReplicaSet", "namespace", namespace, "name", owner.Name, "error", err)
+			continue
+		}
+		for _, parent := range replicaSet.Metadata.OwnerReferences {
+			result.Owners = append(result.Owners, store.PodOwner{Kind: parent.Kind, Name: parent.Name})
+		}
+	}
+	return result, nil
+}
+
+// podCacheTTL is how long pods looked up when their logs appear are
+// remembered, in case they are gone from the API when the logs go away.
+const podCacheTTL = 24 * time.Hour
+
+type cachedPod struct {
+	metadata *store.PodMetadata
+	seen     time.Time
+	// resolved is set once the owners of the pod were looked up.
+	resolved bool
+}
+
+type cachedJob struct {
+	failure string
+	seen    time.Time
+}
+
+// podCache remembers the pods seen by the monitor and the Jobs found to
+// have failed, keyed by <namespace>/<name>.
+type podCache struct {
+	mutex sync.Mutex
+	pods  map[string]cachedPod
+	jobs  map[string]cachedJob
+	// fetching are the pods being looked up by prefetch.
+	fetching map[string]bool
+}
+
+// prefetch looks a pod up in the background, unless it is cached or being
+// looked up already.
+func (c *podCache) prefetch(k *kubeClient, namespace string, name string) {
+	key := namespace + "/" + name
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, cached := c.pods[key]; cached || c.fetching[key] {
+		return
+	}
+	if c.fetching == nil {
+		c.fetching = make(map[string]bool)
+	}
+	c.fetching[key] = true
+	go func() {
+		c.fetch(k, namespace, name)
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		delete(c.fetching, key)
+	}()
+}
+
+// fetch looks up a pod not already in the cache, dropping the expired
+// entries.
+func (c *podCache) fetch(k *kubeClient, namespace string, name string) {
+	key := namespace + "/" + name
+	c.mutex.Lock()
+	if c.pods == nil {
+		c.pods = make(map[string]cachedPod)
+	}
+	cached := c.pods[key].resolved
+	for other, pod := range c.pods {
+		if time.Since(pod.seen) > podCacheTTL {
+			delete(c.pods, other)
+		}
+	}
+	for other, job := range c.jobs {
+		if time.Since(job.seen) > podCacheTTL {
+			delete(c.jobs, other)
+		}
+	}
+	c.mutex.Unlock()
+	if cached {
+		return
+	}
+	pod, err := k.pod(namespace, name)
+	if err != nil {
+		logger.Debug("Failed to look up pod", "namespace", namespace, "pod", name, "error", err)
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.store(key, pod, true)
+}
+
+// labels returns the labels of a cached pod, nil if it isn't cached.
+func (c *podCache) labels(namespace string, name string) map[string]string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	pod, ok := c.pods[namespace+"/"+name]
+	if !ok {
+		return nil
+	}
+	if pod.metadata.Labels == nil {
+		return map[string]string{}
+	}
+	return pod.metadata.Labels
+}
+
+// update records the state of a pod, as given by a watch event.
+func (c *podCache) update(namespace string, name string, pod *store.PodMetadata) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.store(namespace+"/"+name, pod, false)
+}
+
+// store caches pod, keeping the owners found by an earlier lookup and
+// remembering the containers which were crash looping. Called with the
+// mutex held.
+func (c *podCache) store(key string, pod *store.PodMetadata, resolved bool) {
+	if c.pods == nil {
+		c.pods = make(map[string]cachedPod)
+	}
+	if previous, ok := c.pods[key]; ok {
+		if len(previous.metadata.Owners) > len(pod.Owners) {
+			pod.Owners = previous.metadata.Owners
+		}
+		for i := range pod.Containers {
+			for _, old := range previous.metadata.Containers {
+				if old.Name == pod.Containers[i].Name && old.CrashLooped {
+					pod.Containers[i].CrashLooped = true
+				}
+			}
+		}
+		resolved = resolved || previous.resolved
+	}
+	c.pods[key] = cachedPod{metadata: pod, seen: time.Now(), resolved: resolved}
+}
+
+// lookup returns the latest state of a pod, or the one cached when it
+// was seen last if the API server no longer has it.
+func (c *podCache) lookup(k *kubeClient, namespace string, name string) *store.PodMetadata {
+	key := namespace + "/" + name
+	pod, err := k.pod(namespace, name)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err == nil {
+		c.store(key, pod, true)
+		return pod
+	}
+	if err != errKubeNotFound {
+		logger.Warn("Failed to look up pod", "namespace", namespace, "pod", name, "error", err)
+	}
+	return c.pods[key].metadata
+}
+
+// jobFailure tells why a Job failed (e.g. BackoffLimitExceeded), or ""
+// if it didn't, at least not yet.
+func (k *kubeClient) jobFailure(namespace string, name string) (string, error) {
+	job := struct {
+		Status struct {
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+				Reason string `json:"reason"`
+			} `json:"conditions"`
+		} `json:"status"`
+	}{}
+	err := k.get(fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s", namespace, name), &job)
+	if err != nil {
+		return "", err
+	}
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == "Failed" && condition.Status == "True" {
+			if condition.Reason == "" {
+				return "Failed", nil
+			}
+			return condition.Reason, nil
+		}
+	}
+	return "", nil
+}
+
+// failedJob returns the Job owning pod and why it failed, if it did.
+func (c *podCache) failedJob(k *kubeClient, namespace string, pod *store.PodMetadata) (string, string) {
+	for _, owner := range pod.Owners {
+		if owner.Kind != "Job" {
+			continue
+		}
+		key := namespace + "/" + owner.Name
+		c.mutex.Lock()
+		job, known := c.jobs[key]
+		c.mutex.Unlock()
+		if !known {
+			failure, err := k.jobFailure(namespace, owner.Name)
+			if err != nil {
+				logger.Warn("Failed to look up Job", "namespace", namespace, "job", owner.Name, "error", err)
+				continue
+			}
+			// Jobs which didn't fail yet may still do, only failures are
+			// remembered.
+			job = cachedJob{failure: failure, seen: time.Now()}
+			if failure != "" {
+				c.mutex.Lock()
+				if c.jobs == nil {
+					c.jobs = make(map[string]cachedJob)
+				}
+				c.jobs[key] = job
+				c.mutex.Unlock()
+			}
+		}
+		if job.failure != "" {
+			return owner.Name, job.failure
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,118 @@
+package monitor
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/badeadan/k8ts/internal/settings"
+)
+
+// labelRequirement is one of the comma-separated requirements of a label
+// selector, written as in kubectl: key=value, key==value, key!=value,
+// key in (a, b), key notin (a, b), key or !key.
+type labelRequirement struct {
+	key      string
+	operator string
+	values   []string
+}
+
+// labelSelector matches the labels of pods against all its requirements.
+type labelSelector []labelRequirement
+
+const (
+	labelIn       = "in"
+	labelNotIn    = "notin"
+	labelExists   = "exists"
+	labelNotExist = "!"
+)
+
+var labelRequirementPattern = regexp.MustCompile(
+	`^(!?)\s*([A-Za-z0-9][-A-Za-z0-9_./]*)\s*(?:(==?|!=)\s*([-A-Za-z0-9_.]*)|\s(in|notin)\s*\(([^()]*)\))?$`)
+
+// compileLabelSelector parses selector, which selects every pod when empty.
+func compileLabelSelector(selector string) (labelSelector, error) {
+	var compiled labelSelector
+	for _, requirement := range splitLabelSelector(selector) {
+		requirement = strings.TrimSpace(requirement)
+		match := labelRequirementPattern.FindStringSubmatch(requirement)
+		if match == nil || (match[1] != "" && (match[3] != "" || match[5] != "")) {
+			return nil, fmt.Errorf("invalid label requirement '%s' in labels '%s'", requirement, selector)
+		}
+		r := labelRequirement{key: match[2], operator: labelExists}
+		switch {
+		case match[1] != "":
+			r.operator = labelNotExist
+		case match[3] != "":
+			r.operator, r.values = labelIn, []string{match[4]}
+			if match[3] == "!=" {
+				r.operator = labelNotIn
+			}
+		case match[5] != "":
+			r.operator = match[5]
+			for _, value := range strings.Split(match[6], ",") {
+				r.values = append(r.values, strings.TrimSpace(value))
+			}
+		}
+		compiled = append(compiled, r)
+	}
+	return compiled, nil
+}
+
+// splitLabelSelector splits selector on the commas outside of the value
+// lists of in and notin.
+func splitLabelSelector(selector string) []string {
+	if strings.TrimSpace(selector) == "" {
+		return nil
+	}
+	var requirements []string
+	depth, start := 0, 0
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				requirements = append(requirements, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(requirements, selector[start:])
+}
+
+// matches tells whether labels meet every requirement of the selector.
+// Labels are nil when unknown, e.g. without --kube-api, and then only an
+// empty selector matches.
+func (s labelSelector) matches(labels map[string]string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	if labels == nil {
+		return false
+	}
+	for _, r := range s {
+		value, ok := labels[r.key]
+		switch r.operator {
+		case labelExists:
+			if !ok {
+				return false
+			}
+		case labelNotExist:
+			if ok {
+				return false
+			}
+		case labelIn:
+			if !ok || !settings.Contains(r.values, value) {
+				return false
+			}
+		case labelNotIn:
+			if ok && settings.Contains(r.values, value) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package monitor
+
+import (
+	"bytes"
+	"io"
+)
+
+// Sources put in front of the lines of the logs of several containers
+// printed together, like `kubectl logs --prefix`.
+const (
+	PrefixNone      = "none"
+	PrefixContainer = "container"
+	PrefixPod       = "pod"
+)
+
+// linePrefix is what goes in front of the lines of a container with the
+// given --prefix.
+func linePrefix(mode string, pod string, container string) string {
+	switch mode {
+	case PrefixContainer:
+		return container + ": "
+	case PrefixPod:
+		return pod + "/" + container + ": "
+	}
+	return ""
+}
+
+// prefixWriter puts a prefix in front of every line written through it.
+type prefixWriter struct {
+	writer  io.Writer
+	prefix  []byte
+	midLine bool
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if !p.midLine {
+			if _, err := p.writer.Write(p.prefix); err != nil {
+				return written, err
+			}
+			p.midLine = true
+		}
+		chunk := data
+		if end := bytes.IndexByte(data, '\n'); end >= 0 {
+			chunk = data[:end+1]
+		}
+		n, err := p.writer.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p.midLine = chunk[len(chunk)-1] != '\n'
+		data = data[len(chunk):]
+	}
+	return written, nil
+}
@@ -0,0 +1,78 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+type ListArgs struct {
+	Filter  *FilterArgs
+	Output  *string
+	Watched *bool
+}
+
+func List(args *ListArgs) error {
+	filter, err := newTombstoneFilter(args.Filter)
+	if err != nil {
+		return err
+	}
+	if *args.Watched {
+		return listWatched(filter, *args.Output)
+	}
+	tombstones, err := store.FindTombstones(*args.Filter.dir, filter)
+	if err != nil {
+		return err
+	}
+	if *args.Output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(tombstones)
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "PRESERVED\tNAMESPACE\tPOD\tCONTAINER\tSIZE\tPATH")
+	for _, t := range tombstones {
+		size := FormatSize(t.Size)
+		if t.Incomplete {
+			size += " (incomplete)"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			t.PreservedAt.Format(time.RFC3339), t.Namespace, t.Pod,
+			t.Container, size, t.Path)
+	}
+	return table.Flush()
+}
+
+// listWatched lists the logs the running monitor watches, asked through
+// its admin API.
+func listWatched(filter *store.Filter, output string) error {
+	var files []watchedFile
+	err := adminRequest(http.MethodGet, "/v1/files", nil, &files)
+	if err != nil {
+		return err
+	}
+	selected := make([]watchedFile, 0, len(files))
+	for _, file := range files {
+		t := store.Tombstone{Namespace: file.Namespace, Pod: file.Pod, Size: file.Size, PreservedAt: time.Now()}
+		if filter.Match(&t) {
+			selected = append(selected, file)
+		}
+	}
+	if output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(selected)
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "NAMESPACE\tPOD\tCONTAINER\tSIZE\tPOLICY\tPATH")
+	for _, file := range selected {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			file.Namespace, file.Pod, file.Container, FormatSize(file.Size), file.Policy, file.Path)
+	}
+	return table.Flush()
+}
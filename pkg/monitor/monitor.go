@@ -0,0 +1,1514 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/badeadan/k8ts/internal/identity"
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/pkg/convert"
+	"github.com/badeadan/k8ts/pkg/sink"
+	"github.com/badeadan/k8ts/pkg/sink/collector"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// The directories of the container logs and tombstones of the node, which
+// `k8ts bench` and programs embedding the monitor may point elsewhere.
+var KubernetesLogsPath = "/var/log/containers"
+var TombstonePath = "/var/log/tombstone"
+
+func openFile(name string) (*os.File, error) {
+	filePath := name
+	if !filepath.IsAbs(name) {
+		filePath = filepath.Join(KubernetesLogsPath, name)
+	}
+	for {
+		stat, err := os.Stat(filePath)
+		if err != nil {
+			logger.Error("Stat failed", "path", filePath, "error", err)
+			return nil, err
+		}
+		if (stat.Mode() & os.ModeSymlink) != os.ModeSymlink {
+			break
+		}
+		newPath, err := os.Readlink(filePath)
+		if err != nil {
+			logger.Error("Unable to read link", "path", filePath, "error", err)
+			break
+		}
+		if newPath == filePath {
+			break
+		}
+		filePath = newPath
+	}
+
+	return os.Open(filePath)
+}
+
+// Monitor preserves the logs of the containers of the node when they are
+// deleted, as tombstones.
+type Monitor struct {
+	policies     []*policy
+	policyConfig string
+	// clusterPolicies are the K8tsPolicy resources, with --cluster-policies.
+	clusterPolicies []policyConfig
+	monitoredFiles  map[string](*os.File)
+	sinks           map[string]sink.Sink
+	state           monitorState
+	args            *Args
+	// watched is set once the source was first opened.
+	watched bool
+	// container is set when running as the main process of a container,
+	// which leaves the init system out of the picture.
+	container bool
+	health    healthState
+	disk      diskPressure
+	// kube looks pods up when --kube-api is given.
+	kube    *kubeClient
+	kubeAPI string
+	// distribution is the Kubernetes distribution of the node, as detected
+	// or given by --distribution.
+	distribution *distribution
+	pods         podCache
+	// podFiles are the logs watched for every pod with --source kube-api,
+	// keyed by <namespace>/<pod>, and preservedPods the evicted pods whose
+	// logs were preserved already.
+	podFiles      map[string][]string
+	preservedPods map[string]bool
+	// restarted are the logs preserved when their container restarted,
+	// until the kubelet deletes them.
+	restarted map[string]bool
+	// deferred are the logs watched before the labels of their pod were
+	// known, whose filters are applied once deleted.
+	deferred map[string]bool
+	// copies writes the tombstones of deleted logs and merging keeps
+	// them from merging the logs of a pod at the same time.
+	copies  copyQueue
+	merging sync.Mutex
+	// dirPermissions are those of the directories of tombstones.
+	dirPermissions permissions
+	// full degrades preservation when the tombstone volume is full.
+	full diskFull
+	// limits are those of the cgroup of the monitor, which the copies
+	// and their buffers are fitted in.
+	limits cgroupLimits
+	// script decides on deleted logs ahead of the other rules, with
+	// --decision-script.
+	script *decisionScript
+	// rules are those added through the admin API or persisted in the
+	// configuration file, ahead of the policies.
+	rules []*filterRule
+}
+
+// policyFor returns the policy of a log, from the event loop which must
+// not wait for the API server: when policies select pods by label and the
+// pod isn't known yet, it is looked up in the background and the policy is
+// the one of pods whose labels are unknown.
+func (m *Monitor) policyFor(fileName string) *policy {
+	labels, _ := m.podLabels(fileName)
+	return policyFor(m.policies, fileName, labels)
+}
+
+// podLabels returns the labels of the pod of a log when policies select
+// pods by label, and whether they are still unknown, the pod being looked
+// up in the background then.
+func (m *Monitor) podLabels(fileName string) (map[string]string, bool) {
+	if m.kube == nil || !selectsLabels(m.policies) {
+		return nil, false
+	}
+	name := store.ParseLogName(fileName)
+	labels := m.pods.labels(name.Namespace, name.Pod)
+	if labels == nil {
+		m.pods.prefetch(m.kube, name.Namespace, name.Pod)
+		return nil, true
+	}
+	return labels, false
+}
+
+func (m *Monitor) skip(fileName string) bool {
+	p := m.policyFor(fileName)
+	if r := ruleFor(m.rules, fileName); r != nil {
+		if r.Kind == ruleInclude {
+			return false
+		}
+		logger.Debug("Excluded by a rule. Skip it", "file", fileName, "rule", r.ID)
+		skipped := &auditRecord{File: fileName, Policy: p.name, Decision: "skipped", Rule: "rule"}
+		audit.record(skipped, time.Time{})
+		telemetry.observe(skipped, time.Time{})
+		return true
+	}
+	// A policy selecting the pod by label may watch the log, which is
+	// decided once deleted.
+	if _, unknown := m.podLabels(fileName); unknown {
+		logger.Debug("Labels of the pod unknown yet, filtered when deleted", "file", fileName)
+		m.deferred[fileName] = true
+		return false
+	}
+	if rule := p.filter(fileName); rule != "" {
+		skipped := &auditRecord{File: fileName, Policy: p.name, Decision: "skipped", Rule: rule}
+		audit.record(skipped, time.Time{})
+		telemetry.observe(skipped, time.Time{})
+		return true
+	}
+	return false
+}
+
+func (m *Monitor) watch(fileName string) {
+	m.preservePrevious(fileName)
+	m.watchPath(fileName, fileName)
+}
+
+// preservePrevious makes tombstones of the logs of the previous instances
+// of the container of fileName, which just restarted, rather than waiting
+// for the kubelet to delete them: it only keeps the log of the last one,
+// for `kubectl logs --previous`.
+func (m *Monitor) preservePrevious(fileName string) {
+	name := store.ParseLogName(fileName)
+	for other := range m.monitoredFiles {
+		previous := store.ParseLogName(other)
+		if other == fileName || previous.Namespace != name.Namespace || previous.Pod != name.Pod ||
+			previous.Container != name.Container {
+			continue
+		}
+		logger.Info("Container restarted", "file", other, "containerId", name.ContainerID)
+		m.unwatch(other)
+		if *m.args.Source != sourceKubeAPI {
+			m.restarted[other] = true
+		}
+	}
+}
+
+// watchPath keeps the log at path open, to be preserved as fileName.
+func (m *Monitor) watchPath(fileName string, path string) {
+	if m.skip(fileName) {
+		return
+	}
+	file, err := openFile(path)
+	if err != nil {
+		logger.Error("Failed to open file", "file", fileName, "error", err)
+		delete(m.deferred, fileName)
+	} else {
+		m.monitoredFiles[fileName] = file
+	}
+	// Pods may be gone from the API server by the time their logs are
+	// deleted, they are looked up as soon as their logs show up.
+	if m.kube != nil {
+		name := store.ParseLogName(fileName)
+		go m.pods.fetch(m.kube, name.Namespace, name.Pod)
+	}
+}
+
+func (m *Monitor) unwatch(fileName string) {
+	source, ok := m.monitoredFiles[fileName]
+	if !ok && m.restarted[fileName] {
+		logger.Debug("Preserved when its container restarted", "file", fileName)
+		delete(m.restarted, fileName)
+		return
+	}
+	if !ok {
+		logger.Info("Unregistered file gone forever", "file", fileName)
+		return
+	}
+	delete(m.monitoredFiles, fileName)
+	job := &preservation{
+		fileName:     fileName,
+		source:       source,
+		policy:       m.policyFor(fileName),
+		kube:         m.kube,
+		script:       m.script,
+		rules:        m.rules,
+		groupPods:    *m.args.GroupPods,
+		describePods: *m.args.DescribePods,
+		filtered:     m.deferred[fileName],
+	}
+	delete(m.deferred, fileName)
+	if _, unknown := m.podLabels(fileName); unknown {
+		job.policies = m.policies
+	}
+	m.copies.run(func() { m.preserve(job) })
+}
+
+// preservation is a deleted log waiting in the copy queue, with the
+// settings of when it was deleted as the configuration may be reloaded in
+// the meantime.
+type preservation struct {
+	fileName     string
+	source       *os.File
+	policy       *policy
+	kube         *kubeClient
+	script       *decisionScript
+	rules        []*filterRule
+	groupPods    bool
+	describePods bool
+	// policies are set when the labels of the pod were unknown on
+	// deletion, for the policy to be chosen once the pod was looked up.
+	// filtered is set when the filters of the policy are yet to be
+	// applied, the labels being unknown when the log showed up.
+	policies []*policy
+	filtered bool
+	// dropped is the size of the log when only its metadata was recorded.
+	dropped int64
+	// tags are those the decision script gave the log.
+	tags map[string]string
+	// snapshotDir is set when the log is preserved while still written,
+	// at the request of the admin API or periodically, to this directory,
+	// and done is then told how it went. Periodic snapshots copy the log
+	// from snapshotFrom on, and record where they ended in snapshotEnd.
+	snapshotDir  string
+	snapshotFrom int64
+	snapshotEnd  int64
+	done         func(decision *auditRecord, kept *store.Tombstone)
+}
+
+// preserve decides whether a deleted log is kept and writes its tombstone,
+// from the copy queue.
+func (m *Monitor) preserve(job *preservation) {
+	if job.policies != nil {
+		// Off the event loop, the lookup may wait for the API server.
+		name := store.ParseLogName(job.fileName)
+		labels := m.pods.labels(name.Namespace, name.Pod)
+		if labels == nil {
+			m.pods.fetch(job.kube, name.Namespace, name.Pod)
+			labels = m.pods.labels(name.Namespace, name.Pod)
+		}
+		job.policy = policyFor(job.policies, job.fileName, labels)
+	}
+	fileName, source, p := job.fileName, job.source, job.policy
+	defer func() { _ = source.Close() }()
+	started := time.Now()
+	decision := &auditRecord{File: fileName, Policy: p.name, Decision: "failed"}
+	var kept *store.Tombstone
+	defer func() {
+		audit.record(decision, started)
+		telemetry.observe(decision, started)
+		hooks.run(decision, source.Name(), kept)
+		if job.done != nil {
+			job.done(decision, kept)
+		}
+	}()
+	keepReason := ""
+	if job.snapshotDir != "" {
+		decision.Rule, keepReason = "snapshot", "snapshot"
+	} else if r := ruleFor(job.rules, fileName); r != nil {
+		if r.Kind == ruleExclude {
+			logger.Info("Excluded by a rule. Skip it", "file", fileName, "rule", r.ID)
+			decision.Decision, decision.Rule = "skipped", "rule"
+			return
+		}
+		decision.Rule = "rule"
+	}
+	if job.filtered && decision.Rule == "" {
+		if rule := p.filter(fileName); rule != "" {
+			decision.Decision, decision.Rule = "skipped", rule
+			return
+		}
+	}
+	if job.script != nil && decision.Rule == "" {
+		var pod *store.PodMetadata
+		if job.kube != nil {
+			name := store.ParseLogName(fileName)
+			pod = m.pods.lookup(job.kube, name.Namespace, name.Pod)
+		}
+		scripted := job.script.run(fileName, source, p.name, pod)
+		job.tags = scripted.tags
+		switch scripted.verdict {
+		case "skip":
+			logger.Info("Skipped by the decision script", "file", fileName, "policy", p.name)
+			decision.Decision, decision.Rule = "skipped", "script"
+			return
+		case "keep":
+			decision.Rule = "script"
+		}
+	}
+	if p.keepIf != nil && decision.Rule == "" {
+		_, err := source.Seek(0, io.SeekStart)
+		if err != nil {
+			logger.Error("Seek failed", "file", fileName, "error", err)
+			decision.Error = err.Error()
+			return
+		}
+		if search(source, p.keepIf, p.multilineStart) {
+			decision.Rule = "keep-if"
+		}
+	}
+	if decision.Rule == "" {
+		r, err := keepIfRule(job.rules, fileName, source, p.multilineStart)
+		if err != nil {
+			logger.Error("Seek failed", "file", fileName, "error", err)
+			decision.Error = err.Error()
+			return
+		}
+		if r != nil {
+			logger.Debug("Matches the keep-if of a rule", "file", fileName, "rule", r.ID)
+			decision.Rule = "rule"
+		}
+	}
+	forced := decision.Rule != ""
+	matched := p.keepIf == nil || forced
+	pressure := m.disk.check(&m.state) && !forced
+	level := m.full.current(&m.state)
+	size := int64(0)
+	if stat, err := source.Stat(); err == nil {
+		size = stat.Size()
+	}
+	if !matched || pressure || (level >= degradedKeepOnly && decision.Rule == "") {
+		if rule, reason := m.keepReason(job.kube, fileName); rule != "" {
+			logger.Info("Keeping it whatever its content", "file", fileName, "reason", reason)
+			decision.Rule, keepReason = rule, reason
+		} else if !matched {
+			logger.Info("Does not match keep-if pattern. Skip it", "file", fileName, "policy", p.name)
+			decision.Decision, decision.Rule = "skipped", "keep-if"
+			return
+		} else if pressure {
+			logger.Info("Low free space, not preserved", "file", fileName, "policy", p.name)
+			decision.Decision, decision.Rule = "skipped", "disk-pressure"
+			return
+		} else {
+			logger.Warn("Tombstone volume full, dropped", "file", fileName, "policy", p.name, "size", FormatSize(size))
+			decision.Decision, decision.Rule, decision.Dropped = "dropped", "disk-full", size
+			m.full.drop(size, &m.state)
+			return
+		}
+	}
+	filePath := filepath.Join(TombstonePath, fileName)
+	dir := ""
+	if job.snapshotDir != "" {
+		dir = job.snapshotDir
+	} else if job.groupPods {
+		dir = podTombstoneDir(TombstonePath, fileName)
+	}
+	if dir != "" {
+		err := m.dirPermissions.makeDirs(TombstonePath, dir)
+		if err != nil {
+			logger.Error("Failed to create tombstone directory", "path", dir, "error", err)
+			decision.Error = err.Error()
+			return
+		}
+		filePath = filepath.Join(dir, fileName)
+	}
+	destination, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, p.permissions.mode)
+	if err != nil {
+		logger.Error("Failed to open tombstone", "file", fileName, "error", err)
+		decision.Error = err.Error()
+		return
+	}
+	// Before anything is written, as the umask or a previous tombstone
+	// may have left other permissions.
+	if err := p.permissions.apply(filePath); err != nil {
+		logger.Warn("Failed to set the permissions of tombstone", "path", filePath, "error", err)
+	}
+	defer func() { _ = destination.Close() }()
+	// A snapshot whose copy was interrupted isn't resumed as if its log
+	// was deleted.
+	var journal *copyJournal
+	if job.snapshotDir == "" {
+		journal = beginCopy(fileName, source, destination)
+	}
+	// A log which doesn't fit is retried as the monitor degrades, until
+	// only its metadata is recorded.
+	for level < degradedMetadataOnly {
+		decision.Unparsed, err = m.copyLog(destination, source, job.snapshotFrom, p, fileName)
+		if !isDiskFull(err) {
+			break
+		}
+		_ = destination.Truncate(0)
+		_, _ = destination.Seek(0, io.SeekStart)
+		level = m.full.escalate(level, size, started, &m.merging, &m.state)
+		if level == degradedKeepOnly && decision.Rule == "" {
+			if rule, reason := m.keepReason(job.kube, fileName); rule != "" {
+				logger.Info("Keeping it whatever its content", "file", fileName, "reason", reason)
+				decision.Rule, keepReason = rule, reason
+				continue
+			}
+			logger.Warn("Tombstone volume full, dropped", "file", fileName, "policy", p.name, "size", FormatSize(size))
+			decision.Decision, decision.Rule, decision.Dropped = "dropped", "disk-full", size
+			m.full.drop(size, &m.state)
+			_ = os.Remove(filePath)
+			journal.end()
+			return
+		}
+	}
+	journal.end()
+	if job.snapshotDir != "" {
+		job.snapshotEnd, _ = source.Seek(0, io.SeekCurrent)
+	}
+	if level == degradedMetadataOnly {
+		err = nil
+		job.dropped = size
+	}
+	if err != nil {
+		logger.Error("Failed to copy file data", "file", fileName, "error", err)
+		decision.Error = err.Error()
+	} else if job.dropped > 0 {
+		logger.Warn("Tombstone volume full, only recorded metadata", "file", fileName, "policy", p.name,
+			"size", FormatSize(size))
+		decision.Decision, decision.Rule, decision.Dropped = "metadata-only", "disk-full", size
+		m.full.drop(size, &m.state)
+		kept = m.publish(job, filePath, keepReason)
+	} else {
+		logger.Info("Created tombstone", "file", fileName, "policy", p.name)
+		decision.Decision = "kept"
+		if stat, err := destination.Stat(); err == nil {
+			decision.Bytes = stat.Size()
+		}
+		m.state.tombstoneCreated()
+		kept = m.publish(job, filePath, keepReason)
+		if job.groupPods && job.snapshotDir == "" && storesLocally(p.sinkConfigs) {
+			// The containers of a pod may be preserved at the same time.
+			m.merging.Lock()
+			if err := mergePodLogs(filepath.Dir(filePath)); err != nil {
+				logger.Warn("Failed to merge pod logs", "path", filepath.Dir(filePath), "error", err)
+			} else {
+				p.permissions.applyTombstone(filepath.Join(filepath.Dir(filePath), store.MergedLogName))
+			}
+			m.merging.Unlock()
+		}
+	}
+}
+
+// copyLog writes source from offset on to the tombstone destination,
+// converted as policy p says, and returns the number of lines which
+// couldn't be parsed.
+func (m *Monitor) copyLog(destination *os.File, source *os.File, offset int64, p *policy, fileName string) (int, error) {
+	_, err := source.Seek(offset, io.SeekStart)
+	if err != nil {
+		logger.Error("Seek failed", "file", fileName, "error", err)
+		return 0, err
+	}
+	output := io.Writer(destination)
+	if throttle.limited() {
+		output = &throttledWriter{writer: destination, limiter: &throttle}
+	}
+	switch {
+	case p.skipConversion:
+		return 0, passThrough(destination, source)
+	case p.outputFormat == outputNDJSON:
+		return convertToNDJSON(output, source, p.multilineStart, p.rewrite, store.ParseLogName(fileName))
+	case p.outputFormat == outputCSV || p.outputFormat == outputTSV:
+		comma := ','
+		if p.outputFormat == outputTSV {
+			comma = '\t'
+		}
+		return convertToColumns(output, source, p.extract, comma, p.multilineStart, p.rewrite, store.ParseLogName(fileName))
+	default:
+		return jsonToText(output, source, p.outputTemplate, p.multilineStart, p.rewrite, store.ParseLogName(fileName))
+	}
+}
+
+// keepReason tells why the log of a container must be kept whatever its
+// content, as the audit rule and a reason: it was OOM killed, crash
+// looping or its pod was part of a failed Job. The pod is looked up at
+// delete time, if the Kubernetes API can be reached.
+func (m *Monitor) keepReason(kube *kubeClient, fileName string) (string, string) {
+	if kube == nil {
+		return "", ""
+	}
+	name := store.ParseLogName(fileName)
+	pod := m.pods.lookup(kube, name.Namespace, name.Pod)
+	if pod == nil {
+		return "", ""
+	}
+	switch pod.ContainerTrouble(name.ContainerID) {
+	case "OOMKilled":
+		return "oom-killed", "OOMKilled"
+	case "CrashLoopBackOff":
+		return "crash-loop", "CrashLoopBackOff"
+	}
+	if job, failure := m.pods.failedJob(kube, name.Namespace, pod); job != "" {
+		return "failed-job", fmt.Sprintf("Job %s failed: %s", job, failure)
+	}
+	return "", ""
+}
+
+// publish writes the metadata sidecar of a tombstone and hands it to the
+// sinks of its policy, once the pod was looked up when --kube-api is
+// given, and returns the metadata. A tombstone whose policy leaves out the
+// tombstone directory is removed once handed to its sinks, by the sink
+// uploading it if any.
+func (m *Monitor) publish(job *preservation, filePath string, keepReason string) *store.Tombstone {
+	fileName, p := job.fileName, job.policy
+	var pod *store.PodMetadata
+	name := store.ParseLogName(fileName)
+	if job.kube != nil {
+		pod = m.pods.lookup(job.kube, name.Namespace, name.Pod)
+		if keepReason == "" && pod != nil {
+			keepReason = pod.ContainerTrouble(name.ContainerID)
+		}
+	}
+	t := m.writeMetadata(job, filePath, keepReason, pod)
+	if job.kube != nil && job.describePods {
+		describePod(job.kube, filePath, name.Namespace, name.Pod)
+	}
+	signer.sign(filePath)
+	p.permissions.applyTombstone(filePath)
+	local := storesLocally(p.sinkConfigs)
+	var mover sink.Mover
+	for _, s := range p.sinks {
+		if background, ok := s.(sink.Mover); ok && !local {
+			mover = background
+			continue
+		}
+		if err := s.Write(filePath, t); err != nil {
+			logger.Error("Failed to hand tombstone to sink", "path", filePath, "error", err)
+		}
+	}
+	switch {
+	case local:
+	case mover != nil:
+		if err := mover.Move(filePath, t); err != nil {
+			logger.Error("Failed to hand tombstone to sink", "path", filePath, "error", err)
+		}
+	default:
+		store.RemoveTombstone(filePath)
+	}
+	return t
+}
+
+func (m *Monitor) writeMetadata(job *preservation, filePath string, keepReason string,
+	pod *store.PodMetadata) *store.Tombstone {
+	fileName, retention := job.fileName, job.policy.retention
+	name := store.ParseLogName(fileName)
+	t := store.Tombstone{
+		Path:           filePath,
+		Pod:            name.Pod,
+		Namespace:      name.Namespace,
+		Container:      name.Container,
+		ContainerID:    name.ContainerID,
+		Source:         job.source.Name(),
+		PreservedAt:    time.Now(),
+		Kubernetes:     pod,
+		KeepReason:     keepReason,
+		ContentDropped: job.dropped,
+		Tags:           job.tags,
+		Offset:         job.snapshotFrom,
+		Cluster:        identity.Cluster(),
+		Node:           identity.Node(),
+	}
+	if value, ok := pod.Annotation(retentionAnnotation); ok {
+		podRetention, err := settings.ParseDuration(value)
+		if err != nil {
+			logger.Warn("Invalid retention annotation, using the one of the policy", "file", fileName,
+				"annotation", value, "error", err)
+		} else {
+			retention = podRetention
+		}
+	}
+	if retention > 0 {
+		expiresAt := t.PreservedAt.Add(retention)
+		t.ExpiresAt = &expiresAt
+	}
+	if stat, err := os.Stat(filePath); err == nil {
+		t.Size = stat.Size()
+	}
+	err := store.WriteMetadata(&t)
+	if err != nil {
+		logger.Error("Failed to write metadata", "file", fileName, "error", err)
+	}
+	return &t
+}
+
+// passThrough copies a log as it is. Between files, the kernel copies it
+// with sendfile(2) rather than through userspace buffers, which counts when
+// large logs are preserved during mass deletions.
+func passThrough(destination io.Writer, source io.Reader) error {
+	out, outFile := destination.(*os.File)
+	in, inFile := source.(*os.File)
+	if outFile && inFile {
+		err := sendFile(out, in)
+		if err != syscall.EINVAL && err != syscall.ENOSYS && err != syscall.EOPNOTSUPP {
+			return err
+		}
+		logger.Debug("sendfile unavailable, copying through userspace", "file", in.Name(), "error", err)
+	}
+	if throttle.limited() {
+		destination = &throttledWriter{writer: destination, limiter: &throttle}
+	}
+	_, err := io.Copy(destination, source)
+	return err
+}
+
+// maxSendFile is the most a single sendfile call copies.
+const maxSendFile = 1 << 30
+
+// sendFile copies in to out from their current offsets, which it moves
+// along, so that io.Copy can take over when it fails. With
+// --max-write-rate, it copies a little at a time to pace itself.
+func sendFile(out *os.File, in *os.File) error {
+	chunk := maxSendFile
+	if throttle.limited() {
+		chunk = convert.BufferSize
+	}
+	for {
+		copied, err := syscall.Sendfile(int(out.Fd()), int(in.Fd()), nil, chunk)
+		if err == syscall.EINTR || err == syscall.EAGAIN {
+			continue
+		}
+		if err != nil || copied == 0 {
+			return err
+		}
+		throttle.wait(copied)
+	}
+}
+
+// search tells whether a line of source matches pattern. With multiline,
+// it is matched against whole records instead, e.g. to keep the logs with
+// a stack trace going through some function.
+func search(source io.Reader, pattern *regexp.Regexp, multiline *regexp.Regexp) bool {
+	assembler := convert.Assembler{Start: multiline}
+	scanner := convert.NewLineReader(source)
+	defer scanner.Release()
+	for scanner.Scan() {
+		if multiline == nil {
+			if pattern.Find(scanner.Bytes()) != nil {
+				return true
+			}
+			continue
+		}
+		entry, err := convert.ParseRecord(scanner.Bytes())
+		if err != nil {
+			if pattern.Match(scanner.Bytes()) {
+				return true
+			}
+		} else if record, complete := assembler.Add(entry); complete && pattern.MatchString(record.Log) {
+			return true
+		}
+	}
+	for _, record := range assembler.Flush() {
+		if pattern.MatchString(record.Log) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonToText converts Docker JSON or CRI formatted logs of the container
+// of name to plain text, every line rendered with format, the default
+// output template when nil. Lines which can't be parsed are kept as they
+// are after unparsedPrefix rather than losing the rest of the log, and
+// counted. Lines are rewritten then joined into records starting with
+// multiline when given, which are redacted.
+func jsonToText(destination io.Writer, source io.Reader, format *template.Template, multiline *regexp.Regexp, rewrite convert.Rewrite, name store.LogName) (int, error) {
+	if format == nil {
+		format = defaultOutputTemplate
+	}
+	context := &templateEntry{Pod: name.Pod, Namespace: name.Namespace, Container: name.Container, Node: identity.Node()}
+	output := convert.NewPooledWriter(destination)
+	defer convert.ReleaseWriter(output)
+	unparsed := 0
+	assembler := convert.Assembler{Start: multiline}
+	write := func(entry convert.Entry) error {
+		entry.Log = rewrite.Redact(entry.Log)
+		return renderTemplate(output, format, entry, context)
+	}
+	scanner := convert.NewLineReader(source)
+	defer scanner.Release()
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		entry, err := convert.ParseRecord(line)
+		if err != nil {
+			unparsed++
+			_, _ = output.WriteString(unparsedPrefix)
+			_, _ = output.WriteString(rewrite.Redact(string(line)))
+			err = output.WriteByte('\n')
+		} else {
+			rewrite.Apply(&entry)
+			if entry, complete := assembler.Add(entry); complete {
+				err = write(entry)
+			}
+		}
+		if err != nil {
+			logger.Error("Write failed", "error", err)
+			return unparsed, err
+		}
+	}
+	for _, entry := range assembler.Flush() {
+		if err := write(entry); err != nil {
+			return unparsed, err
+		}
+	}
+	reportUnparsed(name, unparsed)
+	if err := scanner.Err(); err != nil {
+		return unparsed, err
+	}
+	return unparsed, output.Flush()
+}
+
+// compileNameFilter merges the --<kind>-log pattern and --<kind>-glob into
+// a single expression matching a name accepted by either of them.
+func compileNameFilter(kind string, pattern string, glob string) (*regexp.Regexp, error) {
+	alternatives := make([]string, 0, 2)
+	if pattern != "" {
+		compiled, err := settings.CompilePattern(kind+"-log", pattern)
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, compiled.String())
+	}
+	if glob != "" {
+		compiled, err := settings.CompileGlob(kind+"-glob", glob)
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, compiled.String())
+	}
+	switch len(alternatives) {
+	case 0:
+		return nil, nil
+	case 1:
+		return regexp.Compile(alternatives[0])
+	}
+	return regexp.Compile("(?:" + strings.Join(alternatives, ")|(?:") + ")")
+}
+
+// New sets up a monitor with args, along with their configuration file if
+// any. It starts watching logs with Run.
+func New(args *Args) (*Monitor, error) {
+	m := &Monitor{
+		monitoredFiles: make(map[string](*os.File)),
+		sinks:          make(map[string]sink.Sink),
+		state:          monitorState{PID: os.Getpid(), StartedAt: time.Now()},
+		args:           args,
+		podFiles:       make(map[string][]string),
+		preservedPods:  make(map[string]bool),
+		restarted:      make(map[string]bool),
+		deferred:       make(map[string]bool),
+		limits:         readCgroupLimits(),
+	}
+	if m.limits.memory > 0 || m.limits.cpus > 0 {
+		m.limits.sizeBuffers()
+		memory := "unlimited"
+		if m.limits.memory > 0 {
+			memory = FormatSize(m.limits.memory)
+		}
+		logger.Info("Running within cgroup limits", "memory", memory, "cpus", m.limits.cpus,
+			"bufferSize", FormatSize(int64(convert.BufferSize)))
+	}
+	err := m.configure()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// configure applies the policies, filters and sink settings from the
+// monitor arguments and configuration file. It is called again whenever
+// the configuration file changes.
+func (m *Monitor) configure() error {
+	identity.SetCluster(*m.args.ClusterName)
+	err := audit.configure(*m.args.AuditLog, *m.args.AuditLogMaxSize)
+	if err != nil {
+		return err
+	}
+	err = telemetry.configure(*m.args.OTLPEndpoint, *m.args.OTLPHeaders)
+	if err != nil {
+		return err
+	}
+	err = m.disk.configure(*m.args.MinFree, *m.args.AlertWebhook)
+	if err != nil {
+		return err
+	}
+	err = hooks.configure(*m.args.OnKeep, *m.args.OnSkip, *m.args.HookTimeout, *m.args.HookConcurrency)
+	if err != nil {
+		return err
+	}
+	// The script is loaded again on every reload, as it may have changed
+	// along with the configuration.
+	var script *decisionScript
+	if *m.args.DecisionScript != "" {
+		if *m.args.ScriptTimeout <= 0 {
+			return fmt.Errorf("invalid --decision-script-timeout %d, expected a number of seconds", *m.args.ScriptTimeout)
+		}
+		script, err = loadDecisionScript(*m.args.DecisionScript, time.Duration(*m.args.ScriptTimeout)*time.Second)
+		if err != nil {
+			return err
+		}
+	}
+	copies := *m.args.MaxConcurrentCopies
+	if fit := m.limits.fitCopies(copies); copies > 0 && fit < copies {
+		logger.Info("Fewer concurrent copies to fit the cgroup limits", "requested", copies, "copies", fit)
+		copies = fit
+	}
+	err = m.copies.configure(copies)
+	if err != nil {
+		return err
+	}
+	m.copies.pressure.configure(m.limits.memory)
+	err = throttle.configure(*m.args.MaxWriteRate)
+	if err != nil {
+		return err
+	}
+	err = signer.configure(*m.args.SigningKey)
+	if err != nil {
+		return err
+	}
+	m.dirPermissions, err = parsePermissions("tombstone-dir", *m.args.TombstoneDirMode,
+		*m.args.TombstoneOwner, *m.args.TombstoneGroup)
+	if err != nil {
+		return err
+	}
+	distribution, err := findDistribution(*m.args.Distribution)
+	if err != nil {
+		return err
+	}
+	if distribution != m.distribution {
+		logger.Info("Kubernetes distribution", "distribution", distribution.name)
+		m.distribution = distribution
+	}
+	kubeAPI := *m.args.KubeAPI
+	if kubeAPI == kubeKubelet {
+		kubeAPI = m.distribution.kubeletConfig
+	}
+	if kubeAPI != m.kubeAPI {
+		m.kube = nil
+		if kubeAPI != "" {
+			m.kube, err = newKubeClient(kubeAPI)
+			if err != nil {
+				return fmt.Errorf("invalid --kube-api: %v", err)
+			}
+		}
+		m.kubeAPI = kubeAPI
+	}
+	configs, err := loadPolicies(m.args.ConfigPath)
+	if err != nil {
+		return err
+	}
+	configs = withClusterPolicies(m.clusterPolicies, configs, m.args)
+	policies, err := compilePolicies(configs, m.args)
+	if err != nil {
+		return err
+	}
+	if m.kube == nil && selectsLabels(policies) {
+		logger.Warn("Policies selecting pods by label need --kube-api, they select no pod without it")
+	}
+	rules, err := loadRules(m.args.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	// Sinks are only replaced when their settings change, so a reload
+	// doesn't interrupt uploads in progress.
+	sinks := make(map[string]sink.Sink)
+	opened := make([]sink.Sink, 0)
+	for _, p := range policies {
+		for _, config := range p.sinkConfigs {
+			key := config.Key()
+			s, ok := sinks[key]
+			if !ok {
+				s, ok = m.sinks[key]
+			}
+			if !ok {
+				s, err = sink.New(config)
+				if err == nil {
+					err = s.Open()
+				}
+				if err != nil {
+					for _, s := range opened {
+						_ = s.Close()
+					}
+					return fmt.Errorf("policy '%s': sink %s: %v", p.name, config, err)
+				}
+				opened = append(opened, s)
+			}
+			sinks[key] = s
+			p.sinks = append(p.sinks, s)
+		}
+	}
+	for key, s := range m.sinks {
+		if sinks[key] == nil {
+			if err := s.Close(); err != nil {
+				logger.Warn("Failed to close sink", "error", err)
+			}
+		}
+	}
+	m.policies = policies
+	m.script = script
+	m.reloadRules(rules)
+	m.policyConfig = fingerprintPolicies(configs)
+	m.sinks = sinks
+	return nil
+}
+
+// reload reads the configuration file again and applies what changed.
+// A broken configuration is reported and the current one is kept.
+func (m *Monitor) reload() {
+	before := settings.Snapshot(m.args.Options)
+	policyConfig := m.policyConfig
+	err := settings.Reload(m.args.Options, m.args.ConfigPath)
+	if err == nil {
+		err = m.configure()
+	}
+	if err != nil {
+		settings.Restore(m.args.Options, before)
+		logger.Error("Configuration not reloaded", "path", m.args.ConfigPath, "error", err)
+		return
+	}
+	changes := settings.Changed(m.args.Options, before)
+	if policyConfig != m.policyConfig {
+		logger.Info("Policies changed", "policies", describePolicies(m.policies))
+	} else if len(changes) == 0 {
+		logger.Debug("Configuration reloaded without changes", "path", m.args.ConfigPath)
+		return
+	}
+	for _, change := range changes {
+		logger.Info("Configuration changed", "option", change[0], "old", change[1], "new", change[2])
+	}
+}
+
+// watchConfig watches the directory of the configuration file, nil when
+// there is none or it can't be watched. The directory is watched rather
+// than the file so that editors replacing the file and Kubernetes ConfigMap
+// updates (which swap the ..data symlink) are noticed as well.
+func (m *Monitor) watchConfig() *inotify {
+	if m.args.ConfigPath == "" {
+		return nil
+	}
+	watches, err := newInotify()
+	if err == nil {
+		_, err = watches.add(filepath.Dir(m.args.ConfigPath), syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO)
+		if err != nil {
+			watches.close()
+		}
+	}
+	if err != nil {
+		logger.Warn("Configuration changes won't be applied until restart",
+			"path", m.args.ConfigPath, "error", err)
+		return nil
+	}
+	return watches
+}
+
+func (m *Monitor) isConfigFile(name string) bool {
+	return name == filepath.Base(m.args.ConfigPath) || name == "..data"
+}
+
+// The watches of the event loop are re-established after errors, waiting
+// from minWatchBackoff to maxWatchBackoff between attempts, and the
+// monitor gives up after maxWatchFailures attempts in a row.
+const (
+	minWatchBackoff  = time.Second
+	maxWatchBackoff  = time.Minute
+	maxWatchFailures = 10
+)
+
+// maxRetryBackoff is the longest wait between the retries of the lookups
+// of pods, container runtimes and cluster policies.
+const maxRetryBackoff = 5 * time.Minute
+
+// Run monitors the logs until ctx is cancelled, then waits for the copies
+// in progress.
+func (m *Monitor) Run(ctx context.Context) error {
+	err := m.dirPermissions.makeDirs(TombstonePath, TombstonePath)
+	if err != nil {
+		return fmt.Errorf("failed to create tombstone directory %s: %v", TombstonePath, err)
+	}
+
+	var policies *policyWatch
+	if *m.args.ClusterPolicies {
+		policies, err = newPolicyWatch(m.kube)
+		if err != nil {
+			return err
+		}
+	}
+	source, err := m.newSource()
+	if err != nil {
+		return err
+	}
+	defer source.close()
+	var admin *adminServer
+	if *m.args.AdminSocket != "" {
+		admin, err = newAdminServer(*m.args.AdminSocket)
+		if err != nil {
+			return err
+		}
+		defer admin.close()
+	}
+	snapshots, err := newPeriodicSnapshots(*m.args.SnapshotInterval, *m.args.SnapshotInclude)
+	if err != nil {
+		return err
+	}
+	if snapshots != nil {
+		err = snapshots.start()
+		if err != nil {
+			return err
+		}
+		defer snapshots.stop()
+	}
+	m.disk.check(&m.state)
+	m.resumeCopies()
+	if *m.args.Sandbox {
+		err = m.sandbox()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The event loop is woken up on cancellation through a pipe, closed
+	// then.
+	cancelled, cancel, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = cancelled.Close() }()
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopped:
+		}
+		_ = cancel.Close()
+	}()
+
+	// The watchdog is pinged and the health checks are told the monitor
+	// is alive from the event loop, so a wedged monitor gets restarted.
+	watchdog := time.Duration(0)
+	if !m.container {
+		watchdog = watchdogInterval()
+	}
+	tick := watchdog
+	if *m.args.DebugListen != "" {
+		go serveDebug(*m.args.DebugListen)
+	}
+	go expireLoop(ctx, TombstonePath)
+	if *m.args.HTTPListen != "" {
+		go serveHealth(*m.args.HTTPListen, &m.health)
+		if tick == 0 || tick > healthTick {
+			tick = healthTick
+		}
+	}
+	backoff, failures := minWatchBackoff, 0
+	for {
+		established, err := m.eventLoop(cancelled, source, policies, admin, snapshots, watchdog, tick)
+		if ctx.Err() != nil {
+			m.stop()
+			return nil
+		}
+		if established {
+			backoff, failures = minWatchBackoff, 0
+		}
+		failures++
+		if failures > maxWatchFailures {
+			return err
+		}
+		m.health.lost()
+		logger.Error("Event loop failed, watching again", "error", err, "retry", backoff)
+		m.pause(ctx, backoff, watchdog)
+		backoff *= 2
+		if backoff > maxWatchBackoff {
+			backoff = maxWatchBackoff
+		}
+	}
+}
+
+// stop lets the copies in progress finish and closes the logs watched, once
+// the monitor was cancelled.
+func (m *Monitor) stop() {
+	logger.Info("Stopping the monitor", "watched", len(m.monitoredFiles))
+	m.notify("STOPPING=1")
+	m.copies.wait()
+	hooks.wait()
+	for _, s := range m.sinks {
+		if err := s.Flush(); err != nil {
+			logger.Warn("Failed to flush sink", "error", err)
+		}
+	}
+	for fileName, file := range m.monitoredFiles {
+		_ = file.Close()
+		delete(m.monitoredFiles, fileName)
+	}
+}
+
+// pause waits for d, unless ctx is cancelled meanwhile, still pinging the
+// watchdog and telling the health checks the monitor is alive as it isn't
+// stuck.
+func (m *Monitor) pause(ctx context.Context, d time.Duration, watchdog time.Duration) {
+	step := healthTick
+	if watchdog > 0 && watchdog < step {
+		step = watchdog
+	}
+	deadline := time.Now().Add(d)
+	for left := d; left > 0; left = time.Until(deadline) {
+		if left > step {
+			left = step
+		}
+		select {
+		case <-time.After(left):
+		case <-ctx.Done():
+			return
+		}
+		m.health.beat()
+		if watchdog > 0 {
+			m.notify("WATCHDOG=1")
+		}
+	}
+}
+
+// eventLoop opens the source of the logs and processes the events of the
+// monitor until it fails or cancelled becomes readable, telling whether the
+// source was opened. Events may have been missed by the time it returns,
+// the logs deleted in the meantime are preserved once the source is opened
+// again.
+func (m *Monitor) eventLoop(cancelled *os.File, source logSource, policies *policyWatch,
+	admin *adminServer, snapshots *periodicSnapshots, watchdog time.Duration, tick time.Duration) (bool, error) {
+	sourceFd, err := source.open()
+	if err != nil {
+		return false, err
+	}
+	defer source.close()
+
+	// The readiness of the descriptors comes back in this order.
+	const sourceReady, cancelReady = 0, 1
+	fds := []int{sourceFd, int(cancelled.Fd())}
+	policyReady, adminReady, snapshotReady, configReady := -1, -1, -1, -1
+	if policies != nil {
+		policyReady = len(fds)
+		fds = append(fds, int(policies.wake.Fd()))
+	}
+	if admin != nil {
+		adminReady = len(fds)
+		fds = append(fds, int(admin.wake.Fd()))
+	}
+	if snapshots != nil {
+		snapshotReady = len(fds)
+		fds = append(fds, int(snapshots.wake.Fd()))
+	}
+	config := m.watchConfig()
+	if config != nil {
+		defer config.close()
+		configReady = len(fds)
+		fds = append(fds, config.fd)
+	}
+	m.health.watch()
+	if m.watched {
+		source.reconcile(m)
+	}
+	m.watched = true
+
+	events, err := newPoller(fds...)
+	if err != nil {
+		return true, fmt.Errorf("failed to wait for events: %v", err)
+	}
+	defer events.close()
+
+	m.saveState()
+	m.notify("READY=1")
+	lastPing := time.Now()
+	for {
+		timeout := time.Duration(-1)
+		if tick > 0 {
+			m.health.beat()
+			timeout = tick
+			if watchdog > 0 {
+				if time.Since(lastPing) >= watchdog {
+					m.notify("WATCHDOG=1")
+					lastPing = time.Now()
+				}
+				if left := watchdog - time.Since(lastPing); left < timeout {
+					timeout = left
+				}
+			}
+		}
+		ready, err := events.wait(timeout)
+		if err != nil {
+			return true, fmt.Errorf("failed to wait for events: %v", err)
+		}
+		if ready[cancelReady] {
+			return true, nil
+		}
+		if policies != nil && ready[policyReady] {
+			m.applyClusterPolicies(policies.take())
+		}
+		if admin != nil && ready[adminReady] {
+			admin.serve(m)
+		}
+		if snapshots != nil && ready[snapshotReady] {
+			snapshots.take(m)
+		}
+		if config != nil && ready[configReady] {
+			reload := false
+			_, err = config.read(func(wd int, mask uint32, name string) {
+				reload = reload || m.isConfigFile(name)
+			})
+			if reload {
+				m.reload()
+			}
+			if err != nil {
+				return true, err
+			}
+		}
+		if !ready[sourceReady] {
+			continue
+		}
+		count, err := source.read(m)
+		m.state.EventsProcessed += uint64(count)
+		m.saveState()
+		if err != nil {
+			return true, err
+		}
+	}
+}
+
+// reconcile catches up with the logs created and deleted while the log
+// directory wasn't watched: the deleted ones are preserved and the new ones
+// watched.
+func (m *Monitor) reconcile() {
+	entries, err := ioutil.ReadDir(KubernetesLogsPath)
+	if err != nil {
+		logger.Warn("Failed to list logs", "path", KubernetesLogsPath, "error", err)
+		return
+	}
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		present[entry.Name()] = true
+		if _, ok := m.monitoredFiles[entry.Name()]; !ok {
+			m.watch(entry.Name())
+		}
+	}
+	for fileName := range m.monitoredFiles {
+		if !present[fileName] {
+			logger.Info("Deleted while not watching", "file", fileName)
+			m.unwatch(fileName)
+		}
+	}
+}
+
+func (m *Monitor) saveState() {
+	m.full.current(&m.state)
+	m.state.WatchedFiles = len(m.monitoredFiles)
+	err := m.state.save()
+	if err != nil {
+		logger.Warn("Failed to publish monitor state", "error", err)
+	}
+}
+
+// Args are the options of a monitor, registered on a command with
+// AttachArgs or set with NewArgs.
+type Args struct {
+	IncludeLog          *string
+	ExcludeLog          *string
+	IncludeGlob         *string
+	ExcludeGlob         *string
+	KeepIf              *string
+	SkipConversion      *bool
+	Collector           *string
+	CollectorCert       *string
+	CollectorKey        *string
+	CollectorCA         *string
+	SpoolDir            *string
+	HTTPListen          *string
+	DebugListen         *string
+	AdminSocket         *string
+	SnapshotInterval    *string
+	SnapshotInclude     *string
+	AuditLog            *string
+	AuditLogMaxSize     *string
+	OTLPEndpoint        *string
+	OTLPHeaders         *[]string
+	Sinks               *[]string
+	MinFree             *string
+	AlertWebhook        *string
+	OnKeep              *string
+	OnSkip              *string
+	HookTimeout         *int
+	HookConcurrency     *int
+	DecisionScript      *string
+	ScriptTimeout       *int
+	SigningKey          *string
+	TombstoneMode       *string
+	TombstoneDirMode    *string
+	TombstoneOwner      *string
+	TombstoneGroup      *string
+	Sandbox             *bool
+	SandboxRead         *[]string
+	KubeAPI             *string
+	Source              *string
+	PollInterval        *int
+	CRISocket           *string
+	DockerSocket        *string
+	Distribution        *string
+	DescribePods        *bool
+	Retention           *string
+	ClusterPolicies     *bool
+	ClusterName         *string
+	GroupPods           *bool
+	OutputFormat        *string
+	OutputTemplate      *string
+	MultilineStart      *string
+	StripANSI           *bool
+	Extract             *string
+	MaxConcurrentCopies *int
+	MaxWriteRate        *string
+	TimeFormat          *string
+	TimeZone            *string
+	Redact              *[]string
+	RedactRules         *string
+	Options             []*settings.Setting
+	ConfigPath          string
+}
+
+// String returns the command line arguments that configure a monitor
+// the same way, e.g. for the service installed by deploy.
+func (args *Args) String() string {
+	return settings.MarshalArgs(args.Options)
+}
+
+// AttachArgs registers the options configuring a monitor on cmd,
+// the monitor command or one running or installing monitors.
+func AttachArgs(settings *settings.Settings, cmd *argparse.Command) *Args {
+	mark := len(settings.Options)
+	args := &Args{
+		IncludeLog: settings.Pattern(cmd, "i", "include-log",
+			&argparse.Options{Help: "Preserve logs of pods matching this pattern.", Required: false}),
+		ExcludeLog: settings.Pattern(cmd, "e", "exclude-log",
+			&argparse.Options{Help: "Ignore logs of pods matching this pattern.", Required: false}),
+		IncludeGlob: settings.Glob(cmd, "", "include-glob",
+			&argparse.Options{Help: "Preserve logs of pods matching this glob (e.g. 'payments-*_prod_*').", Required: false}),
+		ExcludeGlob: settings.Glob(cmd, "", "exclude-glob",
+			&argparse.Options{Help: "Ignore logs of pods matching this glob.", Required: false}),
+		KeepIf: settings.Pattern(cmd, "k", "keep-if",
+			&argparse.Options{Help: "Keep logs only if content matches this pattern.", Required: false}),
+		SkipConversion: settings.Flag(cmd, "s", "skip-conversion",
+			&argparse.Options{Help: "Do not convert logs from JSON to text.", Required: false}),
+		Collector: settings.String(cmd, "c", "collector",
+			&argparse.Options{Help: "Stream tombstones to this collector (https://host:port).", Required: false}),
+		CollectorCert: settings.String(cmd, "", "collector-cert",
+			&argparse.Options{Help: "Client certificate presented to the collector.", Required: false}),
+		CollectorKey: settings.String(cmd, "", "collector-key",
+			&argparse.Options{Help: "Private key of the collector client certificate.", Required: false}),
+		CollectorCA: settings.String(cmd, "", "collector-ca",
+			&argparse.Options{Help: "CA used to verify the collector certificate.", Required: false}),
+		Sinks: settings.Records(cmd, "", "sink",
+			&argparse.Options{Help: "Hand tombstones to this sink, as KIND:KEY=VALUE,... (e.g. directory:path=/mnt/archive), rather than only keep them in the tombstone directory, the directory sink without a path. Can be repeated", Required: false}),
+		SpoolDir: settings.String(cmd, "", "spool-dir",
+			&argparse.Options{Help: "Where pending collector uploads are recorded", Required: false,
+				Default: collector.DefaultSpoolPath}),
+		HTTPListen: settings.String(cmd, "", "http-listen",
+			&argparse.Options{Help: "Serve /healthz and /readyz on this address (e.g. :9542)", Required: false}),
+		DebugListen: settings.String(cmd, "", "debug-listen",
+			&argparse.Options{Help: "Serve Go profiles under /debug/pprof/ on this address (e.g. localhost:6060)", Required: false}),
+		AdminSocket: settings.String(cmd, "", "admin-socket",
+			&argparse.Options{Help: "Serve the admin API on this Unix socket, none if empty", Required: false,
+				Default: adminSocketPath}),
+		AuditLog: settings.String(cmd, "", "audit-log",
+			&argparse.Options{Help: "Record every preservation decision to this JSON lines file", Required: false}),
+		AuditLogMaxSize: settings.String(cmd, "", "audit-log-max-size",
+			&argparse.Options{Help: "Rotate the audit log past this size", Required: false,
+				Default: defaultAuditLogMaxSize}),
+		OTLPEndpoint: settings.String(cmd, "", "otlp-endpoint",
+			&argparse.Options{Help: "Export metrics and spans to this OTLP/HTTP receiver (e.g. http://otel-collector:4318)", Required: false}),
+		OTLPHeaders: settings.Records(cmd, "", "otlp-header",
+			&argparse.Options{Help: "Header sent with OTLP exports, as KEY=VALUE. Can be repeated", Required: false}),
+		MinFree: settings.String(cmd, "", "min-free",
+			&argparse.Options{Help: "Below this free space on the tombstone volume (e.g. 500M or 5%), only keep logs matching keep-if", Required: false}),
+		AlertWebhook: settings.String(cmd, "", "disk-alert-webhook",
+			&argparse.Options{Help: "URL notified when the tombstone volume enters or leaves low free space", Required: false}),
+		OnKeep: settings.String(cmd, "", "on-keep",
+			&argparse.Options{Help: "Run this executable with the path of every tombstone created, described by K8TS_* environment variables", Required: false}),
+		OnSkip: settings.String(cmd, "", "on-skip",
+			&argparse.Options{Help: "Run this executable with the path of every deleted log which isn't preserved, described by K8TS_* environment variables", Required: false}),
+		HookTimeout: settings.Int(cmd, "", "hook-timeout",
+			&argparse.Options{Help: "Seconds after which the --on-keep and --on-skip hooks are killed", Required: false, Default: defaultHookTimeout}),
+		HookConcurrency: settings.Int(cmd, "", "hook-concurrency",
+			&argparse.Options{Help: "Hooks run at once at most", Required: false, Default: defaultHookConcurrency}),
+		DecisionScript: settings.String(cmd, "", "decision-script",
+			&argparse.Options{Help: "Decide whether deleted logs are kept with the decide function of this Starlark script, ahead of keep-if", Required: false}),
+		ScriptTimeout: settings.Int(cmd, "", "decision-script-timeout",
+			&argparse.Options{Help: "Seconds after which a call of the decision script is cancelled", Required: false, Default: defaultScriptTimeout}),
+		SigningKey: settings.String(cmd, "", "signing-key",
+			&argparse.Options{Help: "Sign tombstones and their metadata with this Ed25519 private key (PEM), for `k8ts verify`", Required: false}),
+		TombstoneMode: settings.String(cmd, "", "tombstone-mode",
+			&argparse.Options{Help: "Permissions of tombstones and their metadata, in octal (e.g. 0640, or 0600 for sensitive logs)", Required: false,
+				Default: defaultTombstoneMode}),
+		TombstoneDirMode: settings.String(cmd, "", "tombstone-dir-mode",
+			&argparse.Options{Help: "Permissions of the tombstone directory and of those the monitor creates in it, in octal", Required: false,
+				Default: defaultTombstoneDirMode}),
+		TombstoneOwner: settings.String(cmd, "", "tombstone-owner",
+			&argparse.Options{Help: "User (name or id) owning tombstones and their directories, the one of the monitor by default", Required: false}),
+		TombstoneGroup: settings.String(cmd, "", "tombstone-group",
+			&argparse.Options{Help: "Group (name or id) owning tombstones and their directories (e.g. log-readers)", Required: false}),
+		Sandbox: settings.Flag(cmd, "", "sandbox",
+			&argparse.Options{Help: "Once started, confine the monitor to reading logs and writing tombstones (Landlock) and deny it system administration calls (seccomp)", Required: false}),
+		SandboxRead: settings.List(cmd, "", "sandbox-read",
+			&argparse.Options{Help: "Also let the sandboxed monitor read this path, e.g. logs outside /var/log. Can be repeated", Required: false}),
+		KubeAPI: settings.String(cmd, "", "kube-api",
+			&argparse.Options{Help: "Record the labels, annotations and owners of pods in tombstones, looked up with this kubeconfig, 'in-cluster' or 'kubelet'", Required: false}),
+		Source: settings.Selector(cmd, "", "source", sourceKinds,
+			&argparse.Options{Help: "Preserve logs when they are deleted from /var/log/containers, as reported by inotify or found by polling, when their pod is deleted or evicted according to --kube-api, or when their container is deleted according to the container runtime (or dies, with Docker)", Required: false,
+				Default: sourceInotify}),
+		PollInterval: settings.Int(cmd, "", "poll-interval",
+			&argparse.Options{Help: "Seconds between listings of /var/log/containers with --source poll, or of containers with --source cri when the runtime doesn't stream events", Required: false, Default: 2}),
+		CRISocket: settings.String(cmd, "", "cri-socket",
+			&argparse.Options{Help: "Socket of the container runtime with --source cri, by default that of containerd or CRI-O", Required: false}),
+		DockerSocket: settings.String(cmd, "", "docker-socket",
+			&argparse.Options{Help: "Socket of the Docker daemon with --source docker, /var/run/docker.sock by default", Required: false}),
+		Distribution: settings.Selector(cmd, "", "distribution", distributionNames(),
+			&argparse.Options{Help: "Kubernetes distribution of the node, telling the socket of the container runtime and the kubeconfig of --kube-api kubelet, detected by default", Required: false,
+				Default: distributionAuto}),
+		SnapshotInterval: settings.String(cmd, "", "snapshot-interval",
+			&argparse.Options{Help: "Preserve what the logs watched got during every such period (e.g. 6h), so that rotation doesn't lose it", Required: false}),
+		SnapshotInclude: settings.Pattern(cmd, "", "snapshot-include",
+			&argparse.Options{Help: "Only take periodic snapshots of the logs whose file name matches this pattern", Required: false}),
+		DescribePods: settings.Flag(cmd, "", "describe-pods",
+			&argparse.Options{Help: "Also save the description and events of the pod next to tombstones, needs --kube-api", Required: false}),
+		Retention: settings.String(cmd, "", "retention",
+			&argparse.Options{Help: "Delete tombstones this long after they were preserved (e.g. 30d, 12h)", Required: false}),
+		ClusterPolicies: settings.Flag(cmd, "", "cluster-policies",
+			&argparse.Options{Help: "Apply the K8tsPolicy resources of the cluster ahead of the policies of --config, needs --kube-api", Required: false}),
+		ClusterName: settings.String(cmd, "", "cluster-name",
+			&argparse.Options{Help: "Name of the cluster, recorded in tombstone metadata, uploads, metrics and alerts", Required: false}),
+		OutputFormat: settings.Selector(cmd, "", "output-format", []string{outputText, outputNDJSON, outputCSV, outputTSV},
+			&argparse.Options{Help: "Write tombstones as plain text or as JSON lines with the pod, namespace, container and node of every line", Required: false,
+				Default: outputText}),
+		OutputTemplate: settings.String(cmd, "", "output-template",
+			&argparse.Options{Help: "Go template rendering every line of text tombstones, over .Time, .Stream, .Log, .Pod, .Namespace, .Container and .Node (default '" + defaultOutputFormat + "')", Required: false}),
+		MultilineStart: settings.Pattern(cmd, "", "multiline-start",
+			&argparse.Options{Help: "Join the lines not matching this pattern (e.g. '^\\d{4}-') to the record before them, so keep-if and tombstones see whole stack traces", Required: false}),
+		StripANSI: settings.Flag(cmd, "", "strip-ansi",
+			&argparse.Options{Help: "Remove the color and other terminal escape sequences of log lines when converting them", Required: false}),
+		TimeFormat: settings.Selector(cmd, "", "time-format", []string{convert.TimeOriginal, "rfc3339", "rfc3339-millis", "rfc3339-micros", "rfc3339-nano"},
+			&argparse.Options{Help: "Rewrite the timestamps of log lines as RFC 3339 with this precision when converting them", Required: false,
+				Default: convert.TimeOriginal}),
+		TimeZone: settings.String(cmd, "", "time-zone",
+			&argparse.Options{Help: "Convert the timestamps of log lines to this time zone (e.g. UTC, Local, Europe/Paris) when converting them", Required: false}),
+		Redact: settings.List(cmd, "", "redact",
+			&argparse.Options{Help: "Replace the secrets of this kind (" + strings.Join(convert.RedactionPresets(), ", ") + ") in log lines when converting them. Can be repeated", Required: false}),
+		RedactRules: settings.String(cmd, "", "redact-rules",
+			&argparse.Options{Help: "Also replace the matches of the named patterns of this file in log lines when converting them", Required: false}),
+		Extract: settings.Pattern(cmd, "", "extract",
+			&argparse.Options{Help: "With --output-format csv or tsv, write the capture groups of this pattern (e.g. 'request_id=(?P<request_id>\\S+).*latency=(?P<latency>\\S+)') as columns", Required: false}),
+		MaxConcurrentCopies: settings.Int(cmd, "", "max-concurrent-copies",
+			&argparse.Options{Help: "Write at most this many tombstones at once when many pods are deleted together", Required: false,
+				Default: defaultMaxConcurrentCopies}),
+		MaxWriteRate: settings.String(cmd, "", "max-write-rate",
+			&argparse.Options{Help: "Write tombstones at most this fast altogether, per second (e.g. 20M)", Required: false}),
+		GroupPods: settings.Flag(cmd, "", "group-pods",
+			&argparse.Options{Help: "Preserve the logs of each pod in a directory of its own, with a merged.log interleaving its containers", Required: false}),
+	}
+	args.Options = settings.Since(mark)
+	return args
+}
+
+// NewArgs returns the options of a monitor embedded in another program,
+// named as in the configuration file, e.g. "include-glob": "payments-*".
+// The options left out keep their default.
+func NewArgs(values map[string]interface{}) (*Args, error) {
+	parser := argparse.NewParser("k8ts", "")
+	args := AttachArgs(settings.New(), &parser.Command)
+	err := settings.Apply(args.Options, values)
+	if err != nil {
+		return nil, err
+	}
+	return args, nil
+}
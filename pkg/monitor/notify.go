@@ -0,0 +1,106 @@
+package monitor
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+)
+
+// sdNotify tells systemd about a state change of the monitor (READY=1,
+// WATCHDOG=1) when it runs k8ts as a Type=notify service.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract sockets are given with a leading @.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdogInterval returns how often the monitor must ping the systemd
+// watchdog, half the WatchdogSec of the unit, or 0 without a watchdog.
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// poller waits for file descriptors to have data to read with epoll(7),
+// which unlike select(2) isn't limited to the first 1024 of them.
+type poller struct {
+	fd     int
+	events []syscall.EpollEvent
+}
+
+func newPoller(fds ...int) (*poller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	for i, watched := range fds {
+		// The index of the descriptor is what comes back with its events.
+		event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(i)}
+		err = syscall.EpollCtl(fd, syscall.EPOLL_CTL_ADD, watched, &event)
+		if err != nil {
+			_ = syscall.Close(fd)
+			return nil, err
+		}
+	}
+	return &poller{fd: fd, events: make([]syscall.EpollEvent, len(fds))}, nil
+}
+
+// wait waits up to timeout, or indefinitely if negative, for any of the
+// descriptors to have data to read and tells which ones do, in the order
+// they were given.
+func (p *poller) wait(timeout time.Duration) ([]bool, error) {
+	milliseconds := -1
+	if timeout >= 0 {
+		milliseconds = int((timeout + time.Millisecond - 1) / time.Millisecond)
+	}
+	ready := make([]bool, len(p.events))
+	count, err := syscall.EpollWait(p.fd, p.events, milliseconds)
+	if err == syscall.EINTR {
+		return ready, nil
+	}
+	if err != nil {
+		return ready, err
+	}
+	for _, event := range p.events[:count] {
+		ready[event.Fd] = true
+	}
+	return ready, nil
+}
+
+func (p *poller) close() {
+	_ = syscall.Close(p.fd)
+}
+
+// notify sends a state change to systemd, unless k8ts runs in a container
+// where the init system isn't its business.
+func (m *Monitor) notify(state string) {
+	if m.container {
+		return
+	}
+	err := sdNotify(state)
+	if err != nil {
+		logger.Warn("Failed to notify systemd", "state", state, "error", err)
+	}
+}
@@ -0,0 +1,186 @@
+package monitor
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// maxSnapshotCheck is how often at most the logs due for a periodic
+// snapshot are looked for.
+const maxSnapshotCheck = time.Minute
+
+// periodicSnapshots takes incremental snapshots of the logs watched for
+// longer than --snapshot-interval, every interval, so that the content
+// the runtime rotates away from long-lived pods isn't lost by the time they
+// are deleted. Every snapshot holds what the log got since the previous
+// one.
+type periodicSnapshots struct {
+	interval time.Duration
+	// check is how often the logs due are looked for.
+	check   time.Duration
+	include *regexp.Regexp
+	wake    *os.File
+	done    chan struct{}
+	// due is when the logs get their next snapshot, touched by the event
+	// loop only.
+	due   map[string]time.Time
+	mutex sync.Mutex
+	// offsets are where the last snapshots of the logs ended.
+	offsets map[string]snapshotOffset
+}
+
+// snapshotOffset is where the last snapshot of a log ended, in the file
+// identified by device and inode as the log may have been rotated since.
+type snapshotOffset struct {
+	device uint64
+	inode  uint64
+	end    int64
+}
+
+// newPeriodicSnapshots returns the periodic snapshots of the logs whose
+// name matches include, nil when interval is empty.
+func newPeriodicSnapshots(interval string, include string) (*periodicSnapshots, error) {
+	if interval == "" {
+		return nil, nil
+	}
+	every, err := settings.ParseDuration(interval)
+	if err != nil || every <= 0 {
+		return nil, fmt.Errorf("invalid --snapshot-interval '%s'", interval)
+	}
+	s := &periodicSnapshots{
+		interval: every,
+		check:    every,
+		due:      make(map[string]time.Time),
+		offsets:  make(map[string]snapshotOffset),
+	}
+	if s.check > maxSnapshotCheck {
+		s.check = maxSnapshotCheck
+	}
+	if include != "" {
+		s.include, err = settings.CompilePattern("snapshot-include", include)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// start wakes the event loop up through a pipe whenever snapshots may be
+// due.
+func (s *periodicSnapshots) start() error {
+	wake, signal, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	s.wake, s.done = wake, make(chan struct{})
+	go func() {
+		defer func() { _ = signal.Close() }()
+		ticker := time.NewTicker(s.check)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, _ = signal.Write([]byte{0})
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *periodicSnapshots) stop() {
+	close(s.done)
+	_ = s.wake.Close()
+}
+
+// take queues the snapshots due, from the event loop. Logs are due an
+// interval after they were first seen here, and again an interval after
+// their last snapshot; those which didn't grow are left alone. Logs the
+// runtime rotated get a last snapshot of what the file watched got since
+// the previous one, and the file which replaced it is watched instead.
+func (s *periodicSnapshots) take(m *Monitor) {
+	drain := make([]byte, 512)
+	_, _ = s.wake.Read(drain)
+	now := time.Now()
+	dir := snapshotDir(TombstonePath, now)
+	for fileName, file := range m.monitoredFiles {
+		if s.include != nil && !s.include.MatchString(fileName) {
+			continue
+		}
+		due, ok := s.due[fileName]
+		if !ok {
+			s.due[fileName] = now.Add(s.interval)
+			continue
+		}
+		stat, err := file.Stat()
+		if err != nil {
+			continue
+		}
+		rotated := isRotated(file, stat)
+		// Checks come a little early or late.
+		if now.Add(s.check/2).Before(due) && !rotated {
+			continue
+		}
+		s.due[fileName] = now.Add(s.interval)
+		device, inode := fileIdentity(stat)
+		s.mutex.Lock()
+		last := s.offsets[fileName]
+		s.mutex.Unlock()
+		from := last.end
+		// The log was rotated since its last snapshot or truncated, it is
+		// taken again from the start.
+		if last.device != device || last.inode != inode || stat.Size() < from {
+			from = 0
+		}
+		if stat.Size() > from {
+			logger.Debug("Periodic snapshot", "file", fileName, "from", from, "size", stat.Size(), "rotated", rotated)
+			name := fileName
+			m.snapshotFile(fileName, dir, from, func(decision *auditRecord, kept *store.Tombstone, end int64) {
+				if kept != nil && kept.ContentDropped == 0 {
+					s.mutex.Lock()
+					s.offsets[name] = snapshotOffset{device: device, inode: inode, end: end}
+					s.mutex.Unlock()
+				}
+			})
+		}
+		if rotated {
+			current, err := openFile(file.Name())
+			if err != nil {
+				logger.Error("Failed to open rotated log", "file", fileName, "error", err)
+				continue
+			}
+			logger.Info("Log rotated, watching the new one", "file", fileName, "path", current.Name())
+			m.monitoredFiles[fileName] = current
+			_ = file.Close()
+		}
+	}
+	// The logs gone are preserved in full, their snapshots are done with.
+	for fileName := range s.due {
+		if _, ok := m.monitoredFiles[fileName]; !ok {
+			delete(s.due, fileName)
+			s.mutex.Lock()
+			delete(s.offsets, fileName)
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// isRotated tells whether the runtime replaced the log open as file, of
+// status stat, by a new one at the same path.
+func isRotated(file *os.File, stat os.FileInfo) bool {
+	current, err := os.Stat(file.Name())
+	if err != nil {
+		return false
+	}
+	device, inode := fileIdentity(stat)
+	currentDevice, currentInode := fileIdentity(current)
+	return device != currentDevice || inode != currentInode
+}
@@ -0,0 +1,124 @@
+package monitor
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+const (
+	defaultTombstoneMode    = "0644"
+	defaultTombstoneDirMode = "0755"
+)
+
+// permissions are the mode and ownership given to the tombstones and
+// directories the monitor writes, e.g. so that a log-readers group can
+// read them without root, whatever the umask. The owner and group are left
+// alone when -1.
+type permissions struct {
+	mode os.FileMode
+	uid  int
+	gid  int
+}
+
+// parsePermissions reads an octal mode and the name or id of an owner and
+// a group, which may be empty.
+func parsePermissions(kind string, mode string, owner string, group string) (permissions, error) {
+	p := permissions{uid: -1, gid: -1}
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || value > 0777 {
+		return p, fmt.Errorf("invalid %s-mode '%s', expected octal permissions (e.g. 0640)", kind, mode)
+	}
+	p.mode = os.FileMode(value)
+	if owner != "" {
+		p.uid, err = lookupID(owner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return p, fmt.Errorf("invalid tombstone-owner '%s': %v", owner, err)
+		}
+	}
+	if group != "" {
+		p.gid, err = lookupID(group, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return p, fmt.Errorf("invalid tombstone-group '%s': %v", group, err)
+		}
+	}
+	return p, nil
+}
+
+// lookupID returns the numeric id given or else looked up by name.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil && id >= 0 {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+// owned tells whether the ownership of files is changed.
+func (p permissions) owned() bool {
+	return p.uid >= 0 || p.gid >= 0
+}
+
+// apply sets the mode and ownership of the file at path.
+func (p permissions) apply(path string) error {
+	err := os.Chmod(path, p.mode)
+	if err == nil && p.owned() {
+		err = os.Chown(path, p.uid, p.gid)
+	}
+	return err
+}
+
+// applyTombstone sets the mode and ownership of a tombstone and of the
+// files next to it, logging failures.
+func (p permissions) applyTombstone(path string) {
+	paths := []string{path}
+	for _, suffix := range store.CompanionSuffixes {
+		if _, err := os.Stat(path + suffix); err == nil {
+			paths = append(paths, path+suffix)
+		}
+	}
+	for _, path := range paths {
+		if err := p.apply(path); err != nil {
+			logger.Warn("Failed to set the permissions of tombstone", "path", path, "error", err)
+		}
+	}
+}
+
+// makeDirs creates dir and the directories up to it below root, with the
+// mode and ownership of p, which they are given again if they exist.
+func (p permissions) makeDirs(root string, dir string) error {
+	err := os.MkdirAll(dir, p.mode)
+	if err != nil {
+		return err
+	}
+	for path := dir; ; path = filepath.Dir(path) {
+		err = p.apply(path)
+		if err != nil {
+			return err
+		}
+		if path == root || !strings.HasPrefix(path, root+string(filepath.Separator)) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/identity"
+	"github.com/badeadan/k8ts/internal/logger"
+)
+
+// podWatchTimeout is how long a watch is held before it is opened again,
+// as the API server closes them anyway.
+const podWatchTimeout = 5 * time.Minute
+
+// podEvent is a change to a pod of the node. Pods missing from a list are
+// reported by a podSynced event.
+type podEvent struct {
+	Type   string     `json:"type"`
+	Object kubeObject `json:"object"`
+	pods   map[string]bool
+}
+
+const podSynced = "SYNCED"
+
+// podWatch is the source of --source kube-api: it streams the pods of a
+// node from the API server to the event loop, which it wakes up through a
+// pipe.
+type podWatch struct {
+	kube   *kubeClient
+	node   string
+	mutex  sync.Mutex
+	events []podEvent
+	wake   *os.File
+	signal *os.File
+}
+
+func newPodWatch(kube *kubeClient) (*podWatch, error) {
+	if kube == nil {
+		return nil, fmt.Errorf("--source %s needs --kube-api", sourceKubeAPI)
+	}
+	wake, signal, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	w := &podWatch{kube: kube, node: identity.Node(), wake: wake, signal: signal}
+	go w.run()
+	return w, nil
+}
+
+// run lists the pods of the node then watches them, listing them again
+// whenever the watch breaks.
+func (w *podWatch) run() {
+	selector := url.QueryEscape("spec.nodeName=" + w.node)
+	backoff := time.Second
+	for {
+		list := struct {
+			Metadata struct {
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"metadata"`
+			Items []kubeObject `json:"items"`
+		}{}
+		err := w.kube.get("/api/v1/pods?fieldSelector="+selector, &list)
+		if err != nil {
+			logger.Warn("Failed to list pods", "node", w.node, "retry", backoff, "error", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+		synced := podEvent{Type: podSynced, pods: make(map[string]bool)}
+		for _, pod := range list.Items {
+			w.push(podEvent{Type: "ADDED", Object: pod})
+			synced.pods[pod.Metadata.Namespace+"/"+pod.Metadata.Name] = true
+		}
+		w.push(synced)
+		version := list.Metadata.ResourceVersion
+		for version != "" {
+			version, err = w.watch(selector, version)
+			if err != nil {
+				logger.Warn("Pod watch interrupted", "node", w.node, "error", err)
+			}
+		}
+	}
+}
+
+// watch streams the changes since version, returning the last version
+// seen or "" when the pods must be listed again.
+func (w *podWatch) watch(selector string, version string) (string, error) {
+	stream, err := w.kube.stream(fmt.Sprintf("/api/v1/pods?watch=true&fieldSelector=%s&resourceVersion=%s&timeoutSeconds=%d",
+		selector, url.QueryEscape(version), int(podWatchTimeout.Seconds())))
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = stream.Close() }()
+	decoder := json.NewDecoder(stream)
+	for {
+		event := podEvent{}
+		err = decoder.Decode(&event)
+		if err != nil {
+			// The API server ends watches after timeoutSeconds.
+			if err == io.EOF {
+				return version, nil
+			}
+			return "", err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			version = event.Object.Metadata.ResourceVersion
+			w.push(event)
+		case "ERROR":
+			// Usually 410 Gone: version is too old to resume from.
+			return "", nil
+		}
+	}
+}
+
+func (w *podWatch) push(event podEvent) {
+	w.mutex.Lock()
+	w.events = append(w.events, event)
+	w.mutex.Unlock()
+	_, _ = w.signal.Write([]byte{0})
+}
+
+// open returns the pipe the event loop is woken up through. The pods are
+// watched from newPodWatch on, whether the event loop runs or not.
+func (w *podWatch) open() (int, error) {
+	return int(w.wake.Fd()), nil
+}
+
+// read hands the pending events to the monitor once the event loop was
+// woken up.
+func (w *podWatch) read(m *Monitor) (int, error) {
+	drain := make([]byte, 512)
+	_, _ = w.wake.Read(drain)
+	w.mutex.Lock()
+	events := w.events
+	w.events = nil
+	w.mutex.Unlock()
+	for _, event := range events {
+		m.handlePodEvent(event)
+	}
+	return len(events), nil
+}
+
+// reconcile leaves it to the pods listed again when the watch breaks,
+// whose podSynced event preserves the logs of the pods gone meanwhile.
+func (w *podWatch) reconcile(m *Monitor) {}
+
+func (w *podWatch) close() {}
+
+// handlePodEvent watches the logs of the containers of new pods and
+// preserves them when their pod is deleted or evicted.
+func (m *Monitor) handlePodEvent(event podEvent) {
+	if event.Type == podSynced {
+		// Pods deleted while the watch was broken.
+		for key := range m.podFiles {
+			if !event.pods[key] {
+				m.preservePod(key)
+			}
+		}
+		for key := range m.preservedPods {
+			if !event.pods[key] {
+				delete(m.preservedPods, key)
+			}
+		}
+		return
+	}
+	pod := &event.Object
+	key := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+	evicted := pod.Status.Phase == "Failed" && pod.Status.Reason == "Evicted"
+	if event.Type == "DELETED" || evicted {
+		if _, ok := m.podFiles[key]; ok {
+			logger.Info("Pod gone", "namespace", pod.Metadata.Namespace, "pod", pod.Metadata.Name,
+				"reason", pod.Status.Reason, "message", pod.Status.Message)
+			m.pods.update(pod.Metadata.Namespace, pod.Metadata.Name, pod.metadata())
+			m.preservePod(key)
+		}
+		if event.Type == "DELETED" {
+			delete(m.preservedPods, key)
+		} else {
+			m.preservedPods[key] = true
+		}
+		return
+	}
+	if m.preservedPods[key] {
+		return
+	}
+	// Remembers crash looping containers for when they are deleted.
+	m.pods.update(pod.Metadata.Namespace, pod.Metadata.Name, pod.metadata())
+	for _, status := range pod.Status.ContainerStatuses {
+		current := m.watchContainer(pod, status.Name, status.ContainerID, status.RestartCount)
+		if terminated := status.LastState.Terminated; terminated != nil && status.RestartCount > 0 {
+			m.watchContainer(pod, status.Name, terminated.ContainerID, status.RestartCount-1)
+		}
+		if current != "" {
+			m.preservePrevious(current)
+		}
+	}
+}
+
+// watchContainer opens the log of a container, through its link in
+// /var/log/containers if there is one, else in /var/log/pods, and returns
+// the name of its tombstone.
+func (m *Monitor) watchContainer(pod *kubeObject, container string, containerID string, restarts int) string {
+	containerID = trimContainerID(containerID)
+	if containerID == "" {
+		return ""
+	}
+	fileName := fmt.Sprintf("%s_%s_%s-%s.log", pod.Metadata.Name, pod.Metadata.Namespace, container, containerID)
+	key := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+	// Pods are modified many times, logs skipped by the filters are only
+	// considered once.
+	for _, known := range m.podFiles[key] {
+		if known == fileName {
+			return fileName
+		}
+	}
+	m.podFiles[key] = append(m.podFiles[key], fileName)
+	path := filepath.Join(KubernetesLogsPath, fileName)
+	if _, err := os.Stat(path); err != nil {
+		path = filepath.Join(KubernetesPodLogsPath,
+			fmt.Sprintf("%s_%s_%s", pod.Metadata.Namespace, pod.Metadata.Name, pod.Metadata.UID),
+			container, fmt.Sprintf("%d.log", restarts))
+	}
+	m.watchPath(fileName, path)
+	return fileName
+}
+
+// preservePod makes tombstones of the logs of a pod.
+func (m *Monitor) preservePod(key string) {
+	for _, fileName := range m.podFiles[key] {
+		if _, ok := m.monitoredFiles[fileName]; ok {
+			m.unwatch(fileName)
+		}
+	}
+	delete(m.podFiles, key)
+}
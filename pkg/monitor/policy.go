@@ -0,0 +1,409 @@
+package monitor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/pkg/convert"
+	"github.com/badeadan/k8ts/pkg/sink"
+	"github.com/badeadan/k8ts/pkg/sink/collector"
+	"github.com/badeadan/k8ts/pkg/sink/directory"
+	"github.com/badeadan/k8ts/pkg/store"
+	"gopkg.in/yaml.v2"
+)
+
+// policyConfig is a named set of filter and sink settings from the
+// `policies` list of the configuration file. Settings left out are
+// inherited from the global options.
+type policyConfig struct {
+	Name       string   `yaml:"name"`
+	Namespaces []string `yaml:"namespaces"`
+	Pods       []string `yaml:"pods"`
+	// Labels is a label selector as in kubectl, e.g. "app=web,tier!=test".
+	Labels         string  `yaml:"labels"`
+	IncludeLog     *string `yaml:"include-log"`
+	ExcludeLog     *string `yaml:"exclude-log"`
+	IncludeGlob    *string `yaml:"include-glob"`
+	ExcludeGlob    *string `yaml:"exclude-glob"`
+	KeepIf         *string `yaml:"keep-if"`
+	SkipConversion *bool   `yaml:"skip-conversion"`
+	OutputFormat   *string `yaml:"output-format"`
+	OutputTemplate *string `yaml:"output-template"`
+	Collector      *string `yaml:"collector"`
+	// Sinks are given as a kind and the options of the sink, e.g.
+	// {kind: directory, path: /mnt/archive}.
+	Sinks          []map[string]string `yaml:"sinks"`
+	Retention      *string             `yaml:"retention"`
+	MultilineStart *string             `yaml:"multiline-start"`
+	StripANSI      *bool               `yaml:"strip-ansi"`
+	TimeFormat     *string             `yaml:"time-format"`
+	TimeZone       *string             `yaml:"time-zone"`
+	Redact         []string            `yaml:"redact"`
+	RedactRules    *string             `yaml:"redact-rules"`
+	Extract        *string             `yaml:"extract"`
+	TombstoneMode  *string             `yaml:"tombstone-mode"`
+	TombstoneOwner *string             `yaml:"tombstone-owner"`
+	TombstoneGroup *string             `yaml:"tombstone-group"`
+}
+
+// policy decides what happens to the logs of the pods it selects.
+type policy struct {
+	name           string
+	namespaces     []*regexp.Regexp
+	pods           []*regexp.Regexp
+	labels         labelSelector
+	includePattern *regexp.Regexp
+	excludePattern *regexp.Regexp
+	keepIf         *regexp.Regexp
+	skipConversion bool
+	outputFormat   string
+	outputTemplate *template.Template
+	// extract has the columns of csv and tsv tombstones as capture groups.
+	extract *regexp.Regexp
+	// multilineStart matches the first line of records spanning several
+	// lines, such as stack traces.
+	multilineStart *regexp.Regexp
+	rewrite        convert.Rewrite
+	// sinkConfigs are the settings of the sinks the tombstones of the
+	// policy go to, and sinks those sinks once the monitor made them.
+	sinkConfigs []sink.Config
+	sinks       []sink.Sink
+	// retention is how long the tombstones of the policy are kept on the
+	// node, forever when 0.
+	retention time.Duration
+	// permissions are the mode and ownership of the tombstones of the
+	// policy, e.g. 0600 for those of sensitive pods.
+	permissions permissions
+}
+
+const defaultPolicyName = "default"
+
+func loadPolicies(path string) ([]policyConfig, error) {
+	if path == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Policies []policyConfig `yaml:"policies"`
+	}
+	err = yaml.Unmarshal(content, &file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file '%s': %v", path, err)
+	}
+	names := make(map[string]bool)
+	for i, config := range file.Policies {
+		if config.Name == "" {
+			return nil, fmt.Errorf("policy #%d in %s has no name", i+1, path)
+		}
+		if names[config.Name] || config.Name == defaultPolicyName {
+			return nil, fmt.Errorf("duplicate policy '%s' in %s", config.Name, path)
+		}
+		if strings.ContainsAny(config.Name, "/\\") {
+			return nil, fmt.Errorf("invalid policy name '%s' in %s", config.Name, path)
+		}
+		names[config.Name] = true
+	}
+	return file.Policies, nil
+}
+
+// compilePolicies builds the policies from the configuration file followed
+// by the default policy made of the global options, which selects every
+// pod left.
+func compilePolicies(configs []policyConfig, args *Args) ([]*policy, error) {
+	policies := make([]*policy, 0, len(configs)+1)
+	for _, config := range configs {
+		p, err := compilePolicy(config, args)
+		if err != nil {
+			return nil, fmt.Errorf("policy '%s': %v", config.Name, err)
+		}
+		policies = append(policies, p)
+	}
+	p, err := compilePolicy(policyConfig{Name: defaultPolicyName}, args)
+	if err != nil {
+		return nil, err
+	}
+	return append(policies, p), nil
+}
+
+func compilePolicy(config policyConfig, args *Args) (*policy, error) {
+	inherit := func(value *string, global *string) string {
+		if value != nil {
+			return *value
+		}
+		return *global
+	}
+	p := &policy{
+		name:           config.Name,
+		skipConversion: *args.SkipConversion,
+		outputFormat:   inherit(config.OutputFormat, args.OutputFormat),
+	}
+	if config.SkipConversion != nil {
+		p.skipConversion = *config.SkipConversion
+	}
+	var err error
+	switch p.outputFormat {
+	case outputText, outputNDJSON:
+	case outputCSV, outputTSV:
+		extract := inherit(config.Extract, args.Extract)
+		if extract == "" {
+			return nil, fmt.Errorf("output-format %s needs an extract pattern", p.outputFormat)
+		}
+		p.extract, err = compileExtract(extract)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid output-format '%s', expected %s, %s, %s or %s",
+			p.outputFormat, outputText, outputNDJSON, outputCSV, outputTSV)
+	}
+	stripANSI := *args.StripANSI
+	if config.StripANSI != nil {
+		stripANSI = *config.StripANSI
+	}
+	presets := *args.Redact
+	if config.Redact != nil {
+		presets = config.Redact
+	}
+	redactions, err := compileRedactions(presets, inherit(config.RedactRules, args.RedactRules))
+	if err != nil {
+		return nil, err
+	}
+	// Logs copied as they are would keep their secrets unnoticed.
+	if p.skipConversion && len(redactions) > 0 {
+		return nil, fmt.Errorf("skip-conversion copies logs without redacting them, " +
+			"leave out redact and redact-rules (or set them empty) where it is set")
+	}
+	p.rewrite, err = convert.NewRewrite(stripANSI,
+		inherit(config.TimeFormat, args.TimeFormat), inherit(config.TimeZone, args.TimeZone), redactions)
+	if err != nil {
+		return nil, err
+	}
+	if format := inherit(config.OutputTemplate, args.OutputTemplate); format != "" {
+		p.outputTemplate, err = compileOutputTemplate(format)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.namespaces, err = compileGlobs("namespaces", config.Namespaces)
+	if err != nil {
+		return nil, err
+	}
+	p.pods, err = compileGlobs("pods", config.Pods)
+	if err != nil {
+		return nil, err
+	}
+	p.labels, err = compileLabelSelector(config.Labels)
+	if err != nil {
+		return nil, err
+	}
+	p.includePattern, err = compileNameFilter("include",
+		inherit(config.IncludeLog, args.IncludeLog), inherit(config.IncludeGlob, args.IncludeGlob))
+	if err != nil {
+		return nil, err
+	}
+	p.excludePattern, err = compileNameFilter("exclude",
+		inherit(config.ExcludeLog, args.ExcludeLog), inherit(config.ExcludeGlob, args.ExcludeGlob))
+	if err != nil {
+		return nil, err
+	}
+	if keepIf := inherit(config.KeepIf, args.KeepIf); keepIf != "" {
+		p.keepIf, err = settings.CompilePattern("keep-if", keepIf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if start := inherit(config.MultilineStart, args.MultilineStart); start != "" {
+		p.multilineStart, err = settings.CompilePattern("multiline-start", start)
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.permissions, err = parsePermissions("tombstone", inherit(config.TombstoneMode, args.TombstoneMode),
+		inherit(config.TombstoneOwner, args.TombstoneOwner), inherit(config.TombstoneGroup, args.TombstoneGroup))
+	if err != nil {
+		return nil, err
+	}
+	if retention := inherit(config.Retention, args.Retention); retention != "" {
+		p.retention, err = settings.ParseDuration(retention)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention: %v", err)
+		}
+	}
+	p.sinkConfigs, err = p.compileSinks(config, inherit(config.Collector, args.Collector), args)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// compileSinks returns the sinks of a policy: its collector, then its
+// sinks or, when it has none, those of --sink. Without either, tombstones
+// are kept in the tombstone directory, which is a sink like the others.
+func (p *policy) compileSinks(config policyConfig, url string, args *Args) ([]sink.Config, error) {
+	configs := make([]sink.Config, 0, 1)
+	if url != "" {
+		configs = append(configs, sink.Config{Kind: collector.Kind, Options: map[string]string{
+			"url":       url,
+			"cert":      *args.CollectorCert,
+			"key":       *args.CollectorKey,
+			"ca":        *args.CollectorCA,
+			"spool-dir": p.spoolDir(*args.SpoolDir),
+		}})
+	}
+	switch {
+	case config.Sinks != nil:
+		for i, options := range config.Sinks {
+			c := sink.Config{Kind: options["kind"], Options: make(map[string]string)}
+			if c.Kind == "" {
+				return nil, fmt.Errorf("sink #%d has no kind", i+1)
+			}
+			for name, value := range options {
+				if name != "kind" {
+					c.Options[name] = value
+				}
+			}
+			configs = append(configs, c)
+		}
+	case len(*args.Sinks) > 0:
+		for _, text := range *args.Sinks {
+			c, err := sink.ParseConfig(text)
+			if err != nil {
+				return nil, fmt.Errorf("invalid --sink: %v", err)
+			}
+			configs = append(configs, c)
+		}
+	default:
+		configs = append(configs, sink.Config{Kind: directory.Kind, Options: map[string]string{}})
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no sink, tombstones would go nowhere")
+	}
+	for i := range configs {
+		configs[i].Root = TombstonePath
+	}
+	// Tombstones left out of the tombstone directory are removed by the
+	// collector uploading them, which can't know of another one.
+	collectors := 0
+	for _, c := range configs {
+		if c.Kind == collector.Kind {
+			collectors++
+		}
+	}
+	if collectors > 1 && !storesLocally(configs) {
+		return nil, fmt.Errorf("tombstones can only go to several collectors when kept in the tombstone directory, " +
+			"add the directory sink")
+	}
+	return configs, nil
+}
+
+// storesLocally tells whether the tombstone directory is among sinks.
+func storesLocally(configs []sink.Config) bool {
+	for _, config := range configs {
+		if directory.IsLocal(config) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileGlobs(name string, globs []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(globs))
+	for _, glob := range globs {
+		matcher, err := settings.CompileGlob(name, glob)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, matcher)
+	}
+	return compiled, nil
+}
+
+func matchesAny(matchers []*regexp.Regexp, value string) bool {
+	if len(matchers) == 0 {
+		return true
+	}
+	for _, matcher := range matchers {
+		if matcher.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// selects tells whether the policy applies to a container log, of a pod
+// with labels (nil when unknown). A policy without selectors applies to
+// every log.
+func (p *policy) selects(name store.LogName, labels map[string]string) bool {
+	return matchesAny(p.namespaces, name.Namespace) && matchesAny(p.pods, name.Pod) && p.labels.matches(labels)
+}
+
+// filter returns the filter of the policy skipping a log, include or
+// exclude, or "" if it is kept.
+func (p *policy) filter(fileName string) string {
+	if p.includePattern != nil && !p.includePattern.MatchString(fileName) {
+		logger.Debug("Not in the included mask. Skip it", "file", fileName, "policy", p.name)
+		return "include"
+	}
+	if p.excludePattern != nil && p.excludePattern.MatchString(fileName) {
+		logger.Debug("Matches exclude mask. Skip it", "file", fileName, "policy", p.name)
+		return "exclude"
+	}
+	return ""
+}
+
+// policyFor returns the first policy selecting the log, the default policy
+// being the last one.
+func policyFor(policies []*policy, fileName string, labels map[string]string) *policy {
+	name := store.ParseLogName(fileName)
+	for _, p := range policies {
+		if p.selects(name, labels) {
+			return p
+		}
+	}
+	return policies[len(policies)-1]
+}
+
+// selectsLabels tells whether any of the policies selects pods by label.
+func selectsLabels(policies []*policy) bool {
+	for _, p := range policies {
+		if len(p.labels) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// spoolDir keeps the pending uploads of each policy apart, as every
+// policy may stream to its own collector.
+func (p *policy) spoolDir(root string) string {
+	if p.name == defaultPolicyName {
+		return root
+	}
+	return filepath.Join(root, p.name)
+}
+
+// fingerprintPolicies renders policy settings so a reload can tell whether
+// they changed.
+func fingerprintPolicies(configs []policyConfig) string {
+	content, _ := yaml.Marshal(configs)
+	return string(content)
+}
+
+// describePolicies summarizes policies for the logs.
+func describePolicies(policies []*policy) string {
+	names := make([]string, 0, len(policies))
+	for _, p := range policies {
+		names = append(names, p.name)
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,177 @@
+package monitor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/badeadan/k8ts/pkg/sink"
+	"github.com/badeadan/k8ts/pkg/sink/collector"
+)
+
+func compileTestPolicies(t *testing.T, values map[string]interface{}, configs ...policyConfig) []*policy {
+	t.Helper()
+	policies, err := compilePolicies(configs, compileTestArgs(t, values))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policies
+}
+
+func TestPolicyFor(t *testing.T) {
+	policies := compileTestPolicies(t, nil,
+		policyConfig{Name: "payments", Namespaces: []string{"pay*"}, Pods: []string{"api-?", "worker-[0-9]*"}},
+		policyConfig{Name: "web", Labels: "app=web,tier!=test"},
+		policyConfig{Name: "system", Namespaces: []string{"kube-system", "[!a-z]*"}})
+	for _, c := range []struct {
+		file   string
+		labels map[string]string
+		want   string
+	}{
+		{"api-1_payments_app-0123.log", nil, "payments"},
+		{"worker-12_pay_app-0123.log", nil, "payments"},
+		{"api-12_payments_app-0123.log", nil, defaultPolicyName},
+		{"worker-x_payments_app-0123.log", nil, defaultPolicyName},
+		{"web-1_shop_app-0123.log", map[string]string{"app": "web"}, "web"},
+		{"web-1_shop_app-0123.log", map[string]string{"app": "web", "tier": "test"}, defaultPolicyName},
+		// Labels which aren't known yet select nothing.
+		{"web-1_shop_app-0123.log", nil, defaultPolicyName},
+		{"api-1_payments_app-0123.log", map[string]string{"app": "web"}, "payments"},
+		{"dns_kube-system_app-0123.log", nil, "system"},
+		{"dns_0-system_app-0123.log", nil, "system"},
+		{"dns_kube-system-2_app-0123.log", nil, defaultPolicyName},
+	} {
+		if got := policyFor(policies, c.file, c.labels).name; got != c.want {
+			t.Errorf("%s with labels %v has policy %s, want %s", c.file, c.labels, got, c.want)
+		}
+	}
+}
+
+func TestLabelSelector(t *testing.T) {
+	labels := map[string]string{"app": "web", "tier": "front", "canary": ""}
+	for selector, want := range map[string]bool{
+		"":                          true,
+		"app":                       true,
+		"!app":                      false,
+		"!track":                    true,
+		"app=web":                   true,
+		"app==web":                  true,
+		"app!=web":                  false,
+		"app=api":                   false,
+		"track!=stable":             true,
+		"app in (web, api)":         true,
+		"app notin (web,api)":       false,
+		"tier in (back)":            false,
+		"track notin (stable)":      true,
+		"app=web, tier in (front)":  true,
+		"app=web,tier in (back,db)": false,
+		"canary":                    true,
+		"canary=":                   true,
+	} {
+		selector, err := compileLabelSelector(selector)
+		if err != nil {
+			t.Errorf("%v", err)
+			continue
+		}
+		if got := selector.matches(labels); got != want {
+			t.Errorf("%v matches %v: %t, want %t", selector, labels, got, want)
+		}
+	}
+	for _, selector := range []string{"!app=web", "app in web", "=web", "app in (web"} {
+		if _, err := compileLabelSelector(selector); err == nil {
+			t.Errorf("labels %q compile", selector)
+		}
+	}
+}
+
+func TestPolicyFilter(t *testing.T) {
+	for _, c := range []struct {
+		values map[string]interface{}
+		file   string
+		want   string
+	}{
+		{nil, "web_shop_app-0123.log", ""},
+		{map[string]interface{}{"include-glob": "web_*"}, "web_shop_app-0123.log", ""},
+		{map[string]interface{}{"include-glob": "web_*"}, "api_shop_app-0123.log", "include"},
+		{map[string]interface{}{"include-log": "^api", "include-glob": "web_*"}, "api_shop_app-0123.log", ""},
+		{map[string]interface{}{"exclude-glob": "*_kube-system_*"}, "dns_kube-system_app-0123.log", "exclude"},
+		{map[string]interface{}{"exclude-log": "sidecar"}, "web_shop_sidecar-0123.log", "exclude"},
+		{map[string]interface{}{"include-glob": "web_*", "exclude-glob": "*_sidecar-*"}, "web_shop_sidecar-0123.log", "exclude"},
+	} {
+		p := policyFor(compileTestPolicies(t, c.values), c.file, nil)
+		if got := p.filter(c.file); got != c.want {
+			t.Errorf("%s with %v is filtered by %q, want %q", c.file, c.values, got, c.want)
+		}
+	}
+}
+
+func TestPolicySinks(t *testing.T) {
+	values := map[string]interface{}{
+		"collector": "https://collector:7443",
+		"spool-dir": "/var/spool/k8ts",
+		"sink":      []interface{}{"directory:path=/mnt/archive"},
+	}
+	policies := compileTestPolicies(t, values,
+		policyConfig{Name: "inherits"},
+		policyConfig{Name: "replaces", Sinks: []map[string]string{{"kind": "directory", "path": "/mnt/pci"}}},
+		policyConfig{Name: "local", Collector: new(string), Sinks: []map[string]string{{"kind": "directory"}}})
+	archive := sink.Config{Kind: "directory", Options: map[string]string{"path": "/mnt/archive"}, Root: TombstonePath}
+	local := sink.Config{Kind: "directory", Options: map[string]string{}, Root: TombstonePath}
+	for _, c := range []struct {
+		name string
+		want []sink.Config
+	}{
+		{"inherits", []sink.Config{collectorConfig("/var/spool/k8ts/inherits"), archive}},
+		{"replaces", []sink.Config{collectorConfig("/var/spool/k8ts/replaces"),
+			{Kind: "directory", Options: map[string]string{"path": "/mnt/pci"}, Root: TombstonePath}}},
+		{"local", []sink.Config{local}},
+		{defaultPolicyName, []sink.Config{collectorConfig("/var/spool/k8ts"), archive}},
+	} {
+		var got []sink.Config
+		for _, p := range policies {
+			if p.name == c.name {
+				got = p.sinkConfigs
+			}
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("policy %s has sinks %v, want %v", c.name, got, c.want)
+		}
+		if stored := storesLocally(got); stored != (c.name == "local") {
+			t.Errorf("policy %s keeps tombstones in the tombstone directory: %t", c.name, stored)
+		}
+	}
+
+	// The tombstone directory is the sink of policies without any.
+	policies = compileTestPolicies(t, map[string]interface{}{"collector": "https://collector:7443"})
+	if got := policies[0].sinkConfigs; !reflect.DeepEqual(got, []sink.Config{collectorConfig(collector.DefaultSpoolPath), local}) {
+		t.Errorf("default sinks are %v", got)
+	}
+	if !storesLocally([]sink.Config{{Kind: "directory", Options: map[string]string{"path": TombstonePath + "/"}, Root: TombstonePath}}) {
+		t.Error("directory sink with the path of the tombstone directory isn't the local one")
+	}
+
+	for _, config := range []policyConfig{
+		{Name: "kindless", Sinks: []map[string]string{{"path": "/mnt"}}},
+		{Name: "nowhere", Sinks: []map[string]string{}},
+		{Name: "collectors", Collector: new(string), Sinks: []map[string]string{
+			{"kind": "collector", "url": "https://a:7443"}, {"kind": "collector", "url": "https://b:7443"}}},
+	} {
+		if _, err := compilePolicies([]policyConfig{config}, compileTestArgs(t, nil)); err == nil {
+			t.Errorf("policy %s compiles", config.Name)
+		}
+	}
+}
+
+func collectorConfig(spoolDir string) sink.Config {
+	return sink.Config{Kind: collector.Kind, Options: map[string]string{
+		"url": "https://collector:7443", "cert": "", "key": "", "ca": "", "spool-dir": spoolDir,
+	}, Root: TombstonePath}
+}
+
+func compileTestArgs(t *testing.T, values map[string]interface{}) *Args {
+	t.Helper()
+	args, err := NewArgs(values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return args
+}
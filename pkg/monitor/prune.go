@@ -0,0 +1,143 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+type PruneArgs struct {
+	Dir       *string
+	OlderThan *string
+	MaxSize   *string
+	DryRun    *bool
+}
+
+// Prune enforces the retention of the tombstone store: tombstones past
+// the expiry recorded in their metadata sidecar go first, then those older
+// than --older-than, then the oldest ones until the store fits in
+// --max-size.
+func Prune(args *PruneArgs) error {
+	deadline, maxSize, err := pruneLimits(*args.OlderThan, *args.MaxSize)
+	if err != nil {
+		return err
+	}
+	pruned, err := pruneTombstones(*args.Dir, deadline, maxSize, *args.DryRun)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Pruned %d tombstones\n", pruned)
+	return nil
+}
+
+// pruneLimits parses --older-than and --max-size, either of which may be
+// empty, into the time before which tombstones are pruned and the size the
+// store is pruned down to, -1 for none.
+func pruneLimits(olderThan string, maxSize string) (time.Time, int64, error) {
+	var deadline time.Time
+	if olderThan != "" {
+		age, err := settings.ParseDuration(olderThan)
+		if err != nil {
+			return deadline, 0, fmt.Errorf("invalid --older-than: %v", err)
+		}
+		deadline = time.Now().Add(-age)
+	}
+	size := int64(-1)
+	if maxSize != "" {
+		parsed, err := parseSize(maxSize)
+		if err != nil {
+			return deadline, 0, fmt.Errorf("invalid --max-size: %v", err)
+		}
+		size = parsed
+	}
+	return deadline, size, nil
+}
+
+// pruneTombstones prunes the tombstone store at root as prune does and
+// returns how many tombstones were deleted.
+func pruneTombstones(root string, deadline time.Time, maxSize int64, dryRun bool) (int, error) {
+	tombstones, err := store.FindTombstones(root, nil)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	total := int64(0)
+	left := make([]store.Tombstone, 0, len(tombstones))
+	pruned := 0
+	for _, t := range tombstones {
+		if t.ExpiresAt != nil && t.ExpiresAt.Before(now) {
+			if removeTombstone(t, dryRun) {
+				pruned++
+			}
+			continue
+		}
+		total += t.Size
+		left = append(left, t)
+	}
+	for _, t := range left {
+		if !t.PreservedAt.Before(deadline) && (maxSize < 0 || total <= maxSize) {
+			break
+		}
+		total -= t.Size
+		if removeTombstone(t, dryRun) {
+			pruned++
+		}
+	}
+	return pruned, nil
+}
+
+// removeTombstone deletes a tombstone along with its companion files.
+func removeTombstone(t store.Tombstone, dryRun bool) bool {
+	if dryRun {
+		fmt.Printf("Would prune %s\n", t.Path)
+		return false
+	}
+	err := os.Remove(t.Path)
+	if err != nil {
+		logger.Error("Failed to prune", "path", t.Path, "error", err)
+		return false
+	}
+	store.RemoveTombstone(t.Path)
+	logger.Info("Pruned", "path", t.Path)
+	// The merged view of a pod goes along with its tombstones.
+	dir := filepath.Dir(t.Path)
+	if _, err := os.Stat(filepath.Join(dir, store.MergedLogName)); err == nil {
+		err = mergePodLogs(dir)
+		if err != nil {
+			logger.Warn("Failed to merge pod logs", "path", dir, "error", err)
+		}
+	}
+	return true
+}
+
+// expire deletes the tombstones past the retention of their policy or
+// pod, as recorded in their metadata sidecar.
+func expire(root string) {
+	tombstones, err := store.FindTombstones(root, nil)
+	if err != nil {
+		logger.Warn("Failed to look for expired tombstones", "path", root, "error", err)
+	}
+	now := time.Now()
+	for _, t := range tombstones {
+		if t.ExpiresAt != nil && t.ExpiresAt.Before(now) {
+			removeTombstone(t, false)
+		}
+	}
+}
+
+func expireLoop(ctx context.Context, root string) {
+	for {
+		expire(root)
+		select {
+		case <-time.After(time.Hour):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package monitor
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/badeadan/k8ts/pkg/convert"
+	"gopkg.in/yaml.v2"
+)
+
+// redactionRule is a redaction of the `rules` list of a --redact-rules
+// file, e.g.
+//
+//	rules:
+//	  - name: session-cookie
+//	    pattern: 'session=[0-9a-f]+'
+//	    replacement: 'session=[REDACTED]'
+type redactionRule struct {
+	Name        string `yaml:"name"`
+	Pattern     string `yaml:"pattern"`
+	Replacement string `yaml:"replacement"`
+}
+
+// loadRedactionRules compiles the redactions of the rules file at path.
+func loadRedactionRules(path string) ([]convert.Redaction, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rules []redactionRule `yaml:"rules"`
+	}
+	err = yaml.UnmarshalStrict(content, &file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redaction rules file '%s': %v", path, err)
+	}
+	redactions := make([]convert.Redaction, 0, len(file.Rules))
+	names := make(map[string]bool)
+	for i, rule := range file.Rules {
+		if rule.Name == "" || rule.Pattern == "" {
+			return nil, fmt.Errorf("redaction rule #%d in %s has no name or pattern", i+1, path)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate redaction rule '%s' in %s", rule.Name, path)
+		}
+		names[rule.Name] = true
+		redaction, err := convert.NewRedaction(rule.Name, rule.Pattern, rule.Replacement)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		redactions = append(redactions, redaction)
+	}
+	return redactions, nil
+}
+
+// compileRedactions returns the redactions of the presets followed by
+// those of the rules file, if any.
+func compileRedactions(presets []string, rulesPath string) ([]convert.Redaction, error) {
+	var redactions []convert.Redaction
+	for _, name := range presets {
+		preset, err := convert.RedactionPreset(name)
+		if err != nil {
+			return nil, err
+		}
+		redactions = append(redactions, preset...)
+	}
+	if rulesPath != "" {
+		rules, err := loadRedactionRules(rulesPath)
+		if err != nil {
+			return nil, err
+		}
+		redactions = append(redactions, rules...)
+	}
+	return redactions, nil
+}
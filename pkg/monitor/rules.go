@@ -0,0 +1,465 @@
+package monitor
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/pkg/store"
+	"gopkg.in/yaml.v2"
+)
+
+// Rules added at runtime are one of these kinds: include rules have their
+// logs watched and kept whatever the filters and keep-if say, exclude rules
+// have them skipped, and keep-if rules keep them when their content
+// matches, besides the keep-if of their policy. Exclude rules win over
+// include rules.
+const (
+	ruleInclude = "include"
+	ruleExclude = "exclude"
+	ruleKeepIf  = "keep-if"
+)
+
+var ruleKinds = []string{ruleInclude, ruleExclude, ruleKeepIf}
+
+// filterRule is a rule added through the admin API, e.g. by an incident
+// responder keeping every log of a namespace for the next hours without
+// restarting the monitor. Persisted rules are saved to the `rules` list of
+// the configuration file, the others are lost when the monitor stops.
+type filterRule struct {
+	ID        string `yaml:"id" json:"id"`
+	Kind      string `yaml:"kind" json:"kind"`
+	Namespace string `yaml:"namespace,omitempty" json:"namespace,omitempty"`
+	// Pod is a glob of the names of the pods selected.
+	Pod       string     `yaml:"pod,omitempty" json:"pod,omitempty"`
+	KeepIf    string     `yaml:"keep-if,omitempty" json:"keepIf,omitempty"`
+	Reason    string     `yaml:"reason,omitempty" json:"reason,omitempty"`
+	ExpiresAt *time.Time `yaml:"expires-at,omitempty" json:"expiresAt,omitempty"`
+	Persist   bool       `yaml:"-" json:"persist,omitempty"`
+	pod       *regexp.Regexp
+	keepIf    *regexp.Regexp
+}
+
+// ruleRequest is a rule to add, as posted to the admin API, lasting For
+// (e.g. 2h) unless empty.
+type ruleRequest struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	KeepIf    string `json:"keepIf"`
+	Reason    string `json:"reason"`
+	For       string `json:"for"`
+	Persist   bool   `json:"persist"`
+}
+
+func (r *filterRule) compile() error {
+	if !settings.Contains(ruleKinds, r.Kind) {
+		return fmt.Errorf("invalid kind '%s', expected one of %s", r.Kind, strings.Join(ruleKinds, ", "))
+	}
+	if r.Kind == ruleKeepIf && r.KeepIf == "" {
+		return fmt.Errorf("keep-if rule without pattern")
+	}
+	if r.Kind != ruleKeepIf && r.KeepIf != "" {
+		return fmt.Errorf("only keep-if rules take a pattern")
+	}
+	var err error
+	if r.Pod != "" {
+		r.pod, err = settings.CompileGlob("pod", r.Pod)
+		if err != nil {
+			return err
+		}
+	}
+	if r.KeepIf != "" {
+		r.keepIf, err = settings.CompilePattern("keep-if", r.KeepIf)
+	}
+	return err
+}
+
+func (r *filterRule) expired(now time.Time) bool {
+	return r.ExpiresAt != nil && !now.Before(*r.ExpiresAt)
+}
+
+// selects tells whether the rule applies to the log fileName.
+func (r *filterRule) selects(fileName string, now time.Time) bool {
+	if r.expired(now) {
+		return false
+	}
+	name := store.ParseLogName(fileName)
+	return (r.Namespace == "" || r.Namespace == name.Namespace) &&
+		(r.pod == nil || r.pod.MatchString(name.Pod))
+}
+
+func (r *filterRule) String() string {
+	text := r.Kind
+	if r.Namespace != "" {
+		text += " namespace " + r.Namespace
+	}
+	if r.Pod != "" {
+		text += " pod " + r.Pod
+	}
+	if r.KeepIf != "" {
+		text += " matching " + r.KeepIf
+	}
+	return text
+}
+
+// ruleFor returns the exclude or else the include rule deciding on the log
+// fileName, nil if none does.
+func ruleFor(rules []*filterRule, fileName string) *filterRule {
+	now := time.Now()
+	var include *filterRule
+	for _, r := range rules {
+		if !r.selects(fileName, now) {
+			continue
+		}
+		if r.Kind == ruleExclude {
+			return r
+		}
+		if r.Kind == ruleInclude && include == nil {
+			include = r
+		}
+	}
+	return include
+}
+
+// keepIfRule returns the first keep-if rule which the log source of
+// fileName matches, nil if none does.
+func keepIfRule(rules []*filterRule, fileName string, source *os.File, multiline *regexp.Regexp) (*filterRule, error) {
+	now := time.Now()
+	for _, r := range rules {
+		if r.Kind != ruleKeepIf || !r.selects(fileName, now) {
+			continue
+		}
+		if _, err := source.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if search(source, r.keepIf, multiline) {
+			return r, nil
+		}
+	}
+	return nil, nil
+}
+
+// loadRules returns the rules persisted in the configuration file at path,
+// but those expired.
+func loadRules(path string) ([]*filterRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rules []*filterRule `yaml:"rules"`
+	}
+	err = yaml.Unmarshal(content, &file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration file '%s': %v", path, err)
+	}
+	now := time.Now()
+	rules := make([]*filterRule, 0, len(file.Rules))
+	for i, r := range file.Rules {
+		if r.ID == "" {
+			return nil, fmt.Errorf("rule #%d in %s has no id", i+1, path)
+		}
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule '%s' in %s: %v", r.ID, path, err)
+		}
+		r.Persist = true
+		if !r.expired(now) {
+			rules = append(rules, r)
+		}
+	}
+	return rules, nil
+}
+
+// saveRules replaces the rules list of the configuration file at path with
+// the persisted ones among rules, leaving the rest of the file alone. The
+// file is replaced at once where its symbolic links lead.
+func saveRules(path string, rules []*filterRule) error {
+	if path == "" {
+		return fmt.Errorf("no configuration file to persist rules to, see --config")
+	}
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(target)
+	if err != nil {
+		return err
+	}
+	var file yaml.MapSlice
+	err = yaml.Unmarshal(content, &file)
+	if err != nil {
+		return fmt.Errorf("invalid configuration file '%s': %v", path, err)
+	}
+	persisted := make([]*filterRule, 0, len(rules))
+	for _, r := range rules {
+		if r.Persist {
+			persisted = append(persisted, r)
+		}
+	}
+	found := false
+	for i := range file {
+		if file[i].Key == "rules" {
+			file[i].Value, found = persisted, true
+		}
+	}
+	if !found {
+		file = append(file, yaml.MapItem{Key: "rules", Value: persisted})
+	}
+	content, err = yaml.Marshal(file)
+	if err != nil {
+		return err
+	}
+	// The file keeps its mode, e.g. 0600 when it holds secrets.
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(target); err == nil {
+		mode = info.Mode().Perm()
+	}
+	temporary := filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".tmp")
+	err = ioutil.WriteFile(temporary, content, mode)
+	if err == nil {
+		err = os.Rename(temporary, target)
+	}
+	if err != nil {
+		_ = os.Remove(temporary)
+		return fmt.Errorf("failed to persist rules to %s: %v", path, err)
+	}
+	return nil
+}
+
+func newRuleID() string {
+	id := make([]byte, 4)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// activeRules returns the rules which haven't expired, forgetting the
+// others.
+func (m *Monitor) activeRules() []*filterRule {
+	now := time.Now()
+	active := make([]*filterRule, 0, len(m.rules))
+	for _, r := range m.rules {
+		if r.expired(now) {
+			logger.Info("Rule expired", "rule", r.ID, "description", r.String())
+			continue
+		}
+		active = append(active, r)
+	}
+	m.rules = active
+	return active
+}
+
+// addRule adds the rule of request and, for include rules, watches the
+// logs it selects which the filters left out.
+func (m *Monitor) addRule(request *ruleRequest) (*filterRule, error) {
+	r := &filterRule{
+		ID:        newRuleID(),
+		Kind:      request.Kind,
+		Namespace: request.Namespace,
+		Pod:       request.Pod,
+		KeepIf:    request.KeepIf,
+		Reason:    request.Reason,
+		Persist:   request.Persist,
+	}
+	if request.For != "" {
+		duration, err := settings.ParseDuration(request.For)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid duration '%s'", request.For)
+		}
+		expiresAt := time.Now().Add(duration).Truncate(time.Second)
+		r.ExpiresAt = &expiresAt
+	}
+	err := r.compile()
+	if err != nil {
+		return nil, err
+	}
+	// The copy queue holds on to the rules of the logs it preserves, the
+	// list is replaced rather than changed.
+	rules := append(append([]*filterRule(nil), m.activeRules()...), r)
+	if r.Persist {
+		err = saveRules(m.args.ConfigPath, rules)
+		if err != nil {
+			return nil, err
+		}
+	}
+	m.rules = rules
+	logger.Info("Rule added", "rule", r.ID, "description", r.String(), "reason", r.Reason, "expiresAt", r.ExpiresAt)
+	if r.Kind == ruleInclude && *m.args.Source != sourceKubeAPI {
+		m.watchSelected(r)
+	}
+	return r, nil
+}
+
+// watchSelected watches the logs of /var/log/containers selected by the
+// rule r which aren't yet.
+func (m *Monitor) watchSelected(r *filterRule) {
+	entries, err := ioutil.ReadDir(KubernetesLogsPath)
+	if err != nil {
+		logger.Warn("Failed to list logs", "path", KubernetesLogsPath, "error", err)
+		return
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if _, ok := m.monitoredFiles[entry.Name()]; !ok && r.selects(entry.Name(), now) {
+			m.watchPath(entry.Name(), entry.Name())
+		}
+	}
+}
+
+// removeRule removes the rule id, from the configuration file as well if
+// it was persisted.
+func (m *Monitor) removeRule(id string) error {
+	rules := make([]*filterRule, 0, len(m.rules))
+	var removed *filterRule
+	for _, r := range m.activeRules() {
+		if r.ID == id {
+			removed = r
+		} else {
+			rules = append(rules, r)
+		}
+	}
+	if removed == nil {
+		return fmt.Errorf("no rule %s", id)
+	}
+	if removed.Persist {
+		err := saveRules(m.args.ConfigPath, rules)
+		if err != nil {
+			return err
+		}
+	}
+	m.rules = rules
+	logger.Info("Rule removed", "rule", removed.ID, "description", removed.String())
+	return nil
+}
+
+// reloadRules takes the persisted rules from the configuration file again,
+// keeping the others.
+func (m *Monitor) reloadRules(persisted []*filterRule) {
+	rules := persisted
+	for _, r := range m.rules {
+		if !r.Persist {
+			rules = append(rules, r)
+		}
+	}
+	m.rules = rules
+}
+
+// handleRules lists the rules, adds the one posted or removes the rule id
+// on DELETE.
+func (a *adminServer) handleRules(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	var request ruleRequest
+	if r.Method == http.MethodPost {
+		err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&request)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid rule: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	id := r.URL.Query().Get("id")
+	a.reply(w, func(m *Monitor) (interface{}, int, error) {
+		switch r.Method {
+		case http.MethodPost:
+			rule, err := m.addRule(&request)
+			return rule, http.StatusBadRequest, err
+		case http.MethodDelete:
+			err := m.removeRule(id)
+			return m.activeRules(), http.StatusNotFound, err
+		}
+		return m.activeRules(), 0, nil
+	})
+}
+
+type RuleArgs struct {
+	list      *argparse.Command
+	add       *argparse.Command
+	remove    *argparse.Command
+	kind      *string
+	namespace *string
+	pod       *string
+	keepIf    *string
+	duration  *string
+	reason    *string
+	persist   *bool
+	id        *string
+}
+
+func AttachRuleArgs(settings *settings.Settings, cmd *argparse.Command) *RuleArgs {
+	args := &RuleArgs{
+		list:   cmd.NewCommand("list", "List the rules of the running monitor"),
+		add:    cmd.NewCommand("add", "Add a rule to the running monitor"),
+		remove: cmd.NewCommand("remove", "Remove a rule from the running monitor"),
+	}
+	args.kind = settings.Selector(args.add, "k", "kind", ruleKinds,
+		&argparse.Options{Help: "Watch and keep the logs selected whatever the filters, skip them, or also keep them when they match --matching", Required: true})
+	args.namespace = settings.String(args.add, "n", "namespace",
+		&argparse.Options{Help: "Only logs from this namespace", Required: false})
+	args.pod = settings.Glob(args.add, "p", "pod",
+		&argparse.Options{Help: "Only logs of pods matching this glob (e.g. 'api-*')", Required: false})
+	// Named apart from the keep-if of the monitor, which may be set in
+	// the environment.
+	args.keepIf = settings.Pattern(args.add, "", "matching",
+		&argparse.Options{Help: "Pattern the content of the logs of keep-if rules is matched against", Required: false})
+	args.duration = settings.String(args.add, "", "for",
+		&argparse.Options{Help: "Remove the rule after this duration (e.g. 2h)", Required: false})
+	args.reason = settings.String(args.add, "", "reason",
+		&argparse.Options{Help: "Why the rule was added, e.g. an incident", Required: false})
+	args.persist = settings.Flag(args.add, "", "persist",
+		&argparse.Options{Help: "Save the rule to the configuration file of the monitor, so that it survives restarts", Required: false})
+	args.id = settings.String(args.remove, "", "id",
+		&argparse.Options{Help: "Rule to remove, as listed", Required: true})
+	return args
+}
+
+// Rule lists, adds or removes the rules of the running monitor through its
+// admin API.
+func Rule(args *RuleArgs) error {
+	var rules []*filterRule
+	switch {
+	case args.add.Happened():
+		request := &ruleRequest{Kind: *args.kind, Namespace: *args.namespace, Pod: *args.pod,
+			KeepIf: *args.keepIf, Reason: *args.reason, For: *args.duration, Persist: *args.persist}
+		added := &filterRule{}
+		err := adminRequest(http.MethodPost, "/v1/rules", request, added)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, added)
+	case args.remove.Happened():
+		return adminRequest(http.MethodDelete, "/v1/rules?id="+url.QueryEscape(*args.id), nil, &rules)
+	default:
+		err := adminRequest(http.MethodGet, "/v1/rules", nil, &rules)
+		if err != nil {
+			return err
+		}
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tRULE\tEXPIRES\tPERSISTED\tREASON")
+	for _, r := range rules {
+		expires := "never"
+		if r.ExpiresAt != nil {
+			expires = r.ExpiresAt.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%t\t%s\n", r.ID, r.String(), expires, r.Persist, r.Reason)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,250 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+)
+
+// containerRuntime is what the runtime sources ask the container runtime
+// about containers: the CRI of containerd and CRI-O, or the Docker Engine
+// API.
+type containerRuntime interface {
+	// address names the runtime in logs, e.g. its socket.
+	address() string
+	// list returns the ids of the containers and whether their logs are
+	// to be watched: they were started and weren't reported gone since.
+	list() (map[string]bool, error)
+	// describe returns the pod, name and log of the container id. The pod
+	// is empty for containers which aren't those of pods.
+	describe(id string) (*runtimeContainer, error)
+	// follow calls handle with the containers started and gone until the
+	// events break, or fails with errNoEvents right away.
+	follow(handle func(id string, started bool)) error
+}
+
+// runtimeCallTimeout bounds the calls to the runtime but the events.
+const runtimeCallTimeout = 10 * time.Second
+
+// errNoEvents is returned by runtimes which don't stream container events.
+var errNoEvents = errors.New("the container runtime doesn't stream events")
+
+// runtimeContainer is a container of a pod as its runtime describes it.
+type runtimeContainer struct {
+	id        string
+	pod       string
+	namespace string
+	name      string
+	logPath   string
+}
+
+// fileName is the name of the link to the log of c in /var/log/containers.
+func (c *runtimeContainer) fileName() string {
+	return fmt.Sprintf("%s_%s_%s-%s.log", c.pod, c.namespace, c.name, c.id)
+}
+
+// setPod takes the pod and name of c from the labels the kubelet gives
+// containers, which those of other pods don't have.
+func (c *runtimeContainer) setPod(labels map[string]string) {
+	c.pod = labels["io.kubernetes.pod.name"]
+	c.namespace = labels["io.kubernetes.pod.namespace"]
+	if name := labels["io.kubernetes.container.name"]; name != "" {
+		c.name = name
+	}
+}
+
+// runtimeEvent is a container started or gone. Containers missing from a
+// listing are reported by an event with the ids of those listed.
+type runtimeEvent struct {
+	started *runtimeContainer
+	gone    string
+	synced  map[string]bool
+}
+
+// runtimeSource is the source of --source cri and --source docker: it
+// learns about containers and where their logs are from the runtime,
+// rather than from the names of the files of /var/log/containers, and
+// preserves their logs when the runtime reports them gone. The events of
+// runtimes which don't stream them are found by listing the containers
+// every interval.
+type runtimeSource struct {
+	runtime  containerRuntime
+	interval time.Duration
+	mutex    sync.Mutex
+	events   []runtimeEvent
+	wake     *os.File
+	signal   *os.File
+	// known are the containers described so far, by the goroutine
+	// talking to the runtime.
+	known map[string]bool
+	// containers are the logs of the containers handed to the monitor, by
+	// container id, only used by the event loop.
+	containers map[string]string
+}
+
+func newRuntimeSource(runtime containerRuntime, interval time.Duration) (*runtimeSource, error) {
+	wake, signal, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	s := &runtimeSource{runtime: runtime, interval: interval, wake: wake, signal: signal,
+		known: make(map[string]bool), containers: make(map[string]string)}
+	go s.run()
+	return s, nil
+}
+
+// run lists the containers then follows their events, listing them again
+// whenever the events break, or every interval when the runtime doesn't
+// stream events.
+func (s *runtimeSource) run() {
+	logger.Info("Watching containers", "runtime", s.runtime.address())
+	events := true
+	backoff := time.Second
+	for {
+		err := s.list()
+		if err != nil {
+			logger.Warn("Failed to list containers", "runtime", s.runtime.address(), "retry", backoff, "error", err)
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+		if !events {
+			time.Sleep(s.interval)
+			continue
+		}
+		err = s.runtime.follow(s.handleEvent)
+		if err == errNoEvents {
+			logger.Info("The container runtime doesn't stream events, polling it", "interval", s.interval)
+			events = false
+		} else if err != nil {
+			logger.Warn("Container events interrupted", "runtime", s.runtime.address(), "error", err)
+			time.Sleep(minWatchBackoff)
+		}
+	}
+}
+
+// list describes the containers started since the last listing and
+// reports the ones gone.
+func (s *runtimeSource) list() error {
+	containers, err := s.runtime.list()
+	if err != nil {
+		return err
+	}
+	synced := runtimeEvent{synced: make(map[string]bool, len(containers))}
+	for id, started := range containers {
+		// The log of a container is opened by the runtime once started.
+		if started {
+			s.describe(id)
+		}
+		synced.synced[id] = true
+	}
+	for id := range s.known {
+		if !synced.synced[id] {
+			delete(s.known, id)
+		}
+	}
+	s.push(synced)
+	return nil
+}
+
+func (s *runtimeSource) handleEvent(id string, started bool) {
+	if started {
+		s.describe(id)
+		return
+	}
+	delete(s.known, id)
+	s.push(runtimeEvent{gone: id})
+}
+
+// describe reports the container id as started, once.
+func (s *runtimeSource) describe(id string) {
+	if s.known[id] {
+		return
+	}
+	container, err := s.runtime.describe(id)
+	if err != nil {
+		logger.Warn("Failed to describe container", "containerId", id, "error", err)
+		return
+	}
+	s.known[id] = true
+	if container.pod == "" || container.namespace == "" {
+		logger.Debug("Not the container of a pod", "containerId", id)
+		return
+	}
+	if container.logPath == "" {
+		logger.Warn("Container doesn't log to a file", "containerId", id, "pod", container.pod,
+			"namespace", container.namespace)
+		return
+	}
+	s.push(runtimeEvent{started: container})
+}
+
+func (s *runtimeSource) push(event runtimeEvent) {
+	s.mutex.Lock()
+	s.events = append(s.events, event)
+	s.mutex.Unlock()
+	_, _ = s.signal.Write([]byte{0})
+}
+
+// open returns the pipe the event loop is woken up through. The containers
+// are watched from newRuntimeSource on, whether the event loop runs or
+// not.
+func (s *runtimeSource) open() (int, error) {
+	return int(s.wake.Fd()), nil
+}
+
+// read watches the logs of the containers started and preserves those of
+// the containers gone, once the event loop was woken up.
+func (s *runtimeSource) read(m *Monitor) (int, error) {
+	drain := make([]byte, 512)
+	_, _ = s.wake.Read(drain)
+	s.mutex.Lock()
+	events := s.events
+	s.events = nil
+	s.mutex.Unlock()
+	for _, event := range events {
+		switch {
+		case event.started != nil:
+			fileName := event.started.fileName()
+			if _, ok := s.containers[event.started.id]; ok {
+				continue
+			}
+			s.containers[event.started.id] = fileName
+			m.preservePrevious(fileName)
+			m.watchPath(fileName, event.started.logPath)
+		case event.synced != nil:
+			// Containers gone while the events weren't followed.
+			for id := range s.containers {
+				if !event.synced[id] {
+					s.unwatch(m, id)
+				}
+			}
+		default:
+			s.unwatch(m, event.gone)
+		}
+	}
+	return len(events), nil
+}
+
+func (s *runtimeSource) unwatch(m *Monitor, id string) {
+	fileName, ok := s.containers[id]
+	if !ok {
+		return
+	}
+	delete(s.containers, id)
+	m.unwatch(fileName)
+}
+
+// reconcile leaves it to the containers listed again when the events
+// break, whose runtimeEvent of the listing preserves the logs of the
+// containers gone meanwhile.
+func (s *runtimeSource) reconcile(m *Monitor) {}
+
+func (s *runtimeSource) close() {}
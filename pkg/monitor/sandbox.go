@@ -0,0 +1,302 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"golang.org/x/sys/unix"
+)
+
+// With --sandbox, once initialized, the monitor confines itself with
+// Landlock to reading logs and writing tombstones, and denies itself the
+// system calls a log agent has no business making with seccomp, so that a
+// compromise of the root-running monitor can't take over the node.
+// Neither can be lifted until the monitor exits.
+
+// The Landlock system calls, numbered alike on every architecture.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+)
+
+// The file system accesses of Landlock, as of its ABI version 3.
+const (
+	landlockExecute    = 1 << 0
+	landlockWriteFile  = 1 << 1
+	landlockReadFile   = 1 << 2
+	landlockReadDir    = 1 << 3
+	landlockRemoveDir  = 1 << 4
+	landlockRemoveFile = 1 << 5
+	landlockMakeChar   = 1 << 6
+	landlockMakeDir    = 1 << 7
+	landlockMakeReg    = 1 << 8
+	landlockMakeSock   = 1 << 9
+	landlockMakeFifo   = 1 << 10
+	landlockMakeBlock  = 1 << 11
+	landlockMakeSym    = 1 << 12
+	// ABI 2
+	landlockRefer = 1 << 13
+	// ABI 3
+	landlockTruncate = 1 << 14
+
+	landlockFileAccess = landlockExecute | landlockWriteFile | landlockReadFile | landlockTruncate
+	landlockRead       = landlockReadFile | landlockReadDir
+	landlockReadExec   = landlockRead | landlockExecute
+	landlockReadWrite  = landlockRead | landlockWriteFile | landlockRemoveDir | landlockRemoveFile |
+		landlockMakeDir | landlockMakeReg | landlockRefer | landlockTruncate
+)
+
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+// landlockPathBeneathAttr is packed by the kernel: it reads 12 bytes.
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFD      int32
+}
+
+// sandboxSystemPaths are read by the monitor and the hooks it runs, for
+// name resolution, TLS, users, time zones and commands.
+var sandboxSystemPaths = []string{
+	"/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf", "/etc/passwd", "/etc/group",
+	"/etc/localtime", "/etc/ssl", "/etc/pki", "/etc/ca-certificates", "/run/systemd/resolve",
+	"/usr", "/bin", "/sbin", "/lib", "/lib64", "/proc/self", "/sys/fs/cgroup",
+}
+
+// defaultSandboxLogPaths hold the logs of containers, those of
+// /var/log/containers being links to /var/log/pods, themselves links to
+// /var/lib/docker/containers with Docker.
+var defaultSandboxLogPaths = []string{filepath.Dir(KubernetesLogsPath), "/var/lib/docker/containers"}
+
+// sandboxAccess is a path and what the sandboxed monitor may do beneath it.
+type sandboxAccess struct {
+	path   string
+	access uint64
+}
+
+// sandboxPaths lists where the monitor reads and writes once sandboxed,
+// from its settings at start.
+func (m *Monitor) sandboxPaths() []sandboxAccess {
+	paths := make([]sandboxAccess, 0, 32)
+	add := func(access uint64, list ...string) {
+		for _, path := range list {
+			if path != "" {
+				paths = append(paths, sandboxAccess{path: path, access: access})
+			}
+		}
+	}
+	add(landlockReadExec, sandboxSystemPaths...)
+	add(landlockRead|landlockWriteFile, "/dev/null")
+	add(landlockRead, "/dev/urandom")
+	add(landlockRead, defaultSandboxLogPaths...)
+	add(landlockRead, *m.args.SandboxRead...)
+	// The configuration and the files it names are read again on reloads,
+	// and may have been replaced by then.
+	if m.args.ConfigPath != "" {
+		add(landlockRead, filepath.Dir(m.args.ConfigPath))
+	}
+	for _, path := range []string{*m.args.DecisionScript, *m.args.RedactRules, *m.args.SigningKey} {
+		if path != "" {
+			add(landlockRead, filepath.Dir(path))
+		}
+	}
+	if *m.args.KubeAPI == "in-cluster" {
+		add(landlockRead, kubeServiceAccountDir)
+	}
+	add(landlockReadWrite, TombstonePath, *m.args.SpoolDir, filepath.Dir(StatePath))
+	if *m.args.AdminSocket != "" {
+		add(landlockReadWrite, filepath.Dir(*m.args.AdminSocket))
+	}
+	if *m.args.AuditLog != "" {
+		add(landlockReadWrite, filepath.Dir(*m.args.AuditLog))
+	}
+	for _, p := range m.policies {
+		for _, config := range p.sinkConfigs {
+			add(landlockReadWrite, config.Options["path"], config.Options["spool-dir"])
+		}
+	}
+	return paths
+}
+
+// sandbox confines the monitor, for good. The kernels without Landlock
+// only get the seccomp filter.
+func (m *Monitor) sandbox() error {
+	// Set on every thread of the runtime, as are the restrictions, which
+	// the threads started later inherit.
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0)
+	if errno == syscall.ENOTSUP {
+		return errors.New("--sandbox needs k8ts built without cgo (CGO_ENABLED=0)")
+	}
+	if errno != 0 {
+		return fmt.Errorf("failed to set no_new_privs: %v", errno)
+	}
+	abi, err := landlockABI()
+	if err != nil {
+		logger.Warn("Landlock is unavailable, the file system isn't sandboxed", "error", err)
+	} else {
+		paths := m.sandboxPaths()
+		logger.Debug("Sandboxing the file system", "paths", describeSandbox(paths))
+		err = restrictPaths(abi, paths)
+		if err != nil {
+			return fmt.Errorf("failed to apply the Landlock ruleset: %v", err)
+		}
+	}
+	err = denySyscalls()
+	if err != nil {
+		return fmt.Errorf("failed to apply the seccomp filter: %v", err)
+	}
+	logger.Info("Sandboxed", "landlock", abi)
+	return nil
+}
+
+// landlockABI returns the version of Landlock the kernel supports.
+func landlockABI() (int, error) {
+	version, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(version), nil
+}
+
+// restrictPaths denies the monitor every access to the file system but
+// those given, as far as Landlock of the given ABI version handles them.
+func restrictPaths(abi int, paths []sandboxAccess) error {
+	attr := landlockRulesetAttr{handledAccessFS: landlockExecute | landlockWriteFile | landlockReadFile |
+		landlockReadDir | landlockRemoveDir | landlockRemoveFile | landlockMakeChar | landlockMakeDir |
+		landlockMakeReg | landlockMakeSock | landlockMakeFifo | landlockMakeBlock | landlockMakeSym}
+	if abi >= 2 {
+		attr.handledAccessFS |= landlockRefer
+	}
+	if abi >= 3 {
+		attr.handledAccessFS |= landlockTruncate
+	}
+	ruleset, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+	defer func() { _ = syscall.Close(int(ruleset)) }()
+	for _, path := range paths {
+		info, err := os.Stat(path.path)
+		if err != nil {
+			logger.Debug("Not in the sandbox", "path", path.path, "error", err)
+			continue
+		}
+		access := path.access & attr.handledAccessFS
+		if !info.IsDir() {
+			access &= landlockFileAccess
+		}
+		fd, err := syscall.Open(path.path, unix.O_PATH|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path.path, err)
+		}
+		rule := landlockPathBeneathAttr{allowedAccess: access, parentFD: int32(fd)}
+		_, _, errno = syscall.Syscall6(sysLandlockAddRule, ruleset, landlockRulePathBeneath,
+			uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		_ = syscall.Close(fd)
+		if errno != 0 {
+			return fmt.Errorf("%s: %v", path.path, errno)
+		}
+	}
+	_, _, errno = syscall.AllThreadsSyscall(sysLandlockRestrictSelf, ruleset, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// deniedSyscalls are those of administration, kernel modules, debugging
+// other processes, namespaces and mounts, which fail with EPERM once
+// sandboxed.
+var deniedSyscalls = []uintptr{
+	unix.SYS_ACCT, unix.SYS_ADD_KEY, unix.SYS_ADJTIMEX, unix.SYS_BPF, unix.SYS_CHROOT,
+	unix.SYS_CLOCK_ADJTIME, unix.SYS_CLOCK_SETTIME, unix.SYS_DELETE_MODULE, unix.SYS_FINIT_MODULE,
+	unix.SYS_INIT_MODULE, unix.SYS_KCMP, unix.SYS_KEXEC_LOAD, unix.SYS_KEYCTL, unix.SYS_MOUNT,
+	unix.SYS_NAME_TO_HANDLE_AT, unix.SYS_OPEN_BY_HANDLE_AT, unix.SYS_PERF_EVENT_OPEN, unix.SYS_PIVOT_ROOT,
+	unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV, unix.SYS_PTRACE, unix.SYS_QUOTACTL,
+	unix.SYS_REBOOT, unix.SYS_REQUEST_KEY, unix.SYS_SETDOMAINNAME, unix.SYS_SETHOSTNAME, unix.SYS_SETNS,
+	unix.SYS_SETTIMEOFDAY, unix.SYS_SWAPOFF, unix.SYS_SWAPON, unix.SYS_SYSLOG, unix.SYS_UMOUNT2,
+	unix.SYS_UNSHARE, unix.SYS_USERFAULTFD, unix.SYS_VHANGUP,
+	// The new mount API, numbered alike on every architecture.
+	428, 429, 430, 431, 432, 433,
+}
+
+// seccompArches are the AUDIT_ARCH values of the architectures k8ts is
+// released for.
+var seccompArches = map[string]uint32{
+	"amd64": 0xc000003e,
+	"386":   0x40000003,
+	"arm64": 0xc00000b7,
+	"arm":   0x40000028,
+}
+
+// x32SyscallBit marks the system calls of the x32 ABI on amd64, denied
+// altogether as their numbers differ.
+const x32SyscallBit = 0x40000000
+
+const (
+	bpfLoadWord    = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJumpEqual   = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJumpGreater = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfReturn      = 0x06 // BPF_RET | BPF_K
+
+	seccompAllow = 0x7fff0000
+	seccompErrno = 0x00050000
+)
+
+// denySyscalls installs a seccomp filter failing deniedSyscalls, and the
+// system calls of other architectures, on every thread.
+func denySyscalls() error {
+	arch, ok := seccompArches[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("unsupported architecture %s", runtime.GOARCH)
+	}
+	deny := seccompErrno | uint32(syscall.EPERM)
+	// The offsets of the architecture and number in struct seccomp_data.
+	filter := []unix.SockFilter{
+		{Code: bpfLoadWord, K: 4},
+		{Code: bpfJumpEqual, Jt: 1, K: arch},
+		{Code: bpfReturn, K: deny},
+		{Code: bpfLoadWord, K: 0},
+	}
+	denied := deniedSyscalls
+	if runtime.GOARCH == "amd64" {
+		filter = append(filter, unix.SockFilter{Code: bpfJumpGreater, Jt: uint8(len(denied) + 1), K: x32SyscallBit})
+	}
+	for i, number := range denied {
+		filter = append(filter, unix.SockFilter{Code: bpfJumpEqual, Jt: uint8(len(denied) - i), K: uint32(number)})
+	}
+	filter = append(filter, unix.SockFilter{Code: bpfReturn, K: seccompAllow}, unix.SockFilter{Code: bpfReturn, K: deny})
+	program := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER,
+		uintptr(unsafe.Pointer(&program)))
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// describeSandbox returns the paths of the sandbox, for the logs.
+func describeSandbox(paths []sandboxAccess) string {
+	names := make([]string, 0, len(paths))
+	for _, path := range paths {
+		mode := "r"
+		if path.access&landlockWriteFile != 0 {
+			mode = "rw"
+		}
+		names = append(names, path.path+":"+mode)
+	}
+	return strings.Join(names, " ")
+}
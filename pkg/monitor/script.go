@@ -0,0 +1,270 @@
+package monitor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/convert"
+	"github.com/badeadan/k8ts/pkg/store"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+const (
+	// defaultSampleLines is how many lines sample returns unless told
+	// otherwise.
+	defaultSampleLines = 100
+	// defaultScriptTimeout is the default --decision-script-timeout, in
+	// seconds.
+	defaultScriptTimeout = 10
+	// scriptMaxSteps bounds the computation of a call, about a second worth
+	// of it, whatever the time the builtins spend reading the log.
+	scriptMaxSteps = 100000000
+)
+
+// decisionScript is the Starlark script of --decision-script, whose decide
+// function is called with every deleted log, for rules keep-if and the
+// policies can't express. Starlark has neither while loops nor recursion,
+// but a loop over a huge range still runs for ages: every call is
+// cancelled past scriptMaxSteps or timeout, as the copy waits for it.
+type decisionScript struct {
+	path    string
+	decide  starlark.Value
+	timeout time.Duration
+}
+
+// scriptDecision is what decide returned: keep, skip or "" to leave it to
+// the other rules, and tags recorded in the metadata sidecar.
+type scriptDecision struct {
+	verdict string
+	tags    map[string]string
+}
+
+// loadDecisionScript runs the script at path, which must define decide.
+func loadDecisionScript(path string, timeout time.Duration) (*decisionScript, error) {
+	thread, done := newScriptThread(path, timeout)
+	globals, err := starlark.ExecFile(thread, path, nil, nil)
+	done()
+	if err != nil {
+		return nil, fmt.Errorf("invalid --decision-script: %v", err)
+	}
+	decide, ok := globals["decide"].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("invalid --decision-script: %s has no decide function", path)
+	}
+	// Frozen values may be shared by the copies running at once.
+	globals.Freeze()
+	return &decisionScript{path: path, decide: decide, timeout: timeout}, nil
+}
+
+// newScriptThread returns a thread running the script at path for at most
+// scriptMaxSteps and timeout, until done is called.
+func newScriptThread(path string, timeout time.Duration) (thread *starlark.Thread, done func()) {
+	thread = &starlark.Thread{Name: path, Print: scriptPrint}
+	thread.SetMaxExecutionSteps(scriptMaxSteps)
+	deadline := time.Now().Add(timeout)
+	thread.SetLocal(scriptDeadline, deadline)
+	timer := time.AfterFunc(timeout, func() {
+		thread.Cancel(fmt.Sprintf("timed out after %v", timeout))
+	})
+	return thread, func() { timer.Stop() }
+}
+
+// scriptDeadline is the thread local holding when the call must be done
+// by, which the builtins reading the log check as they go.
+const scriptDeadline = "deadline"
+
+// deadlineReader fails reads past the deadline of a script.
+type deadlineReader struct {
+	reader   io.Reader
+	deadline time.Time
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if time.Now().After(r.deadline) {
+		return 0, fmt.Errorf("timed out reading the log")
+	}
+	return r.reader.Read(p)
+}
+
+// logReader reads source from its start, until the deadline of thread.
+func logReader(thread *starlark.Thread, source *os.File) (io.Reader, error) {
+	if _, err := source.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	deadline, _ := thread.Local(scriptDeadline).(time.Time)
+	return &deadlineReader{reader: source, deadline: deadline}, nil
+}
+
+func scriptPrint(thread *starlark.Thread, message string) {
+	logger.Info(message, "script", thread.Name)
+}
+
+// run calls decide with the log deleted from source, described along with
+// its pod when known. Failures leave the decision to the other rules.
+func (s *decisionScript) run(fileName string, source *os.File, policy string, pod *store.PodMetadata) scriptDecision {
+	name := store.ParseLogName(fileName)
+	size := int64(0)
+	if stat, err := source.Stat(); err == nil {
+		size = stat.Size()
+	}
+	log := starlarkstruct.FromStringDict(starlark.String("log"), starlark.StringDict{
+		"file":         starlark.String(fileName),
+		"pod":          starlark.String(name.Pod),
+		"namespace":    starlark.String(name.Namespace),
+		"container":    starlark.String(name.Container),
+		"container_id": starlark.String(name.ContainerID),
+		"policy":       starlark.String(policy),
+		"size":         starlark.MakeInt64(size),
+		"labels":       stringDict(podLabels(pod)),
+		"annotations":  stringDict(podAnnotations(pod)),
+		"trouble":      starlark.String(podTrouble(pod, name.ContainerID)),
+		"sample":       starlark.NewBuiltin("sample", sampleBuiltin(source)),
+		"contains":     starlark.NewBuiltin("contains", containsBuiltin(source)),
+	})
+	thread, done := newScriptThread(s.path, s.timeout)
+	result, err := starlark.Call(thread, s.decide, starlark.Tuple{log}, nil)
+	done()
+	if err != nil {
+		if evalErr, ok := err.(*starlark.EvalError); ok {
+			err = fmt.Errorf("%s", evalErr.Backtrace())
+		}
+		logger.Error("Decision script failed", "script", s.path, "file", fileName, "error", err)
+		return scriptDecision{}
+	}
+	decision, err := parseScriptResult(result)
+	if err != nil {
+		logger.Error("Invalid result of decision script", "script", s.path, "file", fileName, "error", err)
+	}
+	return decision
+}
+
+// parseScriptResult reads what decide returned: None, "keep", "skip" or a
+// pair of one of them and a dict of tags.
+func parseScriptResult(result starlark.Value) (scriptDecision, error) {
+	decision := scriptDecision{}
+	if pair, ok := result.(starlark.Tuple); ok {
+		if len(pair) != 2 {
+			return decision, fmt.Errorf("expected (decision, tags), got %s", result)
+		}
+		tags, ok := pair[1].(*starlark.Dict)
+		if !ok {
+			return decision, fmt.Errorf("expected a dict of tags, got %s", pair[1].Type())
+		}
+		decision.tags = make(map[string]string, tags.Len())
+		for _, item := range tags.Items() {
+			key, ok := starlark.AsString(item[0])
+			if !ok {
+				return scriptDecision{}, fmt.Errorf("tag %s is not a string", item[0])
+			}
+			value, ok := starlark.AsString(item[1])
+			if !ok {
+				value = item[1].String()
+			}
+			decision.tags[key] = value
+		}
+		result = pair[0]
+	}
+	switch result {
+	case starlark.None:
+	case starlark.String("keep"), starlark.String("skip"):
+		decision.verdict = string(result.(starlark.String))
+	default:
+		return scriptDecision{tags: decision.tags}, fmt.Errorf("expected None, \"keep\" or \"skip\", got %s", result)
+	}
+	return decision, nil
+}
+
+// sampleBuiltin returns sample(lines=100, tail=False), the messages of the
+// first or last lines of the log.
+func sampleBuiltin(source *os.File) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+	return func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		lines, tail := defaultSampleLines, false
+		err := starlark.UnpackArgs(fn.Name(), args, kwargs, "lines?", &lines, "tail?", &tail)
+		if err != nil {
+			return nil, err
+		}
+		if lines < 0 {
+			return nil, fmt.Errorf("%s: negative lines", fn.Name())
+		}
+		reader, err := logReader(thread, source)
+		if err != nil {
+			return nil, err
+		}
+		messages := make([]starlark.Value, 0, lines)
+		scanner := convert.NewLineReader(reader)
+		defer scanner.Release()
+		for scanner.Scan() && (tail || len(messages) < lines) {
+			message := scanner.Text()
+			if entry, err := convert.ParseRecord(scanner.Bytes()); err == nil {
+				message = entry.Log
+			}
+			if tail && len(messages) == lines && lines > 0 {
+				messages = append(messages[1:], starlark.String(message))
+			} else if len(messages) < lines {
+				messages = append(messages, starlark.String(message))
+			}
+		}
+		return starlark.NewList(messages), scanner.Err()
+	}
+}
+
+// containsBuiltin returns contains(pattern), telling whether a line of the
+// log matches the regular expression pattern.
+func containsBuiltin(source *os.File) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+	return func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var expression string
+		err := starlark.UnpackArgs(fn.Name(), args, kwargs, "pattern", &expression)
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := regexp.Compile(expression)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fn.Name(), err)
+		}
+		reader, err := logReader(thread, source)
+		if err != nil {
+			return nil, err
+		}
+		return starlark.Bool(search(reader, pattern, nil)), nil
+	}
+}
+
+func stringDict(values map[string]string) *starlark.Dict {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	dict := starlark.NewDict(len(keys))
+	for _, key := range keys {
+		_ = dict.SetKey(starlark.String(key), starlark.String(values[key]))
+	}
+	return dict
+}
+
+func podLabels(pod *store.PodMetadata) map[string]string {
+	if pod == nil {
+		return nil
+	}
+	return pod.Labels
+}
+
+func podAnnotations(pod *store.PodMetadata) map[string]string {
+	if pod == nil {
+		return nil
+	}
+	return pod.Annotations
+}
+
+func podTrouble(pod *store.PodMetadata, containerID string) string {
+	if pod == nil {
+		return ""
+	}
+	return pod.ContainerTrouble(containerID)
+}
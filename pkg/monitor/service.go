@@ -0,0 +1,855 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/alessio/shellescape"
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/internal/settings"
+)
+
+// InitSystem describes how to run k8ts as a service with an init system.
+// Commands are shell commands, run as root but for status, which prints
+// the state of the service and fails unless it is active.
+type InitSystem struct {
+	Name      string
+	Path      string
+	Mode      os.FileMode
+	Template  *template.Template
+	Install   string
+	Uninstall string
+	Reload    string
+	Restart   string
+	Status    string
+	// Restarts prints how many times the init system restarted the
+	// service, if it keeps count.
+	Restarts string
+	// ArgsLine starts the line of the service definition holding the
+	// monitor options, double quoted and escaped if ArgsEscaped.
+	ArgsLine    string
+	ArgsEscaped bool
+	// LogFile receives the output of the service, when the init system
+	// doesn't keep it in the journal.
+	LogFile string
+	// ConfigPath holds the monitor options of the service.
+	ConfigPath string
+	// Systemctl and Journalctl are the commands managing the units and
+	// reading the journal, for systemd.
+	Systemctl  string
+	Journalctl string
+	// UserLevel is set for the systemd manager of the user.
+	UserLevel bool
+}
+
+const systemdUnitTemplate = `
+[Unit]
+Description={{.Description}}
+{{- with .Requires}}
+Requires={{.}}
+{{- end}}
+{{- with .After}}
+After={{.}}
+{{- end}}
+
+[Service]
+Type=notify
+ExecStart={{.Exec}} monitor {{.Args}}
+Restart={{.Restart}}
+WatchdogSec=60
+{{- range .Environment}}
+Environment="{{unitEscape .}}"
+{{- end}}
+{{- with .User}}
+User={{.}}
+AmbientCapabilities={{join $.Capabilities " "}}
+CapabilityBoundingSet={{join $.Capabilities " "}}
+{{- end}}
+{{- if .Harden}}
+NoNewPrivileges=yes
+ProtectSystem=strict
+ReadWritePaths={{join .WritablePaths " "}}
+{{- end}}
+{{- if or .Harden .User}}
+RuntimeDirectory=k8ts
+{{- end}}
+{{- with .CPUQuota}}
+CPUQuota={{.}}
+{{- end}}
+{{- with .MemoryMax}}
+MemoryMax={{.}}
+{{- end}}
+{{- with .IOWeight}}
+IOWeight={{.}}
+{{- end}}
+{{- with .Nice}}
+Nice={{.}}
+{{- end}}
+
+[Install]
+WantedBy=default.target
+`
+
+const pruneServiceTemplate = `
+[Unit]
+Description=Prune preserved logs of Kubernetes pods and jobs
+
+[Service]
+Type=oneshot
+ExecStart={{.Exec}} prune {{.Args}}
+Nice=19
+IOSchedulingClass=idle
+{{- with .User}}
+User={{.}}
+{{- end}}
+`
+
+const pruneTimerTemplate = `
+[Unit]
+Description=Prune preserved logs of Kubernetes pods and jobs on schedule
+
+[Timer]
+OnCalendar={{.Schedule}}
+Persistent=true
+
+[Install]
+WantedBy=timers.target
+`
+
+// pruneDefinition is what the prune service and timer templates render:
+// the service runs `Exec prune Args` on Schedule.
+type pruneDefinition struct {
+	Exec     string
+	Args     string
+	User     string
+	Schedule string
+}
+
+var pruneTemplates = []struct {
+	name     string
+	template *template.Template
+}{
+	{BinaryName + "-prune.service", template.Must(template.New("prune").Parse(pruneServiceTemplate))},
+	{BinaryName + "-prune.timer", template.Must(template.New("timer").Parse(pruneTimerTemplate))},
+}
+
+const openrcScriptTemplate = `#!/sbin/openrc-run
+
+description="{{dquote .Description}}"
+supervisor=supervise-daemon
+command={{shquote .Exec}}
+command_args="monitor {{dquote .Args}}"
+respawn_delay=5
+output_log=/var/log/k8ts.log
+error_log=/var/log/k8ts.log
+
+depend() {
+	need net
+	after kubelet
+}
+{{- with .User}}
+
+command_user={{shquote .}}
+capabilities="{{range $i, $c := $.Capabilities}}{{if $i}},{{end}}^{{lower $c}}{{end}}"
+
+start_pre() {
+	checkpath -d -o {{shquote .}} /run/k8ts
+	checkpath -f -o {{shquote .}} /var/log/k8ts.log
+}
+{{- end}}
+`
+
+const sysvScriptTemplate = `#!/bin/sh
+### BEGIN INIT INFO
+# Provides:          k8ts
+# Required-Start:    $remote_fs $network
+# Required-Stop:     $remote_fs $network
+# Default-Start:     2 3 4 5
+# Default-Stop:      0 1 6
+# Short-Description: {{.Description}}
+### END INIT INFO
+
+DAEMON={{shquote .Exec}}
+DAEMON_ARGS="monitor {{dquote .Args}}"
+PIDFILE=/var/run/k8ts.pid
+LOGFILE=/var/log/k8ts.log
+
+# kill -0 needs the rights to signal the monitor, /proc doesn't.
+running() {
+	[ -f "$PIDFILE" ] && [ -d "/proc/$(cat "$PIDFILE")" ]
+}
+
+case "$1" in
+start)
+	running && exit 0
+	eval "set -- $DAEMON_ARGS"
+	nohup "$DAEMON" "$@" >>"$LOGFILE" 2>&1 &
+	echo $! >"$PIDFILE"
+	;;
+stop)
+	if running; then
+		kill "$(cat "$PIDFILE")"
+		for i in 1 2 3 4 5 6 7 8 9 10; do
+			running || break
+			sleep 1
+		done
+	fi
+	rm -f "$PIDFILE"
+	;;
+restart)
+	"$0" stop
+	"$0" start
+	;;
+status)
+	if running; then
+		echo active
+	else
+		echo inactive
+		exit 3
+	fi
+	;;
+*)
+	echo "Usage: $0 {start|stop|restart|status}" >&2
+	exit 2
+	;;
+esac
+`
+
+var initTemplateFuncs = template.FuncMap{
+	"shquote": shellescape.Quote,
+	"dquote":  dquote,
+	"join":    strings.Join,
+	"lower":   strings.ToLower,
+	// Double quoted unit file values escape quotes, backslashes and specifiers.
+	"unitEscape": strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%").Replace,
+}
+
+var systemdTemplate = template.Must(template.New("systemd").Funcs(initTemplateFuncs).Parse(systemdUnitTemplate))
+
+// newSystemd describes systemd, managing units of unitsDir with the given
+// systemctl and journalctl commands.
+func newSystemd(name string, unitsDir string, configPath string, systemctl string, journalctl string) *InitSystem {
+	return &InitSystem{
+		Name:      name,
+		Path:      filepath.Join(unitsDir, BinaryName+".service"),
+		Mode:      0644,
+		Template:  systemdTemplate,
+		Install:   systemctl + " enable k8ts && " + systemctl + " start k8ts",
+		Uninstall: systemctl + " stop k8ts; " + systemctl + " disable k8ts",
+		Reload:    systemctl + " daemon-reload",
+		Restart:   systemctl + " restart k8ts",
+		// is-active exits with an error for any state but active.
+		Status:     systemctl + " is-active k8ts",
+		Restarts:   systemctl + " show -p NRestarts --value k8ts",
+		ArgsLine:   "ExecStart=",
+		ConfigPath: configPath,
+		Systemctl:  systemctl,
+		Journalctl: journalctl,
+	}
+}
+
+// userSystemd describes the systemd manager of the user running k8ts,
+// whose units live in ~/.config/systemd/user.
+func userSystemd() (*InitSystem, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	system := newSystemd("systemd --user", filepath.Join(home, ".config", "systemd", "user"),
+		filepath.Join(home, ".config", BinaryName, "config.yaml"), "systemctl --user", "journalctl --user")
+	system.UserLevel = true
+	return system, nil
+}
+
+var initSystems = []*InitSystem{
+	newSystemd("systemd", systemdUnitsPath, ServiceConfigPath, "systemctl", "journalctl"),
+	{
+		Name:      "openrc",
+		Path:      "/etc/init.d/" + BinaryName,
+		Mode:      0755,
+		Template:  template.Must(template.New("openrc").Funcs(initTemplateFuncs).Parse(openrcScriptTemplate)),
+		Install:   "rc-update add k8ts default && rc-service k8ts start",
+		Uninstall: "rc-service k8ts stop; rc-update del k8ts default",
+		Restart:   "rc-service k8ts restart",
+		Status: "if rc-service k8ts status >/dev/null 2>&1; then echo active; " +
+			"else echo inactive; exit 3; fi",
+		ArgsLine:    "command_args=",
+		ArgsEscaped: true,
+		LogFile:     "/var/log/k8ts.log",
+		ConfigPath:  ServiceConfigPath,
+	},
+	{
+		Name:     "sysv",
+		Path:     "/etc/init.d/" + BinaryName,
+		Mode:     0755,
+		Template: template.Must(template.New("sysv").Funcs(initTemplateFuncs).Parse(sysvScriptTemplate)),
+		Install: "if command -v update-rc.d >/dev/null; then update-rc.d k8ts defaults; " +
+			"elif command -v chkconfig >/dev/null; then chkconfig --add k8ts; fi && /etc/init.d/k8ts start",
+		Uninstall: "/etc/init.d/k8ts stop; if command -v update-rc.d >/dev/null; then update-rc.d -f k8ts remove; " +
+			"elif command -v chkconfig >/dev/null; then chkconfig --del k8ts; fi",
+		Restart:     "/etc/init.d/k8ts restart",
+		Status:      "/etc/init.d/k8ts status",
+		ArgsLine:    "DAEMON_ARGS=",
+		ArgsEscaped: true,
+		LogFile:     "/var/log/k8ts.log",
+		ConfigPath:  ServiceConfigPath,
+	},
+}
+
+// DefaultServiceRequires is the unit the service requires unless told
+// otherwise, as the kubelet isn't kubelet.service everywhere (k3s).
+const DefaultServiceRequires = "kubelet.service"
+
+// ServiceConfigPath holds the monitor options of the service, so they can
+// be changed without touching the service definition.
+const ServiceConfigPath = "/etc/k8ts/config.yaml"
+
+// statusErrors is how many of the last errors service status prints.
+const statusErrors = 5
+
+// detectInitCommand prints the name of the init system of the host.
+const detectInitCommand = "if [ -d /run/systemd/system ]; then echo systemd; " +
+	"elif [ -x /sbin/openrc-run ]; then echo openrc; " +
+	"elif [ -d /etc/init.d ]; then echo sysv; fi"
+
+var dquoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+var dquoteUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\$`, "$", "\\`", "`")
+
+// dquote escapes a string for a double quoted shell string.
+func dquote(s string) string {
+	return dquoteEscaper.Replace(s)
+}
+
+// DetectInitSystem finds the init system of the host run executes
+// commands on.
+func DetectInitSystem(run func(string) (string, error)) (*InitSystem, error) {
+	output, err := run(detectInitCommand)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(output)
+	for _, system := range initSystems {
+		if system.Name == name {
+			return system, nil
+		}
+	}
+	return nil, fmt.Errorf("no supported init system found (systemd, OpenRC or SysV init)")
+}
+
+// runLocal runs a shell command on this host and returns its output. The
+// error output is part of the error returned if the command fails.
+func runLocal(command string) (string, error) {
+	cmd := exec.Command("sh", "-c", command)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return string(output), fmt.Errorf("%v: %s", err, message)
+		}
+	}
+	return string(output), err
+}
+
+// serviceDefinition is what the service definition templates render: the
+// service runs `Exec monitor Args`, as User with only the Capabilities
+// if set. Hardening and resource controls are left out when zero, and
+// only systemd supports them, as it does the units Requires and After, the
+// Restart policy and the Environment (KEY=value) of the service.
+type serviceDefinition struct {
+	Exec          string
+	Args          string
+	Description   string
+	Requires      string
+	After         string
+	Restart       string
+	Environment   []string
+	User          string
+	Capabilities  []string
+	Harden        bool
+	WritablePaths []string
+	CPUQuota      string
+	MemoryMax     string
+	IOWeight      int
+	Nice          int
+}
+
+var userNameFormat = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+var environmentFormat = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=[^\n]*$`)
+var cpuQuotaFormat = regexp.MustCompile(`^[0-9]+%$`)
+var memoryMaxFormat = regexp.MustCompile(`^([0-9]+[KMGT]?|[0-9]+%|infinity)$`)
+
+// newServiceDefinition checks the unit, hardening, resource control and
+// prune options of `k8ts service install`.
+func newServiceDefinition(args *ServiceInstallArgs) (*serviceDefinition, error) {
+	d := &serviceDefinition{
+		Description: *args.Description,
+		Requires:    *args.Requires,
+		After:       *args.After,
+		Restart:     *args.Restart,
+		Environment: *args.Environment,
+		User:        *args.RunAs,
+		Harden:      *args.Harden,
+		CPUQuota:    *args.CPUQuota,
+		MemoryMax:   *args.MemoryMax,
+		IOWeight:    *args.IOWeight,
+		Nice:        *args.Nice,
+	}
+	for _, variable := range d.Environment {
+		if !environmentFormat.MatchString(variable) {
+			return nil, fmt.Errorf("invalid --environment '%s', expected KEY=value", variable)
+		}
+	}
+	if *args.PruneOlderThan != "" {
+		if _, err := settings.ParseDuration(*args.PruneOlderThan); err != nil {
+			return nil, fmt.Errorf("invalid --prune-older-than: %v", err)
+		}
+	}
+	if *args.PruneMaxSize != "" {
+		if _, err := parseSize(*args.PruneMaxSize); err != nil {
+			return nil, fmt.Errorf("invalid --prune-max-size: %v", err)
+		}
+	}
+	if d.User != "" && (!userNameFormat.MatchString(d.User) || d.User == "root") {
+		return nil, fmt.Errorf("invalid --run-as '%s', expected the name of a user other than root", d.User)
+	}
+	if d.CPUQuota != "" && !cpuQuotaFormat.MatchString(d.CPUQuota) {
+		return nil, fmt.Errorf("invalid --cpu-quota '%s', expected a percentage (e.g. 20%%)", d.CPUQuota)
+	}
+	if d.MemoryMax != "" && !memoryMaxFormat.MatchString(d.MemoryMax) {
+		return nil, fmt.Errorf("invalid --memory-max '%s', expected bytes with an optional K, M, G or T suffix", d.MemoryMax)
+	}
+	if d.IOWeight < 0 || d.IOWeight > 10000 {
+		return nil, fmt.Errorf("invalid --io-weight %d, expected 1 to 10000", d.IOWeight)
+	}
+	if d.Nice < -20 || d.Nice > 19 {
+		return nil, fmt.Errorf("invalid --nice %d, expected -20 to 19", d.Nice)
+	}
+	// CAP_DAC_READ_SEARCH reads the logs of every container, CAP_CHOWN
+	// hands tombstones to their owner and group.
+	d.Capabilities = []string{"CAP_DAC_READ_SEARCH"}
+	if *args.Monitor.TombstoneOwner != "" || *args.Monitor.TombstoneGroup != "" {
+		d.Capabilities = append(d.Capabilities, "CAP_CHOWN")
+	}
+	// The monitor state lives in the RuntimeDirectory.
+	d.WritablePaths = []string{TombstonePath, *args.Monitor.SpoolDir}
+	return d, nil
+}
+
+// restricted tells whether hardening or resource controls were requested.
+func (d *serviceDefinition) restricted() bool {
+	return d.Harden || d.CPUQuota != "" || d.MemoryMax != "" || d.IOWeight != 0 || d.Nice != 0
+}
+
+// withTemplate returns the init system rendering service definitions with
+// the template file at path rather than the built-in one.
+func (s *InitSystem) withTemplate(path string) (*InitSystem, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	custom := *s
+	custom.Template, err = template.New(filepath.Base(path)).Funcs(initTemplateFuncs).Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("invalid unit template: %v", err)
+	}
+	return &custom, nil
+}
+
+// definition renders the service definition for the init system.
+func (s *InitSystem) definition(d *serviceDefinition) (string, error) {
+	var out bytes.Buffer
+	err := s.Template.Execute(&out, d)
+	return out.String(), err
+}
+
+// MonitorArgs reads the monitor options back from a service definition.
+func (s *InitSystem) MonitorArgs(definition string) string {
+	for _, line := range strings.Split(definition, "\n") {
+		if !strings.HasPrefix(line, s.ArgsLine) {
+			continue
+		}
+		command := strings.TrimPrefix(line, s.ArgsLine)
+		if s.ArgsEscaped {
+			command = dquoteUnescaper.Replace(strings.TrimSuffix(strings.TrimPrefix(command, `"`), `"`))
+		}
+		if i := strings.Index(command, "monitor"); i >= 0 {
+			command = command[i+len("monitor"):]
+		}
+		return strings.TrimSpace(command)
+	}
+	return ""
+}
+
+// State returns the state of the service, as printed by the status
+// command, and how many times it was restarted (empty when the init
+// system doesn't count restarts).
+func (s *InitSystem) State(run func(string) (string, error)) (string, string) {
+	// status exits with an error for any state but active.
+	state, _ := run(s.Status)
+	restarts := ""
+	if s.Restarts != "" {
+		restarts, _ = run(s.Restarts)
+	}
+	return strings.TrimSpace(state), strings.TrimSpace(restarts)
+}
+
+// logsCommand prints the last lines of the service output, following it
+// if follow is set.
+func (s *InitSystem) logsCommand(lines int, follow bool) string {
+	command := fmt.Sprintf("tail -n %d %s", lines, s.LogFile)
+	if s.LogFile == "" {
+		command = fmt.Sprintf("%s -u k8ts --no-pager -n %d", s.Journalctl, lines)
+	}
+	if follow {
+		command += " -f"
+	}
+	return command
+}
+
+// errorsCommand prints the last errors logged by the service.
+func (s *InitSystem) errorsCommand(count int) string {
+	if s.LogFile == "" {
+		return fmt.Sprintf("%s -u k8ts --no-pager -o cat -p err -n %d", s.Journalctl, count)
+	}
+	return fmt.Sprintf(`grep -E 'level=error|"level":"error"' %s | tail -n %d`, s.LogFile, count)
+}
+
+// runServiceCommand runs one of the commands of the init system, logging
+// it if it fails.
+func runServiceCommand(command string) error {
+	if command == "" {
+		return nil
+	}
+	_, err := runLocal(command)
+	if err != nil {
+		logger.Error("Failed to run command", "command", command, "error", err)
+	}
+	return err
+}
+
+// serviceInitSystem returns the init system managing the service, the
+// systemd manager of the user for user level services.
+func serviceInitSystem(userLevel bool) (*InitSystem, error) {
+	if userLevel {
+		return userSystemd()
+	}
+	return DetectInitSystem(runLocal)
+}
+
+func ServiceInstall(args *ServiceInstallArgs) error {
+	service, err := newServiceDefinition(args)
+	if err != nil {
+		return err
+	}
+	system, err := serviceInitSystem(*args.UserLevel)
+	if err != nil {
+		return err
+	}
+	if service.User != "" && system.UserLevel {
+		return fmt.Errorf("--run-as needs a system service, it can't be used with --user")
+	}
+	// The systemd manager of the user doesn't know about the kubelet.
+	if system.UserLevel && service.Requires == DefaultServiceRequires {
+		service.Requires = ""
+	}
+	if *args.UnitTemplate != "" {
+		system, err = system.withTemplate(*args.UnitTemplate)
+		if err != nil {
+			return err
+		}
+	}
+	if service.restricted() && system.Systemctl == "" {
+		logger.Warn("Hardening and resource controls are only supported with systemd, ignoring them", "init", system.Name)
+	}
+	if service.User != "" && system.Name == "sysv" {
+		return fmt.Errorf("running the service as another user than root is not supported with SysV init")
+	}
+	// ProtectSystem=strict lets the service write to existing paths only.
+	// Users are left to create them with the permissions they need.
+	for _, path := range service.WritablePaths {
+		if system.UserLevel {
+			break
+		}
+		err = os.MkdirAll(path, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	if service.User != "" {
+		err = createServiceUser(service.User, service.WritablePaths)
+		if err != nil {
+			return err
+		}
+	}
+	err = writeServiceConfig(args.Monitor, system.ConfigPath, service.User)
+	if err != nil {
+		return err
+	}
+	// The service runs the binary installing it, wherever deploy put it.
+	service.Exec, err = os.Executable()
+	if err != nil {
+		return err
+	}
+	service.Args = "--config " + shellescape.Quote(system.ConfigPath)
+	definition, err := system.definition(service)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(system.Path), 0755)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(system.Path, []byte(definition), system.Mode)
+	if err != nil {
+		logger.Error("Failed to write service definition", "path", system.Path, "error", err)
+		return err
+	}
+	// WriteFile keeps the mode of existing files.
+	err = os.Chmod(system.Path, system.Mode)
+	if err != nil {
+		return err
+	}
+	err = runServiceCommand(system.Reload)
+	if err != nil {
+		return err
+	}
+	err = runServiceCommand(system.Install)
+	if err != nil {
+		return err
+	}
+	if system.Systemctl == "" {
+		if *args.PruneOlderThan != "" || *args.PruneMaxSize != "" {
+			logger.Warn("The prune timer needs systemd, schedule `k8ts prune` with cron instead", "init", system.Name)
+		}
+		return nil
+	}
+	return installPruneTimer(args, system, service)
+}
+
+// writeServiceConfig saves the monitor options to the configuration file
+// of the service, which the monitor reloads when it changes. Only the user
+// running the service can read it, as options may hold secrets.
+func writeServiceConfig(args *Args, path string, user string) error {
+	content, err := settings.MarshalConfig(args.Options, args.ConfigPath)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path, content, 0600)
+	if err == nil {
+		// WriteFile keeps the mode of existing files.
+		err = os.Chmod(path, 0600)
+	}
+	if err == nil && user != "" {
+		_, err = runLocal("chown " + shellescape.Quote(user) + " " + shellescape.Quote(path))
+	}
+	if err != nil {
+		logger.Error("Failed to write service configuration", "path", path, "error", err)
+	}
+	return err
+}
+
+// installPruneTimer has systemd prune the tombstones on schedule, outside
+// of the monitor. It does nothing unless a retention was given.
+func installPruneTimer(args *ServiceInstallArgs, system *InitSystem, service *serviceDefinition) error {
+	pruneArgs := make([]string, 0, 4)
+	if *args.PruneOlderThan != "" {
+		pruneArgs = append(pruneArgs, "--older-than", shellescape.Quote(*args.PruneOlderThan))
+	}
+	if *args.PruneMaxSize != "" {
+		pruneArgs = append(pruneArgs, "--max-size", shellescape.Quote(*args.PruneMaxSize))
+	}
+	if len(pruneArgs) == 0 {
+		return nil
+	}
+	d := &pruneDefinition{Exec: service.Exec, Args: strings.Join(pruneArgs, " "), User: service.User,
+		Schedule: *args.PruneSchedule}
+	for _, unit := range pruneTemplates {
+		var out bytes.Buffer
+		err := unit.template.Execute(&out, d)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(filepath.Dir(system.Path), unit.name)
+		err = ioutil.WriteFile(path, out.Bytes(), 0644)
+		if err != nil {
+			logger.Error("Failed to write unit file", "path", path, "error", err)
+			return err
+		}
+	}
+	err := runServiceCommand(system.Reload)
+	if err != nil {
+		return err
+	}
+	return runServiceCommand(system.Systemctl + " enable --now k8ts-prune.timer")
+}
+
+// uninstallPruneTimer removes the prune timer, if it was installed.
+func uninstallPruneTimer(system *InitSystem) {
+	unitsDir := filepath.Dir(system.Path)
+	if _, err := os.Stat(filepath.Join(unitsDir, pruneTemplates[0].name)); err != nil {
+		return
+	}
+	_, _ = runLocal(system.Systemctl + " disable --now k8ts-prune.timer")
+	for _, unit := range pruneTemplates {
+		_ = os.Remove(filepath.Join(unitsDir, unit.name))
+	}
+}
+
+// createServiceUser adds the system user the service runs as, unless it
+// exists, and hands it the directories the monitor writes to.
+func createServiceUser(name string, paths []string) error {
+	user := shellescape.Quote(name)
+	// useradd is missing from Alpine, which has the busybox adduser.
+	_, err := runLocal("id -u " + user + " >/dev/null 2>&1 || " +
+		"useradd --system --no-create-home --shell /sbin/nologin " + user + " || " +
+		"adduser -S -D -H -s /sbin/nologin " + user)
+	if err != nil {
+		return fmt.Errorf("failed to create user '%s': %v", name, err)
+	}
+	for _, path := range paths {
+		_, err = runLocal("chown -R " + user + " " + shellescape.Quote(path))
+		if err != nil {
+			return fmt.Errorf("failed to hand '%s' to '%s': %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+func ServiceUninstall(args *ServiceArgs) error {
+	system, err := installedInitSystem(*args.UserLevel)
+	if err != nil {
+		return err
+	}
+	_, _ = runLocal(system.Uninstall)
+	if system.Systemctl != "" {
+		uninstallPruneTimer(system)
+	}
+	_ = os.Remove(system.Path)
+	_ = os.Remove(system.ConfigPath)
+	_, _ = runLocal(system.Reload)
+	return nil
+}
+
+// ServiceNotInstalled is the error of the service commands on hosts
+// without the service.
+const ServiceNotInstalled = "service not installed"
+
+// installedInitSystem returns the init system the service is installed
+// with.
+func installedInitSystem(userLevel bool) (*InitSystem, error) {
+	system, err := serviceInitSystem(userLevel)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(system.Path); err != nil {
+		return nil, fmt.Errorf("%s (%s)", ServiceNotInstalled, system.Name)
+	}
+	return system, nil
+}
+
+// ServiceStatus prints the state of the service, how long the monitor has
+// been running and its last errors, failing unless it is active.
+func ServiceStatus(args *ServiceArgs) error {
+	system, err := installedInitSystem(*args.UserLevel)
+	if err != nil {
+		return err
+	}
+	state, restarts := system.State(runLocal)
+	fmt.Printf("State:    %s (%s)\n", state, system.Name)
+	if running := loadMonitorState(); running != nil && state == "active" {
+		fmt.Printf("Uptime:   %s (pid %d)\n", time.Since(running.StartedAt).Round(time.Second), running.PID)
+	}
+	if restarts != "" {
+		fmt.Printf("Restarts: %s\n", restarts)
+	}
+	if errors, _ := runLocal(system.errorsCommand(statusErrors)); strings.TrimSpace(errors) != "" {
+		fmt.Println("Last errors:")
+		for _, line := range strings.Split(strings.TrimSpace(errors), "\n") {
+			fmt.Println("  " + line)
+		}
+	}
+	if state != "active" {
+		return fmt.Errorf("service is %s", state)
+	}
+	return nil
+}
+
+// ServiceRestart restarts the service and prints its state.
+func ServiceRestart(args *ServiceArgs) error {
+	system, err := installedInitSystem(*args.UserLevel)
+	if err != nil {
+		return err
+	}
+	err = runServiceCommand(system.Restart)
+	if err != nil {
+		return err
+	}
+	state, _ := system.State(runLocal)
+	fmt.Printf("%s (%s)\n", state, system.Name)
+	if state != "active" {
+		return fmt.Errorf("service is %s", state)
+	}
+	return nil
+}
+
+// ServiceLogs prints the output of the service from the journal or its
+// log file.
+func ServiceLogs(args *ServiceArgs) error {
+	system, err := installedInitSystem(*args.UserLevel)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("sh", "-c", system.logsCommand(*args.LogLines, *args.LogFollow))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+const BinaryName string = "k8ts"
+const systemdUnitsPath = "/etc/systemd/system"
+
+type ServiceInstallArgs struct {
+	Command        *argparse.Command
+	Monitor        *Args
+	UserLevel      *bool
+	RunAs          *string
+	Description    *string
+	Requires       *string
+	After          *string
+	Restart        *string
+	Environment    *[]string
+	UnitTemplate   *string
+	Harden         *bool
+	CPUQuota       *string
+	MemoryMax      *string
+	IOWeight       *int
+	Nice           *int
+	PruneOlderThan *string
+	PruneMaxSize   *string
+	PruneSchedule  *string
+}
+
+type ServiceArgs struct {
+	Install   ServiceInstallArgs
+	Uninstall *argparse.Command
+	Status    *argparse.Command
+	Restart   *argparse.Command
+	Logs      *argparse.Command
+	LogLines  *int
+	LogFollow *bool
+	UserLevel *bool
+}
@@ -0,0 +1,269 @@
+package monitor
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// signatureAlgorithm is the only algorithm tombstones are signed with.
+const signatureAlgorithm = "ed25519"
+
+// tombstoneSignature is the detached signature of a tombstone, written
+// next to it. What is signed are the digests of the tombstone and of its
+// metadata, so that neither can be changed unnoticed.
+type tombstoneSignature struct {
+	Algorithm string `json:"algorithm"`
+	KeyID     string `json:"keyId"`
+	Log       string `json:"log"`
+	// Metadata is empty for tombstones without a metadata sidecar.
+	Metadata  string `json:"metadata,omitempty"`
+	SignedAt  string `json:"signedAt"`
+	Signature string `json:"signature"`
+}
+
+// message is what the signature is computed over.
+func (s *tombstoneSignature) message() []byte {
+	return []byte(fmt.Sprintf("k8ts tombstone signature v1\nalgorithm %s\nkey %s\nlog sha256:%s\nmetadata sha256:%s\nsigned-at %s\n",
+		s.Algorithm, s.KeyID, s.Log, s.Metadata, s.SignedAt))
+}
+
+func signaturePath(tombstonePath string) string {
+	return tombstonePath + store.SignatureSuffix
+}
+
+// KeyID names a public key by the start of its digest.
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// readPEM returns the content of the PEM block of the given type in the
+// file at path.
+func readPEM(path string, blockType string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("no %s in %s", blockType, path)
+		}
+		if block.Type == blockType {
+			return block.Bytes, nil
+		}
+	}
+}
+
+// loadSigningKey reads a PEM encoded PKCS #8 Ed25519 private key.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(der)
+	key, ok := parsed.(ed25519.PrivateKey)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 private key", path)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		logger.Warn("The signing key can be read by other users", "path", path, "mode", info.Mode().Perm())
+	}
+	return key, nil
+}
+
+// LoadVerifyKey reads a PEM encoded Ed25519 public key.
+func LoadVerifyKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKIXPublicKey(der)
+	key, ok := parsed.(ed25519.PublicKey)
+	if err != nil || !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 public key", path)
+	}
+	return key, nil
+}
+
+// fileDigest returns the SHA-256 of the file at path, empty when it
+// doesn't exist.
+func fileDigest(path string) (string, error) {
+	sum, err := store.Checksum(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return sum, err
+}
+
+// tombstoneSigner signs the tombstones the monitor writes with
+// --signing-key, so that they can serve as evidence.
+type tombstoneSigner struct {
+	mutex sync.Mutex
+	key   ed25519.PrivateKey
+	keyID string
+}
+
+var signer = &tombstoneSigner{}
+
+// configure loads the private key at path, again on every reload as it may
+// have been replaced. Tombstones aren't signed when path is empty.
+func (s *tombstoneSigner) configure(path string) error {
+	var key ed25519.PrivateKey
+	if path != "" {
+		var err error
+		key, err = loadSigningKey(path)
+		if err != nil {
+			return fmt.Errorf("invalid --signing-key: %v", err)
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.key = key
+	if key != nil {
+		s.keyID = KeyID(key.Public().(ed25519.PublicKey))
+	}
+	return nil
+}
+
+// sign writes the signature of the tombstone at tombstonePath, once its
+// metadata is written.
+func (s *tombstoneSigner) sign(tombstonePath string) {
+	s.mutex.Lock()
+	key, id := s.key, s.keyID
+	s.mutex.Unlock()
+	if key == nil {
+		return
+	}
+	err := writeSignature(tombstonePath, key, id)
+	if err != nil {
+		logger.Error("Failed to sign tombstone", "path", tombstonePath, "error", err)
+	}
+}
+
+func writeSignature(tombstonePath string, key ed25519.PrivateKey, id string) error {
+	signature := tombstoneSignature{Algorithm: signatureAlgorithm, KeyID: id,
+		SignedAt: time.Now().UTC().Format(time.RFC3339)}
+	var err error
+	signature.Log, err = store.Checksum(tombstonePath)
+	if err != nil {
+		return err
+	}
+	signature.Metadata, err = fileDigest(store.MetadataPath(tombstonePath))
+	if err != nil {
+		return err
+	}
+	signature.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, signature.message()))
+	content, err := json.MarshalIndent(&signature, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(signaturePath(tombstonePath), append(content, '\n'), 0644)
+}
+
+// verifySignature checks the signature of the tombstone at tombstonePath
+// against key, returning why it doesn't hold.
+func verifySignature(tombstonePath string, key ed25519.PublicKey) error {
+	content, err := ioutil.ReadFile(signaturePath(tombstonePath))
+	if os.IsNotExist(err) {
+		return errors.New("unsigned")
+	}
+	if err != nil {
+		return err
+	}
+	var signature tombstoneSignature
+	err = json.Unmarshal(content, &signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature file: %v", err)
+	}
+	if signature.Algorithm != signatureAlgorithm {
+		return fmt.Errorf("unsupported algorithm '%s'", signature.Algorithm)
+	}
+	if id := KeyID(key); signature.KeyID != id {
+		return fmt.Errorf("signed with key %s, not %s", signature.KeyID, id)
+	}
+	raw, err := base64.StdEncoding.DecodeString(signature.Signature)
+	if err != nil || !ed25519.Verify(key, signature.message(), raw) {
+		return errors.New("invalid signature")
+	}
+	sum, err := store.Checksum(tombstonePath)
+	if err != nil {
+		return err
+	}
+	if sum != signature.Log {
+		return errors.New("log modified")
+	}
+	sum, err = fileDigest(store.MetadataPath(tombstonePath))
+	if err != nil {
+		return err
+	}
+	if sum != signature.Metadata {
+		return errors.New("metadata modified")
+	}
+	return nil
+}
+
+type VerifyArgs struct {
+	Filter    *FilterArgs
+	PublicKey *string
+}
+
+// Verify checks the signatures of the tombstones matching the filters,
+// e.g. those of a support bundle once unpacked.
+func Verify(args *VerifyArgs) error {
+	key, err := LoadVerifyKey(*args.PublicKey)
+	if err != nil {
+		return err
+	}
+	filter, err := newTombstoneFilter(args.Filter)
+	if err != nil {
+		return err
+	}
+	tombstones, err := store.FindTombstones(*args.Filter.dir, filter)
+	if err != nil {
+		return err
+	}
+	// Bundles are verified once unpacked, their manifest isn't signed.
+	signed := tombstones[:0]
+	for _, t := range tombstones {
+		if filepath.Base(t.Path) != bundleManifest {
+			signed = append(signed, t)
+		}
+	}
+	if len(signed) == 0 {
+		return errors.New("no tombstone matches the filters")
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "TOMBSTONE\tSIGNATURE")
+	failed := 0
+	for _, t := range signed {
+		status := "valid"
+		if err := verifySignature(t.Path, key); err != nil {
+			failed++
+			status = "FAILED: " + err.Error()
+		}
+		fmt.Fprintf(table, "%s\t%s\n", t.Path, status)
+	}
+	_ = table.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d of %d tombstones failed verification", failed, len(signed))
+	}
+	return nil
+}
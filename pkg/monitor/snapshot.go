@@ -0,0 +1,40 @@
+package monitor
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+)
+
+type SnapshotArgs struct {
+	Pattern *string
+}
+
+// SnapshotLogs has the running monitor preserve the current content of
+// the logs it watches whose name matches the pattern, e.g. to capture what
+// a misbehaving pod logged before it gets deleted.
+func SnapshotLogs(args *SnapshotArgs) error {
+	var results []snapshotResult
+	err := adminRequest(http.MethodPost, "/v1/snapshot?pattern="+url.QueryEscape(*args.Pattern), nil, &results)
+	if err != nil {
+		return err
+	}
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "FILE\tSIZE\tTOMBSTONE")
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+			fmt.Fprintf(table, "%s\t-\tFAILED: %s\n", result.File, result.Error)
+			continue
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\n", result.File, FormatSize(result.Size), result.Path)
+	}
+	_ = table.Flush()
+	if failed > 0 {
+		return fmt.Errorf("snapshot failed for %d of %d logs", failed, len(results))
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/badeadan/k8ts/internal/logger"
+)
+
+// The monitor learns about logs from one of these sources, selected with
+// --source.
+const (
+	sourceInotify = "inotify"
+	sourcePoll    = "poll"
+	sourceKubeAPI = "kube-api"
+	sourceCRI     = "cri"
+	sourceDocker  = "docker"
+)
+
+var sourceKinds = []string{sourceInotify, sourcePoll, sourceKubeAPI, sourceCRI, sourceDocker}
+
+// logSource tells the monitor which logs show up and which are gone, by
+// calling watch, watchPath and unwatch from the event loop. The event loop
+// knows nothing else of where these come from.
+type logSource interface {
+	// open establishes the watches of the source, again whenever the
+	// event loop failed, and returns a descriptor readable when events are
+	// pending.
+	open() (int, error)
+	// read hands the pending events to m and returns how many there were.
+	// Failing means events may have been missed, and the source is opened
+	// again.
+	read(m *Monitor) (int, error)
+	// reconcile catches up with what changed while the source wasn't
+	// open.
+	reconcile(m *Monitor)
+	close()
+}
+
+// newSource makes the source of --source.
+func (m *Monitor) newSource() (logSource, error) {
+	switch *m.args.Source {
+	case sourcePoll:
+		if *m.args.PollInterval <= 0 {
+			return nil, fmt.Errorf("invalid poll-interval %d, expected seconds", *m.args.PollInterval)
+		}
+		return &pollSource{interval: time.Duration(*m.args.PollInterval) * time.Second}, nil
+	case sourceKubeAPI:
+		pods, err := newPodWatch(m.kube)
+		if err != nil {
+			return nil, err
+		}
+		return pods, nil
+	case sourceCRI:
+		if *m.args.PollInterval <= 0 {
+			return nil, fmt.Errorf("invalid poll-interval %d, expected seconds", *m.args.PollInterval)
+		}
+		socket := *m.args.CRISocket
+		if socket == "" {
+			socket = m.distribution.criSocket
+		}
+		cri, err := newCRIClient(socket)
+		if err != nil {
+			return nil, err
+		}
+		return newRuntimeSource(cri, time.Duration(*m.args.PollInterval)*time.Second)
+	case sourceDocker:
+		return newRuntimeSource(newDockerClient(*m.args.DockerSocket), 0)
+	}
+	return &inotifySource{}, nil
+}
+
+// inotifySource reports the logs created in and deleted from
+// /var/log/containers through inotify.
+type inotifySource struct {
+	watches *inotify
+}
+
+func (s *inotifySource) open() (int, error) {
+	watches, err := newInotify()
+	if err != nil {
+		return -1, err
+	}
+	_, err = watches.add(KubernetesLogsPath, syscall.IN_CREATE|syscall.IN_DELETE)
+	if err != nil {
+		watches.close()
+		return -1, fmt.Errorf("failed to watch log directory %s: %v", KubernetesLogsPath, err)
+	}
+	s.watches = watches
+	return watches.fd, nil
+}
+
+func (s *inotifySource) read(m *Monitor) (int, error) {
+	return s.watches.read(func(wd int, mask uint32, name string) {
+		if mask&syscall.IN_CREATE != 0 {
+			m.watch(name)
+		} else if mask&syscall.IN_DELETE != 0 {
+			m.unwatch(name)
+		} else {
+			logger.Warn("Unsupported event mask", "mask", fmt.Sprintf("%x", mask), "name", name)
+		}
+	})
+}
+
+func (s *inotifySource) reconcile(m *Monitor) {
+	m.reconcile()
+}
+
+func (s *inotifySource) close() {
+	if s.watches != nil {
+		s.watches.close()
+		s.watches = nil
+	}
+}
+
+// pollSource lists /var/log/containers every interval, for filesystems
+// inotify doesn't report changes of, e.g. network or FUSE ones, and hosts
+// out of inotify watches. Logs created and deleted between two listings
+// are missed.
+type pollSource struct {
+	interval time.Duration
+	// known are the logs of the last listing, nil until first opened.
+	known map[string]bool
+	wake  *os.File
+	done  chan struct{}
+}
+
+func (s *pollSource) open() (int, error) {
+	present, err := listLogs()
+	if err != nil {
+		return -1, err
+	}
+	// Like the inotify source, the logs already there when the monitor
+	// starts aren't watched.
+	if s.known == nil {
+		s.known = present
+	}
+	wake, signal, err := os.Pipe()
+	if err != nil {
+		return -1, err
+	}
+	s.wake, s.done = wake, make(chan struct{})
+	go func(done chan struct{}) {
+		defer func() { _ = signal.Close() }()
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, _ = signal.Write([]byte{0})
+			case <-done:
+				return
+			}
+		}
+	}(s.done)
+	return int(wake.Fd()), nil
+}
+
+func (s *pollSource) read(m *Monitor) (int, error) {
+	drain := make([]byte, 512)
+	_, _ = s.wake.Read(drain)
+	present, err := listLogs()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for name := range present {
+		if !s.known[name] {
+			m.watch(name)
+			count++
+		}
+	}
+	for name := range s.known {
+		if !present[name] {
+			m.unwatch(name)
+			count++
+		}
+	}
+	s.known = present
+	return count, nil
+}
+
+func listLogs() (map[string]bool, error) {
+	entries, err := ioutil.ReadDir(KubernetesLogsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list log directory %s: %v", KubernetesLogsPath, err)
+	}
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		present[entry.Name()] = true
+	}
+	return present, nil
+}
+
+// reconcile leaves it to the next listing, which compares with the last
+// one whenever it was.
+func (s *pollSource) reconcile(m *Monitor) {}
+
+func (s *pollSource) close() {
+	if s.done != nil {
+		close(s.done)
+		_ = s.wake.Close()
+		s.done, s.wake = nil, nil
+	}
+}
+
+// inotify reads the events of an inotify instance, without blocking.
+type inotify struct {
+	fd     int
+	buffer []byte
+}
+
+func newInotify() (*inotify, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create inotify instance: %v", err)
+	}
+	const maxEventSize = syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1
+	return &inotify{fd: fd, buffer: make([]byte, maxEventSize*20)}, nil
+}
+
+func (n *inotify) add(path string, mask uint32) (int, error) {
+	return syscall.InotifyAddWatch(n.fd, path, mask)
+}
+
+// read calls handle with every pending event and returns how many there
+// were. It fails once events were lost, the queue having overflowed or a
+// watch being removed.
+func (n *inotify) read(handle func(wd int, mask uint32, name string)) (int, error) {
+	// The kernel only returns whole events.
+	readCount, err := syscall.Read(n.fd, n.buffer)
+	if err == syscall.EINTR || err == syscall.EAGAIN {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read inotify events: %v", err)
+	}
+	var lost error
+	count := 0
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= readCount; count++ {
+		rawEvent := (*syscall.InotifyEvent)(unsafe.Pointer(&n.buffer[offset]))
+		nameBytes := n.buffer[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(rawEvent.Len)]
+		name := strings.TrimRight(string(nameBytes), "\000")
+		offset += syscall.SizeofInotifyEvent + int(rawEvent.Len)
+		logger.Debug("Event", "mask", fmt.Sprintf("%x", rawEvent.Mask), "name", name)
+		if rawEvent.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			lost = errors.New("inotify queue overflowed, events were lost")
+		} else if rawEvent.Mask&syscall.IN_IGNORED != 0 {
+			lost = fmt.Errorf("watch %d was removed", rawEvent.Wd)
+		} else {
+			handle(int(rawEvent.Wd), rawEvent.Mask, name)
+		}
+	}
+	return count, lost
+}
+
+func (n *inotify) close() {
+	_ = syscall.Close(n.fd)
+}
@@ -0,0 +1,187 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// StatePath is where a running monitor publishes its counters for
+// `k8ts stats`.
+var StatePath = "/run/k8ts/monitor.json"
+
+type monitorState struct {
+	PID               int       `json:"pid"`
+	StartedAt         time.Time `json:"startedAt"`
+	UpdatedAt         time.Time `json:"updatedAt"`
+	WatchedFiles      int       `json:"watchedFiles"`
+	EventsProcessed   uint64    `json:"eventsProcessed"`
+	TombstonesCreated uint64    `json:"tombstonesCreated"`
+	TombstoneFree     int64     `json:"tombstoneFreeBytes,omitempty"`
+	DiskPressure      bool      `json:"diskPressure,omitempty"`
+	Degraded          string    `json:"degraded,omitempty"`
+	DroppedLogs       uint64    `json:"droppedLogs,omitempty"`
+	// mutex guards the counters updated by the copy queue.
+	mutex sync.Mutex
+}
+
+func (s *monitorState) tombstoneCreated() {
+	s.mutex.Lock()
+	s.TombstonesCreated++
+	s.mutex.Unlock()
+}
+
+// encode returns the monitor state as JSON, as of now.
+func (s *monitorState) encode() ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.UpdatedAt = time.Now()
+	return json.Marshal(s)
+}
+
+// save atomically replaces the published monitor state.
+func (s *monitorState) save() error {
+	content, err := s.encode()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(StatePath), 0755)
+	if err != nil {
+		return err
+	}
+	temporary := StatePath + ".tmp"
+	err = ioutil.WriteFile(temporary, content, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temporary, StatePath)
+}
+
+// loadMonitorState returns the state of the running monitor, asked
+// through its admin API or else as last published, or nil if no monitor is
+// running.
+func loadMonitorState() *monitorState {
+	state := &monitorState{}
+	if adminRequest(http.MethodGet, "/v1/status", nil, state) == nil {
+		return state
+	}
+	content, err := ioutil.ReadFile(StatePath)
+	if err != nil {
+		return nil
+	}
+	if json.Unmarshal(content, state) != nil {
+		return nil
+	}
+	if syscall.Kill(state.PID, 0) == syscall.ESRCH {
+		return nil
+	}
+	return state
+}
+
+type namespaceStats struct {
+	Tombstones int   `json:"tombstones"`
+	Size       int64 `json:"size"`
+}
+
+type StoreStats struct {
+	Tombstones int                        `json:"tombstones"`
+	Size       int64                      `json:"size"`
+	Oldest     *time.Time                 `json:"oldest,omitempty"`
+	Newest     *time.Time                 `json:"newest,omitempty"`
+	Namespaces map[string]*namespaceStats `json:"namespaces"`
+	Monitor    *monitorState              `json:"monitor,omitempty"`
+}
+
+type StatsArgs struct {
+	Filter *FilterArgs
+	Output *string
+}
+
+func Stats(args *StatsArgs) error {
+	filter, err := newTombstoneFilter(args.Filter)
+	if err != nil {
+		return err
+	}
+	tombstones, err := store.FindTombstones(*args.Filter.dir, filter)
+	if err != nil {
+		return err
+	}
+	result := StoreStats{
+		Namespaces: make(map[string]*namespaceStats),
+		Monitor:    loadMonitorState(),
+	}
+	for i := range tombstones {
+		t := &tombstones[i]
+		result.Tombstones++
+		result.Size += t.Size
+		namespace, ok := result.Namespaces[t.Namespace]
+		if !ok {
+			namespace = &namespaceStats{}
+			result.Namespaces[t.Namespace] = namespace
+		}
+		namespace.Tombstones++
+		namespace.Size += t.Size
+	}
+	if len(tombstones) > 0 {
+		result.Oldest = &tombstones[0].PreservedAt
+		result.Newest = &tombstones[len(tombstones)-1].PreservedAt
+	}
+	if *args.Output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+	printStats(&result)
+	return nil
+}
+
+func printStats(result *StoreStats) {
+	fmt.Printf("Tombstones: %d (%s)\n", result.Tombstones, FormatSize(result.Size))
+	if result.Oldest != nil {
+		fmt.Printf("Oldest:     %s\n", result.Oldest.Format(time.RFC3339))
+		fmt.Printf("Newest:     %s\n", result.Newest.Format(time.RFC3339))
+	}
+	if result.Monitor != nil {
+		fmt.Printf("Monitor:    running (pid %d) since %s\n",
+			result.Monitor.PID, result.Monitor.StartedAt.Format(time.RFC3339))
+		fmt.Printf("            %d files watched, %d events processed, %d tombstones created\n",
+			result.Monitor.WatchedFiles, result.Monitor.EventsProcessed,
+			result.Monitor.TombstonesCreated)
+		if result.Monitor.DiskPressure {
+			fmt.Printf("            low free space (%s), only keeping logs matching keep-if\n",
+				FormatSize(result.Monitor.TombstoneFree))
+		}
+		if result.Monitor.Degraded != "" {
+			fmt.Printf("            tombstone volume full, degraded to %s, %d logs dropped\n",
+				result.Monitor.Degraded, result.Monitor.DroppedLogs)
+		}
+	} else {
+		fmt.Println("Monitor:    not running")
+	}
+	if len(result.Namespaces) == 0 {
+		return
+	}
+	names := make([]string, 0, len(result.Namespaces))
+	for name := range result.Namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Println()
+	table := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "NAMESPACE\tTOMBSTONES\tSIZE")
+	for _, name := range names {
+		namespace := result.Namespaces[name]
+		fmt.Fprintf(table, "%s\t%d\t%s\n", name, namespace.Tombstones, FormatSize(namespace.Size))
+	}
+	_ = table.Flush()
+}
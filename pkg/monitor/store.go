@@ -0,0 +1,100 @@
+package monitor
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akamensky/argparse"
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+type FilterArgs struct {
+	dir        *string
+	namespace  *string
+	pod        *string
+	since      *string
+	largerThan *string
+}
+
+func AttachFilterArgs(settings *settings.Settings, cmd *argparse.Command) *FilterArgs {
+	return &FilterArgs{
+		dir: settings.String(cmd, "d", "dir",
+			&argparse.Options{Help: "Tombstone directory", Required: false, Default: TombstonePath}),
+		namespace: settings.String(cmd, "n", "namespace",
+			&argparse.Options{Help: "Only tombstones from this namespace", Required: false}),
+		pod: settings.Pattern(cmd, "p", "pod",
+			&argparse.Options{Help: "Only tombstones of pods matching this pattern", Required: false}),
+		since: settings.String(cmd, "", "since",
+			&argparse.Options{Help: "Only tombstones preserved within this duration (e.g. 24h, 7d)", Required: false}),
+		largerThan: settings.String(cmd, "", "larger-than",
+			&argparse.Options{Help: "Only tombstones larger than this size (e.g. 512K, 10M)", Required: false}),
+	}
+}
+
+func newTombstoneFilter(args *FilterArgs) (*store.Filter, error) {
+	filter := &store.Filter{Namespace: *args.namespace}
+	if *args.pod != "" {
+		pod, err := settings.CompilePattern("pod", *args.pod)
+		if err != nil {
+			return nil, err
+		}
+		filter.Pod = pod
+	}
+	if *args.since != "" {
+		since, err := settings.ParseDuration(*args.since)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --since: %v", err)
+		}
+		filter.After = time.Now().Add(-since)
+	}
+	if *args.largerThan != "" {
+		size, err := parseSize(*args.largerThan)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --larger-than: %v", err)
+		}
+		filter.LargerThan = size
+	}
+	return filter, nil
+}
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"B": 1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// parseSize parses sizes like "512", "100K" or "1.5G".
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	unit := ""
+	if len(s) > 0 && strings.ContainsAny(s[len(s)-1:], "KMGT") {
+		unit = s[len(s)-1:]
+		s = s[:len(s)-1]
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s+unit)
+	}
+	return int64(value * float64(sizeUnits[unit])), nil
+}
+
+// FormatSize is the inverse of parseSize, rounded for humans.
+func FormatSize(size int64) string {
+	units := "KMGT"
+	if size < 1024 {
+		return strconv.FormatInt(size, 10) + "B"
+	}
+	value := float64(size)
+	unit := -1
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + string(units[unit])
+}
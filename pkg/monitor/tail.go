@@ -0,0 +1,159 @@
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/convert"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+const tailPollInterval = 500 * time.Millisecond
+
+type TailArgs struct {
+	Pattern *string
+	Lines   *int
+	Format  *string
+	Prefix  *string
+}
+
+type tailedFile struct {
+	name string
+	// label names the container in notices, prefix goes in front of its
+	// lines.
+	label   string
+	prefix  string
+	file    *os.File
+	reader  *bufio.Reader
+	pending []byte
+	// fragments are the beginning of lines split by the runtime, printed
+	// once complete.
+	fragments convert.Assembler
+}
+
+// Tail follows the live logs in /var/log/containers whose name matches
+// the pattern, picking up new containers as they appear.
+func Tail(args *TailArgs) error {
+	pattern, err := regexp.Compile(*args.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+	output := bufio.NewWriter(os.Stdout)
+	followed := make(map[string]*tailedFile)
+	initial := true
+	for {
+		entries, err := ioutil.ReadDir(KubernetesLogsPath)
+		if err != nil {
+			return err
+		}
+		present := make(map[string]bool)
+		for _, entry := range entries {
+			name := entry.Name()
+			if !pattern.MatchString(name) {
+				continue
+			}
+			present[name] = true
+			if _, ok := followed[name]; ok {
+				continue
+			}
+			file, err := openFile(name)
+			if err != nil {
+				continue
+			}
+			logName := store.ParseLogName(name)
+			t := &tailedFile{
+				name:   name,
+				label:  logName.Pod + "/" + logName.Container,
+				prefix: linePrefix(*args.Prefix, logName.Pod, logName.Container),
+				file:   file,
+				reader: bufio.NewReader(file),
+			}
+			if initial {
+				err = t.skipToLastLines(*args.Lines)
+				if err != nil {
+					logger.Warn("Failed to read file", "file", name, "error", err)
+				}
+			}
+			followed[name] = t
+		}
+		for name, t := range followed {
+			t.follow(output, *args.Format)
+			if !present[name] {
+				fmt.Fprintf(output, "%s: container log removed\n", t.label)
+				_ = t.file.Close()
+				delete(followed, name)
+			}
+		}
+		_ = output.Flush()
+		initial = false
+		time.Sleep(tailPollInterval)
+	}
+}
+
+// skipToLastLines positions the reader so that only the last count
+// complete lines are printed by the next follow.
+func (t *tailedFile) skipToLastLines(count int) error {
+	offsets := make([]int64, 0, count+1)
+	var offset int64
+	scanner := bufio.NewReader(t.file)
+	for {
+		line, err := scanner.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		offsets = append(offsets, offset)
+		if len(offsets) > count {
+			offsets = offsets[1:]
+		}
+		offset += int64(len(line))
+	}
+	start := offset
+	if len(offsets) > 0 && count > 0 {
+		start = offsets[0]
+	}
+	_, err := t.file.Seek(start, io.SeekStart)
+	t.reader.Reset(t.file)
+	return err
+}
+
+func (t *tailedFile) follow(destination io.Writer, format string) {
+	if stat, err := t.file.Stat(); err == nil {
+		if offset, err := t.file.Seek(0, io.SeekCurrent); err == nil &&
+			stat.Size() < offset-int64(t.reader.Buffered()) {
+			fmt.Fprintf(destination, "%s: file truncated\n", t.label)
+			_, _ = t.file.Seek(0, io.SeekStart)
+			t.reader.Reset(t.file)
+			t.pending = nil
+		}
+	}
+	for {
+		chunk, err := t.reader.ReadBytes('\n')
+		t.pending = append(t.pending, chunk...)
+		if err != nil {
+			return
+		}
+		line := t.pending
+		t.pending = nil
+		if format == "raw" {
+			fmt.Fprintf(destination, "%s%s", t.prefix, line)
+			continue
+		}
+		entry, err := convert.ParseRecord(line)
+		if err != nil {
+			fmt.Fprintf(destination, "%s%s", t.prefix, line)
+			continue
+		}
+		entry, complete := t.fragments.Add(entry)
+		if !complete {
+			continue
+		}
+		fmt.Fprint(destination, t.prefix)
+		_ = convert.RenderRecord(destination, format, entry)
+	}
+}
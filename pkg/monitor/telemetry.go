@@ -0,0 +1,342 @@
+package monitor
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/identity"
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/internal/version"
+)
+
+// otlpExportInterval is how often pending spans and the current value of
+// the counters are pushed to the OTLP endpoint.
+const otlpExportInterval = 15 * time.Second
+
+// otlpMaxSpans bounds the spans kept while the endpoint is unreachable,
+// the oldest ones are dropped past it.
+const otlpMaxSpans = 2048
+
+// OTLP/HTTP with the JSON encoding, see
+// https://opentelemetry.io/docs/specs/otlp/#otlphttp
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID    string         `json:"traceId"`
+	SpanID     string         `json:"spanId"`
+	Name       string         `json:"name"`
+	Kind       int            `json:"kind"`
+	Start      string         `json:"startTimeUnixNano"`
+	End        string         `json:"endTimeUnixNano"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	Status     otlpStatus     `json:"status"`
+}
+
+type otlpDataPoint struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	Start      string         `json:"startTimeUnixNano,omitempty"`
+	Time       string         `json:"timeUnixNano"`
+	Value      string         `json:"asInt"`
+}
+
+type otlpSum struct {
+	DataPoints  []otlpDataPoint `json:"dataPoints"`
+	Temporality int             `json:"aggregationTemporality"`
+	Monotonic   bool            `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Unit        string     `json:"unit,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindClient   = 3
+	otlpStatusOk         = 1
+	otlpStatusError      = 2
+	otlpCumulative       = 2
+)
+
+// otlpCounter identifies a counter exported as an OTLP sum, by metric
+// name and decision attribute.
+type otlpCounter struct {
+	name     string
+	decision string
+}
+
+var otlpMetricHelp = map[string][2]string{
+	"k8ts.decisions":            {"Preservation decisions taken on rotated logs", "1"},
+	"k8ts.preserved.bytes":      {"Bytes written to tombstones", "By"},
+	"k8ts.uploads":              {"Tombstone uploads to sinks", "1"},
+	"k8ts.tombstone.free.bytes": {"Free space of the tombstone volume", "By"},
+	"k8ts.dropped.bytes":        {"Bytes of logs dropped while the tombstone volume was full", "By"},
+	"k8ts.degraded":             {"Degraded mode of the monitor while the tombstone volume is full (0 none, 1 prune, 2 keep-only, 3 metadata-only)", "1"},
+}
+
+// otlpExporter turns audit records into spans and counters and exports
+// them to an OpenTelemetry collector. Nothing is recorded while no
+// endpoint is configured.
+type otlpExporter struct {
+	mutex    sync.Mutex
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+	resource []otlpKeyValue
+	started  time.Time
+	spans    []otlpSpan
+	counters map[otlpCounter]int64
+	gauges   map[string]int64
+	running  bool
+}
+
+var telemetry = &otlpExporter{counters: map[otlpCounter]int64{}, gauges: map[string]int64{}}
+
+// configure switches the export to endpoint, the base URL of an OTLP/HTTP
+// receiver (e.g. http://otel-collector:4318), disabling it if empty.
+// Headers are given as KEY=VALUE, typically for authentication.
+func (e *otlpExporter) configure(endpoint string, headers []string) error {
+	parsed := make(map[string]string, len(headers))
+	for _, header := range headers {
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid --otlp-header '%s', expected KEY=VALUE", header)
+		}
+		parsed[parts[0]] = parts[1]
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.endpoint = strings.TrimSuffix(endpoint, "/")
+	e.headers = parsed
+	if e.endpoint == "" {
+		e.spans = nil
+		return nil
+	}
+	host, _ := os.Hostname()
+	e.resource = []otlpKeyValue{
+		stringAttribute("service.name", "k8ts"),
+		stringAttribute("service.version", version.Version),
+		stringAttribute("host.name", host),
+		stringAttribute("k8s.node.name", identity.Node()),
+	}
+	if cluster := identity.Cluster(); cluster != "" {
+		e.resource = append(e.resource, stringAttribute("k8s.cluster.name", cluster))
+	}
+	if !e.running {
+		e.client = &http.Client{Timeout: 10 * time.Second}
+		e.started = time.Now()
+		e.running = true
+		go e.run()
+	}
+	return nil
+}
+
+// observe records r, as given to the audit log, with a span covering the
+// time since started, unless it is zero.
+func (e *otlpExporter) observe(r *auditRecord, started time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.endpoint == "" {
+		return
+	}
+	attributes := []otlpKeyValue{stringAttribute("k8ts.file", r.File)}
+	name, kind := "k8ts.preserve", otlpSpanKindInternal
+	if r.Sink != "" {
+		name, kind = "k8ts.upload", otlpSpanKindClient
+		attributes = append(attributes, stringAttribute("k8ts.sink", r.Sink))
+		e.counters[otlpCounter{"k8ts.uploads", r.Decision}]++
+	} else {
+		attributes = append(attributes, stringAttribute("k8ts.policy", r.Policy))
+		e.counters[otlpCounter{"k8ts.decisions", r.Decision}]++
+		e.counters[otlpCounter{"k8ts.preserved.bytes", ""}] += r.Bytes
+		if r.Dropped > 0 {
+			e.counters[otlpCounter{"k8ts.dropped.bytes", ""}] += r.Dropped
+		}
+	}
+	if started.IsZero() {
+		return
+	}
+	attributes = append(attributes, stringAttribute("k8ts.decision", r.Decision))
+	if r.Rule != "" {
+		attributes = append(attributes, stringAttribute("k8ts.rule", r.Rule))
+	}
+	if r.Bytes > 0 {
+		attributes = append(attributes, intAttribute("k8ts.bytes", r.Bytes))
+	}
+	span := otlpSpan{
+		TraceID:    randomID(16),
+		SpanID:     randomID(8),
+		Name:       name,
+		Kind:       kind,
+		Start:      unixNano(started),
+		End:        unixNano(time.Now()),
+		Attributes: attributes,
+		Status:     otlpStatus{Code: otlpStatusOk},
+	}
+	if r.Error != "" {
+		span.Status = otlpStatus{Code: otlpStatusError, Message: r.Error}
+	}
+	if len(e.spans) >= otlpMaxSpans {
+		e.spans = e.spans[1:]
+	}
+	e.spans = append(e.spans, span)
+}
+
+// gauge records the current value of a gauge.
+func (e *otlpExporter) gauge(name string, value int64) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.endpoint == "" {
+		return
+	}
+	e.gauges[name] = value
+}
+
+func (e *otlpExporter) run() {
+	for range time.Tick(otlpExportInterval) {
+		e.export()
+	}
+}
+
+// export pushes the pending spans and the counters. Spans are kept for the
+// next attempt when the endpoint can't be reached.
+func (e *otlpExporter) export() {
+	e.mutex.Lock()
+	endpoint, headers, spans := e.endpoint, e.headers, e.spans
+	e.spans = nil
+	metrics := e.metrics()
+	e.mutex.Unlock()
+	if endpoint == "" {
+		return
+	}
+	scope := map[string]interface{}{"name": "k8ts", "version": version.Version}
+	if len(spans) > 0 {
+		err := e.post(endpoint+"/v1/traces", headers, map[string]interface{}{
+			"resourceSpans": []interface{}{map[string]interface{}{
+				"resource":   map[string]interface{}{"attributes": e.resource},
+				"scopeSpans": []interface{}{map[string]interface{}{"scope": scope, "spans": spans}},
+			}},
+		})
+		if err != nil {
+			logger.Warn("Failed to export spans", "endpoint", endpoint, "error", err)
+			e.mutex.Lock()
+			if len(spans)+len(e.spans) <= otlpMaxSpans {
+				e.spans = append(spans, e.spans...)
+			}
+			e.mutex.Unlock()
+		}
+	}
+	if len(metrics) > 0 {
+		err := e.post(endpoint+"/v1/metrics", headers, map[string]interface{}{
+			"resourceMetrics": []interface{}{map[string]interface{}{
+				"resource":     map[string]interface{}{"attributes": e.resource},
+				"scopeMetrics": []interface{}{map[string]interface{}{"scope": scope, "metrics": metrics}},
+			}},
+		})
+		if err != nil {
+			logger.Warn("Failed to export metrics", "endpoint", endpoint, "error", err)
+		}
+	}
+}
+
+// metrics renders the counters as cumulative sums, along with the gauges.
+// Called with the mutex held.
+func (e *otlpExporter) metrics() []otlpMetric {
+	now := unixNano(time.Now())
+	byName := map[string]*otlpMetric{}
+	var metrics []otlpMetric
+	for counter, value := range e.counters {
+		metric, ok := byName[counter.name]
+		if !ok {
+			help := otlpMetricHelp[counter.name]
+			metric = &otlpMetric{Name: counter.name, Description: help[0], Unit: help[1],
+				Sum: &otlpSum{Temporality: otlpCumulative, Monotonic: true}}
+			byName[counter.name] = metric
+		}
+		point := otlpDataPoint{Start: unixNano(e.started), Time: now, Value: strconv.FormatInt(value, 10)}
+		if counter.decision != "" {
+			point.Attributes = []otlpKeyValue{stringAttribute("k8ts.decision", counter.decision)}
+		}
+		metric.Sum.DataPoints = append(metric.Sum.DataPoints, point)
+	}
+	for _, metric := range byName {
+		metrics = append(metrics, *metric)
+	}
+	for name, value := range e.gauges {
+		help := otlpMetricHelp[name]
+		metrics = append(metrics, otlpMetric{Name: name, Description: help[0], Unit: help[1],
+			Gauge: &otlpGauge{DataPoints: []otlpDataPoint{{Time: now, Value: strconv.FormatInt(value, 10)}}}})
+	}
+	return metrics
+}
+
+func (e *otlpExporter) post(url string, headers map[string]string, payload interface{}) error {
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+	response, err := e.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = response.Body.Close() }()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", response.Status)
+	}
+	return nil
+}
+
+func stringAttribute(key string, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: map[string]interface{}{"stringValue": value}}
+}
+
+// intAttribute encodes value as a string, as int64 are in the JSON mapping
+// of protobuf.
+func intAttribute(key string, value int64) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func randomID(size int) string {
+	id := make([]byte, size)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,145 @@
+package monitor
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// defaultMaxConcurrentCopies keeps tombstones written one at a time, as
+// they were from the event loop.
+const defaultMaxConcurrentCopies = 1
+
+// copyQueue preserves logs away from the event loop, in the order they
+// were deleted, with at most limit of them at once so that draining a node
+// doesn't turn into an I/O storm competing with kubelet. Copies go one at
+// a time while the monitor is close to its memory limit.
+type copyQueue struct {
+	mutex    sync.Mutex
+	limit    int
+	running  int
+	pending  []func()
+	done     sync.WaitGroup
+	pressure memoryPressure
+}
+
+func (q *copyQueue) configure(limit int) error {
+	if limit < 1 {
+		return fmt.Errorf("invalid --max-concurrent-copies %d", limit)
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.limit = limit
+	q.start()
+	return nil
+}
+
+// run queues a copy.
+func (q *copyQueue) run(job func()) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.done.Add(1)
+	q.pending = append(q.pending, job)
+	q.start()
+}
+
+// start adds workers, up to the limit, for the pending copies. Called
+// with the mutex held.
+func (q *copyQueue) start() {
+	for started := 0; q.running < q.limit && started < len(q.pending); started++ {
+		if q.running > 0 && q.pressure.high() {
+			return
+		}
+		q.running++
+		go q.work()
+	}
+}
+
+func (q *copyQueue) work() {
+	for {
+		q.mutex.Lock()
+		if len(q.pending) == 0 || q.running > q.limit || (q.running > 1 && q.pressure.high()) {
+			q.running--
+			q.mutex.Unlock()
+			return
+		}
+		job := q.pending[0]
+		q.pending = q.pending[1:]
+		q.mutex.Unlock()
+		job()
+		q.done.Done()
+	}
+}
+
+// wait returns once the queued copies are done.
+func (q *copyQueue) wait() {
+	q.done.Wait()
+}
+
+// throttle paces the tombstone writes of all the copies together, with
+// --max-write-rate.
+var throttle rateLimiter
+
+// rateLimiter is a token bucket of bytes, refilled at rate per second up
+// to a second worth of them. Unlimited when rate is 0.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) configure(maxRate string) error {
+	rate := int64(0)
+	if maxRate != "" {
+		var err error
+		rate, err = parseSize(maxRate)
+		if err != nil || rate <= 0 {
+			return fmt.Errorf("invalid --max-write-rate '%s'", maxRate)
+		}
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rate, l.tokens, l.last = rate, float64(rate), time.Now()
+	return nil
+}
+
+func (l *rateLimiter) limited() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rate > 0
+}
+
+// wait blocks until count bytes may be written. Writers reserve what they
+// write, even past the bucket, so that they are served in turn.
+func (l *rateLimiter) wait(count int) {
+	l.mutex.Lock()
+	if l.rate == 0 {
+		l.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(count)
+	delay := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	l.mutex.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// throttledWriter paces writes to a tombstone.
+type throttledWriter struct {
+	writer  io.Writer
+	limiter *rateLimiter
+}
+
+func (w *throttledWriter) Write(data []byte) (int, error) {
+	w.limiter.wait(len(data))
+	return w.writer.Write(data)
+}
@@ -0,0 +1,596 @@
+// Package server is the collector of `k8ts server`, which stores the
+// tombstones the agents of many nodes stream to it under its data
+// directory, and the protocol it speaks with them.
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/grpc"
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/internal/settings"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// Agents stream tombstones to the collector over gRPC with mutual TLS, by
+// the methods of Service. Every tombstone is addressed by the SHA-256 of
+// its content so an interrupted upload can be resumed from the
+// last byte the collector has seen, and its content is only sent once
+// however many tombstones have it, e.g. empty ones:
+//
+//	rpc Status(Chunk) returns (Progress)         the stored offset, or complete
+//	rpc Upload(stream Chunk) returns (Progress)  appends the chunks at offset
+//
+//	message Chunk {
+//	  // Set in the first chunk of an upload, the others only carry data.
+//	  string sum = 1;
+//	  string cluster = 2;
+//	  string node = 3;
+//	  string name = 4;
+//	  int64 size = 5;
+//	  int64 offset = 6;
+//	  // The metadata sidecar of the tombstone, stored next to it.
+//	  bytes metadata = 7;
+//	  bytes data = 8;
+//	}
+//	message Progress {
+//	  int64 offset = 1;
+//	  bool complete = 2;
+//	}
+const Service = "/k8ts.collector.v1.Collector/"
+
+// ChunkSize is the data sent by chunk, well below the maximum size of
+// gRPC messages.
+const ChunkSize = 1 << 20
+
+// MaxMetadata bounds the metadata sidecar sent along with a tombstone,
+// and maxMessage the chunks the collector reads: the data of a chunk and
+// its other fields.
+const MaxMetadata = 1 << 20
+const maxMessage = ChunkSize + MaxMetadata + 4<<10
+
+const defaultCluster = "default"
+const collectorPartialDir = ".partial"
+const collectorSumsDir = ".sums"
+
+var checksumPattern = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// Chunk is a message of the calls of agents, whose first chunk of a call
+// addresses the tombstone.
+type Chunk struct {
+	Sum      string
+	Cluster  string
+	Node     string
+	Name     string
+	Size     int64
+	Offset   int64
+	Metadata []byte
+	Data     []byte
+}
+
+// Encode encodes the chunk as its protobuf message.
+func (c *Chunk) Encode() []byte {
+	var message []byte
+	for number, value := range []string{1: c.Sum, 2: c.Cluster, 3: c.Node, 4: c.Name} {
+		if value != "" {
+			message = append(message, grpc.ProtoString(number, value)...)
+		}
+	}
+	if c.Size != 0 {
+		message = append(message, grpc.ProtoVarint(5, uint64(c.Size))...)
+	}
+	if c.Offset != 0 {
+		message = append(message, grpc.ProtoVarint(6, uint64(c.Offset))...)
+	}
+	if len(c.Metadata) > 0 {
+		message = append(message, grpc.ProtoBytes(7, c.Metadata)...)
+	}
+	if len(c.Data) > 0 {
+		message = append(message, grpc.ProtoBytes(8, c.Data)...)
+	}
+	return message
+}
+
+// DecodeChunk decodes the protobuf message of a Chunk.
+func DecodeChunk(message []byte) (*Chunk, error) {
+	c := &Chunk{}
+	err := grpc.ProtoFields(message, func(number int, value uint64, data []byte) error {
+		switch number {
+		case 1:
+			c.Sum = string(data)
+		case 2:
+			c.Cluster = string(data)
+		case 3:
+			c.Node = string(data)
+		case 4:
+			c.Name = string(data)
+		case 5:
+			c.Size = int64(value)
+		case 6:
+			c.Offset = int64(value)
+		case 7:
+			c.Metadata = data
+		case 8:
+			c.Data = data
+		}
+		return nil
+	})
+	return c, err
+}
+
+// Progress is the answer of the collector to a call.
+type Progress struct {
+	Offset   int64
+	Complete bool
+}
+
+// Encode encodes the progress as its protobuf message.
+func (p *Progress) Encode() []byte {
+	message := grpc.ProtoVarint(1, uint64(p.Offset))
+	if p.Complete {
+		message = append(message, grpc.ProtoVarint(2, 1)...)
+	}
+	return message
+}
+
+// DecodeProgress decodes the protobuf message of a Progress.
+func DecodeProgress(message []byte) (*Progress, error) {
+	p := &Progress{}
+	err := grpc.ProtoFields(message, func(number int, value uint64, _ []byte) error {
+		switch number {
+		case 1:
+			p.Offset = int64(value)
+		case 2:
+			p.Complete = value != 0
+		}
+		return nil
+	})
+	return p, err
+}
+
+type collector struct {
+	dataDir   string
+	retention time.Duration
+	mutex     sync.Mutex
+	uploads   map[string]bool
+}
+
+func newCollector(dataDir string, retention time.Duration) (*collector, error) {
+	for _, dir := range []string{collectorPartialDir, collectorSumsDir} {
+		err := os.MkdirAll(filepath.Join(dataDir, dir), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &collector{
+		dataDir:   dataDir,
+		retention: retention,
+		uploads:   make(map[string]bool),
+	}, nil
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.URL.Path, Service) {
+		http.NotFound(w, r)
+		return
+	}
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), grpc.ContentType) {
+		http.Error(w, "the collector only speaks gRPC", http.StatusUnsupportedMediaType)
+		return
+	}
+	reader := bufio.NewReader(r.Body)
+	chunk, err := readChunk(reader)
+	if err == nil {
+		err = chunk.validate()
+	}
+	if err != nil {
+		var status *grpc.Error
+		if !errors.As(err, &status) {
+			err = &grpc.Error{Code: grpc.InvalidArgument, Message: err.Error()}
+		}
+		grpc.Reply(w, nil, err)
+		return
+	}
+	err = c.authenticate(r, chunk)
+	if err != nil {
+		grpc.Reply(w, nil, err)
+		return
+	}
+	var progress *Progress
+	switch method := strings.TrimPrefix(r.URL.Path, Service); method {
+	case "Status":
+		progress, err = c.status(chunk)
+	case "Upload":
+		progress, err = c.upload(chunk, reader)
+	default:
+		err = &grpc.Error{Code: grpc.Unimplemented, Message: "unknown method " + method}
+	}
+	if err != nil {
+		grpc.Reply(w, nil, err)
+		return
+	}
+	grpc.Reply(w, progress.Encode(), nil)
+}
+
+// readChunk reads the next chunk of a call, or io.EOF once there are no
+// more.
+func readChunk(reader *bufio.Reader) (*Chunk, error) {
+	message, err := grpc.Read(reader, maxMessage)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeChunk(message)
+}
+
+// validate checks the first chunk of a call.
+func (c *Chunk) validate() error {
+	if !checksumPattern.MatchString(c.Sum) {
+		return errors.New("invalid checksum")
+	}
+	if c.Size < 0 || c.Offset < 0 || c.Offset > c.Size {
+		return errors.New("invalid size or offset")
+	}
+	return nil
+}
+
+func (c *collector) partialPath(sum string) string {
+	return filepath.Join(c.dataDir, collectorPartialDir, sum)
+}
+
+func (c *collector) sumPath(sum string) string {
+	return filepath.Join(c.dataDir, collectorSumsDir, sum)
+}
+
+// status reports a tombstone complete once stored at its destination. The
+// collector has all of it when a tombstone with the same content was
+// stored elsewhere, which the upload only has to be finished for.
+func (c *collector) status(chunk *Chunk) (*Progress, error) {
+	destination, err := c.destination(chunk)
+	if err != nil {
+		return nil, &grpc.Error{Code: grpc.InvalidArgument, Message: err.Error()}
+	}
+	stored, source := c.stored(chunk.Sum, destination)
+	if stored {
+		return &Progress{Complete: true}, nil
+	}
+	if source != "" {
+		return &Progress{Offset: chunk.Size}, nil
+	}
+	var offset int64
+	if stat, err := os.Stat(c.partialPath(chunk.Sum)); err == nil {
+		offset = stat.Size()
+	}
+	return &Progress{Offset: offset}, nil
+}
+
+// stored tells whether the tombstones with the content of sum include the
+// one at destination, or else returns one of them.
+func (c *collector) stored(sum string, destination string) (bool, string) {
+	content, err := ioutil.ReadFile(c.sumPath(sum))
+	if err != nil {
+		return false, ""
+	}
+	var source string
+	for _, relative := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		path := filepath.Join(c.dataDir, relative)
+		// Tombstones older than the retention period may be gone.
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if path == destination {
+			return true, ""
+		}
+		source = path
+	}
+	return false, source
+}
+
+func (c *collector) acquire(sum string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.uploads[sum] {
+		return false
+	}
+	c.uploads[sum] = true
+	return true
+}
+
+func (c *collector) release(sum string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.uploads, sum)
+}
+
+// authenticate sets the node of chunk to the common name of the client
+// certificate, so that an agent only stores tombstones under its own
+// node. Calls claiming another node are refused.
+func (c *collector) authenticate(r *http.Request, chunk *Chunk) error {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	node := r.TLS.PeerCertificates[0].Subject.CommonName
+	if chunk.Node != "" && chunk.Node != node {
+		return &grpc.Error{Code: grpc.PermissionDenied,
+			Message: fmt.Sprintf("node '%s' can't store tombstones of node '%s'", node, chunk.Node)}
+	}
+	chunk.Node = node
+	return nil
+}
+
+// destination returns where a completed tombstone is stored:
+// <data dir>/<cluster>/<node>/<namespace>/<name>, the name being the path
+// of the tombstone within the tombstone directory of the agent.
+func (c *collector) destination(chunk *Chunk) (string, error) {
+	if chunk.Name == "" {
+		return "", errors.New("missing name")
+	}
+	cluster := chunk.Cluster
+	if cluster == "" {
+		cluster = defaultCluster
+	}
+	namespace := store.ParseLogName(chunk.Name).Namespace
+	elements := []string{c.dataDir, store.SafePathElement(cluster), store.SafePathElement(chunk.Node), store.SafePathElement(namespace)}
+	for _, element := range strings.Split(chunk.Name, "/") {
+		elements = append(elements, store.SafePathElement(element))
+	}
+	return filepath.Join(elements...), nil
+}
+
+// upload appends the data of the chunks read to the partial upload of
+// the tombstone, and stores it once complete.
+func (c *collector) upload(chunk *Chunk, reader *bufio.Reader) (*Progress, error) {
+	sum := chunk.Sum
+	destination, err := c.destination(chunk)
+	if err != nil {
+		return nil, &grpc.Error{Code: grpc.InvalidArgument, Message: err.Error()}
+	}
+	if !c.acquire(sum) {
+		return nil, &grpc.Error{Code: grpc.Aborted, Message: "upload in progress"}
+	}
+	defer c.release(sum)
+	stored, source := c.stored(sum, destination)
+	if stored {
+		return &Progress{Offset: chunk.Size, Complete: true}, nil
+	}
+	if source != "" {
+		err = c.link(sum, source, destination)
+		if err != nil {
+			logger.Error("Failed to store tombstone", "checksum", sum, "error", err)
+			return nil, errors.New("storage failure")
+		}
+		c.storeMetadata(chunk, destination)
+		logger.Info("Stored tombstone", "path", destination, "content", source)
+		return &Progress{Offset: chunk.Size, Complete: true}, nil
+	}
+
+	partialPath := c.partialPath(sum)
+	partial, err := os.OpenFile(partialPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logger.Error("Failed to open partial upload", "path", partialPath, "error", err)
+		return nil, errors.New("storage failure")
+	}
+	stat, err := partial.Stat()
+	if err != nil {
+		_ = partial.Close()
+		return nil, errors.New("storage failure")
+	}
+	// The agent resumes from the offset the collector has.
+	if stat.Size() != chunk.Offset {
+		_ = partial.Close()
+		return &Progress{Offset: stat.Size()}, nil
+	}
+	received := chunk.Offset
+	data := chunk.Data
+	for {
+		if int64(len(data)) > chunk.Size-received {
+			err = &grpc.Error{Code: grpc.InvalidArgument, Message: "more data than the size of the tombstone"}
+			break
+		}
+		var written int
+		written, err = partial.Write(data)
+		received += int64(written)
+		if err != nil {
+			break
+		}
+		next, readErr := readChunk(reader)
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			err = readErr
+			break
+		}
+		data = next.Data
+	}
+	closeErr := partial.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		logger.Warn("Upload interrupted", "checksum", sum, "received", received, "size", chunk.Size, "error", err)
+		return nil, err
+	}
+	if received < chunk.Size {
+		return &Progress{Offset: received}, nil
+	}
+	err = c.commit(sum, partialPath, destination)
+	if err != nil {
+		logger.Error("Failed to store tombstone", "checksum", sum, "error", err)
+		return nil, &grpc.Error{Code: grpc.InvalidArgument, Message: err.Error()}
+	}
+	c.storeMetadata(chunk, destination)
+	logger.Info("Stored tombstone", "path", destination)
+	return &Progress{Offset: received, Complete: true}, nil
+}
+
+// commit verifies the checksum of a fully received upload and moves it
+// to its final location.
+func (c *collector) commit(sum string, partialPath string, destination string) error {
+	actual, err := store.Checksum(partialPath)
+	if err != nil {
+		return err
+	}
+	if actual != sum {
+		_ = os.Remove(partialPath)
+		return fmt.Errorf("checksum mismatch: got %s", actual)
+	}
+	err = os.MkdirAll(filepath.Dir(destination), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(partialPath, destination)
+	if err != nil {
+		return err
+	}
+	return c.record(sum, destination)
+}
+
+// link stores the tombstone at destination with the content of the one at
+// source, which has the same checksum.
+func (c *collector) link(sum string, source string, destination string) error {
+	err := os.MkdirAll(filepath.Dir(destination), 0755)
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(destination)
+	err = os.Link(source, destination)
+	if err != nil {
+		err = store.CopyFile(destination, source)
+	}
+	if err != nil {
+		return err
+	}
+	return c.record(sum, destination)
+}
+
+// record adds destination to the tombstones with the content of sum.
+func (c *collector) record(sum string, destination string) error {
+	relative, err := filepath.Rel(c.dataDir, destination)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(c.sumPath(sum), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteString(relative + "\n")
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// storeMetadata writes the metadata sidecar sent along with a tombstone,
+// if any, next to where it is stored, with the cluster and node it is
+// stored under whatever the agent recorded.
+func (c *collector) storeMetadata(chunk *Chunk, destination string) {
+	if len(chunk.Metadata) == 0 {
+		return
+	}
+	t := &store.Tombstone{}
+	err := json.Unmarshal(chunk.Metadata, t)
+	if err != nil {
+		logger.Warn("Ignoring invalid tombstone metadata", "path", destination, "error", err)
+		return
+	}
+	t.Path = destination
+	t.Cluster = chunk.Cluster
+	t.Node = chunk.Node
+	err = store.WriteMetadata(t)
+	if err != nil {
+		logger.Error("Failed to store tombstone metadata", "path", destination, "error", err)
+	}
+}
+
+// prune removes everything (tombstones, checksum records and abandoned
+// partial uploads) older than the retention period.
+func (c *collector) prune() {
+	if c.retention <= 0 {
+		return
+	}
+	deadline := time.Now().Add(-c.retention)
+	_ = filepath.Walk(c.dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if info.ModTime().Before(deadline) {
+			err = os.Remove(path)
+			if err != nil {
+				logger.Error("Failed to prune", "path", path, "error", err)
+			} else {
+				logger.Info("Pruned", "path", path)
+			}
+		}
+		return nil
+	})
+}
+
+func (c *collector) pruneLoop() {
+	for {
+		c.prune()
+		time.Sleep(time.Hour)
+	}
+}
+
+// Args are the options of `k8ts server`.
+type Args struct {
+	Listen    *string
+	DataDir   *string
+	Cert      *string
+	Key       *string
+	ClientCA  *string
+	Retention *string
+}
+
+// Run serves the agents until the listener fails.
+func Run(args *Args) error {
+	var retention time.Duration
+	if *args.Retention != "" {
+		var err error
+		retention, err = settings.ParseDuration(*args.Retention)
+		if err != nil {
+			fmt.Printf("Invalid retention '%s'\n", *args.Retention)
+			return err
+		}
+	}
+	caData, err := ioutil.ReadFile(*args.ClientCA)
+	if err != nil {
+		fmt.Printf("Failed to read client CA '%s'\n", *args.ClientCA)
+		return err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caData) {
+		return fmt.Errorf("no certificates found in '%s'", *args.ClientCA)
+	}
+	c, err := newCollector(*args.DataDir, retention)
+	if err != nil {
+		return err
+	}
+	go c.pruneLoop()
+	server := &http.Server{
+		Addr:    *args.Listen,
+		Handler: c,
+		TLSConfig: &tls.Config{
+			ClientCAs:  clientCAs,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+	logger.Info("Collector listening", "address", *args.Listen, "dataDir", *args.DataDir)
+	return server.ListenAndServeTLS(*args.Cert, *args.Key)
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/badeadan/k8ts/internal/grpc"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// collectorCall serves a call of method made by the agent with the
+// certificate of node, and returns its status.
+func collectorCall(t *testing.T, c *collector, node string, method string, chunks ...*Chunk) int {
+	t.Helper()
+	var body bytes.Buffer
+	for _, chunk := range chunks {
+		body.Write(grpc.Frame(chunk.Encode()))
+	}
+	return collectorRequest(t, c, node, method, &body)
+}
+
+// collectorRequest serves a call whose request is body.
+func collectorRequest(t *testing.T, c *collector, node string, method string, body io.Reader) int {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodPost, Service+method, body)
+	request.ProtoMajor = 2
+	request.Header.Set("Content-Type", grpc.ContentType)
+	request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{
+		{Subject: pkix.Name{CommonName: node}},
+	}}
+	recorder := httptest.NewRecorder()
+	c.ServeHTTP(recorder, request)
+	status, err := strconv.Atoi(recorder.Result().Trailer.Get("Grpc-Status"))
+	if err != nil {
+		t.Fatalf("%s: no status: %v", method, err)
+	}
+	return status
+}
+
+func newUploadChunk(t *testing.T, node string, content []byte) *Chunk {
+	t.Helper()
+	sum := sha256.Sum256(content)
+	metadata, err := json.Marshal(&store.Tombstone{Pod: "web", Namespace: "shop", Node: "node-b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Chunk{
+		Sum:      hex.EncodeToString(sum[:]),
+		Cluster:  "prod",
+		Node:     node,
+		Name:     "web_shop_app-0123.log",
+		Size:     int64(len(content)),
+		Metadata: metadata,
+		Data:     content,
+	}
+}
+
+func TestCollectorStoresUnderCertificateNode(t *testing.T) {
+	dataDir := t.TempDir()
+	c, err := newCollector(dataDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("line\n")
+
+	status := collectorCall(t, c, "node-a", "Upload", newUploadChunk(t, "node-b", content))
+	if status != grpc.PermissionDenied {
+		t.Errorf("upload claiming another node has status %d, want %d", status, grpc.PermissionDenied)
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "prod", "node-b")); !os.IsNotExist(err) {
+		t.Errorf("tombstone stored under the claimed node: %v", err)
+	}
+
+	for _, claimed := range []string{"node-a", ""} {
+		status = collectorCall(t, c, "node-a", "Upload", newUploadChunk(t, claimed, content))
+		if status != grpc.OK {
+			t.Fatalf("upload claiming node %q has status %d", claimed, status)
+		}
+	}
+	path := filepath.Join(dataDir, "prod", "node-a", "shop", "web_shop_app-0123.log")
+	stored, err := ioutil.ReadFile(path)
+	if err != nil || !bytes.Equal(stored, content) {
+		t.Fatalf("tombstone not stored under the node of the certificate: %q, %v", stored, err)
+	}
+	metadata, err := store.ReadMetadata(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Cluster != "prod" || metadata.Node != "node-a" {
+		t.Errorf("metadata records cluster %q and node %q", metadata.Cluster, metadata.Node)
+	}
+}
+
+func TestCollectorDestination(t *testing.T) {
+	c := &collector{dataDir: "/data"}
+	for name, want := range map[string]string{
+		"web_shop_app-0123.log":                            "/data/prod/node-a/shop/web_shop_app-0123.log",
+		"snapshots/20240501T120000Z/web_shop_app-0123.log": "/data/prod/node-a/shop/snapshots/20240501T120000Z/web_shop_app-0123.log",
+		"../../etc/web_shop_app-0123.log":                  "/data/prod/node-a/shop/_/_/etc/web_shop_app-0123.log",
+	} {
+		got, err := c.destination(&Chunk{Cluster: "prod", Node: "node-a", Name: name})
+		if err != nil || got != want {
+			t.Errorf("%s is stored at %s (%v), want %s", name, got, err, want)
+		}
+	}
+}
+
+func TestCollectorMessageLimit(t *testing.T) {
+	c, err := newCollector(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the prefix of a message of 1 GiB, which mustn't be allocated.
+	frame := []byte{0, 0x40, 0, 0, 0}
+	status := collectorRequest(t, c, "node-a", "Upload", bytes.NewReader(frame))
+	if status != grpc.ResourceExhausted {
+		t.Errorf("message of 1 GiB has status %d, want %d", status, grpc.ResourceExhausted)
+	}
+	chunk := newUploadChunk(t, "node-a", bytes.Repeat([]byte("x"), maxMessage))
+	status = collectorCall(t, c, "node-a", "Upload", chunk)
+	if status != grpc.ResourceExhausted {
+		t.Errorf("chunk larger than the limit has status %d, want %d", status, grpc.ResourceExhausted)
+	}
+}
+
+func TestCollectorMessagesRoundTrip(t *testing.T) {
+	for _, chunk := range []*Chunk{
+		{},
+		{Sum: "abc", Cluster: "prod", Node: "node-a", Name: "snapshots/1/web.log",
+			Size: 1 << 40, Offset: 1 << 20, Metadata: []byte(`{"pod":"web"}`), Data: []byte("line\n")},
+		{Name: "web.log", Size: 0, Data: []byte{}},
+	} {
+		got, err := DecodeChunk(chunk.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Sum != chunk.Sum || got.Cluster != chunk.Cluster || got.Node != chunk.Node ||
+			got.Name != chunk.Name || got.Size != chunk.Size || got.Offset != chunk.Offset ||
+			!bytes.Equal(got.Metadata, chunk.Metadata) || !bytes.Equal(got.Data, chunk.Data) {
+			t.Errorf("chunk %+v decodes as %+v", chunk, got)
+		}
+	}
+	for _, progress := range []Progress{{}, {Offset: 4096}, {Offset: 1 << 40, Complete: true}} {
+		got, err := DecodeProgress(progress.Encode())
+		if err != nil || *got != progress {
+			t.Errorf("progress %+v decodes as %+v (%v)", progress, got, err)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+// Package collector provides the collector sink, which streams tombstones
+// to a k8ts collector (see pkg/server) and registers itself as the
+// "collector" kind of pkg/sink once imported.
+package collector
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/badeadan/k8ts/internal/grpc"
+	"github.com/badeadan/k8ts/internal/identity"
+	"github.com/badeadan/k8ts/internal/logger"
+	"github.com/badeadan/k8ts/pkg/server"
+	"github.com/badeadan/k8ts/pkg/sink"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+const DefaultSpoolPath = "/var/lib/k8ts/spool"
+const maxUploadBackoff = 5 * time.Minute
+const callTimeout = 30 * time.Second
+
+// Kind is the kind of the sinks of --collector and of the collector of
+// policies, with the url, cert, key, ca and spool-dir options.
+const Kind = "collector"
+
+func init() {
+	sink.Register(Kind, func(config sink.Config) (sink.Sink, error) {
+		options := config.Options
+		if options["url"] == "" {
+			return nil, fmt.Errorf("collector sink without url")
+		}
+		spoolDir := options["spool-dir"]
+		if spoolDir == "" {
+			spoolDir = DefaultSpoolPath
+		}
+		return newCollectorSink(options["url"], options["cert"], options["key"], options["ca"], spoolDir, config.Root)
+	})
+}
+
+// collectorSink streams tombstones to a k8ts collector.
+// Pending uploads are recorded in a spool directory so they survive
+// restarts and collector outages.
+type collectorSink struct {
+	grpc.Client
+	url      string
+	node     string
+	root     string
+	spoolDir string
+	queue    chan string
+	// spilled is set when tombstones were spooled but not queued, which
+	// run queues once the queue is empty.
+	spilled int32
+	done    chan struct{}
+}
+
+func newCollectorSink(url string, cert string, key string, ca string, spoolDir string, root string) (*collectorSink, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cert != "" {
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	if ca != "" {
+		caData, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found in '%s'", ca)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	err := os.MkdirAll(spoolDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	// gRPC is HTTP/2, negotiated along with TLS.
+	transport := &http.Transport{TLSClientConfig: tlsConfig, ForceAttemptHTTP2: true}
+	url = strings.TrimSuffix(url, "/")
+	return &collectorSink{
+		Client:   grpc.Client{Base: url + server.Service, HTTP: &http.Client{Transport: transport}},
+		url:      url,
+		node:     identity.Node(),
+		root:     root,
+		spoolDir: spoolDir,
+		queue:    make(chan string, 1024),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Open resumes uploads left over in the spool and begins processing
+// newly created tombstones.
+func (s *collectorSink) Open() error {
+	atomic.StoreInt32(&s.spilled, 1)
+	go s.run()
+	return nil
+}
+
+// requeue queues the tombstones of the spool, as many as the queue holds.
+func (s *collectorSink) requeue() {
+	entries, err := ioutil.ReadDir(s.spoolDir)
+	if err != nil {
+		logger.Error("Failed to read spool", "path", s.spoolDir, "error", err)
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(s.spoolDir, entry.Name())
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		tombstone, _ := parseSpoolEntry(content)
+		// Earlier versions named the entries after the tombstone.
+		if key := s.spoolEntry(tombstone); key != path {
+			_ = os.Rename(path, key)
+		}
+		select {
+		case s.queue <- tombstone:
+		default:
+			atomic.StoreInt32(&s.spilled, 1)
+			return
+		}
+	}
+}
+
+// Close abandons the uploads in progress when the collector settings
+// change. They stay in the spool for the next sink to pick up.
+func (s *collectorSink) Close() error {
+	close(s.done)
+	return nil
+}
+
+// Write queues a tombstone for upload. Its metadata is read from its
+// sidecar when uploading, as uploads resume from the spool. Write never
+// waits for the collector: while it is down and the queue full, the
+// tombstones are only spooled.
+func (s *collectorSink) Write(tombstone string, metadata *store.Tombstone) error {
+	return s.spool(tombstone, "")
+}
+
+// Move queues a tombstone for upload like Write, the tombstone being
+// removed from the node once uploaded.
+func (s *collectorSink) Move(tombstone string, metadata *store.Tombstone) error {
+	return s.spool(tombstone, spoolRemove)
+}
+
+// spoolRemove marks the spool entries of tombstones removed once uploaded,
+// on the line after their path.
+const spoolRemove = "remove"
+
+func (s *collectorSink) spool(tombstone string, mark string) error {
+	err := ioutil.WriteFile(s.spoolEntry(tombstone), []byte(tombstone+"\n"+mark), 0644)
+	select {
+	case s.queue <- tombstone:
+	default:
+		atomic.StoreInt32(&s.spilled, 1)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to spool tombstone: %v", err)
+	}
+	return nil
+}
+
+// spoolEntry returns the file recording the pending upload of tombstone,
+// named after the checksum of its path as tombstones of the same log may
+// be in several directories.
+func (s *collectorSink) spoolEntry(tombstone string) string {
+	sum := sha256.Sum256([]byte(tombstone))
+	return filepath.Join(s.spoolDir, hex.EncodeToString(sum[:]))
+}
+
+// parseSpoolEntry returns the tombstone of a spool entry and whether it is
+// removed once uploaded.
+func parseSpoolEntry(content []byte) (string, bool) {
+	lines := strings.SplitN(string(content), "\n", 2)
+	return strings.TrimSpace(lines[0]), len(lines) > 1 && strings.TrimSpace(lines[1]) == spoolRemove
+}
+
+// Flush returns at once: the tombstones written are spooled until
+// uploaded.
+func (s *collectorSink) Flush() error {
+	return nil
+}
+
+func (s *collectorSink) run() {
+	for {
+		if len(s.queue) == 0 && atomic.CompareAndSwapInt32(&s.spilled, 1, 0) {
+			s.requeue()
+		}
+		var tombstone string
+		select {
+		case tombstone = <-s.queue:
+		case <-s.done:
+			return
+		}
+		backoff := time.Second
+		for {
+			started := time.Now()
+			err := s.upload(tombstone)
+			sink.Report(sink.Delivery{Path: tombstone, Sink: s.url, Started: started, Err: err})
+			if err == nil {
+				logger.Info("Uploaded tombstone to collector", "path", tombstone)
+				break
+			}
+			if os.IsNotExist(err) {
+				logger.Warn("Tombstone vanished before upload", "path", tombstone)
+				break
+			}
+			logger.Warn("Upload to collector failed", "path", tombstone, "retry", backoff, "error", err)
+			select {
+			case <-time.After(backoff):
+			case <-s.done:
+				return
+			}
+			backoff *= 2
+			if backoff > maxUploadBackoff {
+				backoff = maxUploadBackoff
+			}
+		}
+		entry := s.spoolEntry(tombstone)
+		if content, err := ioutil.ReadFile(entry); err == nil {
+			if _, remove := parseSpoolEntry(content); remove {
+				store.RemoveTombstone(tombstone)
+			}
+		}
+		_ = os.Remove(entry)
+	}
+}
+
+func (s *collectorSink) upload(tombstone string) error {
+	sum, err := store.Checksum(tombstone)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(tombstone)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = file.Close() }()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	chunk := &server.Chunk{
+		Sum:     sum,
+		Cluster: identity.Cluster(),
+		Node:    s.node,
+		Name:    store.RelativePath(s.root, tombstone),
+		Size:    stat.Size(),
+	}
+	progress, err := s.status(chunk)
+	if err != nil {
+		return err
+	}
+	chunk.Metadata, _ = ioutil.ReadFile(store.MetadataPath(tombstone))
+	if len(chunk.Metadata) > server.MaxMetadata {
+		logger.Warn("Metadata too large for the collector, not sent", "path", tombstone,
+			"bytes", len(chunk.Metadata))
+		chunk.Metadata = nil
+	}
+	for !progress.Complete {
+		chunk.Offset = progress.Offset
+		_, err = file.Seek(chunk.Offset, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		next, err := s.send(io.LimitReader(file, chunk.Size-chunk.Offset), chunk)
+		if err != nil {
+			return err
+		}
+		if !next.Complete && next.Offset == progress.Offset {
+			return fmt.Errorf("collector made no progress")
+		}
+		progress = next
+	}
+	return nil
+}
+
+// status asks the collector how much of a tombstone it already has.
+func (s *collectorSink) status(chunk *server.Chunk) (*server.Progress, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	response, err := s.Call(ctx, "Status", chunk.Encode())
+	if err != nil {
+		return nil, err
+	}
+	return server.DecodeProgress(response)
+}
+
+// send streams first then the chunks of the data read from content. The
+// upload is abandoned once the collector took no chunk for
+// callTimeout, or didn't answer as long after the last one.
+func (s *collectorSink) send(content io.Reader, first *server.Chunk) (*server.Progress, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idle := time.AfterFunc(callTimeout, cancel)
+	defer idle.Stop()
+	reader, writer := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buffer := make([]byte, server.ChunkSize)
+		chunk := first
+		for {
+			n, err := io.ReadFull(content, buffer)
+			chunk.Data = buffer[:n]
+			// The first chunk is sent even without data, e.g. for empty
+			// tombstones.
+			if n > 0 || chunk == first {
+				_, writeErr := writer.Write(grpc.Frame(chunk.Encode()))
+				if writeErr != nil {
+					return
+				}
+				idle.Reset(callTimeout)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				_ = writer.Close()
+				return
+			}
+			if err != nil {
+				_ = writer.CloseWithError(err)
+				return
+			}
+			chunk = &server.Chunk{}
+		}
+	}()
+	var response []byte
+	err := s.Stream(ctx, "Upload", reader, func(message []byte) {
+		response = message
+	})
+	_ = reader.Close()
+	<-done
+	first.Data = nil
+	if err != nil {
+		return nil, err
+	}
+	return server.DecodeProgress(response)
+}
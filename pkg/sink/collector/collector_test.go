@@ -0,0 +1,20 @@
+package collector
+
+import "testing"
+
+func TestParseSpoolEntry(t *testing.T) {
+	for content, want := range map[string]struct {
+		tombstone string
+		remove    bool
+	}{
+		"/var/log/tombstone/web.log\n":         {"/var/log/tombstone/web.log", false},
+		"/var/log/tombstone/web.log":           {"/var/log/tombstone/web.log", false},
+		"/var/log/tombstone/web.log\nremove":   {"/var/log/tombstone/web.log", true},
+		"/var/log/tombstone/web.log\nremove\n": {"/var/log/tombstone/web.log", true},
+	} {
+		tombstone, remove := parseSpoolEntry([]byte(content))
+		if tombstone != want.tombstone || remove != want.remove {
+			t.Errorf("%q is %s, removed %t", content, tombstone, remove)
+		}
+	}
+}
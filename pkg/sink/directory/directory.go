@@ -0,0 +1,80 @@
+// Package directory is the directory sink, which copies tombstones along
+// with their companion files to a directory, e.g. a network filesystem
+// mounted on the node, where they keep their path within the tombstone
+// directory. Given no path, it is the tombstone directory itself, which
+// keeps them where they were written.
+//
+//	k8ts monitor --sink directory --sink directory:path=/mnt/archive
+package directory
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/badeadan/k8ts/pkg/sink"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// Kind is the kind the sink is registered as.
+const Kind = "directory"
+
+func init() {
+	sink.Register(Kind, func(config sink.Config) (sink.Sink, error) {
+		path := config.Options["path"]
+		if path == "" {
+			path = config.Root
+		}
+		return &directorySink{config: config, path: filepath.Clean(path)}, nil
+	})
+}
+
+// IsLocal tells whether config is the sink of the tombstone directory,
+// where tombstones are written before going to the other sinks.
+func IsLocal(config sink.Config) bool {
+	if config.Kind != Kind {
+		return false
+	}
+	path := config.Options["path"]
+	return path == "" || filepath.Clean(path) == filepath.Clean(config.Root)
+}
+
+type directorySink struct {
+	config sink.Config
+	path   string
+}
+
+func (d *directorySink) Open() error {
+	return os.MkdirAll(d.path, 0755)
+}
+
+func (d *directorySink) Write(path string, metadata *store.Tombstone) error {
+	destination := filepath.Join(d.path, store.RelativePath(d.config.Root, path))
+	if destination == filepath.Clean(path) {
+		return nil
+	}
+	started := time.Now()
+	err := os.MkdirAll(filepath.Dir(destination), 0755)
+	if err == nil {
+		err = store.CopyFile(destination, path)
+	}
+	for _, suffix := range store.CompanionSuffixes {
+		if err != nil {
+			break
+		}
+		if _, statErr := os.Stat(path + suffix); statErr == nil {
+			err = store.CopyFile(destination+suffix, path+suffix)
+		}
+	}
+	sink.Report(sink.Delivery{Path: path, Sink: d.config.String(), Bytes: metadata.Size, Started: started, Err: err})
+	return err
+}
+
+// Flush returns at once, tombstones being copied as they are written.
+func (d *directorySink) Flush() error {
+	return nil
+}
+
+func (d *directorySink) Close() error {
+	return nil
+}
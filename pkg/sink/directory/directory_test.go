@@ -0,0 +1,72 @@
+package directory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/badeadan/k8ts/pkg/sink"
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+func TestDirectorySink(t *testing.T) {
+	root := t.TempDir()
+	tombstone := filepath.Join(root, "snapshots", "1", "web_shop_app-0123.log")
+	if err := os.MkdirAll(filepath.Dir(tombstone), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{tombstone, tombstone + store.MetadataSuffix} {
+		if err := ioutil.WriteFile(path, []byte(path), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive := t.TempDir()
+	for _, config := range []sink.Config{
+		{Kind: Kind, Options: map[string]string{}, Root: root},
+		{Kind: Kind, Options: map[string]string{"path": archive}, Root: root},
+	} {
+		s, err := sink.New(config)
+		if err == nil {
+			err = s.Open()
+		}
+		if err == nil {
+			err = s.Write(tombstone, &store.Tombstone{})
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", config, err)
+		}
+	}
+	// The tombstone directory keeps the tombstone where it is.
+	if content, err := ioutil.ReadFile(tombstone); err != nil || string(content) != tombstone {
+		t.Errorf("tombstone in the tombstone directory is %q (%v)", content, err)
+	}
+	for _, suffix := range []string{"", store.MetadataSuffix} {
+		copied := filepath.Join(archive, "snapshots", "1", "web_shop_app-0123.log"+suffix)
+		if content, err := ioutil.ReadFile(copied); err != nil || string(content) != tombstone+suffix {
+			t.Errorf("copy %s is %q (%v)", copied, content, err)
+		}
+	}
+}
+
+func TestIsLocal(t *testing.T) {
+	for path, want := range map[string]bool{
+		"":                     true,
+		"/var/log/tombstone":   true,
+		"/var/log/tombstone/":  true,
+		"/var/log/tombstone/a": false,
+		"/mnt/archive":         false,
+	} {
+		config := sink.Config{Kind: Kind, Options: map[string]string{}, Root: "/var/log/tombstone"}
+		if path != "" {
+			config.Options["path"] = path
+		}
+		if got := IsLocal(config); got != want {
+			t.Errorf("directory sink with path %q is local: %t", path, got)
+		}
+	}
+	if IsLocal(sink.Config{Kind: "collector", Options: map[string]string{}, Root: "/var/log/tombstone"}) {
+		t.Error("collector sink is local")
+	}
+}
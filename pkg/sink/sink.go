@@ -0,0 +1,186 @@
+// Package sink defines where tombstones go once preserved: every output
+// target, the tombstone directory of the node included, is a Sink, made by
+// the Factory registered for its kind from a Config.
+//
+// A sink is registered from the init function of its package, such as
+// those of the directory and collector subpackages:
+//
+//	func init() {
+//		sink.Register("archive", func(config sink.Config) (sink.Sink, error) {
+//			return &archiveSink{path: config.Options["path"]}, nil
+//		})
+//	}
+//
+// and selected, once its package is imported, with
+// `--sink archive:path=/mnt/archive` or the sinks of a policy.
+package sink
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/badeadan/k8ts/pkg/store"
+)
+
+// Sink delivers tombstones to an output target.
+type Sink interface {
+	// Open starts the sink, e.g. resuming the deliveries left over by a
+	// previous run.
+	Open() error
+	// Write delivers the tombstone at path, whose metadata sidecar was
+	// written already, or queues it for delivery.
+	Write(path string, metadata *store.Tombstone) error
+	// Flush returns once the tombstones written are delivered, or queued
+	// durably enough to be delivered after a restart.
+	Flush() error
+	// Close stops the sink, when the monitor stops or the settings of the
+	// sink change.
+	Close() error
+}
+
+// Mover is implemented by sinks which still read tombstones after Write
+// returned, e.g. to upload them in the background. A tombstone which isn't
+// kept in the tombstone directory is handed to such a sink with Move
+// rather than Write, the sink removing it along with its companion files
+// once delivered.
+type Mover interface {
+	Move(path string, metadata *store.Tombstone) error
+}
+
+// Config selects a sink and sets it up.
+type Config struct {
+	Kind    string
+	Options map[string]string
+	// Root is the tombstone directory of the node, within which the
+	// tombstones handed to the sink keep their path (see
+	// store.RelativePath).
+	Root string
+}
+
+// Key identifies the settings of a sink, so that a sink is only replaced
+// when they change.
+func (c Config) Key() string {
+	keys := make([]string, 0, len(c.Options))
+	for key := range c.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var key strings.Builder
+	key.WriteString(c.Kind + "\n" + c.Root)
+	for _, name := range keys {
+		key.WriteString("\n" + name + "=" + c.Options[name])
+	}
+	return key.String()
+}
+
+// String shows the kind of the sink and where it delivers to, e.g. for
+// audit records.
+func (c Config) String() string {
+	for _, name := range []string{"url", "path"} {
+		if value, ok := c.Options[name]; ok {
+			return c.Kind + ":" + value
+		}
+	}
+	return c.Kind
+}
+
+// ParseConfig parses a sink given as KIND:KEY=VALUE,..., e.g.
+// directory:path=/mnt/archive.
+func ParseConfig(text string) (Config, error) {
+	config := Config{Options: make(map[string]string)}
+	separator := strings.Index(text, ":")
+	if separator < 0 {
+		config.Kind = text
+	} else {
+		config.Kind = text[:separator]
+		for _, option := range strings.Split(text[separator+1:], ",") {
+			if option == "" {
+				continue
+			}
+			equal := strings.Index(option, "=")
+			if equal <= 0 {
+				return config, fmt.Errorf("invalid sink option '%s' in '%s', expected KEY=VALUE", option, text)
+			}
+			config.Options[option[:equal]] = option[equal+1:]
+		}
+	}
+	if config.Kind == "" {
+		return config, fmt.Errorf("invalid sink '%s', expected KIND:KEY=VALUE,...", text)
+	}
+	return config, nil
+}
+
+// Factory makes a sink of the kind it is registered for.
+type Factory func(config Config) (Sink, error)
+
+var (
+	mutex     sync.Mutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes the sinks of kind with factory. Registering a kind twice
+// panics.
+func Register(kind string, factory Factory) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := factories[kind]; ok {
+		panic("sink: kind " + kind + " registered twice")
+	}
+	factories[kind] = factory
+}
+
+// Kinds returns the kinds of sinks registered, sorted.
+func Kinds() []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	kinds := make([]string, 0, len(factories))
+	for kind := range factories {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// New makes the sink of config, not opened yet.
+func New(config Config) (Sink, error) {
+	mutex.Lock()
+	factory, ok := factories[config.Kind]
+	mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown sink '%s', expected one of %s", config.Kind, strings.Join(Kinds(), ", "))
+	}
+	return factory(config)
+}
+
+// Delivery is the outcome of handing a tombstone over to a sink.
+type Delivery struct {
+	Path    string
+	Sink    string
+	Bytes   int64
+	Started time.Time
+	Err     error
+}
+
+var reporter func(Delivery)
+
+// SetReporter makes report receive the deliveries of every sink, e.g. for
+// the audit log and telemetry of the monitor.
+func SetReporter(report func(Delivery)) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	reporter = report
+}
+
+// Report hands the delivery of a tombstone to the reporter, if any. Sinks
+// report every delivery, successful or not.
+func Report(delivery Delivery) {
+	mutex.Lock()
+	report := reporter
+	mutex.Unlock()
+	if report != nil {
+		report(delivery)
+	}
+}
@@ -0,0 +1,42 @@
+package sink
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	for text, want := range map[string]Config{
+		"directory":                     {Kind: "directory", Options: map[string]string{}},
+		"directory:":                    {Kind: "directory", Options: map[string]string{}},
+		"directory:path=/mnt/archive":   {Kind: "directory", Options: map[string]string{"path": "/mnt/archive"}},
+		"collector:url=https://c:7443,": {Kind: "collector", Options: map[string]string{"url": "https://c:7443"}},
+		"s3:bucket=logs,prefix=a=b,tls=": {Kind: "s3",
+			Options: map[string]string{"bucket": "logs", "prefix": "a=b", "tls": ""}},
+	} {
+		got, err := ParseConfig(text)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%q parses as %+v (%v), want %+v", text, got, err, want)
+		}
+	}
+	for _, text := range []string{"", ":path=/mnt", "directory:path", "directory:=/mnt", "directory:path=/a,,b"} {
+		if config, err := ParseConfig(text); err == nil {
+			t.Errorf("%q parses as %+v", text, config)
+		}
+	}
+}
+
+func TestConfigKey(t *testing.T) {
+	a, _ := ParseConfig("directory:path=/mnt,mode=0600")
+	b, _ := ParseConfig("directory:mode=0600,path=/mnt")
+	c, _ := ParseConfig("directory:mode=0600,path=/mnt/archive")
+	if a.Key() != b.Key() {
+		t.Errorf("the order of options changes the key: %q and %q", a.Key(), b.Key())
+	}
+	if a.Key() == c.Key() {
+		t.Errorf("options %v and %v have the same key", a.Options, c.Options)
+	}
+	if got := c.String(); got != "directory:/mnt/archive" {
+		t.Errorf("sink shows as %s", got)
+	}
+}
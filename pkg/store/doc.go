@@ -0,0 +1,15 @@
+// Package store reads and writes the tombstone store: the logs of deleted
+// containers preserved by k8ts under a node's tombstone directory, or a
+// collector data directory, along with their metadata sidecar.
+//
+// FindTombstones lists the tombstones of a store and OpenTombstone reads
+// one, whether it was compressed or not:
+//
+//	tombstones, err := store.FindTombstones("/var/log/tombstone", &store.Filter{Namespace: "prod"})
+//	if err != nil {
+//		return err
+//	}
+//	for _, t := range tombstones {
+//		fmt.Println(t.Path, t.Pod, t.Container, t.PreservedAt)
+//	}
+package store
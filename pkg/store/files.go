@@ -0,0 +1,88 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SafePathElement turns an arbitrary string received from the outside
+// world into something that can be used as a single path element.
+func SafePathElement(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" || s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+// RelativePath returns the path of a tombstone within the tombstone
+// directory root, e.g. snapshots/<time>/<log> for snapshots, under which
+// sinks deliver it: tombstones of the same log may be in several
+// directories. Tombstones outside of root go by their base name.
+func RelativePath(root string, path string) string {
+	name, err := filepath.Rel(root, path)
+	if err != nil || strings.HasPrefix(name, "..") {
+		return filepath.Base(path)
+	}
+	return name
+}
+
+// Checksum returns the SHA-256 of the content of the file at path, in
+// hexadecimal.
+func Checksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func() { _ = file.Close() }()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// CopyFile copies source to destination through a temporary file, so that
+// destination is never seen half written.
+func CopyFile(destination string, source string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = in.Close() }()
+	temporary := filepath.Join(filepath.Dir(destination), "."+filepath.Base(destination)+".tmp")
+	out, err := os.OpenFile(temporary, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(temporary, destination)
+	}
+	if err != nil {
+		_ = os.Remove(temporary)
+	}
+	return err
+}
+
+// RemoveTombstone deletes the tombstone at path, if still there, and its
+// companion files.
+func RemoveTombstone(path string) {
+	_ = os.Remove(path)
+	for _, suffix := range CompanionSuffixes {
+		_ = os.Remove(path + suffix)
+	}
+}
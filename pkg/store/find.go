@@ -0,0 +1,86 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Filter selects tombstones. Its zero fields select them all.
+type Filter struct {
+	Namespace string
+	// Pod matches the names of the pods of the tombstones.
+	Pod *regexp.Regexp
+	// After is the time tombstones were preserved after.
+	After time.Time
+	// LargerThan is the size tombstones are larger than.
+	LargerThan int64
+}
+
+// Match tells whether the tombstone t is selected.
+func (f *Filter) Match(t *Tombstone) bool {
+	if f.Namespace != "" && f.Namespace != t.Namespace {
+		return false
+	}
+	if f.Pod != nil && !f.Pod.MatchString(t.Pod) {
+		return false
+	}
+	if !f.After.IsZero() && t.PreservedAt.Before(f.After) {
+		return false
+	}
+	return t.Size > f.LargerThan || f.LargerThan == 0
+}
+
+// FindTombstones walks the tombstone store (a node's tombstone directory
+// or a collector data directory) and returns the tombstones matching
+// filter, all of them when nil, oldest first. Hidden files and directories
+// are bookkeeping and are skipped.
+func FindTombstones(root string, filter *Filter) ([]Tombstone, error) {
+	result := make([]Tombstone, 0)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(info.Name(), ".") && path != root {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || IsCompanion(path) || info.Name() == MergedLogName {
+			return nil
+		}
+		t := DescribeTombstone(path, info)
+		if filter == nil || filter.Match(&t) {
+			result = append(result, t)
+		}
+		return nil
+	})
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].PreservedAt.Before(result[j].PreservedAt)
+	})
+	return result, err
+}
+
+// DescribeTombstone returns what is known about a tombstone: the content
+// of its metadata sidecar or, for tombstones without one, whatever can be
+// derived from its name.
+func DescribeTombstone(path string, info os.FileInfo) Tombstone {
+	if t, err := ReadMetadata(path); err == nil {
+		t.Size = info.Size()
+		return *t
+	}
+	name := ParseLogName(info.Name())
+	return Tombstone{
+		Path:        path,
+		Pod:         name.Pod,
+		Namespace:   name.Namespace,
+		Container:   name.Container,
+		ContainerID: name.ContainerID,
+		Size:        info.Size(),
+		PreservedAt: info.ModTime(),
+	}
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var gzipMagic = []byte{0x1f, 0x8b}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Reader reads a tombstone, decompressed.
+type Reader struct {
+	io.Reader
+	closers []func() error
+}
+
+// Close closes the decompressor then the file of the tombstone.
+func (r *Reader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if closeErr := r.closers[i](); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// OpenTombstone opens a tombstone for reading, transparently decompressing
+// gzip and zstd content.
+func OpenTombstone(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := Decompress(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	reader.closers = append([]func() error{file.Close}, reader.closers...)
+	return reader, nil
+}
+
+// Decompress reads source as it is, or decompressed when it starts like
+// gzip or zstd content whatever its name, e.g. the rotated logs kubelet
+// compresses or a log piped to `k8ts convert`. Closing the reader doesn't
+// close source.
+func Decompress(source io.Reader) (*Reader, error) {
+	buffered := bufio.NewReader(source)
+	reader := &Reader{Reader: buffered}
+	magic, _ := buffered.Peek(len(zstdMagic))
+	if bytes.HasPrefix(magic, gzipMagic) {
+		decompressor, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		reader.Reader = decompressor
+		reader.closers = append(reader.closers, decompressor.Close)
+	} else if bytes.HasPrefix(magic, zstdMagic) {
+		decompressor, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		reader.Reader = decompressor
+		reader.closers = append(reader.closers, func() error {
+			decompressor.Close()
+			return nil
+		})
+	}
+	return reader, nil
+}
@@ -0,0 +1,67 @@
+package store
+
+// PodOwner is an object owning a pod, e.g. the Deployment of its
+// ReplicaSet.
+type PodOwner struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// PodMetadata is what the Kubernetes API tells about the pod of a
+// tombstone, kept in its sidecar.
+type PodMetadata struct {
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Owners      []PodOwner        `json:"owners,omitempty"`
+	Node        string            `json:"node,omitempty"`
+	Phase       string            `json:"phase,omitempty"`
+	Reason      string            `json:"reason,omitempty"`
+	Message     string            `json:"message,omitempty"`
+	Containers  []PodContainer    `json:"containers,omitempty"`
+}
+
+// PodContainer is the state of a container of a pod, along with the one
+// of its previous instance.
+type PodContainer struct {
+	Name         string `json:"name"`
+	ContainerID  string `json:"containerId,omitempty"`
+	Restarts     int    `json:"restarts,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	ExitCode     int    `json:"exitCode,omitempty"`
+	LastID       string `json:"lastContainerId,omitempty"`
+	LastReason   string `json:"lastReason,omitempty"`
+	LastExitCode int    `json:"lastExitCode,omitempty"`
+	CrashLooped  bool   `json:"crashLooped,omitempty"`
+}
+
+// Annotation returns an annotation of the pod, if it is known.
+func (p *PodMetadata) Annotation(name string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	value, ok := p.Annotations[name]
+	return value, ok
+}
+
+// ContainerTrouble tells whether the container instance of containerID
+// was OOM killed or crash looping, whatever its logs say.
+func (p *PodMetadata) ContainerTrouble(containerID string) string {
+	for _, c := range p.Containers {
+		switch containerID {
+		case c.ContainerID:
+			if c.Reason == "OOMKilled" {
+				return c.Reason
+			}
+		case c.LastID:
+			if c.LastReason == "OOMKilled" {
+				return c.LastReason
+			}
+		default:
+			continue
+		}
+		if c.CrashLooped {
+			return "CrashLoopBackOff"
+		}
+	}
+	return ""
+}
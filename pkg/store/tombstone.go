@@ -0,0 +1,135 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Tombstone describes a preserved log file found in the tombstone store.
+type Tombstone struct {
+	Path        string    `json:"path"`
+	Pod         string    `json:"pod"`
+	Namespace   string    `json:"namespace"`
+	Container   string    `json:"container"`
+	ContainerID string    `json:"containerId"`
+	Cluster     string    `json:"cluster,omitempty"`
+	Node        string    `json:"node,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Imported    bool      `json:"imported,omitempty"`
+	Size        int64     `json:"size"`
+	PreservedAt time.Time `json:"preservedAt"`
+	// Kubernetes is set when the monitor has access to the API server.
+	Kubernetes *PodMetadata `json:"kubernetes,omitempty"`
+	// KeepReason is why the log was kept whatever its content, e.g.
+	// OOMKilled.
+	KeepReason string `json:"keepReason,omitempty"`
+	// ExpiresAt is when the monitor deletes the tombstone, given the
+	// retention of its policy.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	// ContentDropped is the size of the log when only its metadata was
+	// recorded, its tombstone volume being full.
+	ContentDropped int64 `json:"contentDropped,omitempty"`
+	// Incomplete is set when the copy of the log was interrupted, by a
+	// crash or a reboot, and its log was gone by the next start.
+	Incomplete bool `json:"incomplete,omitempty"`
+	// Tags are those the decision script of the monitor gave the log.
+	Tags map[string]string `json:"tags,omitempty"`
+	// Offset is where in the log the content of an incremental snapshot
+	// starts, the earlier content being in previous snapshots.
+	Offset int64 `json:"offset,omitempty"`
+}
+
+// LogName holds the pod coordinates encoded by kubelet in the name of
+// the files in /var/log/containers:
+//
+//	<pod>_<namespace>_<container>-<container id>.log
+type LogName struct {
+	Pod         string
+	Namespace   string
+	Container   string
+	ContainerID string
+}
+
+// ParseLogName parses the name of a log or of its tombstone, compressed or
+// not. Names which don't follow the kubelet convention are taken for the
+// name of a pod.
+func ParseLogName(name string) LogName {
+	base := filepath.Base(name)
+	for _, suffix := range []string{".gz", ".zst", ".log"} {
+		base = strings.TrimSuffix(base, suffix)
+	}
+	parts := strings.SplitN(base, "_", 3)
+	if len(parts) != 3 {
+		return LogName{Pod: base}
+	}
+	result := LogName{Pod: parts[0], Namespace: parts[1], Container: parts[2]}
+	if dash := strings.LastIndex(parts[2], "-"); dash > 0 {
+		result.Container = parts[2][:dash]
+		result.ContainerID = parts[2][dash+1:]
+	}
+	return result
+}
+
+// MetadataSuffix is appended to the name of a tombstone to get the name of
+// its metadata sidecar.
+const MetadataSuffix = ".meta.json"
+
+// DescribeSuffix is appended to the name of a tombstone to get the name of
+// the description of its pod, written with --describe-pods.
+const DescribeSuffix = ".describe.txt"
+
+// SignatureSuffix is appended to the name of a tombstone to get the name
+// of its detached signature, written with --signing-key.
+const SignatureSuffix = ".sig"
+
+// MergedLogName is the view of all the containers of a pod written in its
+// directory with --group-pods, lines of every container interleaved by
+// time.
+const MergedLogName = "merged.log"
+
+func MetadataPath(tombstonePath string) string {
+	return tombstonePath + MetadataSuffix
+}
+
+// CompanionSuffixes name the files kept next to a tombstone, which go
+// wherever it goes.
+var CompanionSuffixes = []string{MetadataSuffix, DescribeSuffix, SignatureSuffix}
+
+// IsCompanion tells whether path is a file kept next to a tombstone rather
+// than a tombstone.
+func IsCompanion(path string) bool {
+	for _, suffix := range CompanionSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteMetadata writes the sidecar of the tombstone t.
+func WriteMetadata(t *Tombstone) error {
+	content, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(MetadataPath(t.Path), append(content, '\n'), 0644)
+}
+
+// ReadMetadata loads the sidecar of a tombstone. Path is not trusted
+// since tombstones can be moved around (e.g. by the collector).
+func ReadMetadata(path string) (*Tombstone, error) {
+	content, err := ioutil.ReadFile(MetadataPath(path))
+	if err != nil {
+		return nil, err
+	}
+	t := &Tombstone{}
+	err = json.Unmarshal(content, t)
+	if err != nil {
+		return nil, err
+	}
+	t.Path = path
+	return t, nil
+}